@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"time"
 
 	"github.com/caarlos0/env"
 	"gopkg.in/go-playground/validator.v9"
@@ -27,15 +28,106 @@ import (
 
 type IsGAE bool
 
+const (
+	StorageFirestore = "firestore"
+	StorageMemory    = "memory"
+	StorageSQLite    = "sqlite"
+)
+
+// Where attempts are counted for throttling
+const (
+	// In memory of the instance
+	LimiterMemory = "memory"
+	// In the storage backend, shared by all instances
+	LimiterStorage = "storage"
+)
+
+// TLS modes toward the SMTP server
+const (
+	// Implicit TLS on port 465, opportunistic STARTTLS on other ports
+	SMTPTLSAuto = "auto"
+	// TLS from the first byte, usually on port 465
+	SMTPTLSImplicit = "implicit"
+	// STARTTLS is required, the server must offer it
+	SMTPTLSStartTLS = "starttls"
+	// STARTTLS if the server offers it, plain text otherwise
+	SMTPTLSOpportunistic = "opportunistic"
+	// Plain text, e.g. for a relay on localhost
+	SMTPTLSNone = "none"
+)
+
 type config struct {
-	Port        string `env:"PORT" envDefault:"8080" validate:"required,numeric"`
-	Cookie      string `env:"COOKIE_NAME" envDefault:"sessionid" validate:"required,alphanum"`
-	Project     string `env:"PROJECT_NAME" validate:"required"`
+	Port       string `env:"PORT" envDefault:"8080" validate:"required,numeric"`
+	Cookie     string `env:"COOKIE_NAME" envDefault:"sessionid" validate:"required,alphanum"`
+	Storage    string `env:"STORAGE" envDefault:"firestore" validate:"oneof=firestore memory sqlite"`
+	Project    string `env:"PROJECT_NAME" validate:"project"`
+	SQLitePath string `env:"SQLITE_PATH" envDefault:"gc-tracker.db"`
+	USCISURL   string `env:"USCIS_URL" envDefault:"https://egov.uscis.gov" validate:"url"`
+	// Refresh of all cases: parallel workers, requests per second toward
+	// USCIS shared by all workers, retries per case and the first retry delay
+	UpdateWorkers int           `env:"UPDATE_WORKERS" envDefault:"4" validate:"min=1"`
+	UpdateRate    float64       `env:"UPDATE_RATE" envDefault:"2" validate:"gt=0"`
+	UpdateRetries int           `env:"UPDATE_RETRIES" envDefault:"3" validate:"min=0"`
+	UpdateBackoff time.Duration `env:"UPDATE_BACKOFF" envDefault:"2s"`
+	// Built-in scheduler, a zero interval disables it
+	UpdateInterval time.Duration `env:"UPDATE_INTERVAL" envDefault:"1h"`
+	UpdateJitter   time.Duration `env:"UPDATE_JITTER" envDefault:"5m"`
+	// Bearer token to trigger /update outside of App Engine cron
+	UpdateToken string `env:"UPDATE_TOKEN"`
+	// Outbox of notifications: delivery interval of the background worker,
+	// zero disables it, retries per notification and the first retry delay,
+	// and how long delivered and failed notifications are kept
+	OutboxInterval  time.Duration `env:"OUTBOX_INTERVAL" envDefault:"30s"`
+	OutboxRetries   int           `env:"OUTBOX_RETRIES" envDefault:"5" validate:"min=0"`
+	OutboxBackoff   time.Duration `env:"OUTBOX_BACKOFF" envDefault:"1m"`
+	OutboxRetention time.Duration `env:"OUTBOX_RETENTION" envDefault:"720h"`
+	// Webhooks and chats may only reach public addresses unless
+	// NOTIFY_PRIVATE_HOSTS is set, e.g. for a chat server on the same
+	// network as the tracker
+	NotifyPrivateHosts bool `env:"NOTIFY_PRIVATE_HOSTS"`
+	// Links in emails point to BASE_URL, or to the host of the request
+	// unless it is set, and are signed with SECRET_KEY, a random key unless
+	// it is set
+	BaseURL   string `env:"BASE_URL" validate:"omitempty,url"`
+	SecretKey string `env:"SECRET_KEY"`
+	// Email verification links expire after VERIFY_EXPIRY
+	VerifyExpiry time.Duration `env:"VERIFY_EXPIRY" envDefault:"48h"`
+	// Sessions end SESSION_MAX_AGE after sign in, or after SESSION_IDLE
+	// without requests, zero disables either
+	SessionMaxAge time.Duration `env:"SESSION_MAX_AGE" envDefault:"720h"`
+	SessionIdle   time.Duration `env:"SESSION_IDLE" envDefault:"24h"`
+	// The session cookie is sent over HTTPS only with SECURE_COOKIE, on App
+	// Engine or behind an https BASE_URL
+	SecureCookie bool `env:"SECURE_COOKIE"`
+	// Sign in, password reset and sign up are throttled to RATE_LIMIT_USER
+	// attempts per username and RATE_LIMIT_IP per client address within
+	// RATE_LIMIT_WINDOW, zero disables either. Sign in counts failures only.
+	// Further attempts are refused for LOCKOUT_DURATION.
+	RateLimitWindow time.Duration `env:"RATE_LIMIT_WINDOW" envDefault:"15m"`
+	RateLimitUser   int           `env:"RATE_LIMIT_USER" envDefault:"5" validate:"min=0"`
+	RateLimitIP     int           `env:"RATE_LIMIT_IP" envDefault:"20" validate:"min=0"`
+	LockoutDuration time.Duration `env:"LOCKOUT_DURATION" envDefault:"15m"`
+	// Attempts are counted by the instance or the storage backend, see the
+	// Limiter constants
+	LimiterStore string `env:"LIMITER_STORE" envDefault:"storage" validate:"oneof=memory storage"`
+	// The client address is the last X-Forwarded-For entry behind a proxy
+	TrustProxy  bool   `env:"TRUST_PROXY"`
 	IsAppEngine IsGAE  `env:"GAE_ENV"`
 	SMTPHost    string `env:"SMTP_HOST" validate:"required"`
 	SMTPPort    string `env:"SMTP_PORT" envDefault:"587"`
-	SMTPUser    string `env:"SMTP_USER" validate:"required"`
-	SMTPPass    string `env:"SMTP_PASS" validate:"required"`
+	// TLS toward the SMTP server, see the SMTPTLS constants
+	SMTPTLS string `env:"SMTP_TLS" envDefault:"auto" validate:"oneof=auto implicit starttls opportunistic none"`
+	// Relays which need no authentication leave SMTP_USER and SMTP_PASS
+	// empty, SMTP_FROM is then required
+	SMTPUser string `env:"SMTP_USER" validate:"required_without=SMTPFrom"`
+	SMTPPass string `env:"SMTP_PASS" validate:"required_with=SMTPUser"`
+	// Sender of emails, SMTP_USER unless set
+	SMTPFrom     string `env:"SMTP_FROM" validate:"omitempty,email"`
+	SMTPFromName string `env:"SMTP_FROM_NAME"`
+	SMTPReplyTo  string `env:"SMTP_REPLY_TO" validate:"omitempty,email"`
+	// Idle connections to the SMTP server are kept open this long for the
+	// next email, zero closes them after every email
+	SMTPKeepAlive time.Duration `env:"SMTP_KEEPALIVE" envDefault:"30s"`
 }
 
 var Config = config{}
@@ -49,6 +141,12 @@ func InitConfig() error {
 	env.ParseWithFuncs(&Config, env.CustomParsers{isAppEngineType: isAppEngineFunc})
 
 	v := validator.New()
+	// PROJECT_NAME is only needed to reach Firestore
+	if err := v.RegisterValidation("project", func(fl validator.FieldLevel) bool {
+		return Config.Storage != StorageFirestore || fl.Field().String() != ""
+	}); err != nil {
+		log.Println(err.Error())
+	}
 
 	if err := v.Struct(Config); err != nil {
 		errorMsg := ""
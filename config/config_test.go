@@ -19,6 +19,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_isAppEngineFunc(t *testing.T) {
@@ -58,17 +59,53 @@ func Test_isAppEngineFunc(t *testing.T) {
 	}
 }
 
+// defaults is the config of memory storage with an SMTP server which signs
+// in, the cases change the fields their env sets
+func defaults() config {
+	return config{
+		Port:            "8080",
+		Cookie:          "sessionid",
+		Storage:         "memory",
+		SQLitePath:      "gc-tracker.db",
+		USCISURL:        "https://egov.uscis.gov",
+		UpdateWorkers:   4,
+		UpdateRate:      2,
+		UpdateRetries:   3,
+		UpdateBackoff:   2 * time.Second,
+		UpdateInterval:  time.Hour,
+		UpdateJitter:    5 * time.Minute,
+		OutboxInterval:  30 * time.Second,
+		OutboxRetries:   5,
+		OutboxBackoff:   time.Minute,
+		OutboxRetention: 30 * 24 * time.Hour,
+		VerifyExpiry:    48 * time.Hour,
+		SessionMaxAge:   30 * 24 * time.Hour,
+		SessionIdle:     24 * time.Hour,
+		RateLimitWindow: 15 * time.Minute,
+		RateLimitUser:   5,
+		RateLimitIP:     20,
+		LockoutDuration: 15 * time.Minute,
+		LimiterStore:    "storage",
+		SMTPHost:        "smtp.example.com",
+		SMTPPort:        "587",
+		SMTPTLS:         "auto",
+		SMTPUser:        "user",
+		SMTPPass:        "pass",
+		SMTPKeepAlive:   30 * time.Second,
+	}
+}
+
 func TestInitConfig(t *testing.T) {
 	tests := []struct {
-		name    string
-		env     map[string]string
-		want    config
+		name string
+		env  map[string]string
+		// want changes defaults() into the expected config
+		want    func(c *config)
 		wantErr bool
 	}{
 		// TODO: Add test cases.
 		{
 			name:    "Empty config",
-			want:    config{Port: "8080", Cookie: "sessionid", SMTPPort: "587"},
 			wantErr: true,
 		},
 		{
@@ -83,18 +120,272 @@ func TestInitConfig(t *testing.T) {
 				"SMTP_USER":    "user",
 				"SMTP_PASS":    "pass",
 			},
-			want: config{
-				Port:        "8880",
-				Cookie:      "sessionid",
-				Project:     "PRJ",
-				IsAppEngine: true,
-				SMTPHost:    "smtp.example.com",
-				SMTPPort:    "465",
-				SMTPUser:    "user",
-				SMTPPass:    "pass",
+			want: func(c *config) {
+				c.Port = "8880"
+				c.Storage = "firestore"
+				c.Project = "PRJ"
+				c.IsAppEngine = true
+				c.SMTPPort = "465"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Memory storage without PROJECT_NAME",
+			env: map[string]string{
+				"STORAGE":   "memory",
+				"SMTP_HOST": "smtp.example.com",
+				"SMTP_USER": "user",
+				"SMTP_PASS": "pass",
+			},
+			wantErr: false,
+		},
+		{
+			name: "SQLite storage",
+			env: map[string]string{
+				"STORAGE":     "sqlite",
+				"SQLITE_PATH": "/var/lib/gc-tracker/data.db",
+				"SMTP_HOST":   "smtp.example.com",
+				"SMTP_USER":   "user",
+				"SMTP_PASS":   "pass",
+			},
+			want: func(c *config) {
+				c.Storage = "sqlite"
+				c.SQLitePath = "/var/lib/gc-tracker/data.db"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Custom USCIS_URL",
+			env: map[string]string{
+				"STORAGE":   "memory",
+				"USCIS_URL": "http://localhost:8081",
+				"SMTP_HOST": "smtp.example.com",
+				"SMTP_USER": "user",
+				"SMTP_PASS": "pass",
+			},
+			want: func(c *config) {
+				c.USCISURL = "http://localhost:8081"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Invalid USCIS_URL",
+			env: map[string]string{
+				"STORAGE":   "memory",
+				"USCIS_URL": "egov",
+				"SMTP_HOST": "smtp.example.com",
+				"SMTP_USER": "user",
+				"SMTP_PASS": "pass",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Update tuning",
+			env: map[string]string{
+				"STORAGE":        "memory",
+				"UPDATE_WORKERS": "8",
+				"UPDATE_RATE":    "0.5",
+				"UPDATE_RETRIES": "0",
+				"UPDATE_BACKOFF": "500ms",
+				"UPDATE_TOKEN":   "secret",
+				"SMTP_HOST":      "smtp.example.com",
+				"SMTP_USER":      "user",
+				"SMTP_PASS":      "pass",
+			},
+			want: func(c *config) {
+				c.UpdateWorkers = 8
+				c.UpdateRate = 0.5
+				c.UpdateRetries = 0
+				c.UpdateBackoff = 500 * time.Millisecond
+				c.UpdateToken = "secret"
+			},
+			wantErr: false,
+		},
+		{
+			name: "Outbox tuning",
+			env: map[string]string{
+				"STORAGE":          "memory",
+				"OUTBOX_INTERVAL":  "0",
+				"OUTBOX_RETRIES":   "0",
+				"OUTBOX_BACKOFF":   "10s",
+				"OUTBOX_RETENTION": "24h",
+				"SMTP_HOST":        "smtp.example.com",
+				"SMTP_USER":        "user",
+				"SMTP_PASS":        "pass",
+			},
+			want: func(c *config) {
+				c.OutboxInterval = 0
+				c.OutboxRetries = 0
+				c.OutboxBackoff = 10 * time.Second
+				c.OutboxRetention = 24 * time.Hour
+			},
+			wantErr: false,
+		},
+		{
+			name: "Links",
+			env: map[string]string{
+				"STORAGE":       "memory",
+				"BASE_URL":      "https://tracker.example.com",
+				"SECRET_KEY":    "secret",
+				"VERIFY_EXPIRY": "1h",
+				"SMTP_HOST":     "smtp.example.com",
+				"SMTP_USER":     "user",
+				"SMTP_PASS":     "pass",
+			},
+			want: func(c *config) {
+				c.BaseURL = "https://tracker.example.com"
+				c.SecretKey = "secret"
+				c.VerifyExpiry = time.Hour
+			},
+			wantErr: false,
+		},
+		{
+			name: "Session expiry",
+			env: map[string]string{
+				"STORAGE":         "memory",
+				"SESSION_MAX_AGE": "12h",
+				"SESSION_IDLE":    "0",
+				"SMTP_HOST":       "smtp.example.com",
+				"SMTP_USER":       "user",
+				"SMTP_PASS":       "pass",
+			},
+			want: func(c *config) {
+				c.SessionMaxAge = 12 * time.Hour
+				c.SessionIdle = 0
+			},
+			wantErr: false,
+		},
+		{
+			name: "Rate limits",
+			env: map[string]string{
+				"STORAGE":           "memory",
+				"RATE_LIMIT_WINDOW": "1h",
+				"RATE_LIMIT_USER":   "3",
+				"RATE_LIMIT_IP":     "0",
+				"LOCKOUT_DURATION":  "30m",
+				"LIMITER_STORE":     "memory",
+				"TRUST_PROXY":       "true",
+				"SECURE_COOKIE":     "true",
+				"SMTP_HOST":         "smtp.example.com",
+				"SMTP_USER":         "user",
+				"SMTP_PASS":         "pass",
+			},
+			want: func(c *config) {
+				c.SecureCookie = true
+				c.RateLimitWindow = time.Hour
+				c.RateLimitUser = 3
+				c.RateLimitIP = 0
+				c.LockoutDuration = 30 * time.Minute
+				c.LimiterStore = "memory"
+				c.TrustProxy = true
+			},
+			wantErr: false,
+		},
+		{
+			name: "Unknown LIMITER_STORE",
+			env: map[string]string{
+				"STORAGE":       "memory",
+				"LIMITER_STORE": "redis",
+				"SMTP_HOST":     "smtp.example.com",
+				"SMTP_USER":     "user",
+				"SMTP_PASS":     "pass",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid BASE_URL",
+			env: map[string]string{
+				"STORAGE":   "memory",
+				"BASE_URL":  "tracker",
+				"SMTP_HOST": "smtp.example.com",
+				"SMTP_USER": "user",
+				"SMTP_PASS": "pass",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Scheduler disabled",
+			env: map[string]string{
+				"STORAGE":         "memory",
+				"UPDATE_INTERVAL": "0",
+				"UPDATE_JITTER":   "0",
+				"SMTP_HOST":       "smtp.example.com",
+				"SMTP_USER":       "user",
+				"SMTP_PASS":       "pass",
+			},
+			want: func(c *config) {
+				c.UpdateInterval = 0
+				c.UpdateJitter = 0
+			},
+			wantErr: false,
+		},
+		{
+			name: "Invalid UPDATE_WORKERS",
+			env: map[string]string{
+				"STORAGE":        "memory",
+				"UPDATE_WORKERS": "0",
+				"SMTP_HOST":      "smtp.example.com",
+				"SMTP_USER":      "user",
+				"SMTP_PASS":      "pass",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Relay without authentication",
+			env: map[string]string{
+				"STORAGE":        "memory",
+				"SMTP_HOST":      "localhost",
+				"SMTP_PORT":      "25",
+				"SMTP_TLS":       "none",
+				"SMTP_FROM":      "tracker@example.com",
+				"SMTP_FROM_NAME": "GC Tracker",
+				"SMTP_REPLY_TO":  "support@example.com",
+				"SMTP_KEEPALIVE": "0",
+			},
+			want: func(c *config) {
+				c.SMTPHost = "localhost"
+				c.SMTPPort = "25"
+				c.SMTPTLS = "none"
+				c.SMTPUser = ""
+				c.SMTPPass = ""
+				c.SMTPFrom = "tracker@example.com"
+				c.SMTPFromName = "GC Tracker"
+				c.SMTPReplyTo = "support@example.com"
+				c.SMTPKeepAlive = 0
 			},
 			wantErr: false,
 		},
+		{
+			name: "Unknown SMTP_TLS",
+			env: map[string]string{
+				"STORAGE":   "memory",
+				"SMTP_HOST": "smtp.example.com",
+				"SMTP_TLS":  "ssl",
+				"SMTP_USER": "user",
+				"SMTP_PASS": "pass",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid SMTP_FROM",
+			env: map[string]string{
+				"STORAGE":   "memory",
+				"SMTP_HOST": "localhost",
+				"SMTP_FROM": "tracker",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unknown storage",
+			env: map[string]string{
+				"STORAGE":      "redis",
+				"PROJECT_NAME": "PRJ",
+				"SMTP_HOST":    "smtp.example.com",
+				"SMTP_USER":    "user",
+				"SMTP_PASS":    "pass",
+			},
+			wantErr: true,
+		},
 		{
 			name: "Missed PROJECT_NAME",
 			env: map[string]string{
@@ -106,15 +397,6 @@ func TestInitConfig(t *testing.T) {
 				"SMTP_USER":   "user",
 				"SMTP_PASS":   "pass",
 			},
-			want: config{
-				Port:        "8880",
-				Cookie:      "sessionid",
-				IsAppEngine: true,
-				SMTPHost:    "smtp.example.com",
-				SMTPPort:    "465",
-				SMTPUser:    "user",
-				SMTPPass:    "pass",
-			},
 			wantErr: true,
 		},
 		{
@@ -128,15 +410,6 @@ func TestInitConfig(t *testing.T) {
 				"SMTP_USER":    "user",
 				"SMTP_PASS":    "pass",
 			},
-			want: config{
-				Port:        "8880",
-				Cookie:      "sessionid",
-				Project:     "PRJ",
-				IsAppEngine: true,
-				SMTPPort:    "465",
-				SMTPUser:    "user",
-				SMTPPass:    "pass",
-			},
 			wantErr: true,
 		},
 		{
@@ -150,15 +423,6 @@ func TestInitConfig(t *testing.T) {
 				"SMTP_PORT":    "465",
 				"SMTP_PASS":    "pass",
 			},
-			want: config{
-				Port:        "8880",
-				Cookie:      "sessionid",
-				Project:     "PRJ",
-				IsAppEngine: true,
-				SMTPHost:    "smtp.example.com",
-				SMTPPort:    "465",
-				SMTPPass:    "pass",
-			},
 			wantErr: true,
 		},
 		{
@@ -172,15 +436,6 @@ func TestInitConfig(t *testing.T) {
 				"SMTP_PORT":    "465",
 				"SMTP_USER":    "user",
 			},
-			want: config{
-				Port:        "8880",
-				Cookie:      "sessionid",
-				Project:     "PRJ",
-				IsAppEngine: true,
-				SMTPHost:    "smtp.example.com",
-				SMTPPort:    "465",
-				SMTPUser:    "user",
-			},
 			wantErr: true,
 		},
 	}
@@ -190,8 +445,17 @@ func TestInitConfig(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			if err := InitConfig(); (err != nil) != tt.wantErr {
 				t.Errorf("InitConfig() error = %v, wantErr %v", err, tt.wantErr)
-			} else if err == nil && !reflect.DeepEqual(tt.want, Config) {
-				t.Errorf("InitConfig() got = %v, want %v", Config, tt.want)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			want := defaults()
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			if !reflect.DeepEqual(want, Config) {
+				t.Errorf("InitConfig() got = %v, want %v", Config, want)
 			}
 		})
 		unsetEnvs(t, tt.env)
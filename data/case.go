@@ -16,45 +16,58 @@ limitations under the License.
 package data
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
-	"strings"
+	"time"
 
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-
-	"github.com/PuerkitoBio/goquery"
+	"github.com/batk0/gc-tracker/notify"
+	"github.com/batk0/gc-tracker/status"
 	"github.com/gorilla/schema"
 	"gopkg.in/go-playground/validator.v9"
 )
 
 type GCTrackerCase interface {
-	CheckStatus() error
-	Create()
+	CheckStatus(context.Context, status.StatusProvider) error
+	Update(context.Context) error
 	Set(url.Values)
 	GetID() string
 	GetName() string
 	GetStatus() string
+	GetDetails() status.Status
 	Validate() error
 }
 
+// StatusEntry is a status observed on USCIS, kept in the case history.
+// Timestamps are Unix seconds.
+type StatusEntry struct {
+	Title       string `firestore:"title"`
+	Body        string `firestore:"body"`
+	FirstSeen   int64  `firestore:"firstSeen"`
+	LastChecked int64  `firestore:"lastChecked"`
+}
+
+// sameStatus reports whether e describes the same status as other
+func (e StatusEntry) sameStatus(other StatusEntry) bool {
+	return e.Title == other.Title && e.Body == other.Body
+}
+
 type GCTrackerCaseImpl struct {
 	ID        string        `firestore:"id" schema:"case" validate:"alphanum,len=13"`
-	Name      string        `firestore:"name" schema:"name" validate:"alphanum,min=0,max=40"`
+	Name      string        `firestore:"-" schema:"name" validate:"alphanum,min=0,max=40"`
 	Status    string        `firestore:"status" schema:"-"`
 	OldStatus string        `firestore:"old" schema:"-"`
+	Details   status.Status `firestore:"details" schema:"-"`
 	data      GCTrackerData `firestore:"-" schema:"-"`
 }
 
-func (d *FirestoreGCTrackerData) NewCase() GCTrackerCase { return &GCTrackerCaseImpl{data: d} }
-func (c *GCTrackerCaseImpl) Create()                     { c.data.CreateCase(c) }
-func (c *GCTrackerCaseImpl) Delete()                     { c.data.DeleteCase(c) }
-func (c *GCTrackerCaseImpl) GetID() string               { return c.ID }
-func (c *GCTrackerCaseImpl) GetName() string             { return c.Name }
-func (c *GCTrackerCaseImpl) GetStatus() string           { return c.Status }
+func (c *GCTrackerCaseImpl) Update(ctx context.Context) error { return c.data.UpdateCase(ctx, c) }
+func (c *GCTrackerCaseImpl) GetID() string                    { return c.ID }
+func (c *GCTrackerCaseImpl) GetName() string                  { return c.Name }
+func (c *GCTrackerCaseImpl) GetStatus() string                { return c.Status }
+func (c *GCTrackerCaseImpl) GetDetails() status.Status        { return c.Details }
 
 func (c *GCTrackerCaseImpl) Validate() error {
 	v := validator.New()
@@ -70,21 +83,17 @@ func (c *GCTrackerCaseImpl) Validate() error {
 	return nil
 }
 
-func (c *GCTrackerCaseImpl) GetByID(id string) error {
-	caseSnap, err := c.data.GetCase(id)
+func (c *GCTrackerCaseImpl) GetByID(ctx context.Context, id string) error {
+	gcCase, err := c.data.GetCase(ctx, id)
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			log.Println("GCTrackerCase does not exist: " + err.Error())
-			return errors.New("case does not exist")
-		}
+		log.Println("Cannot get case " + id + ": " + err.Error())
 		return err
 	}
-
-	if err := caseSnap.DataTo(c); err != nil {
-		log.Println(err.Error())
-		return err
+	dbCase, ok := gcCase.(*GCTrackerCaseImpl)
+	if !ok {
+		return errors.New("unsupported case type")
 	}
-
+	*c = *dbCase
 	return nil
 }
 
@@ -95,37 +104,40 @@ func (c *GCTrackerCaseImpl) Set(formData url.Values) {
 	}
 }
 
-func (c *GCTrackerCaseImpl) CheckStatus() error {
-	form := url.Values{
-		"completedActionsCurrentPage": []string{"0"},
-		"upcomingActionsCurrentPage":  []string{"0"},
-		"appReceiptNum":               []string{c.ID},
-		"caseStatusSearchBtn":         []string{"CHECK+STATUS"},
-	}
-	resp, err := http.PostForm("https://egov.uscis.gov/casestatus/mycasestatus.do", form)
+// CheckStatus looks up the case with p. It records the status in the case
+// history and returns ErrStatusChanged if it differs from Status.
+func (c *GCTrackerCaseImpl) CheckStatus(ctx context.Context, p status.StatusProvider) error {
+	st, err := p.CheckStatus(ctx, c.ID)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("non-ok response received")
-	}
-	defer resp.Body.Close()
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
-	if err != nil {
-		return err
+
+	now := time.Now().Unix()
+	entry := StatusEntry{Title: st.Title, Body: st.Description, FirstSeen: now, LastChecked: now}
+	if err := c.data.RecordStatus(ctx, c.ID, entry); err != nil {
+		log.Println("Cannot record status of " + c.ID + ": " + err.Error())
 	}
-	doc.Find(".current-status-sec strong").Remove()
-	doc.Find(".current-status-sec span").Remove()
-	status := strings.TrimSpace(doc.Find(".current-status-sec").Text())
 
-	if c.Status != status {
+	c.Details = st
+	if c.Status != st.Title {
 		log.Println(c.ID + " case status changed")
-		for _, user := range c.data.GetUsersByCase(c.ID) {
-			user.SendNotification("Your case " + c.Name + " status has changed")
+		users, err := c.data.GetUsersByCase(ctx, c.ID)
+		if err != nil {
+			log.Println("Cannot get subscribers of " + c.ID + ": " + err.Error())
+		}
+		for _, user := range users {
+			user.SendNotification(ctx, Notification{
+				Event:     EventStatusChange,
+				Message:   "Your case " + user.GetCaseName(c.ID) + " status has changed from " + notify.StatusOrNone(c.Status) + " to " + st.Title,
+				CaseID:    c.ID,
+				CaseName:  user.GetCaseName(c.ID),
+				OldStatus: c.Status,
+				NewStatus: st.Title,
+			})
 		}
 		c.OldStatus = c.Status
-		c.Status = status
-		return errors.New("status changed")
+		c.Status = st.Title
+		return ErrStatusChanged
 	}
 	return nil
 }
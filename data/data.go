@@ -0,0 +1,122 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"errors"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/gorilla/sessions"
+)
+
+type GCTrackerData interface {
+	NewSession() sessions.Store
+	// NewLimiterStore keeps attempts for throttling in the backend, shared
+	// by all instances
+	NewLimiterStore() LimiterStore
+	NewUser() GCTrackerUser
+	UserAvailable(context.Context, string) bool
+	GetUser(context.Context, string) (GCTrackerUser, error)
+	UpdateUser(context.Context, GCTrackerUser) error
+	GetUserByResetToken(context.Context, string) (GCTrackerUser, error)
+	GetUsersByCase(context.Context, string) ([]GCTrackerUser, error)
+	CreateUser(context.Context, GCTrackerUser) error
+	NewCase() GCTrackerCase
+	GetCase(context.Context, string) (GCTrackerCase, error)
+	GetCases(context.Context, []string) ([]GCTrackerCase, error)
+	GetAllCases(context.Context) ([]GCTrackerCase, error)
+	CreateCase(context.Context, GCTrackerCase) error
+	// UpdateCase saves the status of an existing case. A case released in
+	// the meantime is not created again, ErrCaseNotFound is returned instead.
+	UpdateCase(context.Context, GCTrackerCase) error
+	// AcquireCase creates the shared case unless it exists already, keeping
+	// the status of an existing case
+	AcquireCase(context.Context, GCTrackerCase) error
+	// ReleaseCase deletes the shared case and its history once no user is
+	// subscribed to it
+	ReleaseCase(context.Context, string) error
+	// RecordStatus appends the observed status to the case history, or only
+	// moves LastChecked forward if it matches the latest entry
+	RecordStatus(context.Context, string, StatusEntry) error
+	GetCaseHistory(context.Context, string) ([]StatusEntry, error)
+	// Notifications held for quiet hours and digests, oldest first
+	QueueNotification(context.Context, string, QueuedNotification) error
+	GetQueuedNotifications(context.Context, string) ([]QueuedNotification, error)
+	DeleteQueuedNotifications(context.Context, string, []string) error
+	// GetQueuedUsernames lists users with queued notifications
+	GetQueuedUsernames(context.Context) ([]string, error)
+	// Outbox of notifications to deliver, AddOutbox returns the ID of the
+	// entry
+	AddOutbox(context.Context, OutboxEntry) (string, error)
+	UpdateOutbox(context.Context, OutboxEntry) error
+	// GetDueOutbox lists pending entries due at the time, oldest first
+	GetDueOutbox(context.Context, int64) ([]OutboxEntry, error)
+	// ClaimOutbox moves the next attempt of the entry with the ID to until
+	// if it is due now, and fails with ErrEntryNotDue otherwise, so that only
+	// one attempt is made at a time
+	ClaimOutbox(ctx context.Context, id string, now, until int64) error
+	// GetOutbox lists up to limit latest entries of the user, newest first
+	GetOutbox(context.Context, string, int) ([]OutboxEntry, error)
+	// PruneOutbox deletes delivered and failed entries last updated before
+	// the time
+	PruneOutbox(context.Context, int64) error
+}
+
+var (
+	ErrUserNotFound  = errors.New("user does not exist")
+	ErrUserExists    = errors.New("user already exists")
+	ErrCaseNotFound  = errors.New("case does not exist")
+	ErrTokenNotFound = errors.New("token not found")
+	ErrEntryNotFound = errors.New("outbox entry does not exist")
+	ErrEntryNotDue   = errors.New("outbox entry is not due")
+	ErrStatusChanged = errors.New("status changed")
+)
+
+func toUserImpl(user GCTrackerUser) (GCTrackerUserImpl, error) {
+	u, ok := user.(*GCTrackerUserImpl)
+	if !ok || u == nil {
+		return GCTrackerUserImpl{}, errors.New("unsupported user type")
+	}
+	stored := u.clone()
+	stored.ConfirmPassword = ""
+	stored.data = nil
+	return stored, nil
+}
+
+func toCaseImpl(c GCTrackerCase) (GCTrackerCaseImpl, error) {
+	ci, ok := c.(*GCTrackerCaseImpl)
+	if !ok || ci == nil {
+		return GCTrackerCaseImpl{}, errors.New("unsupported case type")
+	}
+	stored := *ci
+	stored.data = nil
+	// Case descriptions belong to subscribers, see GCTrackerUserImpl.CaseNames
+	stored.Name = ""
+	return stored, nil
+}
+
+// NewGCTrackerData opens the storage backend selected by config
+func NewGCTrackerData(ctx context.Context) (GCTrackerData, error) {
+	switch config.Config.Storage {
+	case config.StorageMemory:
+		return NewMemoryGCTrackerData(), nil
+	case config.StorageSQLite:
+		return NewSQLGCTrackerData(config.Config.SQLitePath)
+	default:
+		return NewFirestoreGCTrackerData(ctx)
+	}
+}
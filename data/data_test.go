@@ -0,0 +1,793 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/status"
+	"github.com/gorilla/sessions"
+)
+
+// testBackends are the storage backends which can run without external services
+var testBackends = map[string]func(t *testing.T) GCTrackerData{
+	"memory": func(t *testing.T) GCTrackerData { return NewMemoryGCTrackerData() },
+	"sqlite": func(t *testing.T) GCTrackerData { return newTestSQLData(t, filepath.Join(t.TempDir(), "test.db")) },
+}
+
+func seedTestData(t *testing.T, d GCTrackerData) GCTrackerData {
+	t.Helper()
+	ctx := context.Background()
+	users := []*GCTrackerUserImpl{
+		{
+			Username:  "alice",
+			Email:     "alice@example.com",
+			Password:  "alicepassword",
+			Cases:     map[string]bool{"ABC0000000001": true, "ABC0000000002": true},
+			CaseNames: map[string]string{"ABC0000000001": "first", "ABC0000000002": "second"},
+			Reset:     resetPassword{Token: "fresh", Timestamp: time.Now().Unix()},
+		},
+		{
+			Username:  "bob",
+			Email:     "bob@example.com",
+			Password:  "bobpassword",
+			Cases:     map[string]bool{"ABC0000000001": true},
+			CaseNames: map[string]string{"ABC0000000001": "mine"},
+			Reset:     resetPassword{Token: "expired", Timestamp: time.Now().Unix() - 7200},
+		},
+	}
+	for _, u := range users {
+		if err := u.HashAndSalt(); err != nil {
+			t.Fatalf("cannot hash password: %v", err)
+		}
+		if err := d.CreateUser(ctx, u); err != nil {
+			t.Fatalf("cannot create user: %v", err)
+		}
+	}
+	for _, c := range []*GCTrackerCaseImpl{
+		{ID: "ABC0000000002", Status: "received"},
+		{ID: "ABC0000000001", Status: "approved", Details: status.Status{
+			Title:      "approved",
+			FormType:   "I-485",
+			ActionDate: time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC),
+			Notice:     "approval notice",
+		}},
+	} {
+		if err := d.CreateCase(ctx, c); err != nil {
+			t.Fatalf("cannot create case: %v", err)
+		}
+	}
+	return d
+}
+
+// usernames accepts the results of a lookup, an error is reported as a name
+func usernames(users []GCTrackerUser, err error) []string {
+	if err != nil {
+		return []string{"error: " + err.Error()}
+	}
+	var names []string
+	for _, u := range users {
+		names = append(names, u.GetUsername())
+	}
+	return names
+}
+
+func caseIDs(cases []GCTrackerCase, err error) []string {
+	if err != nil {
+		return []string{"error: " + err.Error()}
+	}
+	var ids []string
+	for _, c := range cases {
+		ids = append(ids, c.GetID())
+	}
+	return ids
+}
+
+// testSessionStore saves, loads and deletes a session through the store
+func testSessionStore(t *testing.T, store sessions.Store) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.Get(r, "sessionid")
+	if err != nil {
+		t.Fatalf("store.Get() error = %v", err)
+	}
+	if !session.IsNew {
+		t.Errorf("session.IsNew = false for request without cookie")
+	}
+	session.Values["username"] = "alice"
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("session.Save() error = %v", err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || !c[0].HttpOnly || c[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("session.Save() cookies = %v, want one HttpOnly SameSite=Lax cookie", c)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	session, err = store.Get(r, "sessionid")
+	if err != nil {
+		t.Fatalf("store.Get() error = %v", err)
+	}
+	if session.IsNew || session.Values["username"] != "alice" {
+		t.Errorf("store.Get() values = %v, IsNew = %v", session.Values, session.IsNew)
+	}
+
+	session.Options.MaxAge = -1
+	if err := session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatalf("session.Save() error = %v", err)
+	}
+	session, _ = store.New(r, "sessionid")
+	if !session.IsNew {
+		t.Errorf("deleted session is still loaded")
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	defer func(secure bool, gae config.IsGAE, base string) {
+		config.Config.SecureCookie, config.Config.IsAppEngine, config.Config.BaseURL = secure, gae, base
+	}(config.Config.SecureCookie, config.Config.IsAppEngine, config.Config.BaseURL)
+
+	tests := []struct {
+		name    string
+		secure  bool
+		gae     bool
+		baseURL string
+		want    bool
+	}{
+		{name: "Local", baseURL: "http://localhost:8080", want: false},
+		{name: "SECURE_COOKIE", secure: true, want: true},
+		{name: "App Engine", gae: true, want: true},
+		{name: "https BASE_URL", baseURL: "https://tracker.example.com", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.SecureCookie, config.Config.IsAppEngine, config.Config.BaseURL = tt.secure, config.IsGAE(tt.gae), tt.baseURL
+			if got := SessionOptions(); got.Secure != tt.want || got.SameSite != http.SameSiteLaxMode || !got.HttpOnly {
+				t.Errorf("SessionOptions() = %+v, want Secure %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_SessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			b := newData(t).NewSession().(*idSessionStore).backend
+			values := map[interface{}]interface{}{"username": "alice"}
+			if err := b.save(ctx, "expired", values, -60); err != nil {
+				t.Fatalf("sessionBackend.save() error = %v", err)
+			}
+			if got, err := b.load(ctx, "expired"); err != nil || got != nil {
+				t.Errorf("sessionBackend.load() of expired session = %v, %v, want none", got, err)
+			}
+			if m, ok := b.(*memorySessionBackend); ok {
+				m.swept = 0
+			}
+			if err := b.save(ctx, "current", values, 60); err != nil {
+				t.Fatalf("sessionBackend.save() error = %v", err)
+			}
+			if got, err := b.load(ctx, "current"); err != nil || got["username"] != "alice" {
+				t.Errorf("sessionBackend.load() = %v, %v, want username alice", got, err)
+			}
+			switch b := b.(type) {
+			case *memorySessionBackend:
+				if _, ok := b.sessions["expired"]; ok {
+					t.Errorf("memorySessionBackend.save() kept the expired session")
+				}
+			case *sqlSessionBackend:
+				var n int
+				if err := b.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE id = 'expired'`).Scan(&n); err != nil || n != 0 {
+					t.Errorf("sqlSessionBackend.save() kept the expired session: %d, %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_CreateUser(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		user    GCTrackerUser
+		wantErr bool
+	}{
+		{
+			name:    "New user",
+			user:    &GCTrackerUserImpl{Username: "carol", Email: "carol@example.com"},
+			wantErr: false,
+		},
+		{
+			name:    "Existing user",
+			user:    &GCTrackerUserImpl{Username: "alice", Email: "other@example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				if err := d.CreateUser(ctx, tt.user); (err != nil) != tt.wantErr {
+					t.Errorf("GCTrackerData.CreateUser() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if d.UserAvailable(ctx, tt.user.GetUsername()) {
+					t.Errorf("GCTrackerData.UserAvailable(%q) = true after CreateUser()", tt.user.GetUsername())
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_GetByUsername(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		username  string
+		wantEmail string
+		wantErr   bool
+	}{
+		{
+			name:      "Existing user",
+			username:  "alice",
+			wantEmail: "alice@example.com",
+			wantErr:   false,
+		},
+		{
+			name:     "Non existing user",
+			username: "nonexisting",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				u := d.NewUser().(*GCTrackerUserImpl)
+				if err := u.GetByUsername(ctx, tt.username); (err != nil) != tt.wantErr {
+					t.Errorf("GCTrackerUserImpl.GetByUsername() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if u.Email != tt.wantEmail {
+					t.Errorf("GCTrackerUserImpl.GetByUsername() email = %q, want %q", u.Email, tt.wantEmail)
+				}
+				if u.data != d {
+					t.Errorf("GCTrackerUserImpl.GetByUsername() lost data backend")
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_NotFound(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			if _, err := d.GetUser(ctx, "nonexisting"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("GCTrackerData.GetUser() error = %v, want %v", err, ErrUserNotFound)
+			}
+			if _, err := d.GetCase(ctx, "nonexisting"); !errors.Is(err, ErrCaseNotFound) {
+				t.Errorf("GCTrackerData.GetCase() error = %v, want %v", err, ErrCaseNotFound)
+			}
+			if _, err := d.GetUserByResetToken(ctx, "nonexisting"); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("GCTrackerData.GetUserByResetToken() error = %v, want %v", err, ErrTokenNotFound)
+			}
+			u := d.NewUser()
+			if err := u.GetByUsername(ctx, "nonexisting"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("GCTrackerUserImpl.GetByUsername() error = %v, want %v", err, ErrUserNotFound)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{
+			name:     "Correct password",
+			username: "alice",
+			password: "alicepassword",
+			wantErr:  false,
+		},
+		{
+			name:     "Wrong password",
+			username: "alice",
+			password: "bobpassword",
+			wantErr:  true,
+		},
+		{
+			name:     "Non existing user",
+			username: "nonexisting",
+			password: "alicepassword",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				u := &GCTrackerUserImpl{Username: tt.username, Password: tt.password, data: d}
+				if err := u.Authenticate(ctx); (err != nil) != tt.wantErr {
+					t.Errorf("GCTrackerUserImpl.Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_UpdateUser(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			u := d.NewUser().(*GCTrackerUserImpl)
+			if err := u.GetByUsername(ctx, "bob"); err != nil {
+				t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+			}
+			u.Email = "bob@example.org"
+			u.Cases["ABC0000000003"] = true
+			if err := u.Update(ctx); err != nil {
+				t.Fatalf("GCTrackerUserImpl.Update() error = %v", err)
+			}
+
+			got := d.NewUser().(*GCTrackerUserImpl)
+			if err := got.GetByUsername(ctx, "bob"); err != nil {
+				t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+			}
+			if got.Email != "bob@example.org" {
+				t.Errorf("GCTrackerUserImpl.Email = %q, want %q", got.Email, "bob@example.org")
+			}
+			want := map[string]bool{"ABC0000000001": true, "ABC0000000003": true}
+			if !reflect.DeepEqual(got.Cases, want) {
+				t.Errorf("GCTrackerUserImpl.Cases = %v, want %v", got.Cases, want)
+			}
+
+			// Stored values must not be shared with loaded users
+			got.Cases["ABC0000000004"] = true
+			again := d.NewUser().(*GCTrackerUserImpl)
+			again.GetByUsername(ctx, "bob")
+			if again.Cases["ABC0000000004"] {
+				t.Errorf("GCTrackerUserImpl.Cases is shared with the store")
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_GetUserByResetToken(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		token    string
+		wantUser string
+		wantErr  bool
+	}{
+		{
+			name:     "Fresh token",
+			token:    "fresh",
+			wantUser: "alice",
+			wantErr:  false,
+		},
+		{
+			name:    "Expired token",
+			token:   "expired",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown token",
+			token:   "unknown",
+			wantErr: true,
+		},
+		{
+			name:    "Empty token",
+			token:   "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				u, err := d.GetUserByResetToken(ctx, tt.token)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("GCTrackerData.GetUserByResetToken() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if u.GetUsername() != tt.wantUser {
+					t.Errorf("GCTrackerData.GetUserByResetToken() user = %q, want %q", u.GetUsername(), tt.wantUser)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_GetUsersByCase(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		id   string
+		want []string
+	}{
+		{
+			name: "Case of two users",
+			id:   "ABC0000000001",
+			want: []string{"alice", "bob"},
+		},
+		{
+			name: "Case of one user",
+			id:   "ABC0000000002",
+			want: []string{"alice"},
+		},
+		{
+			name: "Unknown case",
+			id:   "ABC0000000009",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				if got := usernames(d.GetUsersByCase(ctx, tt.id)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("GCTrackerData.GetUsersByCase() = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_Cases(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+
+			if got, want := caseIDs(d.GetAllCases(ctx)), []string{"ABC0000000001", "ABC0000000002"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("GCTrackerData.GetAllCases() = %v, want %v", got, want)
+			}
+			if got, want := caseIDs(d.GetCases(ctx, []string{"ABC0000000002", "ABC0000000009"})), []string{"ABC0000000002"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("GCTrackerData.GetCases() = %v, want %v", got, want)
+			}
+
+			c := d.NewCase().(*GCTrackerCaseImpl)
+			if err := c.GetByID(ctx, "ABC0000000001"); err != nil {
+				t.Fatalf("GCTrackerCaseImpl.GetByID() error = %v", err)
+			}
+			if c.Name != "" || c.Status != "approved" {
+				t.Errorf("GCTrackerCaseImpl.GetByID() = %+v", c)
+			}
+			want := status.Status{
+				Title:      "approved",
+				FormType:   "I-485",
+				ActionDate: time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC),
+				Notice:     "approval notice",
+			}
+			if got := c.GetDetails(); !reflect.DeepEqual(got, want) {
+				t.Errorf("GCTrackerCaseImpl.GetDetails() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_UserCases(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		username  string
+		wantCases []string
+		wantNames []string
+	}{
+		{
+			name:      "Two cases",
+			username:  "alice",
+			wantCases: []string{"ABC0000000001", "ABC0000000002"},
+			wantNames: []string{"first", "second"},
+		},
+		{
+			name:      "Shared case",
+			username:  "bob",
+			wantCases: []string{"ABC0000000001"},
+			wantNames: []string{"mine"},
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				u := d.NewUser()
+				if err := u.GetByUsername(ctx, tt.username); err != nil {
+					t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+				}
+				cases, err := u.GetCases(ctx)
+				if got := caseIDs(cases, err); !reflect.DeepEqual(got, tt.wantCases) {
+					t.Errorf("GCTrackerUserImpl.GetCases() = %v, want %v", got, tt.wantCases)
+				}
+				var names []string
+				for _, c := range cases {
+					names = append(names, c.GetName())
+				}
+				if !reflect.DeepEqual(names, tt.wantNames) {
+					t.Errorf("GCTrackerUserImpl.GetCases() names = %v, want %v", names, tt.wantNames)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_AddCase(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			u := d.NewUser()
+			if err := u.GetByUsername(ctx, "bob"); err != nil {
+				t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+			}
+			// The case is tracked by alice already, so it is not checked again
+			c := &GCTrackerCaseImpl{ID: "ABC0000000002", Name: "bobs", data: d}
+			if err := u.AddCase(ctx, c); err != nil {
+				t.Fatalf("GCTrackerUserImpl.AddCase() error = %v", err)
+			}
+
+			got := d.NewUser()
+			got.GetByUsername(ctx, "bob")
+			if name := got.GetCaseName("ABC0000000002"); name != "bobs" {
+				t.Errorf("GCTrackerUserImpl.GetCaseName() = %q, want %q", name, "bobs")
+			}
+			got.GetByUsername(ctx, "alice")
+			if name := got.GetCaseName("ABC0000000002"); name != "second" {
+				t.Errorf("GCTrackerUserImpl.GetCaseName() of other user = %q, want %q", name, "second")
+			}
+			gcCase, err := d.GetCase(ctx, "ABC0000000002")
+			if err != nil || gcCase.GetStatus() != "received" {
+				t.Errorf("GCTrackerData.GetCase() = %v, %v, want status %q", gcCase, err, "received")
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_UpdateCase(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		id        string
+		wantErr   error
+		wantCases []string
+	}{
+		{
+			name:      "Existing case",
+			id:        "ABC0000000002",
+			wantCases: []string{"ABC0000000001", "ABC0000000002"},
+		},
+		{
+			name:      "Released case is not created again",
+			id:        "ABC0000000009",
+			wantErr:   ErrCaseNotFound,
+			wantCases: []string{"ABC0000000001", "ABC0000000002"},
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				c := &GCTrackerCaseImpl{ID: tt.id, Status: "approved", OldStatus: "received", data: d}
+				if err := c.Update(ctx); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("GCTrackerCaseImpl.Update() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got := caseIDs(d.GetAllCases(ctx)); !reflect.DeepEqual(got, tt.wantCases) {
+					t.Errorf("GCTrackerData.GetAllCases() = %v, want %v", got, tt.wantCases)
+				}
+				if tt.wantErr != nil {
+					return
+				}
+				if got, err := d.GetCase(ctx, tt.id); err != nil || got.GetStatus() != "approved" {
+					t.Errorf("GCTrackerData.GetCase() = %v, %v, want status %q", got, err, "approved")
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_DelCase(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		username  string
+		id        string
+		wantCases []string
+		wantUsers []string
+	}{
+		{
+			name:      "Shared case stays",
+			username:  "alice",
+			id:        "ABC0000000001",
+			wantCases: []string{"ABC0000000001", "ABC0000000002"},
+			wantUsers: []string{"bob"},
+		},
+		{
+			name:      "Last subscriber deletes case",
+			username:  "alice",
+			id:        "ABC0000000002",
+			wantCases: []string{"ABC0000000001"},
+			wantUsers: nil,
+		},
+		{
+			name:      "Unknown case",
+			username:  "bob",
+			id:        "ABC0000000009",
+			wantCases: []string{"ABC0000000001", "ABC0000000002"},
+			wantUsers: nil,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				u := d.NewUser()
+				if err := u.GetByUsername(ctx, tt.username); err != nil {
+					t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+				}
+				if err := u.DelCase(ctx, tt.id); err != nil {
+					t.Fatalf("GCTrackerUserImpl.DelCase() error = %v", err)
+				}
+				if got := caseIDs(d.GetAllCases(ctx)); !reflect.DeepEqual(got, tt.wantCases) {
+					t.Errorf("GCTrackerData.GetAllCases() = %v, want %v", got, tt.wantCases)
+				}
+				if got := usernames(d.GetUsersByCase(ctx, tt.id)); !reflect.DeepEqual(got, tt.wantUsers) {
+					t.Errorf("GCTrackerData.GetUsersByCase() = %v, want %v", got, tt.wantUsers)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_RecordStatus(t *testing.T) {
+	ctx := context.Background()
+	received := StatusEntry{Title: "Case Was Received", Body: "We received your case", FirstSeen: 100, LastChecked: 100}
+	approved := StatusEntry{Title: "Case Was Approved", Body: "We approved your case", FirstSeen: 300, LastChecked: 300}
+	tests := []struct {
+		name    string
+		entries []StatusEntry
+		want    []StatusEntry
+	}{
+		{
+			name:    "First observation",
+			entries: []StatusEntry{received},
+			want:    []StatusEntry{received},
+		},
+		{
+			name:    "Unchanged status",
+			entries: []StatusEntry{received, {Title: received.Title, Body: received.Body, FirstSeen: 200, LastChecked: 200}},
+			want:    []StatusEntry{{Title: received.Title, Body: received.Body, FirstSeen: 100, LastChecked: 200}},
+		},
+		{
+			name:    "Changed status",
+			entries: []StatusEntry{received, approved},
+			want:    []StatusEntry{received, approved},
+		},
+		{
+			name:    "Status changed back",
+			entries: []StatusEntry{received, approved, {Title: received.Title, Body: received.Body, FirstSeen: 400, LastChecked: 400}},
+			want:    []StatusEntry{received, approved, {Title: received.Title, Body: received.Body, FirstSeen: 400, LastChecked: 400}},
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				for _, e := range tt.entries {
+					if err := d.RecordStatus(ctx, "ABC0000000002", e); err != nil {
+						t.Fatalf("GCTrackerData.RecordStatus() error = %v", err)
+					}
+				}
+				got, err := d.GetCaseHistory(ctx, "ABC0000000002")
+				if err != nil {
+					t.Fatalf("GCTrackerData.GetCaseHistory() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("GCTrackerData.GetCaseHistory() = %v, want %v", got, tt.want)
+				}
+				if other, _ := d.GetCaseHistory(ctx, "ABC0000000001"); other != nil {
+					t.Errorf("GCTrackerData.GetCaseHistory() of other case = %v, want none", other)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_ConcurrentAddDelCase(t *testing.T) {
+	ctx := context.Background()
+	const id = "ABC0000000009"
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			var wg sync.WaitGroup
+			// alice keeps dropping the case while bob keeps adding it back,
+			// bob adds it last, so the case must survive
+			for _, username := range []string{"alice", "bob"} {
+				wg.Add(1)
+				go func(username string) {
+					defer wg.Done()
+					u := d.NewUser()
+					if err := u.GetByUsername(ctx, username); err != nil {
+						t.Errorf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+						return
+					}
+					for i := 0; i < 50; i++ {
+						if err := u.AddCase(ctx, &GCTrackerCaseImpl{ID: id, Name: username, data: d}); err != nil {
+							t.Errorf("GCTrackerUserImpl.AddCase() error = %v", err)
+						}
+						if username == "alice" {
+							if err := u.DelCase(ctx, id); err != nil {
+								t.Errorf("GCTrackerUserImpl.DelCase() error = %v", err)
+							}
+						}
+					}
+				}(username)
+			}
+			wg.Wait()
+
+			if got, want := usernames(d.GetUsersByCase(ctx, id)), []string{"bob"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("GCTrackerData.GetUsersByCase() = %v, want %v", got, want)
+			}
+			if _, err := d.GetCase(ctx, id); err != nil {
+				t.Errorf("GCTrackerData.GetCase() of subscribed case error = %v", err)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_ReleaseCaseHistory(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			entry := StatusEntry{Title: "Case Was Received", FirstSeen: 100, LastChecked: 100}
+			for _, id := range []string{"ABC0000000001", "ABC0000000002"} {
+				if err := d.RecordStatus(ctx, id, entry); err != nil {
+					t.Fatalf("GCTrackerData.RecordStatus() error = %v", err)
+				}
+			}
+			u := d.NewUser()
+			u.GetByUsername(ctx, "alice")
+			for _, id := range []string{"ABC0000000001", "ABC0000000002"} {
+				if err := u.DelCase(ctx, id); err != nil {
+					t.Fatalf("GCTrackerUserImpl.DelCase() error = %v", err)
+				}
+			}
+			if got, _ := d.GetCaseHistory(ctx, "ABC0000000001"); len(got) != 1 {
+				t.Errorf("GCTrackerData.GetCaseHistory() of shared case = %v, want 1 entry", got)
+			}
+			if got, _ := d.GetCaseHistory(ctx, "ABC0000000002"); got != nil {
+				t.Errorf("GCTrackerData.GetCaseHistory() of released case = %v, want none", got)
+			}
+		})
+	}
+}
@@ -17,8 +17,9 @@ package data
 
 import (
 	"context"
-	"errors"
 	"log"
+	"net/url"
+	"sort"
 	"time"
 
 	"cloud.google.com/go/firestore"
@@ -30,81 +31,110 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-type GCTrackerData interface {
-	NewSession() sessions.Store
-	NewUser() GCTrackerUser
-	UserAvailable(string) bool
-	GetUser(string) (*firestore.DocumentSnapshot, error)
-	UpdateUser(user GCTrackerUser) error
-	GetUserByResetToken(string) (GCTrackerUser, error)
-	GetUsersByCase(string) []GCTrackerUser
-	CreateUser(GCTrackerUser) error
-	NewCase() GCTrackerCase
-	GetCase(string) (*firestore.DocumentSnapshot, error)
-	GetCases([]string) []GCTrackerCase
-	GetAllCases() []GCTrackerCase
-	CreateCase(GCTrackerCase) error
-	DeleteCase(GCTrackerCase) error
-}
-
-type FirestoreGCTrackerData struct{}
-
-func (d *FirestoreGCTrackerData) connectFirestore(ctx context.Context) *firestore.Client {
-	projectID := config.Config.Project
-	if config.Config.IsAppEngine {
-		client, err := firestore.NewClient(ctx, projectID)
-		if err != nil {
-			log.Fatalln("Cannot connect to Firestore: " + err.Error())
-		}
-		return client
+// FirestoreGCTrackerData is the GCTrackerData adapter for Google Firestore.
+// The client is shared by all requests and lives as long as the server.
+type FirestoreGCTrackerData struct {
+	client   *firestore.Client
+	sessions *idSessionStore
+}
+
+func NewFirestoreGCTrackerData(ctx context.Context) (*FirestoreGCTrackerData, error) {
+	var opts []option.ClientOption
+	if !config.Config.IsAppEngine {
+		opts = append(opts, option.WithCredentialsFile(".sa-key.json"))
 	}
-	sa := option.WithCredentialsFile(".sa-key.json")
-	client, err := firestore.NewClient(ctx, projectID, sa)
+	client, err := firestore.NewClient(ctx, config.Config.Project, opts...)
 	if err != nil {
-		log.Fatalln("Cannot connect to Firestore: " + err.Error())
+		log.Println("Cannot connect to Firestore: " + err.Error())
+		return nil, err
+	}
+	store := newIDSessionStore(&firestoreSessionBackend{client: client})
+	d := &FirestoreGCTrackerData{client: client, sessions: store}
+	if err := d.migrateCaseNames(ctx); err != nil {
+		// Nothing is lost, the names stay on the cases until the next start
+		log.Println("Cannot migrate case names: " + err.Error())
 	}
-	return client
+	return d, nil
 }
 
-func (d *FirestoreGCTrackerData) CreateUser(user GCTrackerUser) error {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	userDoc := client.Doc("users/" + user.GetUsername())
-	if _, err := userDoc.Create(ctx, user); err != nil {
-		log.Println("Cannot create user: " + err.Error())
+// migrateCaseNames moves the descriptions which earlier versions kept in the
+// name field of the shared case documents to the caseNames of subscribers
+// who have none yet. The field is deleted once copied, so later starts find
+// nothing to do.
+func (d *FirestoreGCTrackerData) migrateCaseNames(ctx context.Context) error {
+	docs, err := d.client.Collection("cases").Where("name", ">", "").Documents(ctx).GetAll()
+	if err != nil {
 		return err
 	}
+	for _, doc := range docs {
+		id := doc.Ref.ID
+		name, _ := doc.Data()["name"].(string)
+		subscribers := d.client.Collection("users").Where("cases."+id, "==", true)
+		err := d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			users, err := tx.Documents(subscribers).GetAll()
+			if err != nil {
+				return err
+			}
+			for _, u := range users {
+				if _, err := u.DataAt("caseNames." + id); err == nil {
+					continue
+				}
+				if err := tx.Update(u.Ref, []firestore.Update{{Path: "caseNames." + id, Value: name}}); err != nil {
+					return err
+				}
+			}
+			return tx.Update(doc.Ref, []firestore.Update{{Path: "name", Value: firestore.Delete}})
+		})
+		if err != nil {
+			return err
+		}
+		log.Println("Moved name of case " + id + " to its subscribers")
+	}
 	return nil
 }
 
-func (d *FirestoreGCTrackerData) GetUsers() ([]*firestore.DocumentSnapshot, error) {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
+func (d *FirestoreGCTrackerData) Close() error               { return d.client.Close() }
+func (d *FirestoreGCTrackerData) NewUser() GCTrackerUser     { return &GCTrackerUserImpl{data: d} }
+func (d *FirestoreGCTrackerData) NewCase() GCTrackerCase     { return &GCTrackerCaseImpl{data: d} }
+func (d *FirestoreGCTrackerData) NewSession() sessions.Store { return d.sessions }
 
-	return client.Collection("users").Documents(ctx).GetAll()
+func (d *FirestoreGCTrackerData) NewLimiterStore() LimiterStore {
+	return &firestoreLimiterStore{client: d.client}
 }
 
-func (d *FirestoreGCTrackerData) GetUser(username string) (*firestore.DocumentSnapshot, error) {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	user := client.Doc("users/" + username)
-
-	return user.Get(ctx)
+func (d *FirestoreGCTrackerData) CreateUser(ctx context.Context, user GCTrackerUser) error {
+	userDoc := d.client.Doc("users/" + user.GetUsername())
+	if _, err := userDoc.Create(ctx, user); err != nil {
+		log.Println("Cannot create user: " + err.Error())
+		if status.Code(err) == codes.AlreadyExists {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
 }
 
-func (d *FirestoreGCTrackerData) GetUsersByCase(id string) []GCTrackerUser {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
+func (d *FirestoreGCTrackerData) GetUsers(ctx context.Context) ([]*firestore.DocumentSnapshot, error) {
+	return d.client.Collection("users").Documents(ctx).GetAll()
+}
 
-	usersRef := client.Collection("users")
+func (d *FirestoreGCTrackerData) GetUser(ctx context.Context, username string) (GCTrackerUser, error) {
+	doc, err := d.client.Doc("users/" + username).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	u := &GCTrackerUserImpl{data: d}
+	if err := doc.DataTo(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
 
-	q := usersRef.Where("cases."+id, "==", true)
+func (d *FirestoreGCTrackerData) GetUsersByCase(ctx context.Context, id string) ([]GCTrackerUser, error) {
+	q := d.client.Collection("users").Where("cases."+id, "==", true)
 	iter := q.Documents(ctx)
 	defer iter.Stop()
 	var users []GCTrackerUser
@@ -115,60 +145,52 @@ func (d *FirestoreGCTrackerData) GetUsersByCase(id string) []GCTrackerUser {
 		}
 		if err != nil {
 			log.Println(err.Error())
-		} else {
-			u := d.NewUser()
-			doc.DataTo(u)
-			users = append(users, u)
+			return users, err
 		}
+		u := d.NewUser()
+		if err := doc.DataTo(u); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		users = append(users, u)
 	}
-	return users
+	return users, nil
 }
 
-func (d *FirestoreGCTrackerData) GetUserByResetToken(token string) (GCTrackerUser, error) {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	usersRef := client.Collection("users")
-
-	q := usersRef.Where("reset.Token", "==", token).
+func (d *FirestoreGCTrackerData) GetUserByResetToken(ctx context.Context, token string) (GCTrackerUser, error) {
+	q := d.client.Collection("users").
+		Where("reset.Token", "==", token).
 		Where("reset.Timestamp", ">", time.Now().Unix()-3600)
 	iter := q.Documents(ctx)
 	defer iter.Stop()
 	u := d.NewUser()
 	doc, err := iter.Next()
-	if err != iterator.Done && err == nil {
-		doc.DataTo(u)
-		return u, nil
+	if err == iterator.Done {
+		return u, ErrTokenNotFound
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return u, err
 	}
-	log.Println(err.Error())
-	return u, errors.New("token not found")
+	if err := doc.DataTo(u); err != nil {
+		return u, err
+	}
+	return u, nil
 }
 
-func (d *FirestoreGCTrackerData) UserAvailable(username string) bool {
+func (d *FirestoreGCTrackerData) UserAvailable(ctx context.Context, username string) bool {
 	log.Println("Checking user: " + username)
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	user := client.Doc("users/" + username)
-
-	if _, err := user.Get(ctx); err != nil {
+	if _, err := d.client.Doc("users/" + username).Get(ctx); err != nil {
 		if status.Code(err) == codes.NotFound {
 			return true
-		} else {
-			log.Println(err.Error())
 		}
+		log.Println(err.Error())
 	}
 	return false
 }
 
-func (d *FirestoreGCTrackerData) UpdateUser(user GCTrackerUser) error {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	userDoc := client.Doc("users/" + user.GetUsername())
+func (d *FirestoreGCTrackerData) UpdateUser(ctx context.Context, user GCTrackerUser) error {
+	userDoc := d.client.Doc("users/" + user.GetUsername())
 	if _, err := userDoc.Set(ctx, user); err != nil {
 		log.Println("Cannot update user: " + err.Error())
 		return err
@@ -176,12 +198,8 @@ func (d *FirestoreGCTrackerData) UpdateUser(user GCTrackerUser) error {
 	return nil
 }
 
-func (d *FirestoreGCTrackerData) CreateCase(c GCTrackerCase) error {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	caseDoc := client.Doc("cases/" + c.GetID())
+func (d *FirestoreGCTrackerData) CreateCase(ctx context.Context, c GCTrackerCase) error {
+	caseDoc := d.client.Doc("cases/" + c.GetID())
 	if _, err := caseDoc.Set(ctx, c); err != nil {
 		log.Println("Cannot create case: " + err.Error())
 		return err
@@ -189,40 +207,124 @@ func (d *FirestoreGCTrackerData) CreateCase(c GCTrackerCase) error {
 	return nil
 }
 
-func (d *FirestoreGCTrackerData) DeleteCase(c GCTrackerCase) error {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
-
-	caseDoc := client.Doc("cases/" + c.GetID())
-	if _, err := caseDoc.Delete(ctx); err != nil {
-		log.Println("Cannot delete case: " + err.Error())
+// UpdateCase only writes the status fields, Update fails with NotFound when
+// the case document is gone
+func (d *FirestoreGCTrackerData) UpdateCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot update case: " + err.Error())
+		return err
+	}
+	caseDoc := d.client.Doc("cases/" + ci.ID)
+	_, err = caseDoc.Update(ctx, []firestore.Update{
+		{Path: "status", Value: ci.Status},
+		{Path: "old", Value: ci.OldStatus},
+		{Path: "details", Value: ci.Details},
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrCaseNotFound
+	}
+	if err != nil {
+		log.Println("Cannot update case: " + err.Error())
 		return err
 	}
 	return nil
 }
 
-func (d *FirestoreGCTrackerData) GetCase(c string) (*firestore.DocumentSnapshot, error) {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
+func (d *FirestoreGCTrackerData) AcquireCase(ctx context.Context, c GCTrackerCase) error {
+	caseDoc := d.client.Doc("cases/" + c.GetID())
+	if _, err := caseDoc.Create(ctx, c); err != nil && status.Code(err) != codes.AlreadyExists {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	return nil
+}
 
-	caseRef := client.Doc("cases/" + c)
+func (d *FirestoreGCTrackerData) ReleaseCase(ctx context.Context, id string) error {
+	caseDoc := d.client.Doc("cases/" + id)
+	subscribers := d.client.Collection("users").Where("cases."+id, "==", true).Limit(1)
+	err := d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.Documents(subscribers).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docs) > 0 {
+			return nil
+		}
+		// Firestore keeps subcollections of deleted documents
+		history, err := tx.Documents(caseDoc.Collection("history")).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, doc := range history {
+			if err := tx.Delete(doc.Ref); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(caseDoc)
+	})
+	if err != nil {
+		log.Println("Cannot release case: " + err.Error())
+	}
+	return err
+}
 
-	return caseRef.Get(ctx)
+func (d *FirestoreGCTrackerData) RecordStatus(ctx context.Context, id string, e StatusEntry) error {
+	history := d.client.Collection("cases/" + id + "/history")
+	latest := history.OrderBy("firstSeen", firestore.Desc).Limit(1)
+	return d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.Documents(latest).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docs) > 0 {
+			var last StatusEntry
+			if err := docs[0].DataTo(&last); err != nil {
+				return err
+			}
+			if last.sameStatus(e) {
+				return tx.Update(docs[0].Ref, []firestore.Update{{Path: "lastChecked", Value: e.LastChecked}})
+			}
+		}
+		return tx.Create(history.NewDoc(), e)
+	})
 }
 
-func (d *FirestoreGCTrackerData) GetCases(ids []string) []GCTrackerCase {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
+func (d *FirestoreGCTrackerData) GetCaseHistory(ctx context.Context, id string) ([]StatusEntry, error) {
+	iter := d.client.Collection("cases/"+id+"/history").OrderBy("firstSeen", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	var history []StatusEntry
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return history, err
+		}
+		var e StatusEntry
+		if err := doc.DataTo(&e); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		history = append(history, e)
+	}
+	return history, nil
+}
 
-	casesRef := client.Collection("cases")
+func (d *FirestoreGCTrackerData) QueueNotification(ctx context.Context, username string, n QueuedNotification) error {
+	if _, _, err := d.client.Collection("users/"+username+"/queue").Add(ctx, n); err != nil {
+		log.Println("Cannot queue notification: " + err.Error())
+		return err
+	}
+	return nil
+}
 
-	q := casesRef.Where("id", "in", ids)
-	iter := q.Documents(ctx)
+func (d *FirestoreGCTrackerData) GetQueuedNotifications(ctx context.Context, username string) ([]QueuedNotification, error) {
+	iter := d.client.Collection("users/"+username+"/queue").OrderBy("created", firestore.Asc).Documents(ctx)
 	defer iter.Stop()
-	var cases []GCTrackerCase
+	var queue []QueuedNotification
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -230,21 +332,194 @@ func (d *FirestoreGCTrackerData) GetCases(ids []string) []GCTrackerCase {
 		}
 		if err != nil {
 			log.Println(err.Error())
-		} else {
-			c := d.NewCase()
-			doc.DataTo(c)
-			cases = append(cases, c)
+			return queue, err
 		}
+		var n QueuedNotification
+		if err := doc.DataTo(&n); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		n.ID = doc.Ref.ID
+		queue = append(queue, n)
 	}
-	return cases
+	return queue, nil
 }
 
-func (d *FirestoreGCTrackerData) GetAllCases() []GCTrackerCase {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
-	defer client.Close()
+func (d *FirestoreGCTrackerData) DeleteQueuedNotifications(ctx context.Context, username string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	batch := d.client.Batch()
+	for _, id := range ids {
+		batch.Delete(d.client.Doc("users/" + username + "/queue/" + id))
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		log.Println("Cannot delete queued notifications: " + err.Error())
+		return err
+	}
+	return nil
+}
 
-	iter := client.Collection("cases").Documents(ctx)
+// GetQueuedUsernames finds parents of all queue subcollections
+func (d *FirestoreGCTrackerData) GetQueuedUsernames(ctx context.Context) ([]string, error) {
+	docs, err := d.client.CollectionGroup("queue").Documents(ctx).GetAll()
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, doc := range docs {
+		name := doc.Ref.Parent.Parent.ID
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *FirestoreGCTrackerData) AddOutbox(ctx context.Context, e OutboxEntry) (string, error) {
+	ref, _, err := d.client.Collection("outbox").Add(ctx, e)
+	if err != nil {
+		log.Println("Cannot add to outbox: " + err.Error())
+		return "", err
+	}
+	return ref.ID, nil
+}
+
+func (d *FirestoreGCTrackerData) UpdateOutbox(ctx context.Context, e OutboxEntry) error {
+	_, err := d.client.Doc("outbox/"+e.ID).Update(ctx, []firestore.Update{
+		{Path: "status", Value: e.Status},
+		{Path: "attempts", Value: e.Attempts},
+		{Path: "lastError", Value: e.LastError},
+		{Path: "updated", Value: e.Updated},
+		{Path: "nextAttempt", Value: e.NextAttempt},
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrEntryNotFound
+	}
+	return err
+}
+
+// GetDueOutbox filters pending entries in memory, which saves a composite
+// index on status and nextAttempt
+func (d *FirestoreGCTrackerData) GetDueOutbox(ctx context.Context, now int64) ([]OutboxEntry, error) {
+	pending, err := d.readOutbox(ctx, d.client.Collection("outbox").Where("status", "==", OutboxPending))
+	if err != nil {
+		return nil, err
+	}
+	var entries []OutboxEntry
+	for _, e := range pending {
+		if e.due(now) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created < entries[j].Created })
+	return entries, nil
+}
+
+func (d *FirestoreGCTrackerData) ClaimOutbox(ctx context.Context, id string, now, until int64) error {
+	ref := d.client.Doc("outbox/" + id)
+	return d.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrEntryNotFound
+		} else if err != nil {
+			return err
+		}
+		var e OutboxEntry
+		if err := doc.DataTo(&e); err != nil {
+			return err
+		}
+		if !e.due(now) {
+			return ErrEntryNotDue
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "nextAttempt", Value: until}})
+	})
+}
+
+func (d *FirestoreGCTrackerData) GetOutbox(ctx context.Context, username string, limit int) ([]OutboxEntry, error) {
+	entries, err := d.readOutbox(ctx, d.client.Collection("outbox").Where("username", "==", username))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created > entries[j].Created })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (d *FirestoreGCTrackerData) PruneOutbox(ctx context.Context, before int64) error {
+	entries, err := d.readOutbox(ctx, d.client.Collection("outbox").Where("updated", "<", before))
+	if err != nil {
+		return err
+	}
+	// Batches take up to 500 writes
+	batch, writes := d.client.Batch(), 0
+	for _, e := range entries {
+		if !e.pruned(before) {
+			continue
+		}
+		batch.Delete(d.client.Doc("outbox/" + e.ID))
+		if writes++; writes == 500 {
+			if _, err := batch.Commit(ctx); err != nil {
+				return err
+			}
+			batch, writes = d.client.Batch(), 0
+		}
+	}
+	if writes > 0 {
+		_, err = batch.Commit(ctx)
+	}
+	return err
+}
+
+func (d *FirestoreGCTrackerData) readOutbox(ctx context.Context, q firestore.Query) ([]OutboxEntry, error) {
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	var entries []OutboxEntry
+	for _, doc := range docs {
+		var e OutboxEntry
+		if err := doc.DataTo(&e); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		e.ID = doc.Ref.ID
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (d *FirestoreGCTrackerData) GetCase(ctx context.Context, id string) (GCTrackerCase, error) {
+	doc, err := d.client.Doc("cases/" + id).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ErrCaseNotFound
+		}
+		return nil, err
+	}
+	c := &GCTrackerCaseImpl{data: d}
+	if err := doc.DataTo(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (d *FirestoreGCTrackerData) GetCases(ctx context.Context, ids []string) ([]GCTrackerCase, error) {
+	return d.readCases(d.client.Collection("cases").Where("id", "in", ids).Documents(ctx))
+}
+
+func (d *FirestoreGCTrackerData) GetAllCases(ctx context.Context) ([]GCTrackerCase, error) {
+	return d.readCases(d.client.Collection("cases").Documents(ctx))
+}
+
+func (d *FirestoreGCTrackerData) readCases(iter *firestore.DocumentIterator) ([]GCTrackerCase, error) {
 	defer iter.Stop()
 	var cases []GCTrackerCase
 	for {
@@ -254,11 +529,121 @@ func (d *FirestoreGCTrackerData) GetAllCases() []GCTrackerCase {
 		}
 		if err != nil {
 			log.Println(err.Error())
-		} else {
-			c := d.NewCase()
-			doc.DataTo(c)
-			cases = append(cases, c)
+			return cases, err
+		}
+		c := d.NewCase()
+		if err := doc.DataTo(c); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// firestoreSessionBackend stores gob encoded session values in the
+// sessions collection
+type firestoreSessionBackend struct{ client *firestore.Client }
+
+type sessionDoc struct {
+	Data    []byte `firestore:"data"`
+	Expires int64  `firestore:"expires"`
+}
+
+func (b *firestoreSessionBackend) load(ctx context.Context, id string) (map[interface{}]interface{}, error) {
+	doc, err := b.client.Collection("sessions").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session sessionDoc
+	if err := doc.DataTo(&session); err != nil {
+		return nil, err
+	}
+	if session.Expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return decodeValues(session.Data)
+}
+
+func (b *firestoreSessionBackend) save(ctx context.Context, id string, values map[interface{}]interface{}, maxAge int) error {
+	blob, err := encodeValues(values)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Collection("sessions").Doc(id).Set(ctx, sessionDoc{Data: blob, Expires: sessionExpires(maxAge)})
+	return err
+}
+
+func (b *firestoreSessionBackend) delete(ctx context.Context, id string) error {
+	_, err := b.client.Collection("sessions").Doc(id).Delete(ctx)
+	return err
+}
+
+// firestoreLimiterStore keeps attempts in the attempts collection, keys
+// are escaped into document IDs
+type firestoreLimiterStore struct{ client *firestore.Client }
+
+type attemptsDoc struct {
+	Count       int   `firestore:"count"`
+	Start       int64 `firestore:"start"`
+	LockedUntil int64 `firestore:"lockedUntil"`
+	Expires     int64 `firestore:"expires"`
+}
+
+func (s *firestoreLimiterStore) doc(key string) *firestore.DocumentRef {
+	return s.client.Collection("attempts").Doc(url.PathEscape(key))
+}
+
+func (s *firestoreLimiterStore) UpdateAttempts(ctx context.Context, key string, f func(*Attempts)) (Attempts, error) {
+	ref := s.doc(key)
+	var a Attempts
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		a = Attempts{}
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
 		}
+		if err == nil {
+			var stored attemptsDoc
+			if err := doc.DataTo(&stored); err != nil {
+				return err
+			}
+			if stored.Expires > time.Now().Unix() {
+				a = Attempts(stored)
+			}
+		}
+		f(&a)
+		return tx.Set(ref, attemptsDoc(a))
+	})
+	if err != nil {
+		log.Println("Cannot update attempts: " + err.Error())
+		return Attempts{}, err
+	}
+	return a, nil
+}
+
+func (s *firestoreLimiterStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	doc, err := s.doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Attempts{}, nil
 	}
-	return cases
+	if err != nil {
+		return Attempts{}, err
+	}
+	var stored attemptsDoc
+	if err := doc.DataTo(&stored); err != nil {
+		return Attempts{}, err
+	}
+	if stored.Expires <= time.Now().Unix() {
+		return Attempts{}, nil
+	}
+	return Attempts(stored), nil
+}
+
+func (s *firestoreLimiterStore) DeleteAttempts(ctx context.Context, key string) error {
+	_, err := s.doc(key).Delete(ctx)
+	return err
 }
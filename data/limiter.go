@@ -0,0 +1,101 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Attempts counts attempts of a key, e.g. failed sign ins of a user, in
+// the window started at Start. Times are Unix seconds.
+type Attempts struct {
+	Count int
+	Start int64
+	// LockedUntil blocks further attempts until the time
+	LockedUntil int64
+	// Expires is when the store may forget the key
+	Expires int64
+}
+
+// LimiterStore keeps attempts by key for throttling. Expired attempts
+// count as none.
+type LimiterStore interface {
+	// UpdateAttempts applies f to the attempts of the key atomically and
+	// returns the result. f may be called more than once.
+	UpdateAttempts(ctx context.Context, key string, f func(*Attempts)) (Attempts, error)
+	GetAttempts(ctx context.Context, key string) (Attempts, error)
+	DeleteAttempts(ctx context.Context, key string) error
+}
+
+// MemoryLimiterStore keeps attempts in process memory, so every instance
+// counts its own
+type MemoryLimiterStore struct {
+	mu       sync.Mutex
+	attempts map[string]Attempts
+	swept    int64
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{attempts: map[string]Attempts{}}
+}
+
+func (s *MemoryLimiterStore) UpdateAttempts(ctx context.Context, key string, f func(*Attempts)) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	s.sweep(now)
+	a := s.attempts[key]
+	if a.Expires <= now {
+		a = Attempts{}
+	}
+	f(&a)
+	s.attempts[key] = a
+	return a, nil
+}
+
+func (s *MemoryLimiterStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.attempts[key]
+	if a.Expires <= time.Now().Unix() {
+		return Attempts{}, nil
+	}
+	return a, nil
+}
+
+func (s *MemoryLimiterStore) DeleteAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// sweep forgets expired keys, at most once a minute
+func (s *MemoryLimiterStore) sweep(now int64) {
+	if now-s.swept < 60 {
+		return
+	}
+	s.swept = now
+	for key, a := range s.attempts {
+		if a.Expires <= now {
+			delete(s.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGCTrackerData_LimiterStore(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			store := newData(t).NewLimiterStore()
+			now := time.Now().Unix()
+
+			a, err := store.UpdateAttempts(ctx, "signin:user:alice", func(a *Attempts) {
+				if a.Count != 0 {
+					t.Errorf("UpdateAttempts() of a new key got %+v", a)
+				}
+				a.Count++
+				a.Start = now
+				a.Expires = now + 60
+			})
+			if err != nil || a.Count != 1 {
+				t.Fatalf("LimiterStore.UpdateAttempts() = %+v, %v, want 1 attempt", a, err)
+			}
+			if a, err := store.GetAttempts(ctx, "signin:user:alice"); err != nil || a.Count != 1 || a.Start != now {
+				t.Errorf("LimiterStore.GetAttempts() = %+v, %v, want 1 attempt", a, err)
+			}
+			if a, err := store.GetAttempts(ctx, "signin:user:bob"); err != nil || a != (Attempts{}) {
+				t.Errorf("LimiterStore.GetAttempts() of unknown key = %+v, %v", a, err)
+			}
+
+			// Expired attempts count as none
+			if _, err := store.UpdateAttempts(ctx, "signin:ip:10.0.0.1", func(a *Attempts) {
+				a.Count = 5
+				a.Expires = now - 1
+			}); err != nil {
+				t.Fatalf("LimiterStore.UpdateAttempts() error = %v", err)
+			}
+			if a, err := store.GetAttempts(ctx, "signin:ip:10.0.0.1"); err != nil || a.Count != 0 {
+				t.Errorf("LimiterStore.GetAttempts() of expired key = %+v, %v", a, err)
+			}
+			a, err = store.UpdateAttempts(ctx, "signin:ip:10.0.0.1", func(a *Attempts) {
+				a.Count++
+				a.Expires = now + 60
+			})
+			if err != nil || a.Count != 1 {
+				t.Errorf("LimiterStore.UpdateAttempts() of expired key = %+v, %v, want 1 attempt", a, err)
+			}
+
+			if err := store.DeleteAttempts(ctx, "signin:user:alice"); err != nil {
+				t.Fatalf("LimiterStore.DeleteAttempts() error = %v", err)
+			}
+			if a, err := store.GetAttempts(ctx, "signin:user:alice"); err != nil || a.Count != 0 {
+				t.Errorf("LimiterStore.GetAttempts() after delete = %+v, %v", a, err)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_LimiterStore_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			store := newData(t).NewLimiterStore()
+			expires := time.Now().Unix() + 60
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := store.UpdateAttempts(ctx, "signin:user:alice", func(a *Attempts) {
+						a.Count++
+						a.Expires = expires
+					}); err != nil {
+						t.Errorf("LimiterStore.UpdateAttempts() error = %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			if a, err := store.GetAttempts(ctx, "signin:user:alice"); err != nil || a.Count != 20 {
+				t.Errorf("LimiterStore.GetAttempts() = %+v, %v, want 20 attempts", a, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,421 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// MemoryGCTrackerData keeps everything in process memory. Data is lost on
+// restart, so it is meant for local development and tests.
+type MemoryGCTrackerData struct {
+	mu       sync.RWMutex
+	users    map[string]GCTrackerUserImpl
+	cases    map[string]GCTrackerCaseImpl
+	history  map[string][]StatusEntry
+	queue    map[string][]QueuedNotification
+	queued   int
+	outbox   []OutboxEntry
+	outboxID int
+	sessions *idSessionStore
+	limiter  *MemoryLimiterStore
+}
+
+func NewMemoryGCTrackerData() *MemoryGCTrackerData {
+	return &MemoryGCTrackerData{
+		users:    map[string]GCTrackerUserImpl{},
+		cases:    map[string]GCTrackerCaseImpl{},
+		history:  map[string][]StatusEntry{},
+		queue:    map[string][]QueuedNotification{},
+		sessions: newMemorySessionStore(),
+		limiter:  NewMemoryLimiterStore(),
+	}
+}
+
+func (d *MemoryGCTrackerData) NewUser() GCTrackerUser     { return &GCTrackerUserImpl{data: d} }
+func (d *MemoryGCTrackerData) NewCase() GCTrackerCase     { return &GCTrackerCaseImpl{data: d} }
+func (d *MemoryGCTrackerData) NewSession() sessions.Store { return d.sessions }
+
+func (d *MemoryGCTrackerData) NewLimiterStore() LimiterStore { return d.limiter }
+
+func (d *MemoryGCTrackerData) CreateUser(ctx context.Context, user GCTrackerUser) error {
+	u, err := toUserImpl(user)
+	if err != nil {
+		log.Println("Cannot create user: " + err.Error())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.users[u.Username]; ok {
+		log.Println("Cannot create user: " + u.Username + " already exists")
+		return ErrUserExists
+	}
+	d.users[u.Username] = u
+	return nil
+}
+
+func (d *MemoryGCTrackerData) GetUser(ctx context.Context, username string) (GCTrackerUser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	u, ok := d.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := u.clone()
+	user.data = d
+	return &user, nil
+}
+
+func (d *MemoryGCTrackerData) GetUsersByCase(ctx context.Context, id string) ([]GCTrackerUser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var users []GCTrackerUser
+	for _, name := range d.sortedUsernames() {
+		u := d.users[name]
+		if u.Cases[id] {
+			user := u.clone()
+			user.data = d
+			users = append(users, &user)
+		}
+	}
+	return users, nil
+}
+
+func (d *MemoryGCTrackerData) GetUserByResetToken(ctx context.Context, token string) (GCTrackerUser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	notBefore := time.Now().Unix() - 3600
+	for _, name := range d.sortedUsernames() {
+		u := d.users[name]
+		if token != "" && u.Reset.Token == token && u.Reset.Timestamp > notBefore {
+			user := u.clone()
+			user.data = d
+			return &user, nil
+		}
+	}
+	return d.NewUser(), ErrTokenNotFound
+}
+
+func (d *MemoryGCTrackerData) UserAvailable(ctx context.Context, username string) bool {
+	log.Println("Checking user: " + username)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, ok := d.users[username]
+	return !ok
+}
+
+func (d *MemoryGCTrackerData) UpdateUser(ctx context.Context, user GCTrackerUser) error {
+	u, err := toUserImpl(user)
+	if err != nil {
+		log.Println("Cannot update user: " + err.Error())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users[u.Username] = u
+	return nil
+}
+
+func (d *MemoryGCTrackerData) CreateCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cases[ci.ID] = ci
+	return nil
+}
+
+func (d *MemoryGCTrackerData) UpdateCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot update case: " + err.Error())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.cases[ci.ID]; !ok {
+		return ErrCaseNotFound
+	}
+	d.cases[ci.ID] = ci
+	return nil
+}
+
+func (d *MemoryGCTrackerData) AcquireCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.cases[ci.ID]; !ok {
+		d.cases[ci.ID] = ci
+	}
+	return nil
+}
+
+func (d *MemoryGCTrackerData) ReleaseCase(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, u := range d.users {
+		if u.Cases[id] {
+			return nil
+		}
+	}
+	delete(d.cases, id)
+	delete(d.history, id)
+	return nil
+}
+
+func (d *MemoryGCTrackerData) RecordStatus(ctx context.Context, id string, e StatusEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	history := d.history[id]
+	if n := len(history); n > 0 && history[n-1].sameStatus(e) {
+		history[n-1].LastChecked = e.LastChecked
+		return nil
+	}
+	d.history[id] = append(history, e)
+	return nil
+}
+
+func (d *MemoryGCTrackerData) GetCaseHistory(ctx context.Context, id string) ([]StatusEntry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	history := d.history[id]
+	if len(history) == 0 {
+		return nil, nil
+	}
+	return append([]StatusEntry(nil), history...), nil
+}
+
+func (d *MemoryGCTrackerData) QueueNotification(ctx context.Context, username string, n QueuedNotification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queued++
+	n.ID = strconv.Itoa(d.queued)
+	d.queue[username] = append(d.queue[username], n)
+	return nil
+}
+
+func (d *MemoryGCTrackerData) GetQueuedNotifications(ctx context.Context, username string) ([]QueuedNotification, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	queue := d.queue[username]
+	if len(queue) == 0 {
+		return nil, nil
+	}
+	return append([]QueuedNotification(nil), queue...), nil
+}
+
+func (d *MemoryGCTrackerData) DeleteQueuedNotifications(ctx context.Context, username string, ids []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deleted := map[string]bool{}
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	var queue []QueuedNotification
+	for _, n := range d.queue[username] {
+		if !deleted[n.ID] {
+			queue = append(queue, n)
+		}
+	}
+	if len(queue) == 0 {
+		delete(d.queue, username)
+		return nil
+	}
+	d.queue[username] = queue
+	return nil
+}
+
+func (d *MemoryGCTrackerData) GetQueuedUsernames(ctx context.Context) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var names []string
+	for name := range d.queue {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *MemoryGCTrackerData) AddOutbox(ctx context.Context, e OutboxEntry) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.outboxID++
+	e.ID = strconv.Itoa(d.outboxID)
+	d.outbox = append(d.outbox, e)
+	return e.ID, nil
+}
+
+func (d *MemoryGCTrackerData) UpdateOutbox(ctx context.Context, e OutboxEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.outbox {
+		if d.outbox[i].ID == e.ID {
+			d.outbox[i] = e
+			return nil
+		}
+	}
+	return ErrEntryNotFound
+}
+
+func (d *MemoryGCTrackerData) GetDueOutbox(ctx context.Context, now int64) ([]OutboxEntry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var entries []OutboxEntry
+	for _, e := range d.outbox {
+		if e.due(now) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (d *MemoryGCTrackerData) ClaimOutbox(ctx context.Context, id string, now, until int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.outbox {
+		if d.outbox[i].ID == id {
+			if !d.outbox[i].due(now) {
+				return ErrEntryNotDue
+			}
+			d.outbox[i].NextAttempt = until
+			return nil
+		}
+	}
+	return ErrEntryNotFound
+}
+
+func (d *MemoryGCTrackerData) GetOutbox(ctx context.Context, username string, limit int) ([]OutboxEntry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var entries []OutboxEntry
+	for i := len(d.outbox) - 1; i >= 0 && len(entries) < limit; i-- {
+		if d.outbox[i].Username == username {
+			entries = append(entries, d.outbox[i])
+		}
+	}
+	return entries, nil
+}
+
+func (d *MemoryGCTrackerData) PruneOutbox(ctx context.Context, before int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	kept := d.outbox[:0]
+	for _, e := range d.outbox {
+		if !e.pruned(before) {
+			kept = append(kept, e)
+		}
+	}
+	d.outbox = kept
+	return nil
+}
+
+func (d *MemoryGCTrackerData) GetCase(ctx context.Context, id string) (GCTrackerCase, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.cases[id]
+	if !ok {
+		return nil, ErrCaseNotFound
+	}
+	c.data = d
+	return &c, nil
+}
+
+func (d *MemoryGCTrackerData) GetCases(ctx context.Context, ids []string) ([]GCTrackerCase, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var cases []GCTrackerCase
+	for _, id := range d.sortedCaseIDs() {
+		if wanted[id] {
+			c := d.cases[id]
+			c.data = d
+			cases = append(cases, &c)
+		}
+	}
+	return cases, nil
+}
+
+func (d *MemoryGCTrackerData) GetAllCases(ctx context.Context) ([]GCTrackerCase, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var cases []GCTrackerCase
+	for _, id := range d.sortedCaseIDs() {
+		c := d.cases[id]
+		c.data = d
+		cases = append(cases, &c)
+	}
+	return cases, nil
+}
+
+// Firestore returns documents ordered by ID, so do we
+func (d *MemoryGCTrackerData) sortedUsernames() []string {
+	names := make([]string, 0, len(d.users))
+	for name := range d.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *MemoryGCTrackerData) sortedCaseIDs() []string {
+	ids := make([]string, 0, len(d.cases))
+	for id := range d.cases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
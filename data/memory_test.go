@@ -0,0 +1,54 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestMemoryGCTrackerData_NewSession(t *testing.T) {
+	d := NewMemoryGCTrackerData()
+	store := d.NewSession()
+	if store != d.NewSession() {
+		t.Fatalf("MemoryGCTrackerData.NewSession() returned a new store")
+	}
+
+	testSessionStore(t, store)
+}
+
+func TestMemoryGCTrackerData_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	d := seedTestData(t, NewMemoryGCTrackerData())
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := d.NewUser().(*GCTrackerUserImpl)
+			if err := u.GetByUsername(ctx, "alice"); err != nil {
+				t.Errorf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+				return
+			}
+			u.Cases[string(rune('A'+i))] = true
+			d.UpdateUser(ctx, u)
+			d.GetUsersByCase(ctx, "ABC0000000001")
+			d.GetAllCases(ctx)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,239 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/batk0/gc-tracker/notify"
+)
+
+// Events users get notified about
+const (
+	EventStatusChange = notify.EventStatusChange
+	// Account events, muted all together
+	EventAccount         = notify.EventAccount
+	EventSignUp          = notify.EventSignUp
+	EventPasswordChanged = notify.EventPasswordChanged
+	// Security events: password reset and email verification links, the
+	// old address being told of the change, and sign in being blocked after
+	// failed attempts, are always sent right away, and by email only
+	EventPasswordReset = notify.EventPasswordReset
+	EventVerifyEmail   = notify.EventVerifyEmail
+	EventEmailChanged  = notify.EventEmailChanged
+	EventLockout       = notify.EventLockout
+)
+
+// Digest periods
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// NotificationSettings are the user's choice of notifications. The zero
+// value sends everything right away.
+type NotificationSettings struct {
+	MuteStatus  bool `firestore:"muteStatus" json:"muteStatus"`
+	MuteAccount bool `firestore:"muteAccount" json:"muteAccount"`
+	// Status changes are only sent in a digest every DigestPeriod, daily
+	// unless set
+	DigestOnly   bool   `firestore:"digestOnly" json:"digestOnly"`
+	DigestPeriod string `firestore:"digestPeriod" json:"digestPeriod"`
+	// Notifications are held from QuietFrom till QuietTo o'clock in
+	// TimeZone, quiet hours are off when both are equal
+	QuietFrom int    `firestore:"quietFrom" json:"quietFrom"`
+	QuietTo   int    `firestore:"quietTo" json:"quietTo"`
+	TimeZone  string `firestore:"timeZone" json:"timeZone"`
+	// Notifications are also posted to WebhookURL, signed with
+	// WebhookSecret
+	WebhookURL    string `firestore:"webhookUrl" json:"webhookUrl"`
+	WebhookSecret string `firestore:"webhookSecret" json:"webhookSecret"`
+	// Notifications are also posted to ChatURL of ChatService, one of
+	// notify.ChatSlack, ChatDiscord or ChatMatrix. ChatToken is the Matrix
+	// access token.
+	ChatService string `firestore:"chatService" json:"chatService"`
+	ChatURL     string `firestore:"chatUrl" json:"chatUrl"`
+	ChatToken   string `firestore:"chatToken" json:"chatToken"`
+}
+
+// Notification tells a user about an event. Status changes also carry the
+// case and both statuses.
+type Notification struct {
+	Event     string `firestore:"event"`
+	Message   string `firestore:"message"`
+	CaseID    string `firestore:"caseId"`
+	CaseName  string `firestore:"caseName"`
+	OldStatus string `firestore:"oldStatus"`
+	NewStatus string `firestore:"newStatus"`
+	Link      string `firestore:"link"`
+	// To overrides the email address of the user, security events are
+	// never queued
+	To string `firestore:"to"`
+}
+
+// QueuedNotification waits for the end of quiet hours or for the digest
+type QueuedNotification struct {
+	Notification
+	ID      string `firestore:"-"`
+	Digest  bool   `firestore:"digest"`
+	Created int64  `firestore:"created"`
+}
+
+func (s NotificationSettings) Validate() error {
+	if s.QuietFrom < 0 || s.QuietFrom > 23 || s.QuietTo < 0 || s.QuietTo > 23 {
+		return errors.New("quiet hours must be between 0 and 23")
+	}
+	if s.DigestPeriod != "" && s.DigestPeriod != DigestDaily && s.DigestPeriod != DigestWeekly {
+		return errors.New("unknown digest period " + s.DigestPeriod)
+	}
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return errors.New("unknown time zone " + s.TimeZone)
+	}
+	if s.WebhookURL != "" {
+		if !httpURL(s.WebhookURL) {
+			return errors.New("webhook URL must be an http or https URL")
+		}
+		if err := notify.CheckHost(urlHost(s.WebhookURL)); err != nil {
+			return errors.New("webhook URL must point to a public host")
+		}
+		if s.WebhookSecret == "" {
+			return errors.New("webhook secret is required")
+		}
+	}
+	if s.ChatURL != "" {
+		if !httpURL(s.ChatURL) {
+			return errors.New("chat URL must be an http or https URL")
+		}
+		if err := notify.CheckHost(urlHost(s.ChatURL)); err != nil {
+			return errors.New("chat URL must point to a public host")
+		}
+		if _, err := notify.NewChat(s.ChatService, s.ChatURL, s.ChatToken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func httpURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func urlHost(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+func (s NotificationSettings) location() *time.Location {
+	if loc, err := time.LoadLocation(s.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// Quiet tells whether t falls into the quiet hours
+func (s NotificationSettings) Quiet(t time.Time) bool {
+	if s.QuietFrom == s.QuietTo {
+		return false
+	}
+	h := t.In(s.location()).Hour()
+	if s.QuietFrom < s.QuietTo {
+		return h >= s.QuietFrom && h < s.QuietTo
+	}
+	return h >= s.QuietFrom || h < s.QuietTo
+}
+
+// Mutes tells whether the user does not want to hear about the event at all
+func (s NotificationSettings) Mutes(event string) bool {
+	switch event {
+	case EventStatusChange:
+		return s.MuteStatus
+	case EventAccount, EventSignUp, EventPasswordChanged:
+		return s.MuteAccount
+	}
+	return false
+}
+
+func (s NotificationSettings) digestPeriod() time.Duration {
+	if s.DigestPeriod == DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// due selects queued notifications to deliver at now. Digests go out once
+// their oldest entry is a period old, or right away if the user no longer
+// wants them.
+func (s NotificationSettings) due(queue []QueuedNotification, now time.Time) []QueuedNotification {
+	if s.Quiet(now) {
+		return nil
+	}
+	digestDue := false
+	for _, n := range queue {
+		if n.Digest && (!s.DigestOnly || now.Sub(time.Unix(n.Created, 0)) >= s.digestPeriod()) {
+			digestDue = true
+		}
+	}
+	var due []QueuedNotification
+	for _, n := range queue {
+		if !n.Digest || digestDue {
+			due = append(due, n)
+		}
+	}
+	return due
+}
+
+// composeMessage joins queued notifications into a single message. Status
+// changes in the digest are summarized once per case, from the status
+// before the first change to the latest one.
+func composeMessage(queue []QueuedNotification) string {
+	type change struct{ name, old, new string }
+	changes := map[string]*change{}
+	var msgs []string
+	for _, n := range queue {
+		if !n.Digest {
+			msgs = append(msgs, n.Message)
+			continue
+		}
+		if c, ok := changes[n.CaseID]; ok {
+			c.new = n.NewStatus
+			continue
+		}
+		changes[n.CaseID] = &change{name: n.CaseName, old: n.OldStatus, new: n.NewStatus}
+	}
+	if len(changes) == 0 {
+		return strings.Join(msgs, "\n\n")
+	}
+
+	ids := make([]string, 0, len(changes))
+	for id := range changes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	digest := "Status changes of your cases:\n"
+	for _, id := range ids {
+		c := changes[id]
+		digest += fmt.Sprintf("\n%s (%s): %s -> %s", id, c.name, notify.StatusOrNone(c.old), c.new)
+	}
+	return strings.Join(append([]string{digest}, msgs...), "\n\n")
+}
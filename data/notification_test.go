@@ -0,0 +1,487 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/notify"
+)
+
+func TestNotificationSettings_Quiet(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings NotificationSettings
+		at       time.Time
+		want     bool
+	}{
+		{
+			name: "Quiet hours off",
+			at:   time.Date(2021, time.May, 5, 3, 0, 0, 0, time.UTC),
+			want: false,
+		},
+		{
+			name:     "Within daytime hours",
+			settings: NotificationSettings{QuietFrom: 9, QuietTo: 17},
+			at:       time.Date(2021, time.May, 5, 9, 0, 0, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "End is not quiet",
+			settings: NotificationSettings{QuietFrom: 9, QuietTo: 17},
+			at:       time.Date(2021, time.May, 5, 17, 0, 0, 0, time.UTC),
+			want:     false,
+		},
+		{
+			name:     "Over midnight, late",
+			settings: NotificationSettings{QuietFrom: 22, QuietTo: 7},
+			at:       time.Date(2021, time.May, 5, 23, 30, 0, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "Over midnight, early",
+			settings: NotificationSettings{QuietFrom: 22, QuietTo: 7},
+			at:       time.Date(2021, time.May, 5, 6, 59, 0, 0, time.UTC),
+			want:     true,
+		},
+		{
+			name:     "Over midnight, day",
+			settings: NotificationSettings{QuietFrom: 22, QuietTo: 7},
+			at:       time.Date(2021, time.May, 5, 12, 0, 0, 0, time.UTC),
+			want:     false,
+		},
+		{
+			name:     "Time zone",
+			settings: NotificationSettings{QuietFrom: 22, QuietTo: 7, TimeZone: "America/New_York"},
+			at:       time.Date(2021, time.May, 5, 3, 0, 0, 0, time.UTC),
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.Quiet(tt.at); got != tt.want {
+				t.Errorf("NotificationSettings.Quiet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationSettings_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings NotificationSettings
+		wantErr  bool
+	}{
+		{
+			name:    "Defaults",
+			wantErr: false,
+		},
+		{
+			name:     "Valid",
+			settings: NotificationSettings{QuietFrom: 22, QuietTo: 7, TimeZone: "Europe/Berlin"},
+			wantErr:  false,
+		},
+		{
+			name:     "Hour out of range",
+			settings: NotificationSettings{QuietFrom: 24},
+			wantErr:  true,
+		},
+		{
+			name:     "Negative hour",
+			settings: NotificationSettings{QuietTo: -1},
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown time zone",
+			settings: NotificationSettings{TimeZone: "Mars/Olympus"},
+			wantErr:  true,
+		},
+		{
+			name:     "Weekly digest",
+			settings: NotificationSettings{DigestOnly: true, DigestPeriod: DigestWeekly},
+			wantErr:  false,
+		},
+		{
+			name:     "Unknown digest period",
+			settings: NotificationSettings{DigestOnly: true, DigestPeriod: "hourly"},
+			wantErr:  true,
+		},
+		{
+			name:     "Webhook",
+			settings: NotificationSettings{WebhookURL: "https://example.com/hook", WebhookSecret: "secret"},
+			wantErr:  false,
+		},
+		{
+			name:     "Webhook without secret",
+			settings: NotificationSettings{WebhookURL: "https://example.com/hook"},
+			wantErr:  true,
+		},
+		{
+			name:     "Webhook to private address",
+			settings: NotificationSettings{WebhookURL: "http://192.168.1.1/hook", WebhookSecret: "secret"},
+			wantErr:  true,
+		},
+		{
+			name:     "Chat to metadata service",
+			settings: NotificationSettings{ChatService: notify.ChatSlack, ChatURL: "http://169.254.169.254/latest/meta-data"},
+			wantErr:  true,
+		},
+		{
+			name:     "Relative webhook URL",
+			settings: NotificationSettings{WebhookURL: "/hook"},
+			wantErr:  true,
+		},
+		{
+			name:     "Webhook URL without HTTP",
+			settings: NotificationSettings{WebhookURL: "ftp://example.com/hook"},
+			wantErr:  true,
+		},
+		{
+			name:     "Slack",
+			settings: NotificationSettings{ChatService: notify.ChatSlack, ChatURL: "https://hooks.slack.com/services/T/B/X"},
+			wantErr:  false,
+		},
+		{
+			name:     "Unknown chat service",
+			settings: NotificationSettings{ChatService: "irc", ChatURL: "https://example.com/chat"},
+			wantErr:  true,
+		},
+		{
+			name:     "Matrix without token",
+			settings: NotificationSettings{ChatService: notify.ChatMatrix, ChatURL: "https://matrix.example.org/_matrix/client/v3/rooms/!room:example.org/send/m.room.message"},
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid chat URL",
+			settings: NotificationSettings{ChatService: notify.ChatDiscord, ChatURL: "discord.com/api/webhooks/1/x"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("NotificationSettings.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNotificationSettings_due(t *testing.T) {
+	now := time.Date(2021, time.May, 5, 12, 0, 0, 0, time.UTC)
+	held := QueuedNotification{ID: "1", Notification: Notification{Event: EventAccount}, Created: now.Add(-time.Hour).Unix()}
+	fresh := QueuedNotification{ID: "2", Notification: Notification{Event: EventStatusChange}, Digest: true, Created: now.Add(-time.Hour).Unix()}
+	old := QueuedNotification{ID: "3", Notification: Notification{Event: EventStatusChange}, Digest: true, Created: now.Add(-25 * time.Hour).Unix()}
+	tests := []struct {
+		name     string
+		settings NotificationSettings
+		queue    []QueuedNotification
+		want     []QueuedNotification
+	}{
+		{
+			name:  "Empty queue",
+			queue: nil,
+			want:  nil,
+		},
+		{
+			name:     "Quiet hours",
+			settings: NotificationSettings{QuietFrom: 11, QuietTo: 13, DigestOnly: true},
+			queue:    []QueuedNotification{held, old},
+			want:     nil,
+		},
+		{
+			name:     "Digest is not due",
+			settings: NotificationSettings{DigestOnly: true},
+			queue:    []QueuedNotification{held, fresh},
+			want:     []QueuedNotification{held},
+		},
+		{
+			name:     "Digest is due",
+			settings: NotificationSettings{DigestOnly: true},
+			queue:    []QueuedNotification{old, held, fresh},
+			want:     []QueuedNotification{old, held, fresh},
+		},
+		{
+			name:     "Weekly digest is not due",
+			settings: NotificationSettings{DigestOnly: true, DigestPeriod: DigestWeekly},
+			queue:    []QueuedNotification{old, fresh},
+			want:     nil,
+		},
+		{
+			name:  "Digest turned off",
+			queue: []QueuedNotification{fresh},
+			want:  []QueuedNotification{fresh},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.due(tt.queue, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NotificationSettings.due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_composeMessage(t *testing.T) {
+	change := func(id, name, old, new string) QueuedNotification {
+		return QueuedNotification{
+			Notification: Notification{Event: EventStatusChange, CaseID: id, CaseName: name, OldStatus: old, NewStatus: new},
+			Digest:       true,
+		}
+	}
+	held := QueuedNotification{Notification: Notification{Event: EventAccount, Message: "Your password has been changed."}}
+	tests := []struct {
+		name  string
+		queue []QueuedNotification
+		want  string
+	}{
+		{
+			name:  "Held messages only",
+			queue: []QueuedNotification{held, held},
+			want:  "Your password has been changed.\n\nYour password has been changed.",
+		},
+		{
+			name: "Digest",
+			queue: []QueuedNotification{
+				change("ABC0000000002", "second", "", "Case Was Received"),
+				change("ABC0000000001", "first", "Case Was Received", "Case Is Being Actively Reviewed"),
+				held,
+				change("ABC0000000001", "first", "Case Is Being Actively Reviewed", "Case Was Approved"),
+			},
+			want: "Status changes of your cases:\n" +
+				"\nABC0000000001 (first): Case Was Received -> Case Was Approved" +
+				"\nABC0000000002 (second): none -> Case Was Received" +
+				"\n\nYour password has been changed.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := composeMessage(tt.queue); got != tt.want {
+				t.Errorf("composeMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_NotificationQueue(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			for _, n := range []QueuedNotification{
+				{Notification: Notification{Event: EventStatusChange, Message: "first", CaseID: "ABC0000000001", OldStatus: "received", NewStatus: "approved"}, Digest: true, Created: 100},
+				{Notification: Notification{Event: EventAccount, Message: "second"}, Created: 200},
+			} {
+				if err := d.QueueNotification(ctx, "alice", n); err != nil {
+					t.Fatalf("GCTrackerData.QueueNotification() error = %v", err)
+				}
+			}
+			if got, err := d.GetQueuedUsernames(ctx); err != nil || !reflect.DeepEqual(got, []string{"alice"}) {
+				t.Errorf("GCTrackerData.GetQueuedUsernames() = %v, %v, want [alice]", got, err)
+			}
+			queue, err := d.GetQueuedNotifications(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetQueuedNotifications() error = %v", err)
+			}
+			if len(queue) != 2 || queue[0].Message != "first" || !queue[0].Digest || queue[0].NewStatus != "approved" || queue[1].Message != "second" {
+				t.Fatalf("GCTrackerData.GetQueuedNotifications() = %+v", queue)
+			}
+			if queue, _ := d.GetQueuedNotifications(ctx, "bob"); len(queue) != 0 {
+				t.Errorf("GCTrackerData.GetQueuedNotifications() bob = %+v, want none", queue)
+			}
+
+			if err := d.DeleteQueuedNotifications(ctx, "alice", []string{queue[0].ID}); err != nil {
+				t.Fatalf("GCTrackerData.DeleteQueuedNotifications() error = %v", err)
+			}
+			if got, _ := d.GetQueuedNotifications(ctx, "alice"); len(got) != 1 || got[0].ID != queue[1].ID {
+				t.Errorf("GCTrackerData.GetQueuedNotifications() after delete = %+v", got)
+			}
+			if err := d.DeleteQueuedNotifications(ctx, "alice", []string{queue[1].ID}); err != nil {
+				t.Fatalf("GCTrackerData.DeleteQueuedNotifications() error = %v", err)
+			}
+			if got, err := d.GetQueuedUsernames(ctx); err != nil || len(got) != 0 {
+				t.Errorf("GCTrackerData.GetQueuedUsernames() = %v, %v, want none", got, err)
+			}
+		})
+	}
+}
+
+func TestGCTrackerUserImpl_SendNotification(t *testing.T) {
+	ctx := context.Background()
+	// Quiet hours around the clock, except for the last hour of the day
+	quiet := NotificationSettings{QuietFrom: 0, QuietTo: 23}
+	if time.Now().UTC().Hour() == 23 {
+		quiet = NotificationSettings{QuietFrom: 1, QuietTo: 0}
+	}
+	tests := []struct {
+		name      string
+		settings  NotificationSettings
+		event     string
+		wantQueue []QueuedNotification
+	}{
+		{
+			name:     "Muted status change",
+			settings: NotificationSettings{MuteStatus: true, DigestOnly: true},
+			event:    EventStatusChange,
+		},
+		{
+			name:     "Muted account event",
+			settings: NotificationSettings{MuteAccount: true, QuietFrom: quiet.QuietFrom, QuietTo: quiet.QuietTo},
+			event:    EventAccount,
+		},
+		{
+			name:      "Digest only",
+			settings:  NotificationSettings{DigestOnly: true},
+			event:     EventStatusChange,
+			wantQueue: []QueuedNotification{{Notification: Notification{Event: EventStatusChange, Message: "msg"}, Digest: true}},
+		},
+		{
+			name:      "Quiet hours",
+			settings:  quiet,
+			event:     EventAccount,
+			wantQueue: []QueuedNotification{{Notification: Notification{Event: EventAccount, Message: "msg"}}},
+		},
+		{
+			name:     "Password reset ignores quiet hours",
+			settings: quiet,
+			event:    EventPasswordReset,
+		},
+	}
+	for _, tt := range tests {
+		for backend, newData := range testBackends {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				d := seedTestData(t, newData(t))
+				user := d.NewUser()
+				if err := user.GetByUsername(ctx, "alice"); err != nil {
+					t.Fatalf("GCTrackerUser.GetByUsername() error = %v", err)
+				}
+				if err := user.SetNotificationSettings(tt.settings); err != nil {
+					t.Fatalf("GCTrackerUser.SetNotificationSettings() error = %v", err)
+				}
+				user.SendNotification(ctx, Notification{Event: tt.event, Message: "msg"})
+
+				queue, err := d.GetQueuedNotifications(ctx, "alice")
+				if err != nil {
+					t.Fatalf("GCTrackerData.GetQueuedNotifications() error = %v", err)
+				}
+				for i := range queue {
+					queue[i].ID, queue[i].Created = "", 0
+				}
+				if !reflect.DeepEqual(queue, tt.wantQueue) {
+					t.Errorf("GCTrackerUser.SendNotification() queued %+v, want %+v", queue, tt.wantQueue)
+				}
+			})
+		}
+	}
+}
+
+func TestGCTrackerData_NotificationSettings(t *testing.T) {
+	ctx := context.Background()
+	want := NotificationSettings{MuteAccount: true, DigestOnly: true, QuietFrom: 22, QuietTo: 7, TimeZone: "Europe/Berlin", WebhookURL: "https://example.com/hook", WebhookSecret: "secret", ChatService: notify.ChatMatrix, ChatURL: "https://matrix.example.org/send", ChatToken: "token"}
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			user := d.NewUser()
+			if err := user.GetByUsername(ctx, "alice"); err != nil {
+				t.Fatalf("GCTrackerUser.GetByUsername() error = %v", err)
+			}
+			if err := user.SetNotificationSettings(want); err != nil {
+				t.Fatalf("GCTrackerUser.SetNotificationSettings() error = %v", err)
+			}
+			if err := user.Update(ctx); err != nil {
+				t.Fatalf("GCTrackerUser.Update() error = %v", err)
+			}
+			got, err := d.GetUser(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.GetNotificationSettings(), want) {
+				t.Errorf("GCTrackerData.GetUser() settings = %+v, want %+v", got.GetNotificationSettings(), want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerUserImpl_SendNotification_Channels(t *testing.T) {
+	ctx := context.Background()
+	defer func(allow bool) { config.Config.NotifyPrivateHosts = allow }(config.Config.NotifyPrivateHosts)
+	config.Config.NotifyPrivateHosts = true
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{
+			name:  "Status change",
+			event: EventStatusChange,
+			want:  []string{"/chat", "/hook " + EventStatusChange},
+		},
+		{
+			name:  "Password reset is email only",
+			event: EventPasswordReset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.URL.Path == "/chat" {
+					got = append(got, r.URL.Path)
+					return
+				}
+				if sig := r.Header.Get(notify.SignatureHeader); sig != notify.Sign("secret", body) {
+					t.Errorf("webhook signature = %v", sig)
+				}
+				var p notify.WebhookPayload
+				if err := json.Unmarshal(body, &p); err != nil {
+					t.Errorf("webhook payload error = %v", err)
+				}
+				if p.Username != "alice" {
+					t.Errorf("webhook payload username = %v, want alice", p.Username)
+				}
+				got = append(got, r.URL.Path+" "+p.Event)
+			}))
+			defer ts.Close()
+
+			d := seedTestData(t, NewMemoryGCTrackerData())
+			user := d.NewUser()
+			if err := user.GetByUsername(ctx, "alice"); err != nil {
+				t.Fatalf("GCTrackerUser.GetByUsername() error = %v", err)
+			}
+			settings := NotificationSettings{
+				WebhookURL:    ts.URL + "/hook",
+				WebhookSecret: "secret",
+				ChatService:   notify.ChatSlack,
+				ChatURL:       ts.URL + "/chat",
+			}
+			if err := user.SetNotificationSettings(settings); err != nil {
+				t.Fatalf("GCTrackerUser.SetNotificationSettings() error = %v", err)
+			}
+			user.SendNotification(ctx, Notification{Event: tt.event, Message: "msg"})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GCTrackerUser.SendNotification() posted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"time"
+
+	"github.com/batk0/gc-tracker/notify"
+)
+
+// Delivery states of outbox entries
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	// Failed entries ran out of attempts and are not retried any more
+	OutboxFailed = "failed"
+)
+
+// OutboxLease is how long an attempt to deliver an entry may take before
+// the entry is due again
+const OutboxLease = 5 * time.Minute
+
+// Channels notifications are delivered to
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelChat    = "chat"
+)
+
+// OutboxEntry is a notification to deliver to one channel of the user, and
+// the record of its delivery afterwards. Timestamps are Unix seconds.
+type OutboxEntry struct {
+	ID           string              `firestore:"-"`
+	Username     string              `firestore:"username"`
+	Channel      string              `firestore:"channel"`
+	Notification notify.Notification `firestore:"notification"`
+	Status       string              `firestore:"status"`
+	Attempts     int                 `firestore:"attempts"`
+	LastError    string              `firestore:"lastError"`
+	Created      int64               `firestore:"created"`
+	Updated      int64               `firestore:"updated"`
+	NextAttempt  int64               `firestore:"nextAttempt"`
+}
+
+// record updates e after a delivery attempt at now which failed with err,
+// if any. Failed attempts are retried after backoff, doubled every time,
+// until retries run out.
+func (e *OutboxEntry) record(err error, now time.Time, retries int, backoff time.Duration) {
+	e.Attempts++
+	e.Updated = now.Unix()
+	if err == nil {
+		e.Status = OutboxDelivered
+		e.LastError = ""
+		return
+	}
+	e.LastError = err.Error()
+	if e.Attempts > retries {
+		e.Status = OutboxFailed
+		return
+	}
+	e.Status = OutboxPending
+	e.NextAttempt = now.Add(backoff << uint(e.Attempts-1)).Unix()
+}
+
+// due tells whether e waits for an attempt at now
+func (e OutboxEntry) due(now int64) bool {
+	return e.Status == OutboxPending && e.NextAttempt <= now
+}
+
+// pruned tells whether e is done with and last updated before
+func (e OutboxEntry) pruned(before int64) bool {
+	return e.Status != OutboxPending && e.Updated < before
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/notify"
+)
+
+func TestOutboxEntry_record(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name  string
+		entry OutboxEntry
+		err   error
+		want  OutboxEntry
+	}{
+		{
+			name:  "Delivered",
+			entry: OutboxEntry{Status: OutboxPending, Attempts: 1, LastError: "timeout"},
+			want:  OutboxEntry{Status: OutboxDelivered, Attempts: 2, Updated: 1600000000},
+		},
+		{
+			name:  "First retry",
+			entry: OutboxEntry{Status: OutboxPending},
+			err:   errors.New("timeout"),
+			want:  OutboxEntry{Status: OutboxPending, Attempts: 1, LastError: "timeout", Updated: 1600000000, NextAttempt: 1600000060},
+		},
+		{
+			name:  "Backoff doubles",
+			entry: OutboxEntry{Status: OutboxPending, Attempts: 2},
+			err:   errors.New("timeout"),
+			want:  OutboxEntry{Status: OutboxPending, Attempts: 3, LastError: "timeout", Updated: 1600000000, NextAttempt: 1600000240},
+		},
+		{
+			name:  "Out of retries",
+			entry: OutboxEntry{Status: OutboxPending, Attempts: 3},
+			err:   errors.New("timeout"),
+			want:  OutboxEntry{Status: OutboxFailed, Attempts: 4, LastError: "timeout", Updated: 1600000000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.entry.record(tt.err, now, 3, time.Minute)
+			if !reflect.DeepEqual(tt.entry, tt.want) {
+				t.Errorf("OutboxEntry.record() = %+v, want %+v", tt.entry, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerData_Outbox(t *testing.T) {
+	ctx := context.Background()
+	n := notify.Notification{Event: EventStatusChange, Username: "alice", CaseID: "ABC0000000001", NewStatus: "approved", Time: time.Unix(1600000000, 0).UTC()}
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			entries := []OutboxEntry{
+				{Username: "alice", Channel: ChannelEmail, Notification: n, Status: OutboxPending, Created: 100, Updated: 100, NextAttempt: 100},
+				{Username: "alice", Channel: ChannelWebhook, Notification: n, Status: OutboxPending, Created: 100, Updated: 100, NextAttempt: 300},
+				{Username: "bob", Channel: ChannelEmail, Notification: n, Status: OutboxPending, Created: 200, Updated: 200, NextAttempt: 200},
+			}
+			for i := range entries {
+				id, err := d.AddOutbox(ctx, entries[i])
+				if err != nil {
+					t.Fatalf("GCTrackerData.AddOutbox() error = %v", err)
+				}
+				entries[i].ID = id
+			}
+
+			due, err := d.GetDueOutbox(ctx, 200)
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetDueOutbox() error = %v", err)
+			}
+			if want := []OutboxEntry{entries[0], entries[2]}; !reflect.DeepEqual(due, want) {
+				t.Errorf("GCTrackerData.GetDueOutbox() = %+v, want %+v", due, want)
+			}
+
+			// An entry is claimed once, and entries not due yet not at all
+			if err := d.ClaimOutbox(ctx, entries[2].ID, 200, 500); err != nil {
+				t.Fatalf("GCTrackerData.ClaimOutbox() error = %v", err)
+			}
+			entries[2].NextAttempt = 500
+			for _, e := range []OutboxEntry{entries[2], entries[1]} {
+				if err := d.ClaimOutbox(ctx, e.ID, 200, 500); err != ErrEntryNotDue {
+					t.Errorf("GCTrackerData.ClaimOutbox() of %s error = %v, want %v", e.ID, err, ErrEntryNotDue)
+				}
+			}
+			if due, _ := d.GetDueOutbox(ctx, 200); !reflect.DeepEqual(due, []OutboxEntry{entries[0]}) {
+				t.Errorf("GCTrackerData.GetDueOutbox() after claim = %+v, want %+v", due, entries[:1])
+			}
+
+			entries[0].Status, entries[0].Attempts, entries[0].Updated = OutboxDelivered, 1, 150
+			if err := d.UpdateOutbox(ctx, entries[0]); err != nil {
+				t.Fatalf("GCTrackerData.UpdateOutbox() error = %v", err)
+			}
+			if err := d.UpdateOutbox(ctx, OutboxEntry{ID: "12345"}); err != ErrEntryNotFound {
+				t.Errorf("GCTrackerData.UpdateOutbox() error = %v, want %v", err, ErrEntryNotFound)
+			}
+			got, err := d.GetOutbox(ctx, "alice", 10)
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetOutbox() error = %v", err)
+			}
+			if want := []OutboxEntry{entries[1], entries[0]}; !reflect.DeepEqual(got, want) {
+				t.Errorf("GCTrackerData.GetOutbox() = %+v, want %+v", got, want)
+			}
+
+			// Pending entries are kept however old they are
+			if err := d.PruneOutbox(ctx, 1000); err != nil {
+				t.Fatalf("GCTrackerData.PruneOutbox() error = %v", err)
+			}
+			got, _ = d.GetOutbox(ctx, "alice", 10)
+			if want := []OutboxEntry{entries[1]}; !reflect.DeepEqual(got, want) {
+				t.Errorf("GCTrackerData.PruneOutbox() left %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerUserImpl_Deliver(t *testing.T) {
+	ctx := context.Background()
+	defer func(retries int, backoff time.Duration) {
+		config.Config.OutboxRetries, config.Config.OutboxBackoff = retries, backoff
+	}(config.Config.OutboxRetries, config.Config.OutboxBackoff)
+	config.Config.OutboxRetries, config.Config.OutboxBackoff = 1, time.Minute
+	defer func(allow bool) { config.Config.NotifyPrivateHosts = allow }(config.Config.NotifyPrivateHosts)
+	config.Config.NotifyPrivateHosts = true
+
+	fail := true
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	d := seedTestData(t, NewMemoryGCTrackerData())
+	user, err := d.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+	}
+	user.SetNotificationSettings(NotificationSettings{ChatService: notify.ChatMatrix, ChatURL: ts.URL + "/send", ChatToken: "token"})
+	user.SendNotification(ctx, Notification{Event: EventAccount, Message: "msg"})
+
+	// The first attempt is made right away
+	got, _ := d.GetOutbox(ctx, "alice", 10)
+	if len(got) != 2 {
+		t.Fatalf("GCTrackerUser.SendNotification() outbox = %+v, want 2 entries", got)
+	}
+	chat := got[1]
+	if chat.Channel != ChannelChat || chat.Status != OutboxPending || chat.Attempts != 1 || chat.LastError == "" {
+		t.Fatalf("GCTrackerUser.SendNotification() chat entry = %+v", chat)
+	}
+
+	fail = false
+	if err := user.Deliver(ctx, &chat); err != nil {
+		t.Errorf("GCTrackerUser.Deliver() error = %v", err)
+	}
+	got, _ = d.GetOutbox(ctx, "alice", 10)
+	if got[1].Status != OutboxDelivered || got[1].Attempts != 2 {
+		t.Errorf("GCTrackerUser.Deliver() chat entry = %+v", got[1])
+	}
+	// The retry carries the transaction ID of the first attempt
+	if len(paths) != 2 || paths[0] != paths[1] {
+		t.Errorf("GCTrackerUser.Deliver() requests = %v, want the same transaction twice", paths)
+	}
+
+	// Channels removed since are not retried
+	user.SetNotificationSettings(NotificationSettings{})
+	chat = got[1]
+	chat.Status = OutboxPending
+	if err := user.Deliver(ctx, &chat); err == nil || chat.Status != OutboxFailed {
+		t.Errorf("GCTrackerUser.Deliver() = %v, entry %+v", err, chat)
+	}
+}
@@ -16,22 +16,178 @@ limitations under the License.
 package data
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"encoding/gob"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
-	fsgsession "github.com/GoogleCloudPlatform/firestore-gorilla-sessions"
+	"github.com/batk0/gc-tracker/config"
+	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 )
 
-func (d *FirestoreGCTrackerData) NewSession() sessions.Store {
-	ctx := context.Background()
-	client := d.connectFirestore(ctx)
+// sessionBackend persists session values by session ID
+type sessionBackend interface {
+	load(ctx context.Context, id string) (map[interface{}]interface{}, error)
+	save(ctx context.Context, id string, values map[interface{}]interface{}, maxAge int) error
+	delete(ctx context.Context, id string) error
+}
+
+// idSessionStore keeps only the session ID in the cookie and the values in
+// the backend
+type idSessionStore struct {
+	backend sessionBackend
+}
+
+func newIDSessionStore(backend sessionBackend) *idSessionStore {
+	return &idSessionStore{backend: backend}
+}
+
+// SessionOptions are the cookie options of new sessions
+func SessionOptions() sessions.Options {
+	secure := config.Config.SecureCookie || bool(config.Config.IsAppEngine) ||
+		strings.HasPrefix(config.Config.BaseURL, "https://")
+	return sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (s *idSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *idSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := SessionOptions()
+	session.Options = &opts
+	session.IsNew = true
 
-	store, err := fsgsession.New(ctx, client)
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	values, err := s.backend.load(r.Context(), cookie.Value)
 	if err != nil {
-		log.Println("Cannot create session store " + err.Error())
+		return session, err
+	}
+	if values != nil {
+		session.ID = cookie.Value
+		session.Values = values
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+func (s *idSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if err := s.backend.delete(r.Context(), session.ID); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
 		return nil
 	}
+	if session.ID == "" {
+		session.ID = uuid.New().String()
+	}
+	if err := s.backend.save(r.Context(), session.ID, session.Values, session.Options.MaxAge); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// encodeValues gobs session values for backends which store them as a blob
+func encodeValues(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	return store
+func decodeValues(blob []byte) (map[interface{}]interface{}, error) {
+	values := map[interface{}]interface{}{}
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// sessionExpires is when the backend drops a session saved with maxAge
+func sessionExpires(maxAge int) int64 {
+	if maxAge == 0 {
+		// Browser session cookie, keep it for a day at most
+		maxAge = 86400
+	}
+	return time.Now().Add(time.Duration(maxAge) * time.Second).Unix()
+}
+
+type memorySession struct {
+	values  map[interface{}]interface{}
+	expires int64
+}
+
+type memorySessionBackend struct {
+	mu       sync.RWMutex
+	sessions map[string]memorySession
+	swept    int64
+}
+
+func newMemorySessionStore() *idSessionStore {
+	return newIDSessionStore(&memorySessionBackend{
+		sessions: map[string]memorySession{},
+	})
+}
+
+func (b *memorySessionBackend) load(ctx context.Context, id string) (map[interface{}]interface{}, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	session, ok := b.sessions[id]
+	if !ok || session.expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return copyValues(session.values), nil
+}
+
+func (b *memorySessionBackend) save(ctx context.Context, id string, values map[interface{}]interface{}, maxAge int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(time.Now().Unix())
+	b.sessions[id] = memorySession{values: copyValues(values), expires: sessionExpires(maxAge)}
+	return nil
+}
+
+// sweep forgets expired sessions, at most once a minute
+func (b *memorySessionBackend) sweep(now int64) {
+	if now-b.swept < 60 {
+		return
+	}
+	b.swept = now
+	for id, session := range b.sessions {
+		if session.expires <= now {
+			delete(b.sessions, id)
+		}
+	}
+}
+
+func (b *memorySessionBackend) delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sessions, id)
+	return nil
+}
+
+func copyValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	c := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
 }
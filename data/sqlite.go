@@ -0,0 +1,787 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations are applied in order. Never edit an applied migration,
+// append a new one instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		username        TEXT PRIMARY KEY,
+		email           TEXT NOT NULL,
+		password        TEXT NOT NULL,
+		reset_token     TEXT NOT NULL DEFAULT '',
+		reset_timestamp INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX users_reset_token ON users (reset_token);
+	CREATE TABLE cases (
+		id     TEXT PRIMARY KEY,
+		name   TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '',
+		old    TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE user_cases (
+		username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		case_id  TEXT NOT NULL,
+		PRIMARY KEY (username, case_id)
+	);
+	CREATE INDEX user_cases_case_id ON user_cases (case_id);
+	CREATE TABLE sessions (
+		id      TEXT PRIMARY KEY,
+		data    BLOB NOT NULL,
+		expires INTEGER NOT NULL
+	);`,
+	// Case descriptions move from the shared case to each subscription
+	`ALTER TABLE user_cases ADD COLUMN name TEXT NOT NULL DEFAULT '';
+	UPDATE user_cases SET name = COALESCE((SELECT name FROM cases WHERE cases.id = user_cases.case_id), '');
+	ALTER TABLE cases DROP COLUMN name;
+	DELETE FROM cases WHERE id NOT IN (SELECT case_id FROM user_cases);`,
+	`CREATE TABLE case_history (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		case_id      TEXT NOT NULL,
+		title        TEXT NOT NULL,
+		body         TEXT NOT NULL,
+		first_seen   INTEGER NOT NULL,
+		last_checked INTEGER NOT NULL
+	);
+	CREATE INDEX case_history_case_id ON case_history (case_id, id);`,
+	// JSON encoded status.Status
+	`ALTER TABLE cases ADD COLUMN details TEXT NOT NULL DEFAULT '{}';`,
+	// JSON encoded NotificationSettings
+	`ALTER TABLE users ADD COLUMN notifications TEXT NOT NULL DEFAULT '{}';
+	CREATE TABLE notification_queue (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		event    TEXT NOT NULL,
+		message  TEXT NOT NULL,
+		digest   INTEGER NOT NULL,
+		created  INTEGER NOT NULL
+	);
+	CREATE INDEX notification_queue_username ON notification_queue (username, id);`,
+	// Status changes are summarized in digests
+	`ALTER TABLE notification_queue ADD COLUMN case_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE notification_queue ADD COLUMN case_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE notification_queue ADD COLUMN old_status TEXT NOT NULL DEFAULT '';
+	ALTER TABLE notification_queue ADD COLUMN new_status TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE notification_queue ADD COLUMN link TEXT NOT NULL DEFAULT '';`,
+	// JSON encoded notify.Notification
+	`CREATE TABLE outbox (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		username     TEXT NOT NULL,
+		channel      TEXT NOT NULL,
+		notification TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		last_error   TEXT NOT NULL DEFAULT '',
+		created      INTEGER NOT NULL,
+		updated      INTEGER NOT NULL,
+		next_attempt INTEGER NOT NULL
+	);
+	CREATE INDEX outbox_status ON outbox (status, next_attempt);
+	CREATE INDEX outbox_username ON outbox (username, id);`,
+	// Existing users count as verified
+	`ALTER TABLE users ADD COLUMN verify_pending INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN verify_sent INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE users ADD COLUMN email_change TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN email_change_sent INTEGER NOT NULL DEFAULT 0;`,
+	// JSON encoded twoFactor
+	`ALTER TABLE users ADD COLUMN two_factor TEXT NOT NULL DEFAULT '{}';`,
+	`CREATE TABLE attempts (
+		key          TEXT PRIMARY KEY,
+		count        INTEGER NOT NULL,
+		start        INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL,
+		expires      INTEGER NOT NULL
+	);`,
+	// Expired sessions are deleted on save
+	`CREATE INDEX sessions_expires ON sessions (expires);`,
+}
+
+// SQLGCTrackerData stores data in an embedded SQLite database
+type SQLGCTrackerData struct {
+	db       *sql.DB
+	sessions *idSessionStore
+}
+
+func NewSQLGCTrackerData(path string) (*SQLGCTrackerData, error) {
+	// Transactions take the write lock up front so concurrent writers wait
+	// on the busy timeout instead of failing when they upgrade a read lock.
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	d := &SQLGCTrackerData{db: db}
+	d.sessions = newIDSessionStore(&sqlSessionBackend{db: db})
+	return d, nil
+}
+
+func (d *SQLGCTrackerData) Close() error               { return d.db.Close() }
+func (d *SQLGCTrackerData) NewUser() GCTrackerUser     { return &GCTrackerUserImpl{data: d} }
+func (d *SQLGCTrackerData) NewCase() GCTrackerCase     { return &GCTrackerCaseImpl{data: d} }
+func (d *SQLGCTrackerData) NewSession() sessions.Store { return d.sessions }
+
+func (d *SQLGCTrackerData) NewLimiterStore() LimiterStore { return &sqlLimiterStore{db: d.db} }
+
+func migrate(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d", i+1)
+	}
+	return nil
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+const selectUser = `SELECT username, email, password, reset_token, reset_timestamp, notifications,
+	verify_pending, verify_sent, email_change, email_change_sent, two_factor FROM users`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (GCTrackerUserImpl, error) {
+	var u GCTrackerUserImpl
+	var notifications, factor []byte
+	if err := row.Scan(&u.Username, &u.Email, &u.Password, &u.Reset.Token, &u.Reset.Timestamp, &notifications,
+		&u.Verification.Pending, &u.Verification.Sent, &u.EmailChange.Email, &u.EmailChange.Sent, &factor); err != nil {
+		return u, err
+	}
+	if err := json.Unmarshal(notifications, &u.Notifications); err != nil {
+		log.Println("Cannot decode notification settings of " + u.Username + ": " + err.Error())
+	}
+	// Unlike notification settings, a broken second factor must not be
+	// skipped silently
+	if err := json.Unmarshal(factor, &u.TwoFactor); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+func loadUserCases(ctx context.Context, q queryer, u *GCTrackerUserImpl) error {
+	rows, err := q.QueryContext(ctx, `SELECT case_id, name FROM user_cases WHERE username = ? ORDER BY case_id`, u.Username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		if u.Cases == nil {
+			u.Cases = map[string]bool{}
+			u.CaseNames = map[string]string{}
+		}
+		u.Cases[id] = true
+		u.CaseNames[id] = name
+	}
+	return rows.Err()
+}
+
+func saveUserCases(ctx context.Context, q queryer, u *GCTrackerUserImpl) error {
+	if _, err := q.ExecContext(ctx, `DELETE FROM user_cases WHERE username = ?`, u.Username); err != nil {
+		return err
+	}
+	for id, ok := range u.Cases {
+		if !ok {
+			continue
+		}
+		if _, err := q.ExecContext(ctx, `INSERT INTO user_cases (username, case_id, name) VALUES (?, ?, ?)`,
+			u.Username, id, u.CaseNames[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryUsers loads users with their cases, ordered by username
+func (d *SQLGCTrackerData) queryUsers(ctx context.Context, query string, args ...interface{}) ([]GCTrackerUserImpl, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var users []GCTrackerUserImpl
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if err := loadUserCases(ctx, d.db, &users[i]); err != nil {
+			return nil, err
+		}
+		users[i].data = d
+	}
+	return users, nil
+}
+
+func (d *SQLGCTrackerData) writeUser(ctx context.Context, user GCTrackerUser, query string) error {
+	u, err := toUserImpl(user)
+	if err != nil {
+		return err
+	}
+	notifications, err := json.Marshal(u.Notifications)
+	if err != nil {
+		return err
+	}
+	factor, err := json.Marshal(u.TwoFactor)
+	if err != nil {
+		return err
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query, u.Username, u.Email, u.Password, u.Reset.Token, u.Reset.Timestamp, string(notifications),
+		u.Verification.Pending, u.Verification.Sent, u.EmailChange.Email, u.EmailChange.Sent, string(factor)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveUserCases(ctx, tx, &u); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *SQLGCTrackerData) CreateUser(ctx context.Context, user GCTrackerUser) error {
+	if !d.UserAvailable(ctx, user.GetUsername()) {
+		return ErrUserExists
+	}
+	err := d.writeUser(ctx, user, `INSERT INTO users (username, email, password, reset_token, reset_timestamp, notifications,
+		verify_pending, verify_sent, email_change, email_change_sent, two_factor)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		log.Println("Cannot create user: " + err.Error())
+	}
+	return err
+}
+
+func (d *SQLGCTrackerData) UpdateUser(ctx context.Context, user GCTrackerUser) error {
+	err := d.writeUser(ctx, user, `INSERT INTO users (username, email, password, reset_token, reset_timestamp, notifications,
+		verify_pending, verify_sent, email_change, email_change_sent, two_factor)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			email = excluded.email,
+			password = excluded.password,
+			reset_token = excluded.reset_token,
+			reset_timestamp = excluded.reset_timestamp,
+			notifications = excluded.notifications,
+			verify_pending = excluded.verify_pending,
+			verify_sent = excluded.verify_sent,
+			email_change = excluded.email_change,
+			email_change_sent = excluded.email_change_sent,
+			two_factor = excluded.two_factor`)
+	if err != nil {
+		log.Println("Cannot update user: " + err.Error())
+	}
+	return err
+}
+
+func (d *SQLGCTrackerData) GetUser(ctx context.Context, username string) (GCTrackerUser, error) {
+	found, err := d.queryUsers(ctx, selectUser+` WHERE username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &found[0], nil
+}
+
+func (d *SQLGCTrackerData) GetUsersByCase(ctx context.Context, id string) ([]GCTrackerUser, error) {
+	found, err := d.queryUsers(ctx, selectUser+`
+		WHERE username IN (SELECT username FROM user_cases WHERE case_id = ?)
+		ORDER BY username`, id)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	var users []GCTrackerUser
+	for i := range found {
+		users = append(users, &found[i])
+	}
+	return users, nil
+}
+
+func (d *SQLGCTrackerData) GetUserByResetToken(ctx context.Context, token string) (GCTrackerUser, error) {
+	found, err := d.queryUsers(ctx, selectUser+`
+		WHERE reset_token = ? AND reset_token != '' AND reset_timestamp > ?
+		ORDER BY username LIMIT 1`, token, time.Now().Unix()-3600)
+	if err != nil {
+		log.Println(err.Error())
+		return d.NewUser(), err
+	}
+	if len(found) == 0 {
+		return d.NewUser(), ErrTokenNotFound
+	}
+	return &found[0], nil
+}
+
+func (d *SQLGCTrackerData) UserAvailable(ctx context.Context, username string) bool {
+	log.Println("Checking user: " + username)
+	var n int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE username = ?`, username).Scan(&n); err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return n == 0
+}
+
+const selectCase = `SELECT id, status, old, details FROM cases`
+
+func (d *SQLGCTrackerData) queryCases(ctx context.Context, query string, args ...interface{}) ([]GCTrackerCase, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	var cases []GCTrackerCase
+	for rows.Next() {
+		c := &GCTrackerCaseImpl{data: d}
+		var details []byte
+		if err := rows.Scan(&c.ID, &c.Status, &c.OldStatus, &details); err != nil {
+			log.Println(err.Error())
+			return cases, err
+		}
+		if err := json.Unmarshal(details, &c.Details); err != nil {
+			log.Println("Cannot decode details of " + c.ID + ": " + err.Error())
+		}
+		cases = append(cases, c)
+	}
+	return cases, rows.Err()
+}
+
+func (d *SQLGCTrackerData) CreateCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	details, err := json.Marshal(ci.Details)
+	if err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	if _, err := d.db.ExecContext(ctx, `INSERT INTO cases (id, status, old, details) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, old = excluded.old, details = excluded.details`,
+		ci.ID, ci.Status, ci.OldStatus, string(details)); err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+func (d *SQLGCTrackerData) UpdateCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot update case: " + err.Error())
+		return err
+	}
+	details, err := json.Marshal(ci.Details)
+	if err != nil {
+		log.Println("Cannot update case: " + err.Error())
+		return err
+	}
+	res, err := d.db.ExecContext(ctx, `UPDATE cases SET status = ?, old = ?, details = ? WHERE id = ?`,
+		ci.Status, ci.OldStatus, string(details), ci.ID)
+	if err != nil {
+		log.Println("Cannot update case: " + err.Error())
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCaseNotFound
+	}
+	return nil
+}
+
+func (d *SQLGCTrackerData) AcquireCase(ctx context.Context, c GCTrackerCase) error {
+	ci, err := toCaseImpl(c)
+	if err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	details, err := json.Marshal(ci.Details)
+	if err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	if _, err := d.db.ExecContext(ctx, `INSERT INTO cases (id, status, old, details) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`, ci.ID, ci.Status, ci.OldStatus, string(details)); err != nil {
+		log.Println("Cannot create case: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+func (d *SQLGCTrackerData) ReleaseCase(ctx context.Context, id string) error {
+	err := d.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM case_history WHERE case_id = ?
+			AND NOT EXISTS (SELECT 1 FROM user_cases WHERE case_id = ?)`, id, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM cases WHERE id = ?
+			AND NOT EXISTS (SELECT 1 FROM user_cases WHERE case_id = ?)`, id, id)
+		return err
+	})
+	if err != nil {
+		log.Println("Cannot release case: " + err.Error())
+	}
+	return err
+}
+
+func (d *SQLGCTrackerData) RecordStatus(ctx context.Context, id string, e StatusEntry) error {
+	return d.inTx(ctx, func(tx *sql.Tx) error {
+		var rowID int64
+		var latest StatusEntry
+		err := tx.QueryRowContext(ctx, `SELECT id, title, body FROM case_history
+			WHERE case_id = ? ORDER BY id DESC LIMIT 1`, id).Scan(&rowID, &latest.Title, &latest.Body)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && latest.sameStatus(e) {
+			_, err = tx.ExecContext(ctx, `UPDATE case_history SET last_checked = ? WHERE id = ?`, e.LastChecked, rowID)
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO case_history (case_id, title, body, first_seen, last_checked)
+			VALUES (?, ?, ?, ?, ?)`, id, e.Title, e.Body, e.FirstSeen, e.LastChecked)
+		return err
+	})
+}
+
+func (d *SQLGCTrackerData) GetCaseHistory(ctx context.Context, id string) ([]StatusEntry, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT title, body, first_seen, last_checked FROM case_history
+		WHERE case_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []StatusEntry
+	for rows.Next() {
+		var e StatusEntry
+		if err := rows.Scan(&e.Title, &e.Body, &e.FirstSeen, &e.LastChecked); err != nil {
+			return history, err
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+func (d *SQLGCTrackerData) QueueNotification(ctx context.Context, username string, n QueuedNotification) error {
+	_, err := d.db.ExecContext(ctx, `INSERT INTO notification_queue
+		(username, event, message, case_id, case_name, old_status, new_status, link, digest, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		username, n.Event, n.Message, n.CaseID, n.CaseName, n.OldStatus, n.NewStatus, n.Link, n.Digest, n.Created)
+	return err
+}
+
+func (d *SQLGCTrackerData) GetQueuedNotifications(ctx context.Context, username string) ([]QueuedNotification, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT id, event, message, case_id, case_name, old_status, new_status, link, digest, created
+		FROM notification_queue WHERE username = ? ORDER BY id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var queue []QueuedNotification
+	for rows.Next() {
+		var n QueuedNotification
+		var id int64
+		if err := rows.Scan(&id, &n.Event, &n.Message, &n.CaseID, &n.CaseName, &n.OldStatus, &n.NewStatus, &n.Link, &n.Digest, &n.Created); err != nil {
+			return queue, err
+		}
+		n.ID = strconv.FormatInt(id, 10)
+		queue = append(queue, n)
+	}
+	return queue, rows.Err()
+}
+
+func (d *SQLGCTrackerData) DeleteQueuedNotifications(ctx context.Context, username string, ids []string) error {
+	return d.inTx(ctx, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM notification_queue WHERE username = ? AND id = ?`, username, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *SQLGCTrackerData) GetQueuedUsernames(ctx context.Context) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT DISTINCT username FROM notification_queue ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+const outboxColumns = `id, username, channel, notification, status, attempts, last_error, created, updated, next_attempt`
+
+func (d *SQLGCTrackerData) AddOutbox(ctx context.Context, e OutboxEntry) (string, error) {
+	n, err := json.Marshal(e.Notification)
+	if err != nil {
+		return "", err
+	}
+	res, err := d.db.ExecContext(ctx, `INSERT INTO outbox
+		(username, channel, notification, status, attempts, last_error, created, updated, next_attempt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Username, e.Channel, string(n), e.Status, e.Attempts, e.LastError, e.Created, e.Updated, e.NextAttempt)
+	if err != nil {
+		return "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (d *SQLGCTrackerData) UpdateOutbox(ctx context.Context, e OutboxEntry) error {
+	res, err := d.db.ExecContext(ctx, `UPDATE outbox SET status = ?, attempts = ?, last_error = ?, updated = ?, next_attempt = ?
+		WHERE id = ?`, e.Status, e.Attempts, e.LastError, e.Updated, e.NextAttempt, e.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrEntryNotFound
+	}
+	return err
+}
+
+func (d *SQLGCTrackerData) GetDueOutbox(ctx context.Context, now int64) ([]OutboxEntry, error) {
+	return d.queryOutbox(ctx, `SELECT `+outboxColumns+` FROM outbox
+		WHERE status = ? AND next_attempt <= ? ORDER BY id`, OutboxPending, now)
+}
+
+func (d *SQLGCTrackerData) ClaimOutbox(ctx context.Context, id string, now, until int64) error {
+	res, err := d.db.ExecContext(ctx, `UPDATE outbox SET next_attempt = ?
+		WHERE id = ? AND status = ? AND next_attempt <= ?`, until, id, OutboxPending, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrEntryNotDue
+	}
+	return err
+}
+
+func (d *SQLGCTrackerData) GetOutbox(ctx context.Context, username string, limit int) ([]OutboxEntry, error) {
+	return d.queryOutbox(ctx, `SELECT `+outboxColumns+` FROM outbox
+		WHERE username = ? ORDER BY id DESC LIMIT ?`, username, limit)
+}
+
+func (d *SQLGCTrackerData) PruneOutbox(ctx context.Context, before int64) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM outbox WHERE status != ? AND updated < ?`, OutboxPending, before)
+	return err
+}
+
+func (d *SQLGCTrackerData) queryOutbox(ctx context.Context, query string, args ...interface{}) ([]OutboxEntry, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []OutboxEntry
+	for rows.Next() {
+		var e OutboxEntry
+		var id int64
+		var n string
+		if err := rows.Scan(&id, &e.Username, &e.Channel, &n, &e.Status, &e.Attempts, &e.LastError, &e.Created, &e.Updated, &e.NextAttempt); err != nil {
+			return entries, err
+		}
+		if err := json.Unmarshal([]byte(n), &e.Notification); err != nil {
+			return entries, err
+		}
+		e.ID = strconv.FormatInt(id, 10)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// inTx runs f in a transaction which is committed if f succeeds
+func (d *SQLGCTrackerData) inTx(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *SQLGCTrackerData) GetCase(ctx context.Context, id string) (GCTrackerCase, error) {
+	cases, err := d.queryCases(ctx, selectCase+` WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, ErrCaseNotFound
+	}
+	return cases[0], nil
+}
+
+func (d *SQLGCTrackerData) GetCases(ctx context.Context, ids []string) ([]GCTrackerCase, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	return d.queryCases(ctx, selectCase+` WHERE id IN (`+placeholders+`) ORDER BY id`, args...)
+}
+
+func (d *SQLGCTrackerData) GetAllCases(ctx context.Context) ([]GCTrackerCase, error) {
+	return d.queryCases(ctx, selectCase+` ORDER BY id`)
+}
+
+// sqlSessionBackend stores gob encoded session values
+type sqlSessionBackend struct{ db *sql.DB }
+
+func (b *sqlSessionBackend) load(ctx context.Context, id string) (map[interface{}]interface{}, error) {
+	var blob []byte
+	err := b.db.QueryRowContext(ctx, `SELECT data FROM sessions WHERE id = ? AND expires > ?`, id, time.Now().Unix()).Scan(&blob)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeValues(blob)
+}
+
+func (b *sqlSessionBackend) save(ctx context.Context, id string, values map[interface{}]interface{}, maxAge int) error {
+	blob, err := encodeValues(values)
+	if err != nil {
+		return err
+	}
+	if _, err := b.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires <= ?`, time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx, `INSERT INTO sessions (id, data, expires) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires = excluded.expires`, id, blob, sessionExpires(maxAge))
+	return err
+}
+
+func (b *sqlSessionBackend) delete(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+// sqlLimiterStore keeps attempts in the attempts table
+type sqlLimiterStore struct{ db *sql.DB }
+
+func (s *sqlLimiterStore) UpdateAttempts(ctx context.Context, key string, f func(*Attempts)) (Attempts, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Attempts{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM attempts WHERE expires <= ?`, now); err != nil {
+		return Attempts{}, err
+	}
+	var a Attempts
+	err = tx.QueryRowContext(ctx, `SELECT count, start, locked_until, expires FROM attempts WHERE key = ?`, key).
+		Scan(&a.Count, &a.Start, &a.LockedUntil, &a.Expires)
+	if err != nil && err != sql.ErrNoRows {
+		return Attempts{}, err
+	}
+	f(&a)
+	if _, err := tx.ExecContext(ctx, `INSERT INTO attempts (key, count, start, locked_until, expires) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET count = excluded.count, start = excluded.start,
+		locked_until = excluded.locked_until, expires = excluded.expires`,
+		key, a.Count, a.Start, a.LockedUntil, a.Expires); err != nil {
+		return Attempts{}, err
+	}
+	return a, tx.Commit()
+}
+
+func (s *sqlLimiterStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	var a Attempts
+	err := s.db.QueryRowContext(ctx, `SELECT count, start, locked_until, expires FROM attempts WHERE key = ? AND expires > ?`, key, time.Now().Unix()).
+		Scan(&a.Count, &a.Start, &a.LockedUntil, &a.Expires)
+	if err == sql.ErrNoRows {
+		return Attempts{}, nil
+	}
+	return a, err
+}
+
+func (s *sqlLimiterStore) DeleteAttempts(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM attempts WHERE key = ?`, key)
+	return err
+}
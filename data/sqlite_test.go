@@ -0,0 +1,143 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newTestSQLData(t *testing.T, path string) *SQLGCTrackerData {
+	t.Helper()
+	d, err := NewSQLGCTrackerData(path)
+	if err != nil {
+		t.Fatalf("NewSQLGCTrackerData() error = %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestSQLGCTrackerData_Migrate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	seedTestData(t, newTestSQLData(t, path))
+
+	// Reopening must not re-apply migrations and must keep the data
+	d := newTestSQLData(t, path)
+	var version int
+	if err := d.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatalf("cannot read schema version: %v", err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("schema version = %d, want %d", version, len(sqliteMigrations))
+	}
+	if got, want := usernames(d.GetUsersByCase(ctx, "ABC0000000001")), []string{"alice", "bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SQLGCTrackerData.GetUsersByCase() after reopen = %v, want %v", got, want)
+	}
+}
+
+func TestSQLGCTrackerData_DeleteUserCases(t *testing.T) {
+	ctx := context.Background()
+	d := seedTestData(t, newTestSQLData(t, filepath.Join(t.TempDir(), "test.db"))).(*SQLGCTrackerData)
+	u := d.NewUser().(*GCTrackerUserImpl)
+	if err := u.GetByUsername(ctx, "alice"); err != nil {
+		t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+	}
+	delete(u.Cases, "ABC0000000001")
+	if err := u.Update(ctx); err != nil {
+		t.Fatalf("GCTrackerUserImpl.Update() error = %v", err)
+	}
+	if got, want := usernames(d.GetUsersByCase(ctx, "ABC0000000001")), []string{"bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SQLGCTrackerData.GetUsersByCase() = %v, want %v", got, want)
+	}
+}
+
+func TestSQLGCTrackerData_NewSession(t *testing.T) {
+	d := newTestSQLData(t, filepath.Join(t.TempDir(), "test.db"))
+	testSessionStore(t, d.NewSession())
+}
+
+func TestSQLGCTrackerData_CanceledContext(t *testing.T) {
+	d := seedTestData(t, newTestSQLData(t, filepath.Join(t.TempDir(), "test.db")))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.GetUser(ctx, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("SQLGCTrackerData.GetUser() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := d.GetAllCases(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("SQLGCTrackerData.GetAllCases() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSQLGCTrackerData_ConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	d := seedTestData(t, newTestSQLData(t, filepath.Join(t.TempDir(), "test.db")))
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- d.RecordStatus(ctx, "ABC0000000001", StatusEntry{Title: "Status " + strconv.Itoa(i), LastChecked: int64(i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("SQLGCTrackerData.RecordStatus() error = %v", err)
+		}
+	}
+	if history, err := d.GetCaseHistory(ctx, "ABC0000000001"); err != nil || len(history) < cap(errs) {
+		t.Errorf("SQLGCTrackerData.GetCaseHistory() = %d entries, %v, want at least %d", len(history), err, cap(errs))
+	}
+}
+
+func TestSQLGCTrackerData_MigrateCaseNames(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	if err := migrate(db, sqliteMigrations[:1]); err != nil {
+		t.Fatalf("migrate() error = %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, email, password) VALUES ('alice', 'alice@example.com', '');
+		INSERT INTO cases (id, name, status) VALUES ('ABC0000000001', 'first', 'approved'), ('ABC0000000002', 'orphan', '');
+		INSERT INTO user_cases (username, case_id) VALUES ('alice', 'ABC0000000001');`); err != nil {
+		t.Fatalf("cannot insert data: %v", err)
+	}
+	db.Close()
+
+	d := newTestSQLData(t, path)
+	u := d.NewUser()
+	if err := u.GetByUsername(ctx, "alice"); err != nil {
+		t.Fatalf("GCTrackerUserImpl.GetByUsername() error = %v", err)
+	}
+	if got := u.GetCaseName("ABC0000000001"); got != "first" {
+		t.Errorf("GCTrackerUserImpl.GetCaseName() = %q, want %q", got, "first")
+	}
+	if got, want := caseIDs(d.GetAllCases(ctx)), []string{"ABC0000000001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SQLGCTrackerData.GetAllCases() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// twoFactor holds the TOTP (RFC 6238) key of the user. The zero value
+// means two-factor authentication is off.
+type twoFactor struct {
+	// Secret is the base32 encoded key once enabled
+	Secret string
+	// Pending is the key shown on the enrollment page until the user
+	// confirms it with a code
+	Pending string
+	// Recovery holds hex SHA-256 hashes of unused recovery codes
+	Recovery []string
+	// LastStep is the time step of the latest accepted code, a code is
+	// accepted once
+	LastStep int64
+}
+
+const (
+	totpIssuer = "GC-Tracker"
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes of the previous and the next step are accepted too, as clocks
+	// of phones drift
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTwoFactorCode     = errors.New("invalid authentication code")
+	ErrTwoFactorEnabled  = errors.New("two-factor authentication is already on")
+	ErrTwoFactorDisabled = errors.New("two-factor authentication is off")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (u *GCTrackerUserImpl) TwoFactorEnabled() bool { return u.TwoFactor.Secret != "" }
+func (u *GCTrackerUserImpl) RecoveryCodesLeft() int { return len(u.TwoFactor.Recovery) }
+
+// TwoFactorURI returns the provisioning URI of the key waiting for
+// EnableTwoFactor, empty before StartTwoFactor
+func (u *GCTrackerUserImpl) TwoFactorURI() string {
+	if u.TwoFactorEnabled() || u.TwoFactor.Pending == "" {
+		return ""
+	}
+	return provisioningURI(u.Username, u.TwoFactor.Pending)
+}
+
+// StartTwoFactor returns the provisioning URI of a new key for
+// authenticator apps. The key is kept until EnableTwoFactor confirms it,
+// calling again returns the same key.
+func (u *GCTrackerUserImpl) StartTwoFactor(ctx context.Context) (string, error) {
+	if u.TwoFactorEnabled() {
+		return "", ErrTwoFactorEnabled
+	}
+	if u.TwoFactor.Pending == "" {
+		key := make([]byte, 20)
+		if _, err := rand.Read(key); err != nil {
+			log.Println(err.Error())
+			return "", errors.New("cannot generate key")
+		}
+		u.TwoFactor.Pending = base32NoPadding.EncodeToString(key)
+		if err := u.Update(ctx); err != nil {
+			log.Println("Cannot update user " + u.Username)
+			return "", errors.New("cannot save key")
+		}
+	}
+	return provisioningURI(u.Username, u.TwoFactor.Pending), nil
+}
+
+// provisioningURI is the otpauth URI of the key, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func provisioningURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + params.Encode()
+}
+
+// EnableTwoFactor turns two-factor authentication on once the code matches
+// the key of StartTwoFactor, and returns new recovery codes. They are only
+// stored hashed and cannot be shown again.
+func (u *GCTrackerUserImpl) EnableTwoFactor(ctx context.Context, code string) ([]string, error) {
+	if u.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if u.TwoFactor.Pending == "" {
+		return nil, ErrTwoFactorDisabled
+	}
+	step, ok := matchTOTP(u.TwoFactor.Pending, code, 0, time.Now())
+	if !ok {
+		return nil, ErrTwoFactorCode
+	}
+	codes, hashes, err := recoveryCodes()
+	if err != nil {
+		log.Println(err.Error())
+		return nil, errors.New("cannot generate recovery codes")
+	}
+	u.TwoFactor = twoFactor{Secret: u.TwoFactor.Pending, Recovery: hashes, LastStep: step}
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return nil, errors.New("cannot save two-factor authentication")
+	}
+	return codes, nil
+}
+
+// CheckTwoFactor accepts a code of the authenticator app or an unused
+// recovery code, which is then used up
+func (u *GCTrackerUserImpl) CheckTwoFactor(ctx context.Context, code string) error {
+	if !u.TwoFactorEnabled() {
+		return ErrTwoFactorDisabled
+	}
+	if step, ok := matchTOTP(u.TwoFactor.Secret, code, u.TwoFactor.LastStep, time.Now()); ok {
+		u.TwoFactor.LastStep = step
+	} else if i := u.recoveryCode(code); i >= 0 {
+		log.Println("Recovery code used by " + u.Username)
+		u.TwoFactor.Recovery = append(u.TwoFactor.Recovery[:i:i], u.TwoFactor.Recovery[i+1:]...)
+	} else {
+		return ErrTwoFactorCode
+	}
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return errors.New("cannot save two-factor authentication")
+	}
+	return nil
+}
+
+// DisableTwoFactor turns two-factor authentication off, the current
+// password is required
+func (u *GCTrackerUserImpl) DisableTwoFactor(ctx context.Context, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		log.Println(err.Error())
+		return errors.New("password does not match")
+	}
+	if !u.TwoFactorEnabled() {
+		return ErrTwoFactorDisabled
+	}
+	u.TwoFactor = twoFactor{}
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return errors.New("cannot save two-factor authentication")
+	}
+	return nil
+}
+
+// totp is the code of the key for the time step
+func totp(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP finds the time step around now the code belongs to, steps up
+// to after are not accepted any more
+func matchTOTP(secret, code string, after int64, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		log.Println("Invalid TOTP key: " + err.Error())
+		return 0, false
+	}
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > after && subtle.ConstantTimeCompare([]byte(totp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// recoveryCodes generates recovery codes like 3f9a1-c0b7e and their hashes
+func recoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Join(strings.FieldsFunc(code, func(r rune) bool {
+		return r == '-' || r == ' '
+	}), ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// recoveryCode is the index of the unused recovery code, or -1
+func (u *GCTrackerUserImpl) recoveryCode(code string) int {
+	hash := hashRecoveryCode(code)
+	for i, h := range u.TwoFactor.Recovery {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
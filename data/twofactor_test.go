@@ -0,0 +1,165 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_totp(t *testing.T) {
+	// RFC 6238 test vectors of SHA-1, last 6 of 8 digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{time: 59, want: "287082"},
+		{time: 1111111109, want: "081804"},
+		{time: 1234567890, want: "005924"},
+		{time: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		if got := totp(key, tt.time/totpPeriod); got != tt.want {
+			t.Errorf("totp() at %d = %v, want %v", tt.time, got, tt.want)
+		}
+	}
+}
+
+func Test_matchTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / totpPeriod
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		name   string
+		code   string
+		after  int64
+		want   int64
+		wantOK bool
+	}{
+		{name: "Current step", code: "081804", want: step, wantOK: true},
+		{name: "Spaces", code: "081 804", want: step, wantOK: true},
+		{name: "Previous step", code: totp(key, step-1), want: step - 1, wantOK: true},
+		{name: "Next step", code: totp(key, step+1), want: step + 1, wantOK: true},
+		{name: "Too old", code: totp(key, step-2)},
+		{name: "Used already", code: "081804", after: step},
+		{name: "Wrong code", code: "123456"},
+		{name: "Short code", code: "08180"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchTOTP(secret, tt.code, tt.after, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("matchTOTP() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// currentCode is the code an authenticator app shows for the secret now
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %q: %v", secret, err)
+	}
+	return totp(key, time.Now().Unix()/totpPeriod)
+}
+
+func TestGCTrackerUserImpl_TwoFactor(t *testing.T) {
+	ctx := context.Background()
+	for backend, newData := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			load := func() *GCTrackerUserImpl {
+				user, err := d.GetUser(ctx, "alice")
+				if err != nil {
+					t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+				}
+				return user.(*GCTrackerUserImpl)
+			}
+
+			u := load()
+			if got := u.TwoFactorURI(); got != "" {
+				t.Errorf("GCTrackerUserImpl.TwoFactorURI() before start = %v, want none", got)
+			}
+			uri, err := u.StartTwoFactor(ctx)
+			if err != nil {
+				t.Fatalf("GCTrackerUserImpl.StartTwoFactor() error = %v", err)
+			}
+			parsed, err := url.Parse(uri)
+			if err != nil || parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/GC-Tracker:alice" {
+				t.Fatalf("GCTrackerUserImpl.StartTwoFactor() = %v, want an otpauth URI", uri)
+			}
+			secret := parsed.Query().Get("secret")
+			if got := load().TwoFactorURI(); got != uri {
+				t.Errorf("GCTrackerUserImpl.TwoFactorURI() = %v, want %v", got, uri)
+			}
+			if again, _ := load().StartTwoFactor(ctx); again != uri {
+				t.Errorf("GCTrackerUserImpl.StartTwoFactor() again = %v, want %v", again, uri)
+			}
+
+			u = load()
+			if _, err := u.EnableTwoFactor(ctx, "abcdef"); err != ErrTwoFactorCode {
+				t.Errorf("GCTrackerUserImpl.EnableTwoFactor() error = %v, want %v", err, ErrTwoFactorCode)
+			}
+			code := currentCode(t, secret)
+			codes, err := u.EnableTwoFactor(ctx, code)
+			if err != nil || len(codes) != recoveryCodeCount {
+				t.Fatalf("GCTrackerUserImpl.EnableTwoFactor() = %v, %v, want %d recovery codes", codes, err, recoveryCodeCount)
+			}
+
+			u = load()
+			if !u.TwoFactorEnabled() || u.RecoveryCodesLeft() != recoveryCodeCount {
+				t.Fatalf("two-factor authentication is not saved: %+v", u.TwoFactor)
+			}
+			if _, err := u.StartTwoFactor(ctx); err != ErrTwoFactorEnabled {
+				t.Errorf("GCTrackerUserImpl.StartTwoFactor() error = %v, want %v", err, ErrTwoFactorEnabled)
+			}
+			// The code which enabled it cannot be used again
+			if err := u.CheckTwoFactor(ctx, code); err != ErrTwoFactorCode {
+				t.Errorf("GCTrackerUserImpl.CheckTwoFactor() with a used code error = %v, want %v", err, ErrTwoFactorCode)
+			}
+			if err := u.CheckTwoFactor(ctx, " "+strings.ToUpper(codes[3])+" "); err != nil {
+				t.Errorf("GCTrackerUserImpl.CheckTwoFactor() with a recovery code error = %v", err)
+			}
+			u = load()
+			if err := u.CheckTwoFactor(ctx, codes[3]); err != ErrTwoFactorCode {
+				t.Errorf("GCTrackerUserImpl.CheckTwoFactor() with a used recovery code error = %v, want %v", err, ErrTwoFactorCode)
+			}
+			if left := u.RecoveryCodesLeft(); left != recoveryCodeCount-1 {
+				t.Errorf("GCTrackerUserImpl.RecoveryCodesLeft() = %v, want %v", left, recoveryCodeCount-1)
+			}
+
+			if err := u.DisableTwoFactor(ctx, "wrongpassword"); err == nil {
+				t.Error("GCTrackerUserImpl.DisableTwoFactor() with a wrong password succeeded")
+			}
+			if err := u.DisableTwoFactor(ctx, "alicepassword"); err != nil {
+				t.Fatalf("GCTrackerUserImpl.DisableTwoFactor() error = %v", err)
+			}
+			if u = load(); u.TwoFactorEnabled() || u.TwoFactor.Pending != "" || u.RecoveryCodesLeft() != 0 {
+				t.Errorf("two-factor authentication is still saved: %+v", u.TwoFactor)
+			}
+			if err := u.CheckTwoFactor(ctx, codes[0]); err != ErrTwoFactorDisabled {
+				t.Errorf("GCTrackerUserImpl.CheckTwoFactor() error = %v, want %v", err, ErrTwoFactorDisabled)
+			}
+		})
+	}
+}
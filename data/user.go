@@ -16,17 +16,19 @@ limitations under the License.
 package data
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 
-	"github.com/batk0/gc-tracker/mailer"
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/notify"
 	"github.com/google/uuid"
 	"github.com/gorilla/schema"
 	"gopkg.in/go-playground/validator.v9"
@@ -34,18 +36,39 @@ import (
 
 type GCTrackerUser interface {
 	Set(url.Values)
-	Authenticate() error
-	Validate(bool) error
+	Authenticate(context.Context) error
+	Validate(context.Context, bool) error
 	HashAndSalt() error
-	SendNotification(string)
+	SendNotification(context.Context, Notification)
+	FlushNotifications(context.Context, time.Time) error
+	GetNotificationSettings() NotificationSettings
+	SetNotificationSettings(NotificationSettings) error
+	Deliver(context.Context, *OutboxEntry) error
 	GetUsername() string
-	GetByUsername(string) error
-	GenerateResetToken(string) error
+	GetByUsername(context.Context, string) error
+	GenerateResetToken(context.Context, string) error
+	ClearResetToken()
+	GenerateVerifyToken(context.Context, string) error
+	Verify(context.Context, string) error
+	RequestEmailChange(ctx context.Context, password, email, url string) error
+	GetEmail() string
+	GetPendingEmail() string
+	IsVerified() bool
+	SetVerified(bool)
+	// Two-factor authentication with TOTP codes, see twofactor.go
+	TwoFactorEnabled() bool
+	RecoveryCodesLeft() int
+	TwoFactorURI() string
+	StartTwoFactor(context.Context) (string, error)
+	EnableTwoFactor(context.Context, string) ([]string, error)
+	CheckTwoFactor(context.Context, string) error
+	DisableTwoFactor(context.Context, string) error
 	SetPassword2(string, string)
-	Update() error
-	AddCase(GCTrackerCase) error
-	DelCase(string)
-	GetCases() []GCTrackerCase
+	Update(context.Context) error
+	AddCase(context.Context, GCTrackerCase) error
+	DelCase(context.Context, string) error
+	GetCases(context.Context) ([]GCTrackerCase, error)
+	GetCaseName(string) string
 }
 
 type resetPassword struct {
@@ -54,17 +77,42 @@ type resetPassword struct {
 }
 
 type GCTrackerUserImpl struct {
-	Username        string          `firestore:"username" schema:"username" validate:"required,min=2,max=80,alphanum,available"`
-	Email           string          `firestore:"email" schema:"email" validate:"required,email"`
-	Password        string          `firestore:"password" schema:"password" validate:"required,min=8,max=80,eqfield=ConfirmPassword"`
-	ConfirmPassword string          `firestore:"-" schema:"password2"`
-	Cases           map[string]bool `firestore:"cases" schema:"-"`
-	Reset           resetPassword   `firestore:"reset" schema:"-"`
-	data            GCTrackerData   `firestore:"-" schema:"-"`
+	Username        string               `firestore:"username" schema:"username" validate:"required,min=2,max=80,alphanum,available"`
+	Email           string               `firestore:"email" schema:"email" validate:"required,email"`
+	Password        string               `firestore:"password" schema:"password" validate:"required,min=8,max=80,eqfield=ConfirmPassword"`
+	ConfirmPassword string               `firestore:"-" schema:"password2"`
+	Cases           map[string]bool      `firestore:"cases" schema:"-"`
+	CaseNames       map[string]string    `firestore:"caseNames" schema:"-"`
+	Reset           resetPassword        `firestore:"reset" schema:"-"`
+	Verification    emailVerification    `firestore:"verification" schema:"-"`
+	EmailChange     emailChange          `firestore:"emailChange" schema:"-"`
+	Notifications   NotificationSettings `firestore:"notifications" schema:"-"`
+	TwoFactor       twoFactor            `firestore:"twoFactor" schema:"-"`
+	data            GCTrackerData        `firestore:"-" schema:"-"`
 }
 
-func (d *FirestoreGCTrackerData) NewUser() GCTrackerUser { return &GCTrackerUserImpl{data: d} }
-func (u *GCTrackerUserImpl) GetUsername() string         { return u.Username }
+func (u *GCTrackerUserImpl) GetUsername() string { return u.Username }
+func (u *GCTrackerUserImpl) GetEmail() string    { return u.Email }
+
+func (u *GCTrackerUserImpl) clone() GCTrackerUserImpl {
+	c := *u
+	if u.Cases != nil {
+		c.Cases = make(map[string]bool, len(u.Cases))
+		for k, v := range u.Cases {
+			c.Cases[k] = v
+		}
+	}
+	if u.CaseNames != nil {
+		c.CaseNames = make(map[string]string, len(u.CaseNames))
+		for k, v := range u.CaseNames {
+			c.CaseNames[k] = v
+		}
+	}
+	if u.TwoFactor.Recovery != nil {
+		c.TwoFactor.Recovery = append([]string(nil), u.TwoFactor.Recovery...)
+	}
+	return c
+}
 
 func (u *GCTrackerUserImpl) Set(formData url.Values) {
 	decoder := schema.NewDecoder()
@@ -78,10 +126,10 @@ func (u *GCTrackerUserImpl) SetPassword2(p1, p2 string) {
 	u.ConfirmPassword = p2
 }
 
-func (u *GCTrackerUserImpl) Validate(checkAvailable bool) error {
+func (u *GCTrackerUserImpl) Validate(ctx context.Context, checkAvailable bool) error {
 	v := validator.New()
 	if err := v.RegisterValidation("available", func(fl validator.FieldLevel) bool {
-		return !checkAvailable || u.data.UserAvailable(fl.Field().String())
+		return !checkAvailable || u.data.UserAvailable(ctx, fl.Field().String())
 	}); err != nil {
 		log.Println(err.Error())
 	}
@@ -106,50 +154,56 @@ func (u *GCTrackerUserImpl) HashAndSalt() error {
 	return err
 }
 
-func (u *GCTrackerUserImpl) GetByUsername(username string) error {
-	userSnap, err := u.data.GetUser(username)
+// fetch loads the stored copy of the user
+func (u *GCTrackerUserImpl) fetch(ctx context.Context, username string) (*GCTrackerUserImpl, error) {
+	user, err := u.data.GetUser(ctx, username)
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			log.Println("GCTrackerUser does not exist: " + err.Error())
-			return errors.New("user does not exist")
-		}
-		return err
+		log.Println("Cannot get user " + username + ": " + err.Error())
+		return nil, err
 	}
-	if err := userSnap.DataTo(u); err != nil {
-		log.Println(err.Error())
-		return err
+	dbUser, ok := user.(*GCTrackerUserImpl)
+	if !ok {
+		return nil, errors.New("unsupported user type")
 	}
+	return dbUser, nil
+}
 
+func (u *GCTrackerUserImpl) GetByUsername(ctx context.Context, username string) error {
+	dbUser, err := u.fetch(ctx, username)
+	if err != nil {
+		return err
+	}
+	*u = *dbUser
 	return nil
 }
 
-func (u *GCTrackerUserImpl) GenerateResetToken(url string) error {
+func (u *GCTrackerUserImpl) GenerateResetToken(ctx context.Context, url string) error {
 	token := uuid.New()
 	u.Reset.Token = token.String()
 
 	u.Reset.Timestamp = time.Now().Unix()
-	if err := u.Update(); err != nil {
+	if err := u.Update(ctx); err != nil {
 		log.Println("Cannot update user " + u.Username)
 		return errors.New("cannot save reset token")
 	}
 	address := url + "?a=r&t=" + token.String()
-	defer u.SendNotification("Please follow the link " + address + " to reset your password.")
+	defer u.SendNotification(ctx, Notification{
+		Event:   EventPasswordReset,
+		Message: "Please follow the link " + address + " to reset your password.",
+		Link:    address,
+	})
 	return nil
 }
 
-func (u *GCTrackerUserImpl) Authenticate() error {
-	userSnap, err := u.data.GetUser(u.Username)
-	if err != nil {
-		if status.Code(err) == codes.NotFound {
-			log.Println("GCTrackerUser does not exist: " + err.Error())
-			return errors.New("user does not exist")
-		}
-		return err
-	}
+// ClearResetToken invalidates the reset link once it has been used, the
+// next Update saves it
+func (u *GCTrackerUserImpl) ClearResetToken() {
+	u.Reset = resetPassword{}
+}
 
-	var dbUser *GCTrackerUserImpl
-	if err := userSnap.DataTo(dbUser); err != nil {
-		log.Println(err.Error())
+func (u *GCTrackerUserImpl) Authenticate(ctx context.Context) error {
+	dbUser, err := u.fetch(ctx, u.Username)
+	if err != nil {
 		return err
 	}
 	if u.Username != dbUser.Username {
@@ -163,29 +217,56 @@ func (u *GCTrackerUserImpl) Authenticate() error {
 
 }
 
-func (u *GCTrackerUserImpl) AddCase(c GCTrackerCase) error {
-	u.Cases[c.GetID()] = true
+// AddCase subscribes the user to the case under the user's own description
+// and saves the user. The shared case is created from c only if nobody tracks
+// it yet. It is acquired after the subscription is saved, so a concurrent
+// ReleaseCase either sees the new subscriber or runs before the case is
+// created again.
+func (u *GCTrackerUserImpl) AddCase(ctx context.Context, c GCTrackerCase) error {
 	if err := c.Validate(); err != nil {
 		return err
 	}
-	c.Create()
-	return nil
+	if u.Cases == nil {
+		u.Cases = map[string]bool{}
+	}
+	if u.CaseNames == nil {
+		u.CaseNames = map[string]string{}
+	}
+	u.Cases[c.GetID()] = true
+	u.CaseNames[c.GetID()] = c.GetName()
+	if err := u.Update(ctx); err != nil {
+		return err
+	}
+	return u.data.AcquireCase(ctx, c)
 }
 
-func (u *GCTrackerUserImpl) DelCase(c string) {
+// DelCase unsubscribes the user from the case. The shared case is deleted
+// when the user was its last subscriber.
+func (u *GCTrackerUserImpl) DelCase(ctx context.Context, c string) error {
 	delete(u.Cases, c)
-	(&GCTrackerCaseImpl{ID: c}).Delete()
+	delete(u.CaseNames, c)
+	if err := u.Update(ctx); err != nil {
+		return err
+	}
+	return u.data.ReleaseCase(ctx, c)
 }
 
-func (u *GCTrackerUserImpl) Update() error {
-	u.data.UpdateUser(u)
-	return nil
+// GetCaseName returns the user's description of the case or its ID
+func (u *GCTrackerUserImpl) GetCaseName(id string) string {
+	if name := u.CaseNames[id]; name != "" {
+		return name
+	}
+	return id
 }
 
-func (u *GCTrackerUserImpl) GetCases() []GCTrackerCase {
+func (u *GCTrackerUserImpl) Update(ctx context.Context) error {
+	return u.data.UpdateUser(ctx, u)
+}
+
+func (u *GCTrackerUserImpl) GetCases(ctx context.Context) ([]GCTrackerCase, error) {
 	l := len(u.Cases)
 	if l == 0 {
-		return nil
+		return nil, nil
 	}
 	cases := make([]string, l)
 	i := 0
@@ -193,17 +274,186 @@ func (u *GCTrackerUserImpl) GetCases() []GCTrackerCase {
 		cases[i] = c
 		i++
 	}
-	gotCases := u.data.GetCases(cases)
-	// retCases := make([]GCTrackerCase, len(gotCases))
-	// for i, c := range gotCases {
-	// 	// c.data = u.data
-	// 	retCases[i] = GCTrackerCase(c)
-	// }
-	return gotCases
+	gotCases, err := u.data.GetCases(ctx, cases)
+	for _, c := range gotCases {
+		if ci, ok := c.(*GCTrackerCaseImpl); ok {
+			ci.Name = u.CaseNames[ci.ID]
+		}
+	}
+	return gotCases, err
+}
+
+func (u *GCTrackerUserImpl) GetNotificationSettings() NotificationSettings { return u.Notifications }
+
+func (u *GCTrackerUserImpl) SetNotificationSettings(s NotificationSettings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	u.Notifications = s
+	return nil
+}
+
+// securityEvent tells events which carry links only the user may follow or
+// warn of changes to the account
+func securityEvent(event string) bool {
+	switch event {
+	case EventPasswordReset, EventVerifyEmail, EventEmailChanged, EventLockout:
+		return true
+	}
+	return false
+}
+
+// SendNotification emails msg unless the user has muted the event. Users
+// who have not confirmed their email address get security events only.
+// Status changes of digest only users, and everything but security events
+// during quiet hours, are queued for FlushNotifications.
+func (u *GCTrackerUserImpl) SendNotification(ctx context.Context, n Notification) {
+	s := u.Notifications
+	if s.Mutes(n.Event) {
+		return
+	}
+	if !u.IsVerified() && !securityEvent(n.Event) {
+		log.Println("Email of " + u.Username + " is not verified, skip notification")
+		return
+	}
+	digest := n.Event == EventStatusChange && s.DigestOnly
+	if digest || !securityEvent(n.Event) && s.Quiet(time.Now()) {
+		q := QueuedNotification{Notification: n, Digest: digest, Created: time.Now().Unix()}
+		if err := u.data.QueueNotification(ctx, u.Username, q); err != nil {
+			log.Println("Cannot queue notification: " + err.Error())
+		}
+		return
+	}
+	u.deliver(ctx, u.notification(n, time.Now()))
+}
+
+// FlushNotifications sends queued notifications that are due at now in a
+// single email, with the digest of status changes first
+func (u *GCTrackerUserImpl) FlushNotifications(ctx context.Context, now time.Time) error {
+	queue, err := u.data.GetQueuedNotifications(ctx, u.Username)
+	if err != nil {
+		return err
+	}
+	due := u.Notifications.due(queue, now)
+	if len(due) == 0 {
+		return nil
+	}
+	ids := make([]string, len(due))
+	digest := notify.Notification{
+		Event:    notify.EventDigest,
+		Username: u.Username,
+		Message:  composeMessage(due),
+		Time:     now,
+	}
+	for i, n := range due {
+		ids[i] = n.ID
+		digest.Items = append(digest.Items, u.notification(n.Notification, time.Unix(n.Created, 0)))
+	}
+	if len(due) == 1 && !due[0].Digest {
+		digest = digest.Items[0]
+	}
+	if err := u.deliver(ctx, digest); err != nil {
+		return err
+	}
+	return u.data.DeleteQueuedNotifications(ctx, u.Username, ids)
 }
 
-func (u *GCTrackerUserImpl) SendNotification(msg string) {
-	if err := mailer.Send(u.Email, msg); err != nil {
-		log.Println("Cannot send email: " + err.Error())
+func (u *GCTrackerUserImpl) notification(n Notification, t time.Time) notify.Notification {
+	return notify.Notification{
+		Event:     n.Event,
+		Username:  u.Username,
+		Message:   n.Message,
+		CaseID:    n.CaseID,
+		CaseName:  n.CaseName,
+		OldStatus: n.OldStatus,
+		NewStatus: n.NewStatus,
+		Link:      n.Link,
+		To:        n.To,
+		Time:      t,
 	}
 }
+
+// notifiers are the channels the user gets n on. Email is always there,
+// security events go nowhere else.
+func (u *GCTrackerUserImpl) notifiers(n notify.Notification) map[string]notify.Notifier {
+	to := u.Email
+	if n.To != "" {
+		to = n.To
+	}
+	notifiers := map[string]notify.Notifier{ChannelEmail: notify.NewEmail(to)}
+	if securityEvent(n.Event) {
+		return notifiers
+	}
+	if s := u.Notifications; s.WebhookURL != "" {
+		notifiers[ChannelWebhook] = notify.NewWebhook(s.WebhookURL, s.WebhookSecret)
+	}
+	if s := u.Notifications; s.ChatURL != "" {
+		chat, err := notify.NewChat(s.ChatService, s.ChatURL, s.ChatToken)
+		if err != nil {
+			log.Println("Cannot notify " + u.Username + " in chat: " + err.Error())
+		} else {
+			notifiers[ChannelChat] = chat
+		}
+	}
+	return notifiers
+}
+
+// deliver puts n into the outbox for every channel of the user and makes
+// the first attempt right away. It only fails if n cannot be put into the
+// outbox, failed attempts are retried from there. Entries are not due
+// before the first attempt records its outcome, or its lease runs out.
+func (u *GCTrackerUserImpl) deliver(ctx context.Context, n notify.Notification) error {
+	notifiers := u.notifiers(n)
+	channels := make([]string, 0, len(notifiers))
+	for channel := range notifiers {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	var lastErr error
+	now := time.Now().Unix()
+	for _, channel := range channels {
+		e := OutboxEntry{
+			Username:     u.Username,
+			Channel:      channel,
+			Notification: n,
+			Status:       OutboxPending,
+			Created:      now,
+			Updated:      now,
+			NextAttempt:  now + int64(OutboxLease.Seconds()),
+		}
+		id, err := u.data.AddOutbox(ctx, e)
+		if err != nil {
+			log.Println("Cannot add notification to outbox: " + err.Error())
+			lastErr = err
+			continue
+		}
+		e.ID = id
+		u.Deliver(ctx, &e)
+	}
+	return lastErr
+}
+
+// Deliver makes an attempt to deliver the outbox entry to the channel and
+// records the outcome in the outbox
+func (u *GCTrackerUserImpl) Deliver(ctx context.Context, e *OutboxEntry) error {
+	retries := config.Config.OutboxRetries
+	notifier, ok := u.notifiers(e.Notification)[e.Channel]
+	err := errors.New("channel " + e.Channel + " is not set up")
+	if ok {
+		n := e.Notification
+		n.ID = e.ID + "-" + strconv.FormatInt(e.Created, 10)
+		err = notifier.Notify(ctx, n)
+	} else {
+		// Retries cannot help once the user removed the channel
+		retries = 0
+	}
+	if err != nil {
+		log.Printf("Cannot notify %s by %s: %v", u.Username, e.Channel, err)
+	}
+	e.record(err, time.Now(), retries, config.Config.OutboxBackoff)
+	if uerr := u.data.UpdateOutbox(ctx, *e); uerr != nil {
+		log.Println("Cannot update outbox: " + uerr.Error())
+	}
+	return err
+}
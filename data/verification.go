@@ -0,0 +1,273 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/batk0/gc-tracker/config"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// emailVerification tracks whether the user has confirmed the email
+// address. Accounts created before verification have the zero value and
+// count as verified.
+type emailVerification struct {
+	// Pending until the user follows the latest link
+	Pending bool
+	// Sent is when the latest link was sent, links sent before are void
+	Sent int64
+}
+
+// verifyResendDelay is the least time between two verification emails
+const verifyResendDelay = time.Minute
+
+var (
+	ErrVerifyLink    = errors.New("invalid verification link")
+	ErrVerifyExpired = errors.New("verification link has expired, please sign in to get a new one")
+	ErrVerifyTooSoon = errors.New("verification email has just been sent, please try again in a minute")
+)
+
+// generatedKey is the secret key when SECRET_KEY is not set
+var (
+	generatedKey      []byte
+	generatedKeyError error
+	generatedKeyOnce  sync.Once
+)
+
+// secretKey signs links sent to users. Without SECRET_KEY a random key is
+// used, so links do not survive restarts.
+func secretKey() ([]byte, error) {
+	if config.Config.SecretKey != "" {
+		return []byte(config.Config.SecretKey), nil
+	}
+	generatedKeyOnce.Do(func() {
+		log.Println("SECRET_KEY is not set, links in emails expire on restart")
+		generatedKey = make([]byte, 32)
+		if _, err := rand.Read(generatedKey); err != nil {
+			log.Println(err.Error())
+			generatedKeyError = errors.New("cannot generate secret key")
+		}
+	})
+	return generatedKey, generatedKeyError
+}
+
+// verifySignature binds the link to the user, the email address and the
+// time it was sent
+func verifySignature(username, email string, sent int64) (string, error) {
+	key, err := secretKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(username + "\n" + email + "\n" + strconv.FormatInt(sent, 10)))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyToken is the base64 encoded username, the time the link was sent
+// and the signature, separated by dots
+func verifyToken(username, email string, sent int64) (string, error) {
+	signature, err := verifySignature(username, email, sent)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + strconv.FormatInt(sent, 10) + "." + signature, nil
+}
+
+func parseVerifyToken(token string) (string, int64, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", 0, "", ErrVerifyLink
+	}
+	username, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, "", ErrVerifyLink
+	}
+	sent, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, "", ErrVerifyLink
+	}
+	return string(username), sent, parts[2], nil
+}
+
+func (u *GCTrackerUserImpl) IsVerified() bool { return !u.Verification.Pending }
+
+// SetVerified marks the email address as confirmed or not, new accounts are
+// not verified until the user follows the link of GenerateVerifyToken
+func (u *GCTrackerUserImpl) SetVerified(verified bool) { u.Verification.Pending = !verified }
+
+// GenerateVerifyToken sends the user a link to url confirming the email
+// address. Links sent before stop working.
+func (u *GCTrackerUserImpl) GenerateVerifyToken(ctx context.Context, url string) error {
+	now := time.Now()
+	if u.Verification.Pending && now.Sub(time.Unix(u.Verification.Sent, 0)) < verifyResendDelay {
+		return ErrVerifyTooSoon
+	}
+	token, err := verifyToken(u.Username, u.Email, now.Unix())
+	if err != nil {
+		log.Println("Cannot sign verification link: " + err.Error())
+		return errors.New("cannot generate verification link")
+	}
+	u.Verification = emailVerification{Pending: true, Sent: now.Unix()}
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return errors.New("cannot save verification")
+	}
+	address := url + "?t=" + token
+	u.SendNotification(ctx, Notification{
+		Event:   EventVerifyEmail,
+		Message: "Please follow the link " + address + " to confirm your email address.",
+		Link:    address,
+	})
+	return nil
+}
+
+// Verify confirms the email address the token was sent to and loads the
+// user: the address of a new account, or the one the user is changing to.
+// Following a link again is not an error.
+func (u *GCTrackerUserImpl) Verify(ctx context.Context, token string) error {
+	username, sent, signature, err := parseVerifyToken(token)
+	if err != nil {
+		return err
+	}
+	if err := u.GetByUsername(ctx, username); err != nil {
+		return ErrVerifyLink
+	}
+	if c := u.EmailChange; c.Email != "" && sent == c.Sent && validSignature(signature, u.Username, c.Email, sent) {
+		if expired(sent) {
+			return ErrVerifyExpired
+		}
+		return u.changeEmail(ctx)
+	}
+	if sent != u.Verification.Sent || !validSignature(signature, u.Username, u.Email, sent) {
+		return ErrVerifyLink
+	}
+	if u.IsVerified() {
+		return nil
+	}
+	if expired(sent) {
+		return ErrVerifyExpired
+	}
+	u.SetVerified(true)
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return errors.New("cannot save verification")
+	}
+	u.welcome(ctx)
+	return nil
+}
+
+func validSignature(signature, username, email string, sent int64) bool {
+	want, err := verifySignature(username, email, sent)
+	return err == nil && hmac.Equal([]byte(signature), []byte(want))
+}
+
+func expired(sent int64) bool {
+	expiry := config.Config.VerifyExpiry
+	return expiry > 0 && time.Since(time.Unix(sent, 0)) > expiry
+}
+
+func (u *GCTrackerUserImpl) welcome(ctx context.Context) {
+	u.SendNotification(ctx, Notification{
+		Event:   EventSignUp,
+		Message: "Your account '" + u.Username + "' has been created.",
+	})
+}
+
+// emailChange is the address the user is changing to until it is confirmed
+type emailChange struct {
+	Email string
+	// Sent is when the link was sent to Email
+	Sent int64
+}
+
+func (u *GCTrackerUserImpl) GetPendingEmail() string { return u.EmailChange.Email }
+
+// RequestEmailChange checks the current password and sends a link to url
+// confirming the new email address to it. The address only changes once
+// the link is followed, a new request replaces the pending one.
+func (u *GCTrackerUserImpl) RequestEmailChange(ctx context.Context, password, email, url string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		log.Println(err.Error())
+		return errors.New("password does not match")
+	}
+	if err := validator.New().Var(email, "required,email"); err != nil {
+		return errors.New("invalid email address")
+	}
+	if strings.EqualFold(email, u.Email) {
+		return errors.New("this is your current email address")
+	}
+	now := time.Now()
+	if u.EmailChange.Email != "" && now.Sub(time.Unix(u.EmailChange.Sent, 0)) < verifyResendDelay {
+		return ErrVerifyTooSoon
+	}
+	token, err := verifyToken(u.Username, email, now.Unix())
+	if err != nil {
+		log.Println("Cannot sign verification link: " + err.Error())
+		return errors.New("cannot generate verification link")
+	}
+	u.EmailChange = emailChange{Email: email, Sent: now.Unix()}
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return errors.New("cannot save email address")
+	}
+	address := url + "?t=" + token
+	u.SendNotification(ctx, Notification{
+		Event:   EventVerifyEmail,
+		Message: "Please follow the link " + address + " to confirm your new email address.",
+		Link:    address,
+		To:      email,
+	})
+	return nil
+}
+
+// changeEmail switches to the confirmed address, which also confirms the
+// account, and tells the old address unless it was never confirmed
+func (u *GCTrackerUserImpl) changeEmail(ctx context.Context) error {
+	old, wasVerified := u.Email, u.IsVerified()
+	u.Email = u.EmailChange.Email
+	// The link keeps working as a verification link of the new address
+	u.Verification = emailVerification{Sent: u.EmailChange.Sent}
+	u.EmailChange = emailChange{}
+	if err := u.Update(ctx); err != nil {
+		log.Println("Cannot update user " + u.Username)
+		return errors.New("cannot save email address")
+	}
+	if !wasVerified {
+		u.welcome(ctx)
+		return nil
+	}
+	u.SendNotification(ctx, Notification{
+		Event: EventEmailChanged,
+		Message: "The email address of your account '" + u.Username + "' has been changed from " + old + " to " + u.Email +
+			". If you did not change it, reset your password right away.",
+		To: old,
+	})
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/notify"
+)
+
+func TestGCTrackerUserImpl_Verify(t *testing.T) {
+	ctx := context.Background()
+	defer func(key string, expiry time.Duration) {
+		config.Config.SecretKey, config.Config.VerifyExpiry = key, expiry
+	}(config.Config.SecretKey, config.Config.VerifyExpiry)
+	config.Config.SecretKey, config.Config.VerifyExpiry = "secret", 48*time.Hour
+
+	now := time.Now().Unix()
+	token := func(username, email string, sent int64) string {
+		token, err := verifyToken(username, email, sent)
+		if err != nil {
+			t.Fatalf("verifyToken() error = %v", err)
+		}
+		return token
+	}
+	tests := []struct {
+		name         string
+		verification emailVerification
+		token        string
+		wantErr      error
+		wantVerified bool
+	}{
+		{
+			name:         "Valid link",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        token("alice", "alice@example.com", now),
+			wantVerified: true,
+		},
+		{
+			name:         "Already verified",
+			verification: emailVerification{Sent: now},
+			token:        token("alice", "alice@example.com", now),
+			wantVerified: true,
+		},
+		{
+			name:         "Expired link",
+			verification: emailVerification{Pending: true, Sent: now - 49*3600},
+			token:        token("alice", "alice@example.com", now-49*3600),
+			wantErr:      ErrVerifyExpired,
+		},
+		{
+			name:         "Link replaced by a newer one",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        token("alice", "alice@example.com", now-120),
+			wantErr:      ErrVerifyLink,
+		},
+		{
+			name:         "Link to another email address",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        token("alice", "mallory@example.com", now),
+			wantErr:      ErrVerifyLink,
+		},
+		{
+			name:         "Link of another user",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        token("bob", "bob@example.com", now),
+			wantErr:      ErrVerifyLink,
+		},
+		{
+			name:         "Unknown user",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        token("mallory", "alice@example.com", now),
+			wantErr:      ErrVerifyLink,
+		},
+		{
+			name:         "Tampered signature",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        token("alice", "alice@example.com", now)[:40] + "0",
+			wantErr:      ErrVerifyLink,
+		},
+		{
+			name:         "Malformed link",
+			verification: emailVerification{Pending: true, Sent: now},
+			token:        "garbage",
+			wantErr:      ErrVerifyLink,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := seedTestData(t, NewMemoryGCTrackerData())
+			user, err := d.GetUser(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+			}
+			user.(*GCTrackerUserImpl).Verification = tt.verification
+			if err := user.Update(ctx); err != nil {
+				t.Fatalf("GCTrackerUser.Update() error = %v", err)
+			}
+
+			err = d.NewUser().Verify(ctx, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("GCTrackerUser.Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, _ := d.GetUser(ctx, "alice")
+			if got.IsVerified() != tt.wantVerified {
+				t.Errorf("GCTrackerUser.IsVerified() = %v, want %v", got.IsVerified(), tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestGCTrackerUserImpl_GenerateVerifyToken(t *testing.T) {
+	ctx := context.Background()
+	for name, newData := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			user, err := d.GetUser(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+			}
+			user.SetVerified(false)
+			if err := user.GenerateVerifyToken(ctx, "https://example.com/verify"); err != nil {
+				t.Fatalf("GCTrackerUser.GenerateVerifyToken() error = %v", err)
+			}
+			if err := user.GenerateVerifyToken(ctx, "https://example.com/verify"); !errors.Is(err, ErrVerifyTooSoon) {
+				t.Errorf("GCTrackerUser.GenerateVerifyToken() again error = %v, want %v", err, ErrVerifyTooSoon)
+			}
+
+			// Unverified users get the link and nothing else
+			user, _ = d.GetUser(ctx, "alice")
+			if user.IsVerified() {
+				t.Fatal("GCTrackerUser.IsVerified() = true before the link is followed")
+			}
+			user.SendNotification(ctx, Notification{Event: EventAccount, Message: "msg"})
+			outbox, _ := d.GetOutbox(ctx, "alice", 10)
+			if len(outbox) != 1 || outbox[0].Notification.Event != EventVerifyEmail {
+				t.Fatalf("GCTrackerData.GetOutbox() = %+v, want the verification link only", outbox)
+			}
+			link := outbox[0].Notification.Link
+			if !strings.HasPrefix(link, "https://example.com/verify?t=") {
+				t.Fatalf("GCTrackerUser.GenerateVerifyToken() link = %q", link)
+			}
+
+			if err := d.NewUser().Verify(ctx, strings.TrimPrefix(link, "https://example.com/verify?t=")); err != nil {
+				t.Fatalf("GCTrackerUser.Verify() error = %v", err)
+			}
+			user, _ = d.GetUser(ctx, "alice")
+			if !user.IsVerified() {
+				t.Error("GCTrackerUser.IsVerified() = false after the link is followed")
+			}
+			outbox, _ = d.GetOutbox(ctx, "alice", 10)
+			if len(outbox) != 2 || outbox[0].Notification.Event != EventSignUp {
+				t.Errorf("GCTrackerData.GetOutbox() = %+v, want the welcome email first", outbox)
+			}
+		})
+	}
+}
+
+func TestGCTrackerUserImpl_RequestEmailChange(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		password string
+		email    string
+		wantErr  bool
+	}{
+		{
+			name:     "Wrong password",
+			password: "wrongpassword",
+			email:    "alice@example.org",
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid email",
+			password: "alicepassword",
+			email:    "alice",
+			wantErr:  true,
+		},
+		{
+			name:     "Current email",
+			password: "alicepassword",
+			email:    "Alice@example.com",
+			wantErr:  true,
+		},
+		{
+			name:     "New email",
+			password: "alicepassword",
+			email:    "alice@example.org",
+			wantErr:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := seedTestData(t, NewMemoryGCTrackerData())
+			user, err := d.GetUser(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+			}
+			err = user.RequestEmailChange(ctx, tt.password, tt.email, "https://example.com/verify")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GCTrackerUser.RequestEmailChange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			want := ""
+			if !tt.wantErr {
+				want = tt.email
+			}
+			user, _ = d.GetUser(ctx, "alice")
+			if user.GetEmail() != "alice@example.com" || user.GetPendingEmail() != want {
+				t.Errorf("GCTrackerUser email = %q, pending %q, want alice@example.com, pending %q", user.GetEmail(), user.GetPendingEmail(), want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerUserImpl_Verify_EmailChange(t *testing.T) {
+	ctx := context.Background()
+	for name, newData := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			d := seedTestData(t, newData(t))
+			user, err := d.GetUser(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+			}
+			if err := user.RequestEmailChange(ctx, "alicepassword", "alice@example.org", "https://example.com/verify"); err != nil {
+				t.Fatalf("GCTrackerUser.RequestEmailChange() error = %v", err)
+			}
+			if err := user.RequestEmailChange(ctx, "alicepassword", "alice@example.net", "https://example.com/verify"); !errors.Is(err, ErrVerifyTooSoon) {
+				t.Errorf("GCTrackerUser.RequestEmailChange() again error = %v, want %v", err, ErrVerifyTooSoon)
+			}
+
+			// The link goes to the new address only
+			outbox, _ := d.GetOutbox(ctx, "alice", 10)
+			if len(outbox) != 1 || outbox[0].Notification.Event != EventVerifyEmail || outbox[0].Notification.To != "alice@example.org" {
+				t.Fatalf("GCTrackerData.GetOutbox() = %+v, want the link to the new address", outbox)
+			}
+			email, ok := user.(*GCTrackerUserImpl).notifiers(outbox[0].Notification)[ChannelEmail].(*notify.Email)
+			if !ok || email.To != "alice@example.org" {
+				t.Errorf("GCTrackerUserImpl.notifiers() email = %+v, want to alice@example.org", email)
+			}
+			token := strings.TrimPrefix(outbox[0].Notification.Link, "https://example.com/verify?t=")
+
+			for i := 0; i < 2; i++ {
+				if err := d.NewUser().Verify(ctx, token); err != nil {
+					t.Fatalf("GCTrackerUser.Verify() error = %v", err)
+				}
+			}
+			user, _ = d.GetUser(ctx, "alice")
+			if user.GetEmail() != "alice@example.org" || user.GetPendingEmail() != "" || !user.IsVerified() {
+				t.Errorf("GCTrackerUser email = %q, pending %q, verified %v", user.GetEmail(), user.GetPendingEmail(), user.IsVerified())
+			}
+			outbox, _ = d.GetOutbox(ctx, "alice", 10)
+			if len(outbox) != 2 || outbox[0].Notification.Event != EventEmailChanged || outbox[0].Notification.To != "alice@example.com" {
+				t.Errorf("GCTrackerData.GetOutbox() = %+v, want the old address told first", outbox)
+			}
+		})
+	}
+}
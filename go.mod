@@ -3,18 +3,18 @@ module github.com/batk0/gc-tracker
 go 1.16
 
 require (
-	cloud.google.com/go/firestore v1.6.0 // indirect
-	github.com/GoogleCloudPlatform/firestore-gorilla-sessions v0.1.0
-	github.com/PuerkitoBio/goquery v1.7.1 // indirect
+	cloud.google.com/go/firestore v1.6.0
+	github.com/PuerkitoBio/goquery v1.7.1
 	github.com/caarlos0/env v3.5.0+incompatible
 	github.com/go-playground/universal-translator v0.18.0 // indirect
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/schema v1.2.0
-	github.com/gorilla/sessions v1.2.1 // indirect
+	github.com/gorilla/sessions v1.2.1
 	github.com/leodido/go-urn v1.2.1 // indirect
+	github.com/mattn/go-sqlite3 v1.14.9
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f // indirect
-	google.golang.org/api v0.58.0 // indirect
-	google.golang.org/grpc v1.41.0 // indirect
+	google.golang.org/api v0.58.0
+	google.golang.org/grpc v1.41.0
 	gopkg.in/go-playground/validator.v9 v9.31.0
 )
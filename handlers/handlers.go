@@ -16,36 +16,59 @@ limitations under the License.
 package handlers
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
+	"github.com/batk0/gc-tracker/config"
 	"github.com/batk0/gc-tracker/service"
 )
 
 type GCTrackerService interface {
 	RenderPage(string, string) string
 	ShowStyle() string
-	ShowCases() string
+	ShowCases(context.Context) string
+	ShowCase(context.Context, string) string
 	ShowUsers() string
-	ShowSignIn(string) string
-	ShowSignUp(string) string
-	ShowResetPwd(string) string
-	ShowChangePwd(string) string
-
-	SignIn(url.Values) error
-	SignUp(url.Values) error
-	ChangePwd(*http.Request) error
+	ShowSignIn(context.Context, string) string
+	ShowSignUp(context.Context, string) string
+	ShowResetPwd(context.Context, string) string
+	ShowChangePwd(context.Context, string) string
+	ShowSettings(context.Context, string) string
+	ShowOutbox(context.Context) string
+	ShowAccount(context.Context, string) string
+	ShowTwoFactor(context.Context, string) string
+	ShowSignInTwoFactor(context.Context, string) string
+	ShowRecoveryCodes(context.Context, []string) string
+
+	SignIn(http.ResponseWriter, *http.Request) error
+	SignOut(http.ResponseWriter, *http.Request) error
+	VerifyTwoFactor(http.ResponseWriter, *http.Request) error
+	StartTwoFactor(*http.Request) error
+	EnableTwoFactor(*http.Request) ([]string, error)
+	DisableTwoFactor(*http.Request) error
+	SignUp(*http.Request) error
+	VerifyEmail(context.Context, string) error
+	ResendVerification(*http.Request) error
+	ChangeEmail(*http.Request) error
+	ChangePwd(http.ResponseWriter, *http.Request) error
 	ResetPwd(*http.Request) error
-	AddCase(url.Values)
-	DelCases([]string)
-	UpdateCases() error
-	IsAuthenticated() bool
-	GetSession(*http.Request)
-	SetAuthenticated(bool)
-	SetResetToken(string)
-	GetResetToken() string
+	SaveSettings(context.Context, url.Values) error
+	AddCase(context.Context, url.Values)
+	DelCases(context.Context, []string)
+	UpdateCases(context.Context) (service.UpdateResult, error)
+	UpdateStatus() service.UpdateStatus
+	IsAuthenticated(context.Context) bool
+	GetSession(http.ResponseWriter, *http.Request) *http.Request
+	SetResetToken(http.ResponseWriter, *http.Request, string) error
+	GetResetToken(context.Context) string
+	CheckCSRF(context.Context, string) bool
+	SaveSession(http.ResponseWriter, *http.Request) error
 }
 
 type GCTrackerServer struct{ service GCTrackerService }
@@ -57,21 +80,65 @@ func NewGCTrackerServer(s GCTrackerService) *GCTrackerServer {
 	return &GCTrackerServer{service: s}
 }
 
+// render writes the page, saving the session first as rendering forms may
+// have put a new CSRF token into it
+func (s *GCTrackerServer) render(w http.ResponseWriter, r *http.Request, page string) {
+	s.renderStatus(w, r, http.StatusOK, page)
+}
+
+func (s *GCTrackerServer) renderStatus(w http.ResponseWriter, r *http.Request, code int, page string) {
+	s.service.SaveSession(w, r)
+	w.WriteHeader(code)
+	fmt.Fprint(w, page)
+}
+
+// errorStatus is the status code of the page showing err, 429 while the
+// attempt is throttled
+func errorStatus(err error) int {
+	if err == service.ErrTooManyAttempts {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusOK
+}
+
+// validCSRF answers 403 unless the posted form carries the CSRF token of the
+// session
+func (s *GCTrackerServer) validCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		log.Println(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	if !s.service.CheckCSRF(r.Context(), r.PostForm.Get(service.CSRFField)) {
+		log.Println("Invalid CSRF token for " + r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func (s *GCTrackerServer) CaseHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	s.service.GetSession(r)
-	if s.service.IsAuthenticated() && r.Method == http.MethodPost {
+	r = s.service.GetSession(w, r)
+	if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+		return
+	}
+	if id := r.URL.Query().Get("id"); s.service.IsAuthenticated(r.Context()) && r.Method == http.MethodGet && id != "" {
+		s.render(w, r, s.service.ShowCase(r.Context(), id))
+		return
+	}
+	if s.service.IsAuthenticated(r.Context()) && r.Method == http.MethodPost {
 		defer r.Body.Close()
 		if err := r.ParseForm(); err != nil {
 			log.Println(err.Error())
 		} else if r.PostForm.Get("add") != "" {
-			s.service.AddCase(r.PostForm)
+			s.service.AddCase(r.Context(), r.PostForm)
 		} else if r.PostForm.Get("delete") != "" {
-			s.service.DelCases(r.PostForm["cases"])
+			s.service.DelCases(r.Context(), r.PostForm["cases"])
 		}
 	}
 	w.Header().Set("Location", "/")
@@ -80,9 +147,9 @@ func (s *GCTrackerServer) CaseHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *GCTrackerServer) IndexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
-			fmt.Fprint(w, s.service.ShowCases())
+		r = s.service.GetSession(w, r)
+		if s.service.IsAuthenticated(r.Context()) {
+			s.render(w, r, s.service.ShowCases(r.Context()))
 		} else {
 			w.Header().Set("Location", "/signin")
 			w.WriteHeader(http.StatusSeeOther)
@@ -95,9 +162,9 @@ func (s *GCTrackerServer) IndexHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *GCTrackerServer) UsersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
-			fmt.Fprint(w, s.service.ShowUsers())
+		r = s.service.GetSession(w, r)
+		if s.service.IsAuthenticated(r.Context()) {
+			s.render(w, r, s.service.ShowUsers())
 		} else {
 			w.Header().Set("Location", "/signin")
 			w.WriteHeader(http.StatusSeeOther)
@@ -109,20 +176,23 @@ func (s *GCTrackerServer) UsersHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *GCTrackerServer) ResetPwdHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet || r.Method == http.MethodPost {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
+		r = s.service.GetSession(w, r)
+		if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+			return
+		}
+		if s.service.IsAuthenticated(r.Context()) {
 			w.Header().Set("Location", "/")
 			w.WriteHeader(http.StatusSeeOther)
 		} else if r.Method == http.MethodPost {
 			if err := r.ParseForm(); err != nil {
-				fmt.Fprint(w, s.service.ShowResetPwd(err.Error()))
+				s.render(w, r, s.service.ShowResetPwd(r.Context(), err.Error()))
 			} else if err := s.service.ResetPwd(r); err != nil {
-				fmt.Fprint(w, s.service.ShowResetPwd(err.Error()))
+				s.renderStatus(w, r, errorStatus(err), s.service.ShowResetPwd(r.Context(), err.Error()))
 			} else {
-				fmt.Fprint(w, s.service.RenderPage("Check your mailbox for the reset link.", ""))
+				s.render(w, r, s.service.RenderPage("Check your mailbox for the reset link.", ""))
 			}
 		} else {
-			fmt.Fprint(w, s.service.ShowResetPwd(""))
+			s.render(w, r, s.service.ShowResetPwd(r.Context(), ""))
 		}
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -131,32 +201,35 @@ func (s *GCTrackerServer) ResetPwdHandler(w http.ResponseWriter, r *http.Request
 
 func (s *GCTrackerServer) ChangePwdHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet || r.Method == http.MethodPost {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
+		r = s.service.GetSession(w, r)
+		if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+			return
+		}
+		if s.service.IsAuthenticated(r.Context()) {
 			if r.Method == http.MethodPost {
 				if err := r.ParseForm(); err != nil {
-					fmt.Fprint(w, s.service.ShowChangePwd(err.Error()))
-				} else if err := s.service.ChangePwd(r); err != nil {
-					fmt.Fprint(w, s.service.ShowChangePwd(err.Error()))
+					s.render(w, r, s.service.ShowChangePwd(r.Context(), err.Error()))
+				} else if err := s.service.ChangePwd(w, r); err != nil {
+					s.render(w, r, s.service.ShowChangePwd(r.Context(), err.Error()))
 				} else {
-					fmt.Fprint(w, s.service.RenderPage("Password changed", ""))
+					s.render(w, r, s.service.RenderPage("Password changed", ""))
 				}
 			} else {
-				fmt.Fprint(w, s.service.ShowChangePwd(""))
+				s.render(w, r, s.service.ShowChangePwd(r.Context(), ""))
 			}
 		} else {
-			if r.Method == http.MethodPost && s.service.GetResetToken() != "" {
+			if r.Method == http.MethodPost && s.service.GetResetToken(r.Context()) != "" {
 				if err := r.ParseForm(); err != nil {
-					fmt.Fprint(w, s.service.ShowChangePwd(err.Error()))
-				} else if err := s.service.ChangePwd(r); err != nil {
-					fmt.Fprint(w, s.service.ShowChangePwd(err.Error()))
+					s.render(w, r, s.service.ShowChangePwd(r.Context(), err.Error()))
+				} else if err := s.service.ChangePwd(w, r); err != nil {
+					s.render(w, r, s.service.ShowChangePwd(r.Context(), err.Error()))
 				} else {
-					fmt.Fprint(w, s.service.RenderPage("Password changed", ""))
+					s.render(w, r, s.service.RenderPage("Password changed", ""))
 				}
 			} else if q, err := url.ParseQuery(r.RequestURI); err == nil {
 				if token := q.Get("t"); token != "" {
-					s.service.SetResetToken(token)
-					fmt.Fprint(w, s.service.ShowChangePwd(""))
+					s.service.SetResetToken(w, r, token)
+					s.render(w, r, s.service.ShowChangePwd(r.Context(), ""))
 					return
 				}
 			}
@@ -168,36 +241,186 @@ func (s *GCTrackerServer) ChangePwdHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func (s *GCTrackerServer) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r = s.service.GetSession(w, r)
+	if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+		return
+	}
+	if !s.service.IsAuthenticated(r.Context()) {
+		w.Header().Set("Location", "/signin")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			s.render(w, r, s.service.ShowSettings(r.Context(), err.Error()))
+		} else if err := s.service.SaveSettings(r.Context(), r.PostForm); err != nil {
+			s.render(w, r, s.service.ShowSettings(r.Context(), err.Error()))
+		} else {
+			w.Header().Set("Location", "/settings")
+			w.WriteHeader(http.StatusSeeOther)
+		}
+		return
+	}
+	s.render(w, r, s.service.ShowSettings(r.Context(), ""))
+}
+
+// AccountHandler shows the account of the user and changes its email
+// address
+func (s *GCTrackerServer) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r = s.service.GetSession(w, r)
+	if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+		return
+	}
+	if !s.service.IsAuthenticated(r.Context()) {
+		w.Header().Set("Location", "/signin")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			s.render(w, r, s.service.ShowAccount(r.Context(), err.Error()))
+		} else if err := s.service.ChangeEmail(r); err != nil {
+			s.render(w, r, s.service.ShowAccount(r.Context(), err.Error()))
+		} else {
+			s.render(w, r, s.service.RenderPage(`Check the mailbox of the new address for the link confirming it. <a href="/account">Back to account</a>`, ""))
+		}
+		return
+	}
+	s.render(w, r, s.service.ShowAccount(r.Context(), ""))
+}
+
+// OutboxHandler shows the latest notifications of the user and whether
+// they were delivered
+func (s *GCTrackerServer) OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r = s.service.GetSession(w, r)
+	if !s.service.IsAuthenticated(r.Context()) {
+		w.Header().Set("Location", "/signin")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	s.render(w, r, s.service.ShowOutbox(r.Context()))
+}
+
 func (s *GCTrackerServer) SignInHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet || r.Method == http.MethodPost {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
+		r = s.service.GetSession(w, r)
+		if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+			return
+		}
+		if s.service.IsAuthenticated(r.Context()) {
 			w.Header().Set("Location", "/")
 			w.WriteHeader(http.StatusSeeOther)
 		} else if r.Method == http.MethodPost {
 			if err := r.ParseForm(); err != nil {
-				fmt.Fprint(w, s.service.ShowSignIn(err.Error()))
-			} else if err := s.service.SignIn(r.PostForm); err != nil {
-				fmt.Fprint(w, s.service.ShowSignIn(err.Error()))
+				s.render(w, r, s.service.ShowSignIn(r.Context(), err.Error()))
+			} else if err := s.service.SignIn(w, r); err == service.ErrTwoFactorRequired {
+				w.Header().Set("Location", "/signin/2fa")
+				w.WriteHeader(http.StatusSeeOther)
+			} else if err != nil {
+				s.renderStatus(w, r, errorStatus(err), s.service.ShowSignIn(r.Context(), err.Error()))
 			} else {
-				s.service.SetAuthenticated(true)
 				w.Header().Set("Location", "/")
 				w.WriteHeader(http.StatusSeeOther)
 			}
 		} else {
-			fmt.Fprint(w, s.service.ShowSignIn(""))
+			s.render(w, r, s.service.ShowSignIn(r.Context(), ""))
 		}
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// SignInTwoFactorHandler asks for the code of the authenticator app after
+// the password, and signs the user in with it
+func (s *GCTrackerServer) SignInTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r = s.service.GetSession(w, r)
+	if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+		return
+	}
+	if s.service.IsAuthenticated(r.Context()) {
+		w.Header().Set("Location", "/")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := s.service.VerifyTwoFactor(w, r); err != nil {
+			s.renderStatus(w, r, errorStatus(err), s.service.ShowSignInTwoFactor(r.Context(), err.Error()))
+		} else {
+			w.Header().Set("Location", "/")
+			w.WriteHeader(http.StatusSeeOther)
+		}
+		return
+	}
+	s.render(w, r, s.service.ShowSignInTwoFactor(r.Context(), ""))
+}
+
+// TwoFactorHandler creates the key of the authenticator app, turns
+// two-factor authentication of the signed in user on with a code of the app,
+// or off with the password. GET only shows the state.
+func (s *GCTrackerServer) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r = s.service.GetSession(w, r)
+	if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+		return
+	}
+	if !s.service.IsAuthenticated(r.Context()) {
+		w.Header().Set("Location", "/signin")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if r.PostForm.Get("start") != "" {
+			if err := s.service.StartTwoFactor(r); err != nil {
+				s.render(w, r, s.service.ShowTwoFactor(r.Context(), err.Error()))
+			} else {
+				w.Header().Set("Location", "/twofactor")
+				w.WriteHeader(http.StatusSeeOther)
+			}
+		} else if r.PostForm.Get("disable") != "" {
+			if err := s.service.DisableTwoFactor(r); err != nil {
+				s.render(w, r, s.service.ShowTwoFactor(r.Context(), err.Error()))
+			} else {
+				s.render(w, r, s.service.RenderPage(`Two-factor authentication is off. <a href="/account">Back to account</a>`, ""))
+			}
+		} else if codes, err := s.service.EnableTwoFactor(r); err != nil {
+			s.render(w, r, s.service.ShowTwoFactor(r.Context(), err.Error()))
+		} else {
+			s.render(w, r, s.service.ShowRecoveryCodes(r.Context(), codes))
+		}
+		return
+	}
+	s.render(w, r, s.service.ShowTwoFactor(r.Context(), ""))
+}
+
+// SignOutHandler only signs out on POST, so that other sites cannot sign
+// the user out with a link
 func (s *GCTrackerServer) SignOutHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
-			s.service.SetAuthenticated(false)
+	if r.Method == http.MethodPost {
+		r = s.service.GetSession(w, r)
+		if !s.validCSRF(w, r) {
+			return
 		}
+		s.service.SignOut(w, r)
 		w.Header().Set("Location", "/signin")
 		w.WriteHeader(http.StatusSeeOther)
 	} else {
@@ -207,26 +430,61 @@ func (s *GCTrackerServer) SignOutHandler(w http.ResponseWriter, r *http.Request)
 
 func (s *GCTrackerServer) SignUpHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet || r.Method == http.MethodPost {
-		s.service.GetSession(r)
-		if s.service.IsAuthenticated() {
+		r = s.service.GetSession(w, r)
+		if r.Method == http.MethodPost && !s.validCSRF(w, r) {
+			return
+		}
+		if s.service.IsAuthenticated(r.Context()) {
 			w.Header().Set("Location", "/")
 			w.WriteHeader(http.StatusSeeOther)
 		} else if r.Method == http.MethodPost {
 			if err := r.ParseForm(); err != nil {
-				fmt.Fprint(w, s.service.ShowSignUp(err.Error()))
-			} else if err := s.service.SignUp(r.PostForm); err != nil {
-				fmt.Fprint(w, s.service.ShowSignUp(err.Error()))
+				s.render(w, r, s.service.ShowSignUp(r.Context(), err.Error()))
+			} else if err := s.service.SignUp(r); err != nil {
+				s.renderStatus(w, r, errorStatus(err), s.service.ShowSignUp(r.Context(), err.Error()))
 			} else {
-				fmt.Fprint(w, s.service.RenderPage("Account created", ""))
+				s.render(w, r, s.service.RenderPage("Account created. Check your mailbox for the link confirming your email address.", ""))
 			}
 		} else {
-			fmt.Fprint(w, s.service.ShowSignUp(""))
+			s.render(w, r, s.service.ShowSignUp(r.Context(), ""))
 		}
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// VerifyHandler confirms email addresses with the link from the email on
+// GET, and sends the signed in user a new link on POST
+func (s *GCTrackerServer) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		token := r.URL.Query().Get("t")
+		if token == "" {
+			w.Header().Set("Location", "/")
+			w.WriteHeader(http.StatusSeeOther)
+		} else if err := s.service.VerifyEmail(r.Context(), token); err != nil {
+			fmt.Fprint(w, s.service.RenderPage("", err.Error()))
+		} else {
+			fmt.Fprint(w, s.service.RenderPage(`Email address confirmed. <a href="/">Go to your cases</a>`, ""))
+		}
+	case http.MethodPost:
+		r = s.service.GetSession(w, r)
+		if !s.validCSRF(w, r) {
+			return
+		}
+		if !s.service.IsAuthenticated(r.Context()) {
+			w.Header().Set("Location", "/signin")
+			w.WriteHeader(http.StatusSeeOther)
+		} else if err := s.service.ResendVerification(r); err != nil {
+			s.render(w, r, s.service.RenderPage("", err.Error()))
+		} else {
+			s.render(w, r, s.service.RenderPage("Check your mailbox for the link confirming your email address.", ""))
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func (s *GCTrackerServer) StyleHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		w.Header().Set("Content-Type", "text/css")
@@ -236,16 +494,55 @@ func (s *GCTrackerServer) StyleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// canTriggerUpdate accepts App Engine cron, which strips X-Appengine-Cron
+// from outside requests, and the UPDATE_TOKEN bearer token
+func canTriggerUpdate(r *http.Request) bool {
+	if config.Config.IsAppEngine && r.Header.Get("X-Appengine-Cron") == "true" {
+		return true
+	}
+	token := config.Config.UpdateToken
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
 func (s *GCTrackerServer) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if !canTriggerUpdate(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	if r.Method == http.MethodGet {
-		if err := s.service.UpdateCases(); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		result, err := s.service.UpdateCases(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if err == service.ErrUpdateRunning {
+			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			log.Println(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if err := json.NewEncoder(w).Encode(result); err != nil {
 			log.Println(err.Error())
-			fmt.Fprint(w, "FAIL")
-		} else {
-			fmt.Fprint(w, "OK")
 		}
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+func (s *GCTrackerServer) UpdateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !canTriggerUpdate(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.service.UpdateStatus()); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -16,15 +16,21 @@ limitations under the License.
 package handlers
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
-	"strconv"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/data"
+	"github.com/batk0/gc-tracker/service"
 	"github.com/gorilla/sessions"
 )
 
@@ -48,6 +54,20 @@ type want struct {
 	password string
 }
 
+// newFormRequest posts form with the CSRF token of the mock session
+func newFormRequest(method, uri string, form url.Values) *http.Request {
+	if method != http.MethodPost {
+		return httptest.NewRequest(method, uri, strings.NewReader(form.Encode()))
+	}
+	values := url.Values{service.CSRFField: []string{testCSRFToken}}
+	for k, v := range form {
+		values[k] = v
+	}
+	request := httptest.NewRequest(method, uri, strings.NewReader(values.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
 type testMatrix []struct {
 	name string
 	args args
@@ -56,41 +76,146 @@ type testMatrix []struct {
 
 type MockGCTrackerService struct {
 	pageError     error
+	updateResult  service.UpdateResult
+	updateStatus  service.UpdateStatus
 	session       *sessions.Session
 	authenticated bool
 	casesList     map[string]string
 	usersList     map[string]bool
 	resetToken    string
 	password      string
+	settings      url.Values
+	email         string
+	// twoFactor is "on" or "off" once turned on or off
+	twoFactor string
+}
+
+func (*MockGCTrackerService) ShowStyle() string                { return "showStyle" }
+func (*MockGCTrackerService) ShowCases(context.Context) string { return "showCases" }
+func (*MockGCTrackerService) ShowCase(ctx context.Context, id string) string {
+	return "showCase" + id
+}
+func (*MockGCTrackerService) ShowUsers() string { return "showUsers" }
+func (*MockGCTrackerService) ShowSignUp(ctx context.Context, err string) string {
+	return "showSignUp" + err
+}
+func (*MockGCTrackerService) ShowSignIn(ctx context.Context, err string) string {
+	return "showSignIn" + err
+}
+func (*MockGCTrackerService) ShowResetPwd(ctx context.Context, err string) string {
+	return "showResetPwd" + err
+}
+func (*MockGCTrackerService) ShowChangePwd(ctx context.Context, err string) string {
+	return "showChangePwd" + err
+}
+func (*MockGCTrackerService) ShowSettings(ctx context.Context, err string) string {
+	return "showSettings" + err
+}
+func (*MockGCTrackerService) ShowOutbox(ctx context.Context) string { return "showOutbox" }
+func (*MockGCTrackerService) ShowAccount(ctx context.Context, err string) string {
+	return "showAccount" + err
+}
+func (*MockGCTrackerService) ShowTwoFactor(ctx context.Context, err string) string {
+	return "showTwoFactor" + err
+}
+func (*MockGCTrackerService) ShowSignInTwoFactor(ctx context.Context, err string) string {
+	return "showSignInTwoFactor" + err
+}
+func (*MockGCTrackerService) ShowRecoveryCodes(ctx context.Context, codes []string) string {
+	return "showRecoveryCodes" + strings.Join(codes, ",")
 }
 
-func (*MockGCTrackerService) ShowStyle() string               { return "showStyle" }
-func (*MockGCTrackerService) ShowCases() string               { return "showCases" }
-func (*MockGCTrackerService) ShowUsers() string               { return "showUsers" }
-func (*MockGCTrackerService) ShowSignUp(err string) string    { return "showSignUp" + err }
-func (*MockGCTrackerService) ShowSignIn(err string) string    { return "showSignIn" + err }
-func (*MockGCTrackerService) ShowResetPwd(err string) string  { return "showResetPwd" + err }
-func (*MockGCTrackerService) ShowChangePwd(err string) string { return "showChangePwd" + err }
-func (m *MockGCTrackerService) GetResetToken() string         { return m.resetToken }
-func (m *MockGCTrackerService) SetResetToken(token string)    { m.resetToken = token }
-func (m *MockGCTrackerService) UpdateCases() error            { return m.pageError }
-func (m *MockGCTrackerService) IsAuthenticated() bool         { return m.authenticated }
-func (m *MockGCTrackerService) SetAuthenticated(auth bool)    { m.authenticated = auth }
+// twoFactorUser gets service.ErrTwoFactorRequired from the mock, which
+// then accepts testTwoFactorCode
+const (
+	twoFactorUser     = "twofactor"
+	testTwoFactorCode = "123456"
+)
+
+func (m *MockGCTrackerService) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	switch r.PostForm.Get("code") {
+	case testTwoFactorCode:
+		m.SetAuthenticated(true)
+		return nil
+	case throttledUser:
+		return service.ErrTooManyAttempts
+	}
+	return data.ErrTwoFactorCode
+}
+func (m *MockGCTrackerService) StartTwoFactor(r *http.Request) error {
+	if m.twoFactor == "on" {
+		return data.ErrTwoFactorEnabled
+	}
+	m.twoFactor = "started"
+	return nil
+}
+func (m *MockGCTrackerService) EnableTwoFactor(r *http.Request) ([]string, error) {
+	if r.PostForm.Get("code") != testTwoFactorCode {
+		return nil, data.ErrTwoFactorCode
+	}
+	m.twoFactor = "on"
+	return []string{"aaaaa-bbbbb", "ccccc-ddddd"}, nil
+}
+func (m *MockGCTrackerService) DisableTwoFactor(r *http.Request) error {
+	if r.PostForm.Get("password") != "testpassword" {
+		return errors.New("password does not match")
+	}
+	m.twoFactor = "off"
+	return nil
+}
+func (m *MockGCTrackerService) ChangeEmail(r *http.Request) error {
+	if r.PostForm.Get("password") != "testpassword" {
+		return errors.New("password does not match")
+	}
+	m.email = r.PostForm.Get("email")
+	return nil
+}
+func (m *MockGCTrackerService) SaveSettings(ctx context.Context, form url.Values) error {
+	if form.Get("timeZone") == "Mars/Olympus" {
+		return errors.New("unknown time zone")
+	}
+	m.settings = form
+	return nil
+}
+
+// testCSRFToken is the CSRF token of the mock session
+const testCSRFToken = "csrf-token"
+
+func (m *MockGCTrackerService) CheckCSRF(ctx context.Context, token string) bool {
+	return token == testCSRFToken
+}
+func (m *MockGCTrackerService) SaveSession(http.ResponseWriter, *http.Request) error { return nil }
+func (m *MockGCTrackerService) GetResetToken(context.Context) string                 { return m.resetToken }
+func (m *MockGCTrackerService) SetResetToken(w http.ResponseWriter, r *http.Request, token string) error {
+	m.resetToken = token
+	return nil
+}
+func (m *MockGCTrackerService) UpdateCases(context.Context) (service.UpdateResult, error) {
+	return m.updateResult, m.pageError
+}
+func (m *MockGCTrackerService) UpdateStatus() service.UpdateStatus   { return m.updateStatus }
+func (m *MockGCTrackerService) IsAuthenticated(context.Context) bool { return m.authenticated }
+func (m *MockGCTrackerService) SetAuthenticated(auth bool)           { m.authenticated = auth }
 
 func (m *MockGCTrackerService) RenderPage(content, errorMsg string) string {
 	return "renderPage " + content + errorMsg
 }
 
+// throttledUser gets service.ErrTooManyAttempts from the mock
+const throttledUser = "throttled"
+
 func (m *MockGCTrackerService) ResetPwd(r *http.Request) error {
 	form := r.PostForm
 	username := form.Get("username")
 	if username == "" {
 		return errors.New("username is empty")
+	} else if username == throttledUser {
+		return service.ErrTooManyAttempts
 	}
 	return nil
 }
 
-func (m *MockGCTrackerService) ChangePwd(r *http.Request) error {
+func (m *MockGCTrackerService) ChangePwd(w http.ResponseWriter, r *http.Request) error {
 	form := r.PostForm
 	password := form.Get("password")
 	if password == "" {
@@ -100,10 +225,14 @@ func (m *MockGCTrackerService) ChangePwd(r *http.Request) error {
 	return nil
 }
 
-func (m *MockGCTrackerService) SignIn(form url.Values) error {
-	username := form.Get("username")
+func (m *MockGCTrackerService) SignIn(w http.ResponseWriter, r *http.Request) error {
+	username := r.PostForm.Get("username")
 	if username == "" {
 		return errors.New("username is empty")
+	} else if username == throttledUser {
+		return service.ErrTooManyAttempts
+	} else if username == twoFactorUser {
+		return service.ErrTwoFactorRequired
 	} else if !m.usersList[username] {
 		return errors.New("user does not exist")
 	}
@@ -111,28 +240,45 @@ func (m *MockGCTrackerService) SignIn(form url.Values) error {
 	return nil
 }
 
-func (m *MockGCTrackerService) SignUp(form url.Values) error {
-	username := form.Get("username")
+func (m *MockGCTrackerService) SignUp(r *http.Request) error {
+	username := r.PostForm.Get("username")
 	if username == "" {
 		return errors.New("username is empty")
+	} else if username == throttledUser {
+		return service.ErrTooManyAttempts
 	} else if m.usersList[username] {
 		return errors.New("user already exists")
 	}
 	m.usersList[username] = true
 	return nil
 }
-func (m *MockGCTrackerService) AddCase(postForm url.Values) {
+func (m *MockGCTrackerService) VerifyEmail(ctx context.Context, token string) error {
+	if token != "token" {
+		return errors.New("invalid verification link")
+	}
+	return nil
+}
+
+func (m *MockGCTrackerService) ResendVerification(r *http.Request) error { return m.pageError }
+
+func (m *MockGCTrackerService) AddCase(ctx context.Context, postForm url.Values) {
 	m.casesList[postForm["case"][0]] = postForm["name"][0]
 }
 
-func (m *MockGCTrackerService) DelCases(cases []string) {
+func (m *MockGCTrackerService) DelCases(ctx context.Context, cases []string) {
 	for _, c := range cases {
 		delete(m.casesList, c)
 	}
 }
 
-func (m *MockGCTrackerService) GetSession(r *http.Request) {
+func (m *MockGCTrackerService) SignOut(w http.ResponseWriter, r *http.Request) error {
+	m.SetAuthenticated(false)
+	return nil
+}
+
+func (m *MockGCTrackerService) GetSession(w http.ResponseWriter, r *http.Request) *http.Request {
 	m.session = sessions.NewSession(sessions.NewCookieStore(), "TESTSESSION")
+	return r
 }
 
 // Helper functions
@@ -236,49 +382,206 @@ func TestGCTrackerServer_StyleHandler(t *testing.T) {
 }
 
 func TestGCTrackerServer_UpdateHandler(t *testing.T) {
-	tests := testMatrix{
+	tests := []struct {
+		name   string
+		method string
+		result service.UpdateResult
+		err    error
+		code   int
+		body   string
+	}{
 		{
-			name: "Successful update",
-			args: args{method: http.MethodGet, uri: "/update"},
-			want: want{
-				code: http.StatusOK,
-				headers: http.Header{
-					"Content-Type": []string{"text/plain; charset=utf-8"},
-				},
-				body: "OK",
-				err:  nil,
-			},
+			name:   "Successful update",
+			method: http.MethodGet,
+			result: service.UpdateResult{Checked: 3, Changed: 1, FailedIDs: []string{}},
+			code:   http.StatusOK,
+			body:   `{"checked":3,"changed":1,"failed":0,"failedIds":[]}` + "\n",
 		},
 		{
-			name: "Failed update",
-			args: args{method: http.MethodGet, uri: "/update"},
-			want: want{
-				code: http.StatusBadRequest,
-				body: "FAIL",
-				err:  errors.New("some error"),
-			},
+			name:   "Some cases failed",
+			method: http.MethodGet,
+			result: service.UpdateResult{Checked: 3, Failed: 2, FailedIDs: []string{"ABC0000000001", "ABC0000000002"}},
+			code:   http.StatusOK,
+			body:   `{"checked":3,"changed":0,"failed":2,"failedIds":["ABC0000000001","ABC0000000002"]}` + "\n",
 		},
 		{
-			name: "Invalid method",
-			args: args{method: http.MethodPost, uri: "/update"},
-			want: want{
-				code: http.StatusMethodNotAllowed,
-			},
+			name:   "Failed update",
+			method: http.MethodGet,
+			result: service.UpdateResult{FailedIDs: []string{}},
+			err:    errors.New("some error"),
+			code:   http.StatusInternalServerError,
+			body:   `{"checked":0,"changed":0,"failed":0,"failedIds":[]}` + "\n",
+		},
+		{
+			name:   "Already running",
+			method: http.MethodGet,
+			result: service.UpdateResult{FailedIDs: []string{}},
+			err:    service.ErrUpdateRunning,
+			code:   http.StatusConflict,
+			body:   `{"checked":0,"changed":0,"failed":0,"failedIds":[]}` + "\n",
+		},
+		{
+			name:   "Invalid method",
+			method: http.MethodPost,
+			code:   http.StatusMethodNotAllowed,
 		},
 	}
+	defer setUpdateAuth("secret", false)()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			request, _ := http.NewRequest(tt.args.method, tt.args.uri, nil)
+			request, _ := http.NewRequest(tt.method, "/update", nil)
+			request.Header.Set("Authorization", "Bearer secret")
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{
-				pageError: tt.want.err,
+				pageError:    tt.err,
+				updateResult: tt.result,
 			}
 			server := NewGCTrackerServer(service)
 			server.UpdateHandler(response, request)
 
-			assertStatus(t, tt.want.code, response.Code)
-			assertHeaders(t, tt.want.headers, response.Header())
-			assertBody(t, tt.want.body, response.Body.String())
+			assertStatus(t, tt.code, response.Code)
+			if tt.method == http.MethodGet {
+				assertHeaders(t, http.Header{"Content-Type": []string{"application/json"}}, response.Header())
+			}
+			assertBody(t, tt.body, response.Body.String())
+		})
+	}
+}
+
+// setUpdateAuth configures how /update is protected and returns a function
+// restoring the previous config
+func setUpdateAuth(token string, isAppEngine config.IsGAE) func() {
+	oldToken, oldIsAppEngine := config.Config.UpdateToken, config.Config.IsAppEngine
+	config.Config.UpdateToken, config.Config.IsAppEngine = token, isAppEngine
+	return func() {
+		config.Config.UpdateToken, config.Config.IsAppEngine = oldToken, oldIsAppEngine
+	}
+}
+
+func TestGCTrackerServer_UpdateHandler_Auth(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		isAppEngine config.IsGAE
+		headers     map[string]string
+		code        int
+	}{
+		{
+			name:  "Anonymous",
+			token: "secret",
+			code:  http.StatusUnauthorized,
+		},
+		{
+			name:    "Valid token",
+			token:   "secret",
+			headers: map[string]string{"Authorization": "Bearer secret"},
+			code:    http.StatusOK,
+		},
+		{
+			name:    "Wrong token",
+			token:   "secret",
+			headers: map[string]string{"Authorization": "Bearer guess"},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:    "Token without Bearer scheme",
+			token:   "secret",
+			headers: map[string]string{"Authorization": "secret"},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:    "Empty token is not accepted",
+			headers: map[string]string{"Authorization": "Bearer "},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:        "App Engine cron",
+			isAppEngine: true,
+			headers:     map[string]string{"X-Appengine-Cron": "true"},
+			code:        http.StatusOK,
+		},
+		{
+			name:    "Cron header outside of App Engine",
+			token:   "secret",
+			headers: map[string]string{"X-Appengine-Cron": "true"},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:        "Token on App Engine",
+			token:       "secret",
+			isAppEngine: true,
+			headers:     map[string]string{"Authorization": "Bearer secret"},
+			code:        http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setUpdateAuth(tt.token, tt.isAppEngine)()
+			server := NewGCTrackerServer(&MockGCTrackerService{})
+			for _, handler := range []http.HandlerFunc{server.UpdateHandler, server.UpdateStatusHandler} {
+				request, _ := http.NewRequest(http.MethodGet, "/update", nil)
+				for k, v := range tt.headers {
+					request.Header.Set(k, v)
+				}
+				response := httptest.NewRecorder()
+				handler(response, request)
+
+				assertStatus(t, tt.code, response.Code)
+				if tt.code == http.StatusUnauthorized {
+					assertHeaders(t, http.Header{"Www-Authenticate": []string{"Bearer"}}, response.Header())
+				}
+			}
+		})
+	}
+}
+
+func TestGCTrackerServer_UpdateStatusHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status service.UpdateStatus
+		code   int
+		body   string
+	}{
+		{
+			name:   "Never run",
+			method: http.MethodGet,
+			status: service.UpdateStatus{NextRun: 1620000000},
+			code:   http.StatusOK,
+			body:   `{"running":false,"lastStarted":0,"lastFinished":0,"lastResult":null,"nextRun":1620000000}` + "\n",
+		},
+		{
+			name:   "Last run failed",
+			method: http.MethodGet,
+			status: service.UpdateStatus{
+				LastStarted:  1610000000,
+				LastFinished: 1610000060,
+				LastResult:   &service.UpdateResult{FailedIDs: []string{}},
+				LastError:    "some error",
+				NextRun:      1610003600,
+			},
+			code: http.StatusOK,
+			body: `{"running":false,"lastStarted":1610000000,"lastFinished":1610000060,` +
+				`"lastResult":{"checked":0,"changed":0,"failed":0,"failedIds":[]},"lastError":"some error","nextRun":1610003600}` + "\n",
+		},
+		{
+			name:   "Invalid method",
+			method: http.MethodPost,
+			code:   http.StatusMethodNotAllowed,
+		},
+	}
+	defer setUpdateAuth("secret", false)()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(tt.method, "/update/status", nil)
+			request.Header.Set("Authorization", "Bearer secret")
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{updateStatus: tt.status}
+			server := NewGCTrackerServer(service)
+			server.UpdateStatusHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertBody(t, tt.body, response.Body.String())
 		})
 	}
 }
@@ -402,6 +705,24 @@ func TestGCTrackerServer_CaseHandler(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Unauthenticated GET case - redirect to /",
+			args: args{method: http.MethodGet, uri: "/case?id=ABC"},
+			want: want{
+				code: http.StatusSeeOther,
+				headers: http.Header{
+					"Location": []string{"/"},
+				},
+			},
+		},
+		{
+			name: "Authenticated GET case - showCase",
+			args: args{method: http.MethodGet, uri: "/case?id=ABC", auth: true},
+			want: want{
+				code: http.StatusOK,
+				body: "showCaseABC",
+			},
+		},
 		{
 			name: "Authenticated POST - addCase",
 			args: args{
@@ -497,12 +818,7 @@ func TestGCTrackerServer_CaseHandler(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			form := strings.NewReader(tt.args.form.Encode())
-			request, _ := http.NewRequest(tt.args.method, tt.args.uri, form)
-			if tt.args.form != nil {
-				request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-				request.Header.Add("Content-Length", strconv.Itoa(len(tt.args.form.Encode())))
-			}
+			request := newFormRequest(tt.args.method, tt.args.uri, tt.args.form)
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{
 				pageError: tt.want.err,
@@ -528,7 +844,7 @@ func TestGCTrackerServer_SignOutHandler(t *testing.T) {
 	tests := testMatrix{
 		{
 			name: "Unauthenticated - redirect to /signin",
-			args: args{method: http.MethodGet, uri: "/signout"},
+			args: args{method: http.MethodPost, uri: "/signout"},
 			want: want{
 				code: http.StatusSeeOther,
 				headers: http.Header{
@@ -539,7 +855,7 @@ func TestGCTrackerServer_SignOutHandler(t *testing.T) {
 		},
 		{
 			name: "Authenticated - unauthorize - redirect to /signin",
-			args: args{method: http.MethodGet, uri: "/signout", auth: true},
+			args: args{method: http.MethodPost, uri: "/signout", auth: true},
 			want: want{
 				code: http.StatusSeeOther,
 				headers: http.Header{
@@ -550,7 +866,7 @@ func TestGCTrackerServer_SignOutHandler(t *testing.T) {
 		},
 		{
 			name: "Invalid method - authenticated",
-			args: args{method: http.MethodPost, uri: "/signout", auth: true},
+			args: args{method: http.MethodGet, uri: "/signout", auth: true},
 			want: want{
 				code: http.StatusMethodNotAllowed,
 				auth: true,
@@ -558,7 +874,7 @@ func TestGCTrackerServer_SignOutHandler(t *testing.T) {
 		},
 		{
 			name: "Invalid method - unauthenticated",
-			args: args{method: http.MethodPost, uri: "/signout"},
+			args: args{method: http.MethodGet, uri: "/signout"},
 			want: want{
 				code: http.StatusMethodNotAllowed,
 				auth: false,
@@ -567,7 +883,7 @@ func TestGCTrackerServer_SignOutHandler(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			request, _ := http.NewRequest(tt.args.method, tt.args.uri, nil)
+			request := newFormRequest(tt.args.method, tt.args.uri, nil)
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{
 				pageError: tt.want.err,
@@ -581,7 +897,7 @@ func TestGCTrackerServer_SignOutHandler(t *testing.T) {
 			assertStatus(t, tt.want.code, response.Code)
 			assertHeaders(t, tt.want.headers, response.Header())
 			assertBody(t, tt.want.body, response.Body.String())
-			assertAuthenticated(t, tt.want.auth, service.IsAuthenticated())
+			assertAuthenticated(t, tt.want.auth, service.IsAuthenticated(context.Background()))
 		})
 	}
 }
@@ -626,6 +942,20 @@ func TestGCTrackerServer_SignUpHandler(t *testing.T) {
 				code: http.StatusMethodNotAllowed,
 			},
 		},
+		{
+			name: "Unauthenticated POST - throttled - showSignUp with error and 429",
+			args: args{
+				method: http.MethodPost,
+				uri:    "/signup",
+				form: url.Values{
+					"username": []string{throttledUser},
+				},
+			},
+			want: want{
+				code: http.StatusTooManyRequests,
+				body: "showSignUp" + service.ErrTooManyAttempts.Error(),
+			},
+		},
 		{
 			name: "Unauthenticated POST - empty form - showSignUp with error",
 			args: args{
@@ -669,19 +999,14 @@ func TestGCTrackerServer_SignUpHandler(t *testing.T) {
 			want: want{
 				code:  http.StatusOK,
 				auth:  false,
-				body:  "renderPage Account created",
+				body:  "renderPage Account created. Check your mailbox for the link confirming your email address.",
 				users: []string{"newuser", "existing"},
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			form := strings.NewReader(tt.args.form.Encode())
-			request, _ := http.NewRequest(tt.args.method, tt.args.uri, form)
-			if tt.args.form != nil {
-				request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-				request.Header.Add("Content-Length", strconv.Itoa(len(tt.args.form.Encode())))
-			}
+			request := newFormRequest(tt.args.method, tt.args.uri, tt.args.form)
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{
 				pageError: tt.want.err,
@@ -743,6 +1068,20 @@ func TestGCTrackerServer_SignInHandler(t *testing.T) {
 				code: http.StatusMethodNotAllowed,
 			},
 		},
+		{
+			name: "Unauthenticated POST - throttled - showSignIn with error and 429",
+			args: args{
+				method: http.MethodPost,
+				uri:    "/signin",
+				form: url.Values{
+					"username": []string{throttledUser},
+				},
+			},
+			want: want{
+				code: http.StatusTooManyRequests,
+				body: "showSignIn" + service.ErrTooManyAttempts.Error(),
+			},
+		},
 		{
 			name: "Unauthenticated POST - empty form - showSignIn with error",
 			args: args{
@@ -773,6 +1112,23 @@ func TestGCTrackerServer_SignInHandler(t *testing.T) {
 				body: "showSignInuser does not exist",
 			},
 		},
+		{
+			name: "Unauthenticated POST - two-factor user - redirect to /signin/2fa",
+			args: args{
+				method: http.MethodPost,
+				uri:    "/signin",
+				form: url.Values{
+					"username": []string{twoFactorUser},
+				},
+			},
+			want: want{
+				code: http.StatusSeeOther,
+				headers: http.Header{
+					"Location": []string{"/signin/2fa"},
+				},
+				auth: false,
+			},
+		},
 		{
 			name: "Unauthenticated POST - existing user - authorize redirect to /",
 			args: args{
@@ -794,12 +1150,7 @@ func TestGCTrackerServer_SignInHandler(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			form := strings.NewReader(tt.args.form.Encode())
-			request, _ := http.NewRequest(tt.args.method, tt.args.uri, form)
-			if tt.args.form != nil {
-				request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-				request.Header.Add("Content-Length", strconv.Itoa(len(tt.args.form.Encode())))
-			}
+			request := newFormRequest(tt.args.method, tt.args.uri, tt.args.form)
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{
 				pageError: tt.want.err,
@@ -814,7 +1165,7 @@ func TestGCTrackerServer_SignInHandler(t *testing.T) {
 			assertStatus(t, tt.want.code, response.Code)
 			assertHeaders(t, tt.want.headers, response.Header())
 			assertBody(t, tt.want.body, response.Body.String())
-			assertAuthenticated(t, tt.want.auth, service.IsAuthenticated())
+			assertAuthenticated(t, tt.want.auth, service.IsAuthenticated(context.Background()))
 		})
 	}
 }
@@ -859,6 +1210,20 @@ func TestGCTrackerServer_ResetPwdHandler(t *testing.T) {
 				code: http.StatusMethodNotAllowed,
 			},
 		},
+		{
+			name: "Unauthenticated POST - throttled - showResetPwd with error and 429",
+			args: args{
+				method: http.MethodPost,
+				uri:    "/resetpwd",
+				form: url.Values{
+					"username": []string{throttledUser},
+				},
+			},
+			want: want{
+				code: http.StatusTooManyRequests,
+				body: "showResetPwd" + service.ErrTooManyAttempts.Error(),
+			},
+		},
 		{
 			name: "Unauthenticated POST - empty form - showResetPwd with error",
 			args: args{
@@ -908,12 +1273,7 @@ func TestGCTrackerServer_ResetPwdHandler(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			form := strings.NewReader(tt.args.form.Encode())
-			request, _ := http.NewRequest(tt.args.method, tt.args.uri, form)
-			if tt.args.form != nil {
-				request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-				request.Header.Add("Content-Length", strconv.Itoa(len(tt.args.form.Encode())))
-			}
+			request := newFormRequest(tt.args.method, tt.args.uri, tt.args.form)
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{}
 			service.SetAuthenticated(tt.args.auth)
@@ -923,7 +1283,7 @@ func TestGCTrackerServer_ResetPwdHandler(t *testing.T) {
 			assertStatus(t, tt.want.code, response.Code)
 			assertHeaders(t, tt.want.headers, response.Header())
 			assertBody(t, tt.want.body, response.Body.String())
-			assertAuthenticated(t, tt.want.auth, service.IsAuthenticated())
+			assertAuthenticated(t, tt.want.auth, service.IsAuthenticated(context.Background()))
 		})
 	}
 }
@@ -1053,17 +1413,12 @@ func TestGCTrackerServer_ChangePwdHandler(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			form := strings.NewReader(tt.args.form.Encode())
-			request := httptest.NewRequest(tt.args.method, tt.args.uri, form)
-			if tt.args.form != nil {
-				request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-				request.Header.Add("Content-Length", strconv.Itoa(len(tt.args.form.Encode())))
-			}
+			request := newFormRequest(tt.args.method, tt.args.uri, tt.args.form)
 			response := httptest.NewRecorder()
 			service := &MockGCTrackerService{password: "oldpass"}
 			service.SetAuthenticated(tt.args.auth)
 			if tt.args.reset {
-				service.SetResetToken("token")
+				service.resetToken = "token"
 			}
 			server := NewGCTrackerServer(service)
 			server.ChangePwdHandler(response, request)
@@ -1071,8 +1426,640 @@ func TestGCTrackerServer_ChangePwdHandler(t *testing.T) {
 			assertStatus(t, tt.want.code, response.Code)
 			assertHeaders(t, tt.want.headers, response.Header())
 			assertBody(t, tt.want.body, response.Body.String())
-			assertToken(t, tt.want.token, service.GetResetToken())
+			assertToken(t, tt.want.token, service.GetResetToken(context.Background()))
 			assertPassword(t, tt.want.password, service.password)
 		})
 	}
 }
+
+func TestGCTrackerServer_SettingsHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		auth         bool
+		form         url.Values
+		code         int
+		headers      http.Header
+		body         string
+		wantSettings url.Values
+	}{
+		{
+			name:   "Invalid method",
+			method: http.MethodPut,
+			auth:   true,
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "Unauthenticated - redirect to /signin",
+			method:  http.MethodGet,
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+		{
+			name:   "Authenticated GET - showSettings",
+			method: http.MethodGet,
+			auth:   true,
+			code:   http.StatusOK,
+			body:   "showSettings",
+		},
+		{
+			name:         "Authenticated POST - saved",
+			method:       http.MethodPost,
+			auth:         true,
+			form:         url.Values{"status": []string{"on"}, "timeZone": []string{"Europe/Moscow"}},
+			code:         http.StatusSeeOther,
+			headers:      http.Header{"Location": []string{"/settings"}},
+			wantSettings: url.Values{"status": []string{"on"}, "timeZone": []string{"Europe/Moscow"}, "csrf": []string{testCSRFToken}},
+		},
+		{
+			name:   "Authenticated POST - error",
+			method: http.MethodPost,
+			auth:   true,
+			form:   url.Values{"timeZone": []string{"Mars/Olympus"}},
+			code:   http.StatusOK,
+			body:   "showSettingsunknown time zone",
+		},
+		{
+			name:   "Unauthenticated POST - not saved",
+			method: http.MethodPost,
+			form:   url.Values{"status": []string{"on"}},
+			code:   http.StatusSeeOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := newFormRequest(tt.method, "/settings", tt.form)
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{}
+			service.SetAuthenticated(tt.auth)
+			server := NewGCTrackerServer(service)
+			server.SettingsHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertHeaders(t, tt.headers, response.Header())
+			assertBody(t, tt.body, response.Body.String())
+			if !reflect.DeepEqual(tt.wantSettings, service.settings) {
+				t.Errorf("Settings are wrong got %v want %v", service.settings, tt.wantSettings)
+			}
+		})
+	}
+}
+
+func TestGCTrackerServer_AccountHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		auth      bool
+		form      url.Values
+		code      int
+		headers   http.Header
+		body      string
+		wantEmail string
+	}{
+		{
+			name:   "Invalid method",
+			method: http.MethodPut,
+			auth:   true,
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "Unauthenticated - redirect to /signin",
+			method:  http.MethodGet,
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+		{
+			name:   "Authenticated GET - showAccount",
+			method: http.MethodGet,
+			auth:   true,
+			code:   http.StatusOK,
+			body:   "showAccount",
+		},
+		{
+			name:      "Authenticated POST - link sent",
+			method:    http.MethodPost,
+			auth:      true,
+			form:      url.Values{"email": []string{"new@example.com"}, "password": []string{"testpassword"}},
+			code:      http.StatusOK,
+			body:      `renderPage Check the mailbox of the new address for the link confirming it. <a href="/account">Back to account</a>`,
+			wantEmail: "new@example.com",
+		},
+		{
+			name:   "Authenticated POST - wrong password",
+			method: http.MethodPost,
+			auth:   true,
+			form:   url.Values{"email": []string{"new@example.com"}, "password": []string{"wrongpassword"}},
+			code:   http.StatusOK,
+			body:   "showAccountpassword does not match",
+		},
+		{
+			name:    "Unauthenticated POST - not changed",
+			method:  http.MethodPost,
+			form:    url.Values{"email": []string{"new@example.com"}, "password": []string{"testpassword"}},
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := newFormRequest(tt.method, "/account", tt.form)
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{}
+			service.SetAuthenticated(tt.auth)
+			server := NewGCTrackerServer(service)
+			server.AccountHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertHeaders(t, tt.headers, response.Header())
+			assertBody(t, tt.body, response.Body.String())
+			if service.email != tt.wantEmail {
+				t.Errorf("Email is wrong got %q want %q", service.email, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestGCTrackerServer_SignInTwoFactorHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		auth    bool
+		form    url.Values
+		code    int
+		headers http.Header
+		body    string
+		want    bool
+	}{
+		{
+			name:   "Invalid method",
+			method: http.MethodPut,
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "Authenticated - redirect to /",
+			method:  http.MethodGet,
+			auth:    true,
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/"}},
+			want:    true,
+		},
+		{
+			name:   "Unauthenticated GET - showSignInTwoFactor",
+			method: http.MethodGet,
+			code:   http.StatusOK,
+			body:   "showSignInTwoFactor",
+		},
+		{
+			name:    "Unauthenticated POST - right code - redirect to /",
+			method:  http.MethodPost,
+			form:    url.Values{"code": []string{testTwoFactorCode}},
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/"}},
+			want:    true,
+		},
+		{
+			name:   "Unauthenticated POST - wrong code - showSignInTwoFactor with error",
+			method: http.MethodPost,
+			form:   url.Values{"code": []string{"654321"}},
+			code:   http.StatusOK,
+			body:   "showSignInTwoFactor" + data.ErrTwoFactorCode.Error(),
+		},
+		{
+			name:   "Unauthenticated POST - throttled - showSignInTwoFactor with error and 429",
+			method: http.MethodPost,
+			form:   url.Values{"code": []string{throttledUser}},
+			code:   http.StatusTooManyRequests,
+			body:   "showSignInTwoFactor" + service.ErrTooManyAttempts.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := newFormRequest(tt.method, "/signin/2fa", tt.form)
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{}
+			service.SetAuthenticated(tt.auth)
+			server := NewGCTrackerServer(service)
+			server.SignInTwoFactorHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertHeaders(t, tt.headers, response.Header())
+			assertBody(t, tt.body, response.Body.String())
+			assertAuthenticated(t, tt.want, service.IsAuthenticated(context.Background()))
+		})
+	}
+}
+
+func TestGCTrackerServer_TwoFactorHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		auth          bool
+		form          url.Values
+		code          int
+		headers       http.Header
+		body          string
+		wantTwoFactor string
+	}{
+		{
+			name:   "Invalid method",
+			method: http.MethodPut,
+			auth:   true,
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "Unauthenticated - redirect to /signin",
+			method:  http.MethodGet,
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+		{
+			name:   "Authenticated GET - showTwoFactor",
+			method: http.MethodGet,
+			auth:   true,
+			code:   http.StatusOK,
+			body:   "showTwoFactor",
+		},
+		{
+			name:          "Authenticated POST - set up - redirect to /twofactor",
+			method:        http.MethodPost,
+			auth:          true,
+			form:          url.Values{"start": []string{"Set up"}},
+			code:          http.StatusSeeOther,
+			headers:       http.Header{"Location": []string{"/twofactor"}},
+			wantTwoFactor: "started",
+		},
+		{
+			name:          "Authenticated POST - right code - recovery codes",
+			method:        http.MethodPost,
+			auth:          true,
+			form:          url.Values{"enable": []string{"Turn on"}, "code": []string{testTwoFactorCode}},
+			code:          http.StatusOK,
+			body:          "showRecoveryCodesaaaaa-bbbbb,ccccc-ddddd",
+			wantTwoFactor: "on",
+		},
+		{
+			name:   "Authenticated POST - wrong code",
+			method: http.MethodPost,
+			auth:   true,
+			form:   url.Values{"enable": []string{"Turn on"}, "code": []string{"654321"}},
+			code:   http.StatusOK,
+			body:   "showTwoFactor" + data.ErrTwoFactorCode.Error(),
+		},
+		{
+			name:          "Authenticated POST - turn off",
+			method:        http.MethodPost,
+			auth:          true,
+			form:          url.Values{"disable": []string{"Turn off"}, "password": []string{"testpassword"}},
+			code:          http.StatusOK,
+			body:          `renderPage Two-factor authentication is off. <a href="/account">Back to account</a>`,
+			wantTwoFactor: "off",
+		},
+		{
+			name:   "Authenticated POST - turn off with wrong password",
+			method: http.MethodPost,
+			auth:   true,
+			form:   url.Values{"disable": []string{"Turn off"}, "password": []string{"wrongpassword"}},
+			code:   http.StatusOK,
+			body:   "showTwoFactorpassword does not match",
+		},
+		{
+			name:    "Unauthenticated POST - not changed",
+			method:  http.MethodPost,
+			form:    url.Values{"disable": []string{"Turn off"}, "password": []string{"testpassword"}},
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := newFormRequest(tt.method, "/twofactor", tt.form)
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{}
+			service.SetAuthenticated(tt.auth)
+			server := NewGCTrackerServer(service)
+			server.TwoFactorHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertHeaders(t, tt.headers, response.Header())
+			assertBody(t, tt.body, response.Body.String())
+			if service.twoFactor != tt.wantTwoFactor {
+				t.Errorf("Two-factor authentication is wrong got %q want %q", service.twoFactor, tt.wantTwoFactor)
+			}
+		})
+	}
+}
+
+func TestGCTrackerServer_OutboxHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		auth    bool
+		code    int
+		headers http.Header
+		body    string
+	}{
+		{
+			name:   "Invalid method",
+			method: http.MethodPost,
+			auth:   true,
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "Unauthenticated - redirect to /signin",
+			method:  http.MethodGet,
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+		{
+			name:   "Authenticated - showOutbox",
+			method: http.MethodGet,
+			auth:   true,
+			code:   http.StatusOK,
+			body:   "showOutbox",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "/notifications", nil)
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{}
+			service.SetAuthenticated(tt.auth)
+			server := NewGCTrackerServer(service)
+			server.OutboxHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertHeaders(t, tt.headers, response.Header())
+			assertBody(t, tt.body, response.Body.String())
+		})
+	}
+}
+
+func TestGCTrackerServer_VerifyHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		uri       string
+		auth      bool
+		pageError error
+		code      int
+		headers   http.Header
+		body      string
+	}{
+		{
+			name:   "Invalid method",
+			method: http.MethodPut,
+			uri:    "/verify",
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "No token - redirect to /",
+			method:  http.MethodGet,
+			uri:     "/verify",
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/"}},
+		},
+		{
+			name:   "Valid token - confirmed",
+			method: http.MethodGet,
+			uri:    "/verify?t=token",
+			code:   http.StatusOK,
+			body:   `renderPage Email address confirmed. <a href="/">Go to your cases</a>`,
+		},
+		{
+			name:   "Invalid token - error",
+			method: http.MethodGet,
+			uri:    "/verify?t=forged",
+			code:   http.StatusOK,
+			body:   "renderPage invalid verification link",
+		},
+		{
+			name:    "Unauthenticated resend - redirect to /signin",
+			method:  http.MethodPost,
+			uri:     "/verify",
+			code:    http.StatusSeeOther,
+			headers: http.Header{"Location": []string{"/signin"}},
+		},
+		{
+			name:   "Authenticated resend - link sent",
+			method: http.MethodPost,
+			uri:    "/verify",
+			auth:   true,
+			code:   http.StatusOK,
+			body:   "renderPage Check your mailbox for the link confirming your email address.",
+		},
+		{
+			name:      "Authenticated resend - error",
+			method:    http.MethodPost,
+			uri:       "/verify",
+			auth:      true,
+			pageError: errors.New("email address is already confirmed"),
+			code:      http.StatusOK,
+			body:      "renderPage email address is already confirmed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := newFormRequest(tt.method, tt.uri, nil)
+			response := httptest.NewRecorder()
+			service := &MockGCTrackerService{pageError: tt.pageError}
+			service.SetAuthenticated(tt.auth)
+			server := NewGCTrackerServer(service)
+			server.VerifyHandler(response, request)
+
+			assertStatus(t, tt.code, response.Code)
+			assertHeaders(t, tt.headers, response.Header())
+			assertBody(t, tt.body, response.Body.String())
+		})
+	}
+}
+
+func TestGCTrackerServer_CSRF(t *testing.T) {
+	handlers := []struct {
+		name    string
+		uri     string
+		form    url.Values
+		handler func(*GCTrackerServer) http.HandlerFunc
+	}{
+		{"Delete cases", "/case", url.Values{"delete": []string{"Delete"}, "cases": []string{"INIT"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.CaseHandler }},
+		{"Add case", "/case", url.Values{"add": []string{"Add"}, "case": []string{"ABC"}, "name": []string{"abc"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.CaseHandler }},
+		{"Change password", "/changepwd", url.Values{"password": []string{"newpassword"}, "password2": []string{"newpassword"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.ChangePwdHandler }},
+		{"Sign in", "/signin", url.Values{"username": []string{"gooduser"}, "password": []string{"goodpassword"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.SignInHandler }},
+		{"Sign up", "/signup", url.Values{"username": []string{"gooduser"}, "password": []string{"goodpassword"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.SignUpHandler }},
+		{"Reset password", "/resetpwd", url.Values{"username": []string{"gooduser"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.ResetPwdHandler }},
+		{"Save settings", "/settings", url.Values{"status": []string{"on"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.SettingsHandler }},
+		{"Change email", "/account", url.Values{"email": []string{"new@example.com"}, "password": []string{"testpassword"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.AccountHandler }},
+		{"Resend verification", "/verify", url.Values{}, func(s *GCTrackerServer) http.HandlerFunc { return s.VerifyHandler }},
+		{"Sign out", "/signout", url.Values{}, func(s *GCTrackerServer) http.HandlerFunc { return s.SignOutHandler }},
+		{"Second factor", "/signin/2fa", url.Values{"code": []string{testTwoFactorCode}}, func(s *GCTrackerServer) http.HandlerFunc { return s.SignInTwoFactorHandler }},
+		{"Set up two-factor", "/twofactor", url.Values{"start": []string{"Set up"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.TwoFactorHandler }},
+		{"Turn on two-factor", "/twofactor", url.Values{"code": []string{testTwoFactorCode}}, func(s *GCTrackerServer) http.HandlerFunc { return s.TwoFactorHandler }},
+		{"Turn off two-factor", "/twofactor", url.Values{"disable": []string{"Turn off"}, "password": []string{"testpassword"}}, func(s *GCTrackerServer) http.HandlerFunc { return s.TwoFactorHandler }},
+	}
+	tokens := []struct {
+		name  string
+		token []string
+	}{
+		{"missing token", nil},
+		{"empty token", []string{""}},
+		{"wrong token", []string{"forged-token"}},
+	}
+	for _, h := range handlers {
+		for _, tok := range tokens {
+			for _, auth := range []bool{true, false} {
+				t.Run(fmt.Sprintf("%s - %s - authenticated %v", h.name, tok.name, auth), func(t *testing.T) {
+					form := url.Values{}
+					for k, v := range h.form {
+						form[k] = v
+					}
+					if tok.token != nil {
+						form[service.CSRFField] = tok.token
+					}
+					request := httptest.NewRequest(http.MethodPost, h.uri, strings.NewReader(form.Encode()))
+					request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+					response := httptest.NewRecorder()
+					service := &MockGCTrackerService{casesList: map[string]string{"INIT": "init"}}
+					service.SetAuthenticated(auth)
+					h.handler(NewGCTrackerServer(service))(response, request)
+
+					assertStatus(t, http.StatusForbidden, response.Code)
+					assertBody(t, "", response.Body.String())
+					assertCases(t, map[string]string{"INIT": "init"}, service.casesList)
+					assertAuthenticated(t, auth, service.IsAuthenticated(context.Background()))
+					if service.settings != nil || service.usersList != nil || service.password != "" || service.email != "" || service.twoFactor != "" {
+						t.Errorf("Forged request changed the state: %+v", service)
+					}
+				})
+			}
+		}
+	}
+}
+
+// browser keeps the cookies of a user between requests
+type browser struct {
+	cookies map[string]*http.Cookie
+}
+
+func (b *browser) do(handler http.HandlerFunc, method, uri string, form url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, uri, strings.NewReader(form.Encode()))
+	if method == http.MethodPost {
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range b.cookies {
+		request.AddCookie(c)
+	}
+	response := httptest.NewRecorder()
+	handler(response, request)
+	for _, c := range response.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return response
+}
+
+var csrfInput = regexp.MustCompile(`name=` + service.CSRFField + ` value=([^>]+)>`)
+
+// csrfToken is the token of the first form of the page. It is called from
+// other goroutines, so it does not stop the test.
+func csrfToken(t *testing.T, body string) string {
+	t.Helper()
+	m := csrfInput.FindStringSubmatch(body)
+	if m == nil {
+		t.Errorf("No CSRF token in %q", body)
+		return ""
+	}
+	return m[1]
+}
+
+// Run with -race: every request gets its own session, so users signing in
+// and editing cases at the same time never see each other's session
+func TestGCTrackerServer_Concurrent_MemoryData(t *testing.T) {
+	uscis := httptest.NewServer(http.NotFoundHandler())
+	defer uscis.Close()
+	defer func(cookie, url string) { config.Config.Cookie, config.Config.USCISURL = cookie, url }(config.Config.Cookie, config.Config.USCISURL)
+	config.Config.Cookie = "TESTSESSION"
+	config.Config.USCISURL = uscis.URL
+
+	const users = 8
+	d := data.NewMemoryGCTrackerData()
+	for i := 0; i < users; i++ {
+		user := d.NewUser()
+		user.Set(url.Values{
+			"username": []string{fmt.Sprintf("user%d", i)},
+			"email":    []string{fmt.Sprintf("user%d@example.com", i)},
+			"password": []string{"testpassword"},
+		})
+		if err := user.HashAndSalt(); err != nil {
+			t.Fatalf("cannot hash password: %v", err)
+		}
+		if err := d.CreateUser(context.Background(), user); err != nil {
+			t.Fatalf("cannot create user: %v", err)
+		}
+	}
+	server := NewGCTrackerServer(service.NewGCTrackerService(d))
+
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := &browser{cookies: map[string]*http.Cookie{}}
+			username := fmt.Sprintf("user%d", i)
+			own := fmt.Sprintf("ABC%010d", 100+i)
+
+			page := b.do(server.SignInHandler, http.MethodGet, "/signin", nil)
+			response := b.do(server.SignInHandler, http.MethodPost, "/signin", url.Values{
+				"username":        []string{username},
+				"password":        []string{"testpassword"},
+				service.CSRFField: []string{csrfToken(t, page.Body.String())},
+			})
+			if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/" {
+				t.Errorf("%s: sign in got %d %q", username, response.Code, response.Body.String())
+				return
+			}
+			for round := 0; round < 5; round++ {
+				token := csrfToken(t, b.do(server.IndexHandler, http.MethodGet, "/", nil).Body.String())
+				// Everyone edits the shared case, each with their own name
+				for _, form := range []url.Values{
+					{"add": []string{"Add"}, "case": []string{"ABC0000000001"}, "name": []string{username}},
+					{"add": []string{"Add"}, "case": []string{own}, "name": []string{username}},
+					{"delete": []string{"Delete"}, "cases": []string{own}},
+					{"add": []string{"Add"}, "case": []string{own}, "name": []string{username}},
+				} {
+					form.Set(service.CSRFField, token)
+					if response := b.do(server.CaseHandler, http.MethodPost, "/case", form); response.Code != http.StatusSeeOther {
+						t.Errorf("%s: case edit got %d", username, response.Code)
+					}
+				}
+			}
+
+			body := b.do(server.IndexHandler, http.MethodGet, "/", nil).Body.String()
+			for j := 0; j < users; j++ {
+				other := fmt.Sprintf("ABC%010d", 100+j)
+				if got := strings.Contains(body, other); got != (i == j) {
+					t.Errorf("%s: cases page shows %s = %v, want %v", username, other, got, i == j)
+				}
+			}
+			if !strings.Contains(body, "ABC0000000001") {
+				t.Errorf("%s: cases page misses the shared case", username)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < users; i++ {
+		username := fmt.Sprintf("user%d", i)
+		user, err := d.GetUser(context.Background(), username)
+		if err != nil {
+			t.Fatalf("GCTrackerData.GetUser() error = %v", err)
+		}
+		if got := user.GetCaseName("ABC0000000001"); got != username {
+			t.Errorf("%s: shared case name = %q, want %q", username, got, username)
+		}
+		if got := user.GetCaseName(fmt.Sprintf("ABC%010d", 100+i)); got != username {
+			t.Errorf("%s: own case name = %q, want %q", username, got, username)
+		}
+	}
+}
@@ -16,61 +16,174 @@ limitations under the License.
 package mailer
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
 	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
 
 	"github.com/batk0/gc-tracker/config"
 )
 
-const subjectText = "Notification from GC-Tracker"
-const greetingText = "Hello!"
-const footerText = "This is automated message. Please do not reply."
-
-// Need for mocking
-type smtpMailer struct{}
+// Need for mocking, see smtpMailer
 type mail interface {
 	SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error
 }
 
-func (m *smtpMailer) SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
-	return smtp.SendMail(addr, a, from, to, msg)
+// sender is the From and Reply-To of emails
+type sender struct {
+	name    string
+	address string
+	replyTo string
+}
+
+func senderFromConfig() sender {
+	s := sender{
+		name:    config.Config.SMTPFromName,
+		address: config.Config.SMTPFrom,
+		replyTo: config.Config.SMTPReplyTo,
+	}
+	if s.address == "" {
+		s.address = config.Config.SMTPUser
+	}
+	return s
+}
+
+// from is the From header, with the display name if there is one
+func (s sender) from() string {
+	if s.name == "" {
+		return s.address
+	}
+	return (&netmail.Address{Name: s.name, Address: s.address}).String()
+}
+
+// Message is rendered with the template named Template, see templates.go
+type Message struct {
+	Template string
+	// Text is the body of the generic template and of digests
+	Text     string
+	Username string
+	Link     string
+	CaseID   string
+	CaseName string
+	// OldStatus is empty before the first check
+	OldStatus string
+	NewStatus string
 }
 
 // wraps sendReal to pass mailer interface
-func Send(to string, msg string) error {
-	var mailer smtpMailer = smtpMailer{}
-	return sendReal(&mailer, to, msg)
+func Send(to string, m Message) error {
+	return sendReal(defaultMailer, to, m)
 }
 
-func getHeaders(from, to, subject string) string {
-	return fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\n\n", from, to, subject)
+// compose renders m into a multipart/alternative email with text and HTML
+// parts
+func compose(from sender, to string, m Message, now time.Time) ([]byte, error) {
+	subject, text, html, err := render(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	for _, h := range []struct{ key, value string }{
+		{"From", from.from()},
+		{"Reply-To", from.replyTo},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", messageID(from.address)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + w.Boundary()},
+	} {
+		if h.value != "" {
+			fmt.Fprintf(&msg, "%s: %s\r\n", h.key, h.value)
+		}
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
 }
-func getBody(msg string) string {
-	return fmt.Sprintf("%s\n\n%s\n\n%s\n", greetingText, msg, footerText)
+
+// messageID is unique and uses the domain of the sender
+func messageID(from string) string {
+	domain := "gc-tracker"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err.Error())
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
 }
 
-func sendReal(mailer mail, to string, msg string) error {
+func sendReal(mailer mail, to string, m Message) error {
 	if to == "" {
 		return errors.New("emtpty recepients list")
 	}
-	if msg == "" {
+	if _, ok := templates[m.Template]; !ok {
+		return errors.New("unknown template " + m.Template)
+	}
+	if m.Template == TemplateGeneric && m.Text == "" {
 		return errors.New("empty message")
 	}
-	toList := []string{to}
-	header := getHeaders(config.Config.SMTPUser, to, subjectText)
-	body := getBody(msg)
+	from := senderFromConfig()
+	if from.address == "" {
+		return errors.New("empty sender")
+	}
+	msg, err := compose(from, to, m, time.Now())
+	if err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot compose email to " + to)
+	}
 
-	auth := smtp.PlainAuth("",
-		config.Config.SMTPUser,
-		config.Config.SMTPPass,
-		config.Config.SMTPHost)
+	// Relays which need no authentication have no user
+	var auth smtp.Auth
+	if config.Config.SMTPUser != "" {
+		auth = smtp.PlainAuth("",
+			config.Config.SMTPUser,
+			config.Config.SMTPPass,
+			config.Config.SMTPHost)
+	}
 	if err := mailer.SendMail(config.Config.SMTPHost+":"+config.Config.SMTPPort,
 		auth,
-		config.Config.SMTPUser,
-		toList,
-		[]byte(header+body)); err != nil {
+		from.address,
+		[]string{to},
+		msg); err != nil {
 		log.Println(err.Error())
 		return errors.New("cannot send email to " + to)
 	}
@@ -18,8 +18,14 @@ package mailer
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
 	"net/smtp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/batk0/gc-tracker/config"
 )
@@ -57,60 +63,185 @@ func (m *spyMailer) String() string {
 	return fmt.Sprintf("addr: %s, auth: %s, from: %s, to: %s, msg: %s", m.addr, m.auth, m.from, m.to, m.msg)
 }
 
-func Test_getHeaders(t *testing.T) {
-	type args struct {
-		from    string
-		to      string
-		subject string
+// parsedMail is an email composed by the mailer, with decoded parts
+type parsedMail struct {
+	header netmail.Header
+	text   string
+	html   string
+}
+
+func parseMail(t *testing.T, msg []byte) parsedMail {
+	t.Helper()
+	m, err := netmail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatalf("netmail.ReadMessage() error = %v", err)
 	}
-	tests := []struct {
-		name string
-		args args
-		want string
-	}{
-		{
-			name: "Correct values",
-			args: args{"from@example.com", "to@example.com", "subj"},
-			want: `From: from@example.com
-To: to@example.com
-Subject: subj
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", m.Header.Get("Content-Type"), err)
+	}
+	parsed := parsedMail{header: m.Header}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// NextPart decodes quoted-printable
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("cannot read part: %v", err)
+		}
+		switch part.Header.Get("Content-Type") {
+		case "text/plain; charset=utf-8":
+			parsed.text = string(content)
+		case "text/html; charset=utf-8":
+			parsed.html = string(content)
+		default:
+			t.Errorf("unexpected part %q", part.Header.Get("Content-Type"))
+		}
+	}
+	return parsed
+}
 
-`,
-		},
+func Test_compose(t *testing.T) {
+	now := time.Date(2021, time.May, 5, 10, 30, 0, 0, time.UTC)
+	msg, err := compose(sender{address: "from@example.com"}, "to@example.com", Message{
+		Template:  TemplateStatusChange,
+		CaseID:    "ABC0000000001",
+		CaseName:  "Mom's I-485",
+		OldStatus: "Case Was Received",
+		NewStatus: "Case Was Approved",
+	}, now)
+	if err != nil {
+		t.Fatalf("compose() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := getHeaders(tt.args.from, tt.args.to, tt.args.subject); got != tt.want {
-				t.Errorf("getHeaders() = %v, want %v", got, tt.want)
-			}
-		})
+	if strings.Count(string(msg), "\n") != strings.Count(string(msg), "\r\n") {
+		t.Errorf("compose() lines do not end with CRLF")
+	}
+	got := parseMail(t, msg)
+	for key, want := range map[string]string{
+		"From":         "from@example.com",
+		"To":           "to@example.com",
+		"Subject":      "ABC0000000001: Case Was Approved",
+		"Date":         "Wed, 05 May 2021 10:30:00 +0000",
+		"MIME-Version": "1.0",
+	} {
+		if value := got.header.Get(key); value != want {
+			t.Errorf("compose() %s = %q, want %q", key, value, want)
+		}
+	}
+	if id := got.header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("compose() Message-ID = %q", id)
+	}
+	wantText := "Hello!\r\n\r\nYour case Mom's I-485 (ABC0000000001) status has changed from Case Was Received to Case Was Approved.\r\n\r\n" +
+		"This is automated message. Please do not reply.\r\n"
+	if got.text != wantText {
+		t.Errorf("compose() text = %q, want %q", got.text, wantText)
+	}
+	if !strings.Contains(got.html, "<b>Mom&#39;s I-485</b>") || !strings.Contains(got.html, "to <b>Case Was Approved</b>") {
+		t.Errorf("compose() html = %q", got.html)
 	}
 }
 
-func Test_getBody(t *testing.T) {
-	type args struct {
-		msg string
+func Test_compose_encodedSubject(t *testing.T) {
+	msg, err := compose(sender{address: "from@example.com"}, "to@example.com", Message{Template: TemplateSignUp, Username: "Jürgen"}, time.Now())
+	if err != nil {
+		t.Fatalf("compose() error = %v", err)
+	}
+	got := parseMail(t, msg)
+	subject, err := new(mime.WordDecoder).DecodeHeader(got.header.Get("Subject"))
+	if err != nil || subject != "Welcome to GC-Tracker, Jürgen" {
+		t.Errorf("compose() Subject = %q, %v", subject, err)
 	}
+}
+
+func Test_render(t *testing.T) {
 	tests := []struct {
-		name string
-		args args
-		want string
+		name        string
+		m           Message
+		wantSubject string
+		wantText    string
+		wantHTML    string
 	}{
 		{
-			"Some message",
-			args{"Message"},
-			`Hello!
-
-Message
-
-This is automated message. Please do not reply.
-`,
+			name:        "Generic",
+			m:           Message{Template: TemplateGeneric, Text: "First\n\nSecond"},
+			wantSubject: "Notification from GC-Tracker",
+			wantText:    "First\n\nSecond",
+			wantHTML:    "First\n\nSecond",
+		},
+		{
+			name:        "Sign up",
+			m:           Message{Template: TemplateSignUp, Username: "alice"},
+			wantSubject: "Welcome to GC-Tracker, alice",
+			wantText:    "Your account 'alice' has been created.",
+			wantHTML:    "<b>alice</b>",
+		},
+		{
+			name:        "Reset password",
+			m:           Message{Template: TemplateResetPassword, Link: "https://example.com/changepwd?a=r&t=token"},
+			wantSubject: "Reset your GC-Tracker password",
+			wantText:    "https://example.com/changepwd?a=r&t=token",
+			wantHTML:    `<a href="https://example.com/changepwd?a=r&amp;t=token">`,
+		},
+		{
+			name:        "Verify email",
+			m:           Message{Template: TemplateVerifyEmail, Username: "alice", Link: "https://example.com/verify?t=token"},
+			wantSubject: "Confirm your GC-Tracker email address",
+			wantText:    "https://example.com/verify?t=token to confirm the email address of your account 'alice'.",
+			wantHTML:    `<a href="https://example.com/verify?t=token">`,
+		},
+		{
+			name:        "Email changed",
+			m:           Message{Template: TemplateEmailChanged, Text: "Changed to <new@example.com>."},
+			wantSubject: "Your GC-Tracker email address has been changed",
+			wantText:    "Changed to <new@example.com>.",
+			wantHTML:    "<p>Changed to &lt;new@example.com&gt;.</p>",
+		},
+		{
+			name:        "Lockout",
+			m:           Message{Template: TemplateLockout, Text: "Sign in to your account 'alice' has been blocked for 15 minutes."},
+			wantSubject: "Sign in to your GC-Tracker account has been blocked",
+			wantText:    "Sign in to your account 'alice' has been blocked for 15 minutes.",
+			wantHTML:    "<p>Sign in to your account &#39;alice&#39; has been blocked for 15 minutes.</p>",
+		},
+		{
+			name:        "Password changed",
+			m:           Message{Template: TemplatePasswordChanged},
+			wantSubject: "Your GC-Tracker password has been changed",
+			wantText:    "Your password has been changed.",
+			wantHTML:    "Your password has been changed.",
+		},
+		{
+			name:        "First status",
+			m:           Message{Template: TemplateStatusChange, CaseID: "ABC0000000001", CaseName: "mine", NewStatus: "Case Was Received"},
+			wantSubject: "ABC0000000001: Case Was Received",
+			wantText:    "from none to Case Was Received",
+			wantHTML:    "from <i>none</i>",
+		},
+		{
+			name:        "Digest",
+			m:           Message{Template: TemplateDigest, Text: "Status changes of your cases:\n\nABC0000000001 (<mine>): none -> Case Was Received"},
+			wantSubject: "Status changes of your cases",
+			wantText:    "ABC0000000001 (<mine>): none -> Case Was Received",
+			wantHTML:    "ABC0000000001 (&lt;mine&gt;): none -&gt; Case Was Received",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getBody(tt.args.msg); got != tt.want {
-				t.Errorf("getBody() = %v, want %v", got, tt.want)
+			subject, text, html, err := render(tt.m)
+			if err != nil {
+				t.Fatalf("render() error = %v", err)
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("render() subject = %q, want %q", subject, tt.wantSubject)
+			}
+			if !strings.HasPrefix(text, greetingText) || !strings.HasSuffix(text, footerText+"\n") || !strings.Contains(text, tt.wantText) {
+				t.Errorf("render() text = %q, want %q inside", text, tt.wantText)
+			}
+			if !strings.Contains(html, tt.wantHTML) {
+				t.Errorf("render() html = %q, want %q inside", html, tt.wantHTML)
 			}
 		})
 	}
@@ -118,73 +249,99 @@ This is automated message. Please do not reply.
 
 func Test_sendReal(t *testing.T) {
 	type args struct {
-		to  string
-		msg string
+		to string
+		m  Message
 	}
 	type cfg struct {
-		SMTPHost string
-		SMTPPort string
-		SMTPUser string
-		SMTPPass string
+		SMTPHost     string
+		SMTPPort     string
+		SMTPUser     string
+		SMTPPass     string
+		SMTPFrom     string
+		SMTPFromName string
+		SMTPReplyTo  string
 	}
 	tests := []struct {
-		name    string
-		args    args
-		cfg     cfg
-		want    spyMailer
-		wantErr bool
+		name       string
+		args       args
+		cfg        cfg
+		want       spyMailer
+		wantText   string
+		wantHeader map[string]string
+		wantErr    bool
 	}{
 
 		{
 			name: "Positive: Send Mail",
-			args: args{"to@example.com", "Message"},
-			cfg:  cfg{"smtp.example.com", "587", "from@example.com", "password"},
+			args: args{"to@example.com", Message{Template: TemplateGeneric, Text: "Message"}},
+			cfg:  cfg{"smtp.example.com", "587", "from@example.com", "password", "", "", ""},
 			want: spyMailer{
-				"smtp.example.com:587",
-				smtp.PlainAuth("", "from@example.com", "password", "smtp.example.com"),
-				"from@example.com",
-				[]string{"to@example.com"},
-				([]byte)(getHeaders("from@example.com", "to@example.com", subjectText) + getBody("Message")),
+				addr: "smtp.example.com:587",
+				auth: smtp.PlainAuth("", "from@example.com", "password", "smtp.example.com"),
+				from: "from@example.com",
+				to:   []string{"to@example.com"},
+			},
+			wantText: "Hello!\r\n\r\nMessage\r\n\r\nThis is automated message. Please do not reply.\r\n",
+			wantHeader: map[string]string{
+				"From":     "from@example.com",
+				"Reply-To": "",
 			},
 			wantErr: false,
 		},
 		{
-			name: "Negative: Send Mail incorrect To",
-			args: args{"", "Message"},
-			cfg:  cfg{"smtp.example.com", "587", "from@example.com", "password"},
+			name: "Positive: Sender with name and Reply-To",
+			args: args{"to@example.com", Message{Template: TemplateGeneric, Text: "Message"}},
+			cfg:  cfg{"smtp.example.com", "587", "login@example.com", "password", "noreply@example.com", "GC Tracker", "support@example.com"},
 			want: spyMailer{
-				"smtp.example.com:587",
-				smtp.PlainAuth("", "from@example.com", "password", "smtp.example.com"),
-				"from@example.com",
-				[]string{""},
-				([]byte)(getHeaders("from@example.com", "", subjectText) + getBody("Message")),
+				addr: "smtp.example.com:587",
+				auth: smtp.PlainAuth("", "login@example.com", "password", "smtp.example.com"),
+				from: "noreply@example.com",
+				to:   []string{"to@example.com"},
 			},
-			wantErr: true,
+			wantText: "Hello!\r\n\r\nMessage\r\n\r\nThis is automated message. Please do not reply.\r\n",
+			wantHeader: map[string]string{
+				"From":     `"GC Tracker" <noreply@example.com>`,
+				"Reply-To": "support@example.com",
+			},
+			wantErr: false,
 		},
 		{
-			name: "Negative: Send Mail incorrect From",
-			args: args{"to@example.com", "Message"},
-			cfg:  cfg{"smtp.example.com", "587", "", "password"},
+			name: "Positive: Relay without authentication",
+			args: args{"to@example.com", Message{Template: TemplateGeneric, Text: "Message"}},
+			cfg:  cfg{"relay.example.com", "25", "", "", "noreply@example.com", "", ""},
 			want: spyMailer{
-				"smtp.example.com:587",
-				smtp.PlainAuth("", "", "password", "smtp.example.com"),
-				"",
-				[]string{"to@example.com"},
-				([]byte)(getHeaders("", "to@example.com", subjectText) + getBody("Message")),
+				addr: "relay.example.com:25",
+				from: "noreply@example.com",
+				to:   []string{"to@example.com"},
+			},
+			wantText: "Hello!\r\n\r\nMessage\r\n\r\nThis is automated message. Please do not reply.\r\n",
+			wantHeader: map[string]string{
+				"From": "noreply@example.com",
 			},
+			wantErr: false,
+		},
+		{
+			name:    "Negative: Send Mail incorrect To",
+			args:    args{"", Message{Template: TemplateGeneric, Text: "Message"}},
+			cfg:     cfg{"smtp.example.com", "587", "from@example.com", "password", "", "", ""},
 			wantErr: true,
 		},
 		{
-			name: "Negative: Send Mail incorrect Message",
-			args: args{"to@example.com", ""},
-			cfg:  cfg{"smtp.example.com", "587", "from@example.com", "password"},
-			want: spyMailer{
-				"smtp.example.com:587",
-				smtp.PlainAuth("", "from@example.com", "password", "smtp.example.com"),
-				"from@example.com",
-				[]string{"to@example.com"},
-				([]byte)(getHeaders("from@example.com", "to@example.com", subjectText) + getBody("")),
-			},
+			name:    "Negative: Send Mail incorrect From",
+			args:    args{"to@example.com", Message{Template: TemplateGeneric, Text: "Message"}},
+			cfg:     cfg{"smtp.example.com", "587", "", "password", "", "", ""},
+			wantErr: true,
+		},
+		{
+			name:    "Negative: Send Mail incorrect Message",
+			args:    args{"to@example.com", Message{Template: TemplateGeneric}},
+			cfg:     cfg{"smtp.example.com", "587", "from@example.com", "password", "", "", ""},
+			wantErr: true,
+		},
+		{
+			name:    "Negative: Unknown template",
+			args:    args{"to@example.com", Message{Template: "welcome_back", Text: "Message"}},
+			cfg:     cfg{"smtp.example.com", "587", "from@example.com", "password", "", "", ""},
 			wantErr: true,
 		},
 	}
@@ -194,13 +351,31 @@ func Test_sendReal(t *testing.T) {
 		config.Config.SMTPPort = tt.cfg.SMTPPort
 		config.Config.SMTPUser = tt.cfg.SMTPUser
 		config.Config.SMTPPass = tt.cfg.SMTPPass
+		config.Config.SMTPFrom = tt.cfg.SMTPFrom
+		config.Config.SMTPFromName = tt.cfg.SMTPFromName
+		config.Config.SMTPReplyTo = tt.cfg.SMTPReplyTo
 		t.Run(tt.name, func(t *testing.T) {
-			if err := sendReal(mailer, tt.args.to, tt.args.msg); (err != nil) != tt.wantErr {
+			err := sendReal(mailer, tt.args.to, tt.args.m)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("sendReal() error = %v, wantErr = %v", err, tt.wantErr)
-			} else if err == nil && mailer.String() != tt.want.String() {
+			}
+			if err != nil {
+				return
+			}
+			msg := mailer.msg
+			mailer.msg = nil
+			if mailer.String() != tt.want.String() {
 				t.Errorf("sendReal() got = %v, want = %v", mailer.String(), tt.want.String())
 			}
-
+			got := parseMail(t, msg)
+			if got.text != tt.wantText {
+				t.Errorf("sendReal() text = %q, want %q", got.text, tt.wantText)
+			}
+			for key, want := range tt.wantHeader {
+				if value := got.header.Get(key); value != want {
+					t.Errorf("sendReal() %s = %q, want %q", key, value, want)
+				}
+			}
 		})
 	}
 }
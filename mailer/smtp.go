@@ -0,0 +1,193 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+)
+
+// smtpTimeout bounds connecting to the SMTP server and every email sent
+const smtpTimeout = 30 * time.Second
+
+// smtpMailer sends emails over one connection to the SMTP server, which is
+// kept open for config.Config.SMTPKeepAlive after the last email so that
+// batches of emails reuse it
+type smtpMailer struct {
+	mu     sync.Mutex
+	addr   string
+	conn   net.Conn
+	client *smtp.Client
+	// sent counts emails, an idle timer only closes the connection if no
+	// email was sent since it started
+	sent int
+	idle *time.Timer
+	// tlsConfig is used instead of the system roots, for tests
+	tlsConfig *tls.Config
+}
+
+var defaultMailer = &smtpMailer{}
+
+func (m *smtpMailer) SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent++
+	if m.idle != nil {
+		m.idle.Stop()
+		m.idle = nil
+	}
+
+	if m.client != nil {
+		m.conn.SetDeadline(time.Now().Add(smtpTimeout))
+		// The server may have closed the kept connection meanwhile
+		if m.addr != addr || m.client.Reset() != nil {
+			m.close()
+		}
+	}
+	if m.client == nil {
+		if err := m.dial(addr, a); err != nil {
+			return err
+		}
+	}
+	if err := send(m.client, from, to, msg); err != nil {
+		m.close()
+		return err
+	}
+
+	if keepAlive := config.Config.SMTPKeepAlive; keepAlive > 0 {
+		sent := m.sent
+		m.idle = time.AfterFunc(keepAlive, func() { m.closeIdle(sent) })
+		return nil
+	}
+	// The email is accepted already, a failing QUIT does not matter
+	if err := m.client.Quit(); err != nil {
+		log.Println(err.Error())
+	}
+	m.close()
+	return nil
+}
+
+func (m *smtpMailer) closeIdle(sent int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sent != sent || m.client == nil {
+		return
+	}
+	m.conn.SetDeadline(time.Now().Add(smtpTimeout))
+	m.client.Quit()
+	m.close()
+}
+
+func (m *smtpMailer) close() {
+	if m.client != nil {
+		m.client.Close()
+	}
+	m.client, m.conn = nil, nil
+}
+
+// tlsMode resolves config.SMTPTLSAuto for the port
+func tlsMode(mode, port string) string {
+	if mode != config.SMTPTLSAuto && mode != "" {
+		return mode
+	}
+	if port == "465" {
+		return config.SMTPTLSImplicit
+	}
+	return config.SMTPTLSOpportunistic
+}
+
+// dial connects to addr with TLS as configured and authenticates with a,
+// unless it is nil
+func (m *smtpMailer) dial(addr string, a smtp.Auth) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if m.tlsConfig != nil {
+		tlsConfig = m.tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	mode := tlsMode(config.Config.SMTPTLS, port)
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if mode == config.SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if mode == config.SMTPTLSStartTLS || mode == config.SMTPTLSOpportunistic {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return err
+			}
+		} else if mode == config.SMTPTLSStartTLS {
+			c.Close()
+			return errors.New(host + " does not offer STARTTLS")
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return errors.New(host + " does not offer AUTH")
+		}
+		if err := c.Auth(a); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	m.addr, m.conn, m.client = addr, conn, c
+	return nil
+}
+
+// send is one mail transaction on c
+func send(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,390 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mailer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+)
+
+// delivery is an email accepted by fakeSMTP
+type delivery struct {
+	from   string
+	tls    bool
+	authed bool
+}
+
+// fakeSMTP is just enough of an SMTP server for smtpMailer
+type fakeSMTP struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	implicit  bool
+	starttls  bool
+	auth      bool
+
+	mu         sync.Mutex
+	conns      []net.Conn
+	deliveries []delivery
+	quits      int
+}
+
+// newFakeSMTP starts a server and returns it with the TLS config trusting
+// its certificate
+func newFakeSMTP(t *testing.T, implicit, starttls, auth bool) (*fakeSMTP, *tls.Config) {
+	t.Helper()
+	// httptest has a certificate for 127.0.0.1 and a client which trusts it
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(ts.Close)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	s := &fakeSMTP{
+		ln:        ln,
+		tlsConfig: &tls.Config{Certificates: ts.TLS.Certificates},
+		implicit:  implicit,
+		starttls:  starttls,
+		auth:      auth,
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		s.drop()
+	})
+	go s.serve()
+	return s, ts.Client().Transport.(*http.Transport).TLSClientConfig
+}
+
+func (s *fakeSMTP) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		if s.implicit {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// drop closes all connections as servers do with idle ones
+func (s *fakeSMTP) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeSMTP) stats() (conns int, deliveries []delivery, quits int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), append([]delivery(nil), s.deliveries...), s.quits
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	_, secure := conn.(*tls.Conn)
+	authed := false
+	from := ""
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			ext := []string{"fake"}
+			if s.starttls && !secure {
+				ext = append(ext, "STARTTLS")
+			}
+			if s.auth {
+				ext = append(ext, "AUTH PLAIN")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			authed = true
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			from = strings.TrimSuffix(strings.TrimPrefix(line[len("MAIL FROM:"):], "<"), ">")
+			tp.PrintfLine("250 ok")
+		case "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			if _, err := tp.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.deliveries = append(s.deliveries, delivery{from: from, tls: secure, authed: authed})
+			s.mu.Unlock()
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			s.mu.Lock()
+			s.quits++
+			s.mu.Unlock()
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown")
+		}
+	}
+}
+
+// sendTo sends one email to s with m
+func sendTo(m *smtpMailer, s *fakeSMTP, a smtp.Auth) error {
+	return m.SendMail(s.addr(), a, "from@example.com", []string{"to@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+}
+
+func setSMTPConfig(t *testing.T, mode string, keepAlive time.Duration) {
+	t.Helper()
+	saved := config.Config
+	t.Cleanup(func() { config.Config = saved })
+	config.Config.SMTPTLS = mode
+	config.Config.SMTPKeepAlive = keepAlive
+}
+
+func TestSmtpMailer_SendMail(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		implicit bool
+		starttls bool
+		auth     bool
+		withAuth bool
+		want     delivery
+		wantErr  bool
+	}{
+		{
+			name:     "Positive: No TLS",
+			mode:     config.SMTPTLSNone,
+			starttls: true,
+			want:     delivery{from: "from@example.com"},
+		},
+		{
+			name:     "Positive: Opportunistic STARTTLS offered",
+			mode:     config.SMTPTLSOpportunistic,
+			starttls: true,
+			want:     delivery{from: "from@example.com", tls: true},
+		},
+		{
+			name: "Positive: Opportunistic STARTTLS not offered",
+			mode: config.SMTPTLSOpportunistic,
+			want: delivery{from: "from@example.com"},
+		},
+		{
+			name:     "Positive: Required STARTTLS",
+			mode:     config.SMTPTLSStartTLS,
+			starttls: true,
+			want:     delivery{from: "from@example.com", tls: true},
+		},
+		{
+			name:    "Negative: Required STARTTLS not offered",
+			mode:    config.SMTPTLSStartTLS,
+			wantErr: true,
+		},
+		{
+			name:     "Positive: Implicit TLS",
+			mode:     config.SMTPTLSImplicit,
+			implicit: true,
+			want:     delivery{from: "from@example.com", tls: true},
+		},
+		{
+			name:     "Negative: Implicit TLS to plain server",
+			mode:     config.SMTPTLSImplicit,
+			starttls: true,
+			wantErr:  true,
+		},
+		{
+			name:     "Positive: Authentication",
+			mode:     config.SMTPTLSStartTLS,
+			starttls: true,
+			auth:     true,
+			withAuth: true,
+			want:     delivery{from: "from@example.com", tls: true, authed: true},
+		},
+		{
+			name:     "Positive: Relay without authentication",
+			mode:     config.SMTPTLSStartTLS,
+			starttls: true,
+			auth:     true,
+			want:     delivery{from: "from@example.com", tls: true},
+		},
+		{
+			name:     "Negative: Authentication not offered",
+			mode:     config.SMTPTLSStartTLS,
+			starttls: true,
+			withAuth: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSMTPConfig(t, tt.mode, 0)
+			s, tlsConfig := newFakeSMTP(t, tt.implicit, tt.starttls, tt.auth)
+			m := &smtpMailer{tlsConfig: tlsConfig}
+			var a smtp.Auth
+			if tt.withAuth {
+				a = smtp.PlainAuth("", "user", "password", "127.0.0.1")
+			}
+			err := sendTo(m, s, a)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("smtpMailer.SendMail() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			_, deliveries, _ := s.stats()
+			if len(deliveries) != 1 || deliveries[0] != tt.want {
+				t.Errorf("smtpMailer.SendMail() delivered %+v, want %+v", deliveries, tt.want)
+			}
+		})
+	}
+}
+
+func TestSmtpMailer_SendMail_reuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive time.Duration
+		drop      bool
+		wantConns int
+		wantQuits int
+	}{
+		{
+			name:      "Positive: New connection per email",
+			keepAlive: 0,
+			wantConns: 2,
+			wantQuits: 2,
+		},
+		{
+			name:      "Positive: Connection kept alive",
+			keepAlive: time.Minute,
+			wantConns: 1,
+			wantQuits: 0,
+		},
+		{
+			name:      "Positive: Redial after server closed connection",
+			keepAlive: time.Minute,
+			drop:      true,
+			wantConns: 2,
+			wantQuits: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSMTPConfig(t, config.SMTPTLSOpportunistic, tt.keepAlive)
+			s, tlsConfig := newFakeSMTP(t, false, true, false)
+			m := &smtpMailer{tlsConfig: tlsConfig}
+			defer func() {
+				m.mu.Lock()
+				m.close()
+				m.mu.Unlock()
+			}()
+			for i := 0; i < 2; i++ {
+				if err := sendTo(m, s, nil); err != nil {
+					t.Fatalf("smtpMailer.SendMail() error = %v", err)
+				}
+				if tt.drop {
+					s.drop()
+				}
+			}
+			conns, deliveries, quits := s.stats()
+			if conns != tt.wantConns || len(deliveries) != 2 || quits != tt.wantQuits {
+				t.Errorf("smtpMailer.SendMail() conns = %d, deliveries = %d, quits = %d, want %d, 2, %d",
+					conns, len(deliveries), quits, tt.wantConns, tt.wantQuits)
+			}
+		})
+	}
+}
+
+func TestSmtpMailer_closeIdle(t *testing.T) {
+	setSMTPConfig(t, config.SMTPTLSNone, 10*time.Millisecond)
+	s, _ := newFakeSMTP(t, false, false, false)
+	m := &smtpMailer{}
+	if err := sendTo(m, s, nil); err != nil {
+		t.Fatalf("smtpMailer.SendMail() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, quits := s.stats(); quits == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		t.Error("smtpMailer keeps the closed client")
+	}
+}
+
+func Test_tlsMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		port string
+		want string
+	}{
+		{config.SMTPTLSAuto, "465", config.SMTPTLSImplicit},
+		{config.SMTPTLSAuto, "587", config.SMTPTLSOpportunistic},
+		{"", "25", config.SMTPTLSOpportunistic},
+		{config.SMTPTLSStartTLS, "465", config.SMTPTLSStartTLS},
+		{config.SMTPTLSNone, "587", config.SMTPTLSNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.port, func(t *testing.T) {
+			if got := tlsMode(tt.mode, tt.port); got != tt.want {
+				t.Errorf("tlsMode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mailer
+
+import (
+	"bytes"
+	html "html/template"
+	text "text/template"
+)
+
+// Templates, one per event
+const (
+	TemplateGeneric         = "notification"
+	TemplateSignUp          = "signup"
+	TemplateResetPassword   = "reset_password"
+	TemplateVerifyEmail     = "verify_email"
+	TemplateEmailChanged    = "email_changed"
+	TemplateLockout         = "lockout"
+	TemplatePasswordChanged = "password_changed"
+	TemplateStatusChange    = "status_change"
+	TemplateDigest          = "digest"
+)
+
+const greetingText = "Hello!"
+const footerText = "This is automated message. Please do not reply."
+
+type mailTemplate struct {
+	subject *text.Template
+	text    *text.Template
+	html    *html.Template
+}
+
+// Bodies are wrapped into the greeting and the footer
+const textLayout = greetingText + "\n\n{{template \"body\" .}}\n\n" + footerText + "\n"
+const htmlLayout = `<!DOCTYPE html>
+<html><body>
+<p>` + greetingText + `</p>
+{{template "body" .}}
+<p><small>` + footerText + `</small></p>
+</body></html>
+`
+
+var templates = map[string]mailTemplate{
+	TemplateGeneric: newTemplate(
+		`Notification from GC-Tracker`,
+		`{{.Text}}`,
+		`<p style="white-space: pre-line">{{.Text}}</p>`),
+	TemplateSignUp: newTemplate(
+		`Welcome to GC-Tracker, {{.Username}}`,
+		`Your account '{{.Username}}' has been created.`,
+		`<p>Your account <b>{{.Username}}</b> has been created.</p>`),
+	TemplateResetPassword: newTemplate(
+		`Reset your GC-Tracker password`,
+		`Please follow the link {{.Link}} to reset your password.`,
+		`<p>Please follow <a href="{{.Link}}">this link</a> to reset your password.</p>`),
+	TemplateVerifyEmail: newTemplate(
+		`Confirm your GC-Tracker email address`,
+		`Please follow the link {{.Link}} to confirm the email address of your account '{{.Username}}'.`,
+		`<p>Please follow <a href="{{.Link}}">this link</a> to confirm the email address of your account <b>{{.Username}}</b>.</p>`),
+	TemplateEmailChanged: newTemplate(
+		`Your GC-Tracker email address has been changed`,
+		`{{.Text}}`,
+		`<p>{{.Text}}</p>`),
+	TemplateLockout: newTemplate(
+		`Sign in to your GC-Tracker account has been blocked`,
+		`{{.Text}}`,
+		`<p>{{.Text}}</p>`),
+	TemplatePasswordChanged: newTemplate(
+		`Your GC-Tracker password has been changed`,
+		`Your password has been changed.`,
+		`<p>Your password has been changed.</p>`),
+	TemplateStatusChange: newTemplate(
+		`{{.CaseID}}: {{.NewStatus}}`,
+		`Your case {{.CaseName}} ({{.CaseID}}) status has changed from {{with .OldStatus}}{{.}}{{else}}none{{end}} to {{.NewStatus}}.`,
+		`<p>Your case <b>{{.CaseName}}</b> ({{.CaseID}}) status has changed</p>
+<p>from <i>{{with .OldStatus}}{{.}}{{else}}none{{end}}</i><br>to <b>{{.NewStatus}}</b></p>`),
+	TemplateDigest: newTemplate(
+		`Status changes of your cases`,
+		`{{.Text}}`,
+		`<p style="white-space: pre-line">{{.Text}}</p>`),
+}
+
+func newTemplate(subject, textBody, htmlBody string) mailTemplate {
+	return mailTemplate{
+		subject: text.Must(text.New("subject").Parse(subject)),
+		text:    text.Must(text.Must(text.New("text").Parse(textLayout)).New("body").Parse(textBody)),
+		html:    html.Must(html.Must(html.New("html").Parse(htmlLayout)).New("body").Parse(htmlBody)),
+	}
+}
+
+// render returns the subject, the text and the HTML body of m
+func render(m Message) (string, string, string, error) {
+	t := templates[m.Template]
+	var subject, textBody, htmlBody bytes.Buffer
+	if err := t.subject.Execute(&subject, m); err != nil {
+		return "", "", "", err
+	}
+	if err := t.text.ExecuteTemplate(&textBody, "text", m); err != nil {
+		return "", "", "", err
+	}
+	if err := t.html.ExecuteTemplate(&htmlBody, "html", m); err != nil {
+		return "", "", "", err
+	}
+	return subject.String(), textBody.String(), htmlBody.String(), nil
+}
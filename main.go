@@ -16,11 +16,14 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 
 	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/data"
 	"github.com/batk0/gc-tracker/handlers"
+	"github.com/batk0/gc-tracker/service"
 )
 
 func main() {
@@ -29,15 +32,32 @@ func main() {
 		log.Fatalln(err.Error())
 	}
 
-	gcTracker := handlers.NewGCTrackerServer(nil)
+	// Storage clients are shared by all requests
+	storage, err := data.NewGCTrackerData(context.Background())
+	if err != nil {
+		log.Fatalln("Cannot open storage: " + err.Error())
+	}
+
+	gcTrackerService := service.NewGCTrackerService(storage)
+	gcTrackerService.StartScheduler(context.Background(), config.Config.UpdateInterval, config.Config.UpdateJitter)
+	gcTrackerService.StartOutbox(context.Background(), config.Config.OutboxInterval)
+
+	gcTracker := handlers.NewGCTrackerServer(gcTrackerService)
 	http.HandleFunc("/", gcTracker.IndexHandler)
 	http.HandleFunc("/resetpwd", gcTracker.ResetPwdHandler)
 	http.HandleFunc("/changepwd", gcTracker.ChangePwdHandler)
 	http.HandleFunc("/signup", gcTracker.SignUpHandler)
 	http.HandleFunc("/signin", gcTracker.SignInHandler)
+	http.HandleFunc("/signin/2fa", gcTracker.SignInTwoFactorHandler)
 	http.HandleFunc("/signout", gcTracker.SignOutHandler)
+	http.HandleFunc("/verify", gcTracker.VerifyHandler)
 	http.HandleFunc("/case", gcTracker.CaseHandler)
+	http.HandleFunc("/settings", gcTracker.SettingsHandler)
+	http.HandleFunc("/account", gcTracker.AccountHandler)
+	http.HandleFunc("/twofactor", gcTracker.TwoFactorHandler)
+	http.HandleFunc("/notifications", gcTracker.OutboxHandler)
 	http.HandleFunc("/update", gcTracker.UpdateHandler)
+	http.HandleFunc("/update/status", gcTracker.UpdateStatusHandler)
 	http.HandleFunc("/users", gcTracker.UsersHandler)
 	http.HandleFunc("/style.css", gcTracker.StyleHandler)
 	log.Printf("Listening at %s", config.Config.Port)
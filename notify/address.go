@@ -0,0 +1,116 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+)
+
+// ErrPrivateHost is returned for webhook and chat URLs which point to the
+// tracker's own network, unless config.Config.NotifyPrivateHosts is set
+var ErrPrivateHost = errors.New("host is not a public address")
+
+// privateNetworks are loopback, private, link-local, shared, multicast and
+// reserved ranges, cloud metadata services live among them
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// metadataHosts are names of cloud metadata services
+var metadataHosts = []string{"metadata", "metadata.google.internal", "instance-data"}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// PublicIP tells whether ip may be reached by webhooks and chats
+func PublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost refuses localhost, metadata service names and addresses which
+// are not public. Other names are only checked once resolved, when the
+// request is sent.
+func CheckHost(host string) error {
+	if config.Config.NotifyPrivateHosts {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return ErrPrivateHost
+	}
+	for _, m := range metadataHosts {
+		if name == m {
+			return ErrPrivateHost
+		}
+	}
+	if ip := net.ParseIP(strings.Trim(name, "[]")); ip != nil && !PublicIP(ip) {
+		return ErrPrivateHost
+	}
+	return nil
+}
+
+// dialControl refuses connections to addresses which are not public, after
+// resolution and on every redirect
+func dialControl(network, address string, c syscall.RawConn) error {
+	if config.Config.NotifyPrivateHosts {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+		return ErrPrivateHost
+	}
+	return nil
+}
+
+// client is shared by webhooks and chats. It takes no proxy from the
+// environment, which would hide the address it connects to.
+var client = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, Control: dialControl}).DialContext
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}()
+
+func newClient() *http.Client { return client }
@@ -0,0 +1,88 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/batk0/gc-tracker/config"
+)
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: "hooks.slack.com", wantErr: false},
+		{host: "93.184.216.34", wantErr: false},
+		{host: "2606:2800:220:1:248:1893:25c8:1946", wantErr: false},
+		{host: "localhost", wantErr: true},
+		{host: "api.localhost", wantErr: true},
+		{host: "127.0.0.1", wantErr: true},
+		{host: "::1", wantErr: true},
+		{host: "::ffff:127.0.0.1", wantErr: true},
+		{host: "10.1.2.3", wantErr: true},
+		{host: "172.16.0.1", wantErr: true},
+		{host: "192.168.1.1", wantErr: true},
+		{host: "100.64.0.1", wantErr: true},
+		{host: "169.254.169.254", wantErr: true},
+		{host: "fd00:ec2::254", wantErr: true},
+		{host: "fe80::1", wantErr: true},
+		{host: "0.0.0.0", wantErr: true},
+		{host: "metadata.google.internal.", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if err := CheckHost(tt.host); (err != nil) != tt.wantErr {
+				t.Errorf("CheckHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckHost_Allowed(t *testing.T) {
+	allowPrivateHosts(t)
+	if err := CheckHost("127.0.0.1"); err != nil {
+		t.Errorf("CheckHost() with private hosts allowed error = %v", err)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	if !PublicIP(net.ParseIP("8.8.8.8")) || PublicIP(net.ParseIP("192.168.0.1")) {
+		t.Errorf("PublicIP() does not tell public from private addresses")
+	}
+}
+
+func TestWebhook_Notify_PrivateHost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("webhook reached the private host")
+	}))
+	defer ts.Close()
+
+	// Name resolution or a redirect may lead anywhere, the address is
+	// checked once connecting
+	defer func(allow bool) { config.Config.NotifyPrivateHosts = allow }(config.Config.NotifyPrivateHosts)
+	config.Config.NotifyPrivateHosts = false
+	err := NewWebhook(ts.URL, "secret").Notify(context.Background(), Notification{Event: EventAccount})
+	if !errors.Is(err, ErrPrivateHost) {
+		t.Errorf("Webhook.Notify() error = %v, want %v", err, ErrPrivateHost)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Chat services with incoming webhooks
+const (
+	ChatSlack   = "slack"
+	ChatDiscord = "discord"
+	ChatMatrix  = "matrix"
+)
+
+// chatMaxItems caps the digest entries of a chat message, chat services
+// reject too large messages
+const chatMaxItems = 20
+
+// NewChat returns the notifier of the chat service. Slack and Discord only
+// need the incoming webhook URL, Matrix also needs an access token.
+func NewChat(service, url, token string) (Notifier, error) {
+	switch service {
+	case ChatSlack:
+		return NewSlack(url), nil
+	case ChatDiscord:
+		return NewDiscord(url), nil
+	case ChatMatrix:
+		if token == "" {
+			return nil, errors.New("matrix needs an access token")
+		}
+		return NewMatrix(url, token), nil
+	}
+	return nil, errors.New("unknown chat service " + service)
+}
+
+func chatTitle(n Notification) string {
+	switch n.Event {
+	case EventStatusChange:
+		return "Case status changed"
+	case EventDigest:
+		for _, item := range n.Items {
+			if item.Event == EventStatusChange {
+				return "Status changes of your cases"
+			}
+		}
+	case EventSignUp:
+		return "Welcome to GC Tracker"
+	}
+	return "GC Tracker"
+}
+
+// caseLabel is the case name with the receipt number, or the receipt
+// number alone
+func caseLabel(n Notification) string {
+	if n.CaseName == "" {
+		return n.CaseID
+	}
+	return n.CaseName + " (" + n.CaseID + ")"
+}
+
+// StatusOrNone is the status as shown in messages, "none" before the first
+// check
+func StatusOrNone(status string) string {
+	if status == "" {
+		return "none"
+	}
+	return status
+}
+
+func statusChange(n Notification) string {
+	return StatusOrNone(n.OldStatus) + " → " + n.NewStatus
+}
+
+// chatItems are the digest entries to show and a note about the rest
+func chatItems(n Notification) ([]Notification, string) {
+	if len(n.Items) <= chatMaxItems {
+		return n.Items, ""
+	}
+	return n.Items[:chatMaxItems], fmt.Sprintf("and %d more", len(n.Items)-chatMaxItems)
+}
+
+// Slack posts notifications to a Slack incoming webhook with Block Kit
+// formatting
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewSlack(url string) *Slack { return &Slack{URL: url, Client: newClient()} }
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func slackSection(text string) slackBlock {
+	return slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: slackEscaper.Replace(text)}}
+}
+
+func slackStatus(n Notification) slackBlock {
+	return slackBlock{Type: "section", Fields: []slackText{
+		{Type: "mrkdwn", Text: "*Case*\n" + slackEscaper.Replace(caseLabel(n))},
+		{Type: "mrkdwn", Text: "*Status*\n" + slackEscaper.Replace(statusChange(n))},
+	}}
+}
+
+func newSlackMessage(n Notification) slackMessage {
+	m := slackMessage{
+		Text:   n.Message,
+		Blocks: []slackBlock{{Type: "header", Text: &slackText{Type: "plain_text", Text: chatTitle(n)}}},
+	}
+	switch n.Event {
+	case EventStatusChange:
+		m.Blocks = append(m.Blocks, slackStatus(n))
+	case EventDigest:
+		items, more := chatItems(n)
+		for _, item := range items {
+			if item.Event == EventStatusChange {
+				m.Blocks = append(m.Blocks, slackStatus(item))
+			} else {
+				m.Blocks = append(m.Blocks, slackSection(item.Message))
+			}
+		}
+		if more != "" {
+			m.Blocks = append(m.Blocks, slackSection(more))
+		}
+	default:
+		m.Blocks = append(m.Blocks, slackSection(n.Message))
+	}
+	return m
+}
+
+func (s *Slack) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, s.Client, http.MethodPost, s.URL, nil, newSlackMessage(n))
+}
+
+// Discord posts notifications to a Discord webhook as an embed
+type Discord struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewDiscord(url string) *Discord { return &Discord{URL: url, Client: newClient()} }
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+func newDiscordMessage(n Notification) discordMessage {
+	e := discordEmbed{Title: chatTitle(n)}
+	if !n.Time.IsZero() {
+		e.Timestamp = n.Time.UTC().Format(time.RFC3339)
+	}
+	switch n.Event {
+	case EventStatusChange:
+		e.Fields = []discordField{
+			{Name: "Case", Value: caseLabel(n)},
+			{Name: "Old status", Value: StatusOrNone(n.OldStatus), Inline: true},
+			{Name: "New status", Value: n.NewStatus, Inline: true},
+		}
+	case EventDigest:
+		items, more := chatItems(n)
+		var messages []string
+		for _, item := range items {
+			if item.Event == EventStatusChange {
+				e.Fields = append(e.Fields, discordField{Name: caseLabel(item), Value: statusChange(item)})
+			} else {
+				messages = append(messages, item.Message)
+			}
+		}
+		if more != "" {
+			messages = append(messages, more)
+		}
+		e.Description = strings.Join(messages, "\n\n")
+	default:
+		e.Description = n.Message
+	}
+	return discordMessage{Embeds: []discordEmbed{e}}
+}
+
+func (d *Discord) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, d.Client, http.MethodPost, d.URL, nil, newDiscordMessage(n))
+}
+
+// Matrix sends notifications as m.room.message events. URL is the send
+// endpoint of the room, e.g.
+// https://matrix.example.org/_matrix/client/v3/rooms/!room:example.org/send/m.room.message
+type Matrix struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func NewMatrix(url, token string) *Matrix {
+	return &Matrix{URL: url, Token: token, Client: newClient()}
+}
+
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+func newMatrixMessage(n Notification) matrixMessage {
+	title := chatTitle(n)
+	var lines, htmlLines []string
+	add := func(item Notification) {
+		if item.Event == EventStatusChange {
+			lines = append(lines, caseLabel(item)+": "+statusChange(item))
+			htmlLines = append(htmlLines, "<b>"+html.EscapeString(caseLabel(item))+"</b>: "+html.EscapeString(statusChange(item)))
+		} else {
+			lines = append(lines, item.Message)
+			htmlLines = append(htmlLines, html.EscapeString(item.Message))
+		}
+	}
+	if n.Event == EventDigest {
+		items, more := chatItems(n)
+		for _, item := range items {
+			add(item)
+		}
+		if more != "" {
+			lines = append(lines, more)
+			htmlLines = append(htmlLines, more)
+		}
+	} else {
+		add(n)
+	}
+	return matrixMessage{
+		MsgType:       "m.text",
+		Body:          title + "\n\n" + strings.Join(lines, "\n"),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: "<h4>" + html.EscapeString(title) + "</h4><ul><li>" + strings.Join(htmlLines, "</li><li>") + "</li></ul>",
+	}
+}
+
+// transactionID is derived from the ID of n, so that homeservers drop a
+// retry of an event they have already got. Notifications without an ID get
+// a random one.
+func transactionID(n Notification) string {
+	if n.ID != "" {
+		sum := sha256.Sum256([]byte(n.ID))
+		return hex.EncodeToString(sum[:16])
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (m *Matrix) Notify(ctx context.Context, n Notification) error {
+	header := http.Header{"Authorization": []string{"Bearer " + m.Token}}
+	url := strings.TrimSuffix(m.URL, "/") + "/" + transactionID(n)
+	return postJSON(ctx, m.Client, http.MethodPut, url, header, newMatrixMessage(n))
+}
@@ -0,0 +1,274 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	chatTime   = time.Unix(1600000000, 0)
+	chatStatus = Notification{Event: EventStatusChange, Username: "alice", Message: "msg", CaseID: "ABC0000000001", CaseName: "first", NewStatus: "Case Was Approved", Time: chatTime}
+	chatDigest = Notification{Event: EventDigest, Username: "alice", Message: "msg", Time: chatTime, Items: []Notification{
+		{Event: EventStatusChange, CaseID: "ABC0000000001", OldStatus: "Case Was Received", NewStatus: "Case Was Approved"},
+		{Event: EventPasswordChanged, Message: "Your password has been changed."},
+	}}
+	chatAccount = Notification{Event: EventSignUp, Username: "alice", Message: "Your account <alice> has been created.", Time: chatTime}
+)
+
+// chatServer is a stand-in chat service which decodes requests into v
+func chatServer(t *testing.T, method string, v interface{}) (*httptest.Server, *http.Request) {
+	t.Helper()
+	allowPrivateHosts(t)
+	got := &http.Request{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = *r
+		if r.Method != method {
+			t.Errorf("chat method = %v, want %v", r.Method, method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("chat Content-Type = %v, want application/json", ct)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Errorf("chat payload error = %v", err)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, got
+}
+
+func TestSlack_Notify(t *testing.T) {
+	tests := []struct {
+		name string
+		n    Notification
+		want slackMessage
+	}{
+		{
+			name: "Status change",
+			n:    chatStatus,
+			want: slackMessage{Text: "msg", Blocks: []slackBlock{
+				{Type: "header", Text: &slackText{Type: "plain_text", Text: "Case status changed"}},
+				{Type: "section", Fields: []slackText{
+					{Type: "mrkdwn", Text: "*Case*\nfirst (ABC0000000001)"},
+					{Type: "mrkdwn", Text: "*Status*\nnone → Case Was Approved"},
+				}},
+			}},
+		},
+		{
+			name: "Digest",
+			n:    chatDigest,
+			want: slackMessage{Text: "msg", Blocks: []slackBlock{
+				{Type: "header", Text: &slackText{Type: "plain_text", Text: "Status changes of your cases"}},
+				{Type: "section", Fields: []slackText{
+					{Type: "mrkdwn", Text: "*Case*\nABC0000000001"},
+					{Type: "mrkdwn", Text: "*Status*\nCase Was Received → Case Was Approved"},
+				}},
+				{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "Your password has been changed."}},
+			}},
+		},
+		{
+			name: "Account event",
+			n:    chatAccount,
+			want: slackMessage{Text: "Your account <alice> has been created.", Blocks: []slackBlock{
+				{Type: "header", Text: &slackText{Type: "plain_text", Text: "Welcome to GC Tracker"}},
+				{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "Your account &lt;alice&gt; has been created."}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got slackMessage
+			ts, _ := chatServer(t, http.MethodPost, &got)
+			if err := NewSlack(ts.URL).Notify(context.Background(), tt.n); err != nil {
+				t.Fatalf("Slack.Notify() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Slack.Notify() payload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscord_Notify(t *testing.T) {
+	tests := []struct {
+		name string
+		n    Notification
+		want discordMessage
+	}{
+		{
+			name: "Status change",
+			n:    chatStatus,
+			want: discordMessage{Embeds: []discordEmbed{{
+				Title: "Case status changed",
+				Fields: []discordField{
+					{Name: "Case", Value: "first (ABC0000000001)"},
+					{Name: "Old status", Value: "none", Inline: true},
+					{Name: "New status", Value: "Case Was Approved", Inline: true},
+				},
+				Timestamp: "2020-09-13T12:26:40Z",
+			}}},
+		},
+		{
+			name: "Digest",
+			n:    chatDigest,
+			want: discordMessage{Embeds: []discordEmbed{{
+				Title:       "Status changes of your cases",
+				Description: "Your password has been changed.",
+				Fields:      []discordField{{Name: "ABC0000000001", Value: "Case Was Received → Case Was Approved"}},
+				Timestamp:   "2020-09-13T12:26:40Z",
+			}}},
+		},
+		{
+			name: "Account event",
+			n:    chatAccount,
+			want: discordMessage{Embeds: []discordEmbed{{
+				Title:       "Welcome to GC Tracker",
+				Description: "Your account <alice> has been created.",
+				Timestamp:   "2020-09-13T12:26:40Z",
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got discordMessage
+			ts, _ := chatServer(t, http.MethodPost, &got)
+			if err := NewDiscord(ts.URL).Notify(context.Background(), tt.n); err != nil {
+				t.Fatalf("Discord.Notify() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Discord.Notify() payload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatrix_Notify(t *testing.T) {
+	tests := []struct {
+		name string
+		n    Notification
+		want matrixMessage
+	}{
+		{
+			name: "Status change",
+			n:    chatStatus,
+			want: matrixMessage{
+				MsgType:       "m.text",
+				Body:          "Case status changed\n\nfirst (ABC0000000001): none → Case Was Approved",
+				Format:        "org.matrix.custom.html",
+				FormattedBody: "<h4>Case status changed</h4><ul><li><b>first (ABC0000000001)</b>: none → Case Was Approved</li></ul>",
+			},
+		},
+		{
+			name: "Digest",
+			n:    chatDigest,
+			want: matrixMessage{
+				MsgType:       "m.text",
+				Body:          "Status changes of your cases\n\nABC0000000001: Case Was Received → Case Was Approved\nYour password has been changed.",
+				Format:        "org.matrix.custom.html",
+				FormattedBody: "<h4>Status changes of your cases</h4><ul><li><b>ABC0000000001</b>: Case Was Received → Case Was Approved</li><li>Your password has been changed.</li></ul>",
+			},
+		},
+		{
+			name: "Account event",
+			n:    chatAccount,
+			want: matrixMessage{
+				MsgType:       "m.text",
+				Body:          "Welcome to GC Tracker\n\nYour account <alice> has been created.",
+				Format:        "org.matrix.custom.html",
+				FormattedBody: "<h4>Welcome to GC Tracker</h4><ul><li>Your account &lt;alice&gt; has been created.</li></ul>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got matrixMessage
+			ts, r := chatServer(t, http.MethodPut, &got)
+			send := "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message"
+			if err := NewMatrix(ts.URL+send, "token").Notify(context.Background(), tt.n); err != nil {
+				t.Fatalf("Matrix.Notify() error = %v", err)
+			}
+			if !strings.HasPrefix(r.URL.Path, send+"/") || len(r.URL.Path) == len(send)+1 {
+				t.Errorf("Matrix.Notify() path = %v, want a transaction ID after %v", r.URL.Path, send)
+			}
+			if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+				t.Errorf("Matrix.Notify() Authorization = %v, want Bearer token", auth)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Matrix.Notify() payload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_transactionID(t *testing.T) {
+	first := Notification{ID: "1-1600000000"}
+	if transactionID(first) != transactionID(first) {
+		t.Errorf("transactionID() differs between attempts of %+v", first)
+	}
+	if transactionID(first) == transactionID(Notification{ID: "2-1600000000"}) {
+		t.Errorf("transactionID() is the same for other notifications")
+	}
+	if transactionID(Notification{}) == transactionID(Notification{}) {
+		t.Errorf("transactionID() without ID is not random")
+	}
+}
+
+func TestNewChat(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		token   string
+		want    Notifier
+		wantErr bool
+	}{
+		{name: "Slack", service: ChatSlack, want: &Slack{URL: "https://example.com", Client: newClient()}},
+		{name: "Discord", service: ChatDiscord, want: &Discord{URL: "https://example.com", Client: newClient()}},
+		{name: "Matrix", service: ChatMatrix, token: "token", want: &Matrix{URL: "https://example.com", Token: "token", Client: newClient()}},
+		{name: "Matrix without token", service: ChatMatrix, wantErr: true},
+		{name: "Unknown", service: "irc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewChat(tt.service, "https://example.com", tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewChat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewChat() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatItems(t *testing.T) {
+	n := Notification{Event: EventDigest}
+	for i := 0; i < chatMaxItems+3; i++ {
+		n.Items = append(n.Items, Notification{Event: EventAccount})
+	}
+	items, more := chatItems(n)
+	if len(items) != chatMaxItems || more != "and 3 more" {
+		t.Errorf("chatItems() = %d items, %q", len(items), more)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"context"
+
+	"github.com/batk0/gc-tracker/mailer"
+)
+
+// Email sends notifications by SMTP
+type Email struct {
+	To string
+}
+
+func NewEmail(to string) *Email { return &Email{To: to} }
+
+func (e *Email) Notify(ctx context.Context, n Notification) error {
+	return mailer.Send(e.To, emailMessage(n))
+}
+
+// emailMessage picks the mailer template for the event
+func emailMessage(n Notification) mailer.Message {
+	m := mailer.Message{
+		Template:  mailer.TemplateGeneric,
+		Text:      n.Message,
+		Username:  n.Username,
+		Link:      n.Link,
+		CaseID:    n.CaseID,
+		CaseName:  n.CaseName,
+		OldStatus: n.OldStatus,
+		NewStatus: n.NewStatus,
+	}
+	switch n.Event {
+	case EventStatusChange:
+		m.Template = mailer.TemplateStatusChange
+	case EventSignUp:
+		m.Template = mailer.TemplateSignUp
+	case EventPasswordChanged:
+		m.Template = mailer.TemplatePasswordChanged
+	case EventPasswordReset:
+		m.Template = mailer.TemplateResetPassword
+	case EventVerifyEmail:
+		m.Template = mailer.TemplateVerifyEmail
+	case EventEmailChanged:
+		m.Template = mailer.TemplateEmailChanged
+	case EventLockout:
+		m.Template = mailer.TemplateLockout
+	case EventDigest:
+		// Notifications held for quiet hours may have no status changes
+		for _, item := range n.Items {
+			if item.Event == EventStatusChange {
+				m.Template = mailer.TemplateDigest
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/batk0/gc-tracker/mailer"
+)
+
+func Test_emailMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		n    Notification
+		want mailer.Message
+	}{
+		{
+			name: "Status change",
+			n:    Notification{Username: "alice", Event: EventStatusChange, Message: "msg", CaseID: "ABC0000000001", CaseName: "first", OldStatus: "received", NewStatus: "approved"},
+			want: mailer.Message{Template: mailer.TemplateStatusChange, Text: "msg", Username: "alice", CaseID: "ABC0000000001", CaseName: "first", OldStatus: "received", NewStatus: "approved"},
+		},
+		{
+			name: "Sign up",
+			n:    Notification{Username: "alice", Event: EventSignUp, Message: "msg"},
+			want: mailer.Message{Template: mailer.TemplateSignUp, Text: "msg", Username: "alice"},
+		},
+		{
+			name: "Password changed",
+			n:    Notification{Username: "alice", Event: EventPasswordChanged, Message: "msg"},
+			want: mailer.Message{Template: mailer.TemplatePasswordChanged, Text: "msg", Username: "alice"},
+		},
+		{
+			name: "Password reset",
+			n:    Notification{Username: "alice", Event: EventPasswordReset, Message: "msg", Link: "https://example.com/changepwd"},
+			want: mailer.Message{Template: mailer.TemplateResetPassword, Text: "msg", Username: "alice", Link: "https://example.com/changepwd"},
+		},
+		{
+			name: "Email verification",
+			n:    Notification{Username: "alice", Event: EventVerifyEmail, Message: "msg", Link: "https://example.com/verify"},
+			want: mailer.Message{Template: mailer.TemplateVerifyEmail, Text: "msg", Username: "alice", Link: "https://example.com/verify"},
+		},
+		{
+			name: "Email changed",
+			n:    Notification{Username: "alice", Event: EventEmailChanged, Message: "msg", To: "old@example.com"},
+			want: mailer.Message{Template: mailer.TemplateEmailChanged, Text: "msg", Username: "alice"},
+		},
+		{
+			name: "Lockout",
+			n:    Notification{Username: "alice", Event: EventLockout, Message: "msg"},
+			want: mailer.Message{Template: mailer.TemplateLockout, Text: "msg", Username: "alice"},
+		},
+		{
+			name: "Other account event",
+			n:    Notification{Username: "alice", Event: EventAccount, Message: "msg"},
+			want: mailer.Message{Template: mailer.TemplateGeneric, Text: "msg", Username: "alice"},
+		},
+		{
+			name: "Digest",
+			n:    Notification{Username: "alice", Event: EventDigest, Message: "msg", Items: []Notification{{Event: EventStatusChange}, {Event: EventAccount}}},
+			want: mailer.Message{Template: mailer.TemplateDigest, Text: "msg", Username: "alice"},
+		},
+		{
+			name: "Held account events",
+			n:    Notification{Username: "alice", Event: EventDigest, Message: "msg", Items: []Notification{{Event: EventAccount}, {Event: EventSignUp}}},
+			want: mailer.Message{Template: mailer.TemplateGeneric, Text: "msg", Username: "alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := emailMessage(tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("emailMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package notify delivers notifications to users over their channels
+package notify
+
+import (
+	"context"
+	"time"
+)
+
+// Events users get notified about
+const (
+	EventStatusChange = "status"
+	// Account events without a template of their own
+	EventAccount         = "account"
+	EventSignUp          = "signup"
+	EventPasswordChanged = "password"
+	EventPasswordReset   = "reset"
+	EventVerifyEmail     = "verify"
+	EventEmailChanged    = "email"
+	EventLockout         = "lockout"
+	// Digest of status changes, or notifications held for quiet hours,
+	// in Items
+	EventDigest = "digest"
+)
+
+// Notification tells a user about an event. Status changes also carry the
+// case and both statuses.
+type Notification struct {
+	// ID stays the same on every attempt to deliver the notification
+	ID       string
+	Event    string
+	Username string
+	Message  string
+	CaseID   string
+	CaseName string
+	// OldStatus is empty before the first check
+	OldStatus string
+	NewStatus string
+	Link      string
+	// To is the email address of security events when it is not the
+	// user's, e.g. the new address before it is confirmed
+	To    string
+	Time  time.Time
+	Items []Notification
+}
+
+// Notifier is a channel notifications are delivered to
+type Notifier interface {
+	Notify(context.Context, Notification) error
+}
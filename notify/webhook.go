@@ -0,0 +1,132 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the request
+// body keyed with the user's webhook secret
+const SignatureHeader = "X-GC-Tracker-Signature"
+
+// EventHeader carries the event of the payload
+const EventHeader = "X-GC-Tracker-Event"
+
+// Webhook posts notifications as JSON to a URL of the user's choice
+type Webhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{URL: url, Secret: secret, Client: newClient()}
+}
+
+// WebhookPayload is the body of webhook requests. Timestamps are Unix
+// seconds.
+type WebhookPayload struct {
+	Event     string           `json:"event"`
+	Username  string           `json:"username"`
+	Message   string           `json:"message"`
+	CaseID    string           `json:"caseId,omitempty"`
+	CaseName  string           `json:"caseName,omitempty"`
+	OldStatus string           `json:"oldStatus,omitempty"`
+	NewStatus string           `json:"newStatus,omitempty"`
+	Timestamp int64            `json:"timestamp"`
+	Items     []WebhookPayload `json:"items,omitempty"`
+}
+
+func newWebhookPayload(n Notification) WebhookPayload {
+	p := WebhookPayload{
+		Event:     n.Event,
+		Username:  n.Username,
+		Message:   n.Message,
+		CaseID:    n.CaseID,
+		CaseName:  n.CaseName,
+		OldStatus: n.OldStatus,
+		NewStatus: n.NewStatus,
+		Timestamp: n.Time.Unix(),
+	}
+	for _, item := range n.Items {
+		p.Items = append(p.Items, newWebhookPayload(item))
+	}
+	return p
+}
+
+// Sign returns the value of SignatureHeader for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(newWebhookPayload(n))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, n.Event)
+	req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	return do(w.Client, req)
+}
+
+// do sends req with client, anything but 2xx is an error
+func do(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(req.URL.Host + " responded " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// postJSON sends v as JSON with method to url
+func postJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(client, req)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+)
+
+// allowPrivateHosts lets the test reach its local stand-in servers
+func allowPrivateHosts(t *testing.T) {
+	t.Helper()
+	allow := config.Config.NotifyPrivateHosts
+	t.Cleanup(func() { config.Config.NotifyPrivateHosts = allow })
+	config.Config.NotifyPrivateHosts = true
+}
+
+func TestWebhook_Notify(t *testing.T) {
+	allowPrivateHosts(t)
+	at := time.Unix(1600000000, 0)
+	tests := []struct {
+		name    string
+		n       Notification
+		status  int
+		want    WebhookPayload
+		wantErr bool
+	}{
+		{
+			name:   "Status change",
+			n:      Notification{Event: EventStatusChange, Username: "alice", Message: "msg", CaseID: "ABC0000000001", CaseName: "first", OldStatus: "received", NewStatus: "approved", Time: at},
+			status: http.StatusOK,
+			want:   WebhookPayload{Event: EventStatusChange, Username: "alice", Message: "msg", CaseID: "ABC0000000001", CaseName: "first", OldStatus: "received", NewStatus: "approved", Timestamp: 1600000000},
+		},
+		{
+			name: "Digest",
+			n: Notification{Event: EventDigest, Username: "alice", Message: "msg", Time: at, Items: []Notification{
+				{Event: EventStatusChange, Username: "alice", CaseID: "ABC0000000001", NewStatus: "approved", Time: at},
+			}},
+			status: http.StatusNoContent,
+			want: WebhookPayload{Event: EventDigest, Username: "alice", Message: "msg", Timestamp: 1600000000, Items: []WebhookPayload{
+				{Event: EventStatusChange, Username: "alice", CaseID: "ABC0000000001", NewStatus: "approved", Timestamp: 1600000000},
+			}},
+		},
+		{
+			name:    "Error response",
+			n:       Notification{Event: EventAccount, Username: "alice", Message: "msg", Time: at},
+			status:  http.StatusInternalServerError,
+			want:    WebhookPayload{Event: EventAccount, Username: "alice", Message: "msg", Timestamp: 1600000000},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got WebhookPayload
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if r.Method != http.MethodPost {
+					t.Errorf("webhook method = %v, want POST", r.Method)
+				}
+				if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+					t.Errorf("webhook Content-Type = %v, want application/json", ct)
+				}
+				if event := r.Header.Get(EventHeader); event != tt.n.Event {
+					t.Errorf("webhook %s = %v, want %v", EventHeader, event, tt.n.Event)
+				}
+				if sig := r.Header.Get(SignatureHeader); sig != Sign("secret", body) {
+					t.Errorf("webhook %s = %v, want %v", SignatureHeader, sig, Sign("secret", body))
+				}
+				if err := json.Unmarshal(body, &got); err != nil {
+					t.Errorf("webhook payload error = %v", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer ts.Close()
+
+			err := NewWebhook(ts.URL, "secret").Notify(context.Background(), tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Webhook.Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Webhook.Notify() payload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13"
+	if got := Sign("secret", []byte("{}")); got != want {
+		t.Errorf("Sign() = %v, want %v", got, want)
+	}
+}
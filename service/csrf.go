@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+)
+
+// CSRFField is the form field carrying the CSRF token
+const CSRFField = "csrf"
+
+// csrfKey is the session value with the CSRF token
+const csrfKey = "csrfToken"
+
+// CSRFToken returns the token forms of the session post back. A new token
+// is put into the session if it has none yet, see SaveSession.
+func (s *GCTrackerService) CSRFToken(ctx context.Context) string {
+	session := getSession(ctx)
+	if session == nil {
+		return ""
+	}
+	if token, ok := session.Values[csrfKey].(string); ok && token != "" {
+		return token
+	}
+	if session.Values == nil {
+		session.Values = map[interface{}]interface{}{}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("Cannot generate CSRF token: " + err.Error())
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session.Values[csrfKey] = token
+	return token
+}
+
+// CheckCSRF tells whether token is the CSRF token of the session
+func (s *GCTrackerService) CheckCSRF(ctx context.Context, token string) bool {
+	session := getSession(ctx)
+	if session == nil || token == "" {
+		return false
+	}
+	want, ok := session.Values[csrfKey].(string)
+	return ok && want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// csrfInput is put into every form
+func (s *GCTrackerService) csrfInput(ctx context.Context) string {
+	return `<input type=hidden name=` + CSRFField + ` value=` + s.CSRFToken(ctx) + `>`
+}
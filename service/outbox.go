@@ -0,0 +1,165 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/data"
+)
+
+// outboxLimit is the number of latest notifications shown to the user
+const outboxLimit = 50
+
+// DeliverOutbox retries notifications which are due and prunes delivered
+// and failed ones older than OUTBOX_RETENTION. It returns the number of
+// delivered notifications.
+func (s *GCTrackerService) DeliverOutbox(ctx context.Context) (int, error) {
+	if s.outbox != nil {
+		s.outbox.Lock()
+		defer s.outbox.Unlock()
+	}
+	now := time.Now()
+	entries, err := s.data.GetDueOutbox(ctx, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	users := map[string]data.GCTrackerUser{}
+	for i := range entries {
+		if err := ctx.Err(); err != nil {
+			return delivered, err
+		}
+		e := &entries[i]
+		// Another worker or the first attempt may be at it already
+		if err := s.data.ClaimOutbox(ctx, e.ID, now.Unix(), now.Add(data.OutboxLease).Unix()); err != nil {
+			if !errors.Is(err, data.ErrEntryNotDue) {
+				log.Println("Cannot claim outbox entry " + e.ID + ": " + err.Error())
+			}
+			continue
+		}
+		user, ok := users[e.Username]
+		if !ok {
+			if user, err = s.data.GetUser(ctx, e.Username); err != nil {
+				log.Println("Cannot deliver notification to " + e.Username + ": " + err.Error())
+				if errors.Is(err, data.ErrUserNotFound) {
+					e.Status, e.LastError, e.Updated = data.OutboxFailed, err.Error(), now.Unix()
+					s.data.UpdateOutbox(ctx, *e)
+				}
+				continue
+			}
+			users[e.Username] = user
+		}
+		if user.Deliver(ctx, e) == nil {
+			delivered++
+		}
+	}
+	if retention := config.Config.OutboxRetention; retention > 0 {
+		if err := s.data.PruneOutbox(ctx, now.Add(-retention).Unix()); err != nil {
+			log.Println("Cannot prune outbox: " + err.Error())
+		}
+	}
+	return delivered, nil
+}
+
+// StartOutbox delivers the outbox every interval until ctx is done. A zero
+// interval disables it, the outbox is then only delivered after refreshes.
+func (s *GCTrackerService) StartOutbox(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Outbox worker is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			delivered, err := s.DeliverOutbox(ctx)
+			if err != nil {
+				log.Println("Cannot deliver outbox: " + err.Error())
+				continue
+			}
+			if delivered > 0 {
+				log.Printf("Outbox: delivered %d notifications", delivered)
+			}
+		}
+	}()
+}
+
+// RenderOutbox renders the latest notifications of the signed in user with
+// their delivery status, newest first
+func (s *GCTrackerService) RenderOutbox(ctx context.Context) (string, error) {
+	username := sessionUser(ctx)
+	entries, err := s.data.GetOutbox(ctx, username, outboxLimit)
+	if err != nil {
+		log.Println("Cannot get outbox of " + username + ": " + err.Error())
+		return "", errors.New("cannot get notifications")
+	}
+	if len(entries) == 0 {
+		return `<div>No notifications yet</div>`, nil
+	}
+	str := `<table>`
+	str += `<tr><th>Sent</th><th>Channel</th><th>Notification</th><th>Status</th></tr>`
+	for _, e := range entries {
+		str += `<tr><td>`
+		str += formatTime(e.Created)
+		str += `</td><td>`
+		str += e.Channel
+		str += `</td><td>`
+		str += html.EscapeString(outboxSummary(e))
+		str += `</td><td>`
+		str += html.EscapeString(outboxStatus(e))
+		str += `</td></tr>`
+	}
+	str += `</table>`
+	return str, nil
+}
+
+// outboxSummary is the first line of the notification
+func outboxSummary(e data.OutboxEntry) string {
+	n := e.Notification
+	if n.Event == data.EventStatusChange {
+		if n.CaseName == "" {
+			return n.CaseID + ": " + n.NewStatus
+		}
+		return n.CaseID + " " + n.CaseName + ": " + n.NewStatus
+	}
+	return strings.SplitN(n.Message, "\n", 2)[0]
+}
+
+func outboxStatus(e data.OutboxEntry) string {
+	switch e.Status {
+	case data.OutboxDelivered:
+		return "delivered"
+	case data.OutboxFailed:
+		return fmt.Sprintf("failed after %d attempts: %s", e.Attempts, e.LastError)
+	}
+	if e.Attempts == 0 {
+		return "pending"
+	}
+	return fmt.Sprintf("retrying at %s after %d attempts: %s", formatTime(e.NextAttempt), e.Attempts, e.LastError)
+}
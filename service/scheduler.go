@@ -0,0 +1,130 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrUpdateRunning is returned when a refresh is requested while another
+// one has not finished yet
+var ErrUpdateRunning = errors.New("update is already running")
+
+// UpdateStatus tells operators how refreshing goes. Timestamps are Unix
+// seconds, zero when unknown.
+type UpdateStatus struct {
+	Running      bool          `json:"running"`
+	LastStarted  int64         `json:"lastStarted"`
+	LastFinished int64         `json:"lastFinished"`
+	LastResult   *UpdateResult `json:"lastResult"`
+	LastError    string        `json:"lastError,omitempty"`
+	NextRun      int64         `json:"nextRun"`
+}
+
+// updateState is shared by everything that refreshes cases so that runs do
+// not overlap
+type updateState struct {
+	mu     sync.Mutex
+	status UpdateStatus
+}
+
+func (u *updateState) begin() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.status.Running {
+		return false
+	}
+	u.status.Running = true
+	u.status.LastStarted = time.Now().Unix()
+	return true
+}
+
+func (u *updateState) finish(result UpdateResult, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status.Running = false
+	u.status.LastFinished = time.Now().Unix()
+	u.status.LastResult = &result
+	u.status.LastError = ""
+	if err != nil {
+		u.status.LastError = err.Error()
+	}
+}
+
+func (u *updateState) schedule(next time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status.NextRun = next.Unix()
+}
+
+func (u *updateState) get() UpdateStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := u.status
+	if status.LastResult != nil {
+		result := *status.LastResult
+		status.LastResult = &result
+	}
+	return status
+}
+
+// UpdateStatus returns the state of the last and the next refresh
+func (s *GCTrackerService) UpdateStatus() UpdateStatus {
+	if s.updates == nil {
+		return UpdateStatus{}
+	}
+	return s.updates.get()
+}
+
+// StartScheduler refreshes all cases every interval plus a random delay of
+// up to jitter until ctx is done. A zero interval disables it, e.g. when an
+// external cron calls /update instead.
+func (s *GCTrackerService) StartScheduler(ctx context.Context, interval, jitter time.Duration) {
+	if interval <= 0 {
+		log.Println("Scheduler is disabled")
+		return
+	}
+	if s.updates == nil {
+		s.updates = &updateState{}
+	}
+	go func() {
+		for {
+			delay := interval
+			if jitter > 0 {
+				delay += time.Duration(rand.Int63n(int64(jitter)))
+			}
+			s.updates.schedule(time.Now().Add(delay))
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			result, err := s.UpdateCases(ctx)
+			if err != nil {
+				log.Println("Scheduled update failed: " + err.Error())
+				continue
+			}
+			log.Printf("Scheduled update: checked %d, changed %d, failed %d", result.Checked, result.Changed, result.Failed)
+		}
+	}()
+}
@@ -16,28 +16,53 @@ limitations under the License.
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/batk0/gc-tracker/config"
 	"github.com/batk0/gc-tracker/data"
-	"github.com/gorilla/sessions"
+	"github.com/batk0/gc-tracker/notify"
+	"github.com/batk0/gc-tracker/status"
 )
 
+// GCTrackerService is shared by all requests, the session of a request is
+// carried by its context, see GetSession
 type GCTrackerService struct {
-	session *sessions.Session
-	data    data.GCTrackerData
+	data     data.GCTrackerData
+	provider status.StatusProvider
+	update   UpdateOptions
+	updates  *updateState
+	// outbox serializes deliveries of the outbox
+	outbox *sync.Mutex
+	// throttle limits sign in, password reset and sign up, nil disables it
+	throttle *throttle
 }
 
 func NewGCTrackerService(d data.GCTrackerData) *GCTrackerService {
 	if d == nil {
-		d = &data.FirestoreGCTrackerData{}
+		var err error
+		if d, err = data.NewGCTrackerData(context.Background()); err != nil {
+			log.Fatalln("Cannot open storage: " + err.Error())
+		}
+	}
+	provider := status.NewUSCISProvider(config.Config.USCISURL, &http.Client{Timeout: 30 * time.Second})
+	return &GCTrackerService{
+		data:     d,
+		provider: provider,
+		update:   updateOptionsFromConfig(),
+		updates:  &updateState{},
+		outbox:   &sync.Mutex{},
+		throttle: newThrottle(d, limitOptionsFromConfig()),
 	}
-	return &GCTrackerService{data: d}
 }
 
 func (s *GCTrackerService) RenderPage(content, errorMsg string) string {
@@ -53,100 +78,146 @@ func (s *GCTrackerService) ShowStyle() string {
 	return showStyle()
 }
 
-func (s *GCTrackerService) GetResetToken() string {
-	// TODO: Test it
-	if s.session == nil {
-		return ""
-	}
-	return fmt.Sprint(s.session.Values["resetToken"])
-}
+// errNotVerified is returned for features which need a confirmed email
+// address
+var errNotVerified = errors.New("please confirm your email address first")
 
-func (s *GCTrackerService) SetResetToken(token string) {
-	s.session.Values["resetToken"] = token
-	// TODO: Save session and test
-}
+// SignUp creates the account and sends a link confirming the email
+// address, the user is welcomed once it is followed
+func (s *GCTrackerService) SignUp(r *http.Request) error {
+	ctx := r.Context()
+	byUser := s.throttle.user("signup", r.PostForm.Get("username"))
+	byIP := s.throttle.ip("signup", clientIP(r))
+	if s.throttle.locked(ctx, byUser, byIP) {
+		return ErrTooManyAttempts
+	}
+	s.throttle.hit(ctx, byUser)
+	s.throttle.hit(ctx, byIP)
 
-func (s *GCTrackerService) SignIn(form url.Values) error {
 	user := s.data.NewUser()
 
-	user.Set(form)
-	if err := user.Authenticate(); err != nil {
+	user.Set(r.PostForm)
+	if err := user.Validate(ctx, true); err != nil {
 		log.Println(err.Error())
 		return err
 	}
-	return nil
-}
-
-func (s *GCTrackerService) UpdateCases() error {
-	for _, c := range s.data.GetAllCases() {
-		if err := c.CheckStatus(); err == nil {
-			continue
-		} else if err.Error() == "status changed" {
-			c.Create()
-		} else {
-			return err
-		}
+	if err := user.HashAndSalt(); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	user.SetVerified(false)
+	if err := s.data.CreateUser(ctx, user); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := user.GenerateVerifyToken(ctx, linkURL(r, "/verify")); err != nil {
+		log.Println(err.Error())
+		return errors.New("account created, but the confirmation email cannot be sent, please sign in to send it again")
 	}
 	return nil
 }
 
-func (s *GCTrackerService) GetSession(r *http.Request) {
-	store := s.data.NewSession()
-
-	if store == nil {
-		log.Println("Session store does not exist")
+// linkURL is the absolute address of path for links in emails
+func linkURL(r *http.Request, path string) string {
+	if base := config.Config.BaseURL; base != "" {
+		return strings.TrimSuffix(base, "/") + path
 	}
-
-	session, err := store.Get(r, config.Config.Cookie)
-	if err != nil {
-		log.Println("Cannot get session " + err.Error())
-	} else {
-		s.session = session
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
 	}
+	return scheme + "://" + r.Host + path
 }
 
-func (s *GCTrackerService) IsAuthenticated() bool {
-	if s.session == nil {
-		log.Println("IsAuthenticated(): session is nil")
-		return false
+// VerifyEmail confirms the email address the token was sent to
+func (s *GCTrackerService) VerifyEmail(ctx context.Context, token string) error {
+	user := s.data.NewUser()
+	if err := user.Verify(ctx, token); err != nil {
+		log.Println(err.Error())
+		return err
 	}
-	return s.session.Values["authenticated"] != nil && s.session.Values["authenticated"].(bool) && s.session.Values["username"] != nil
+	return nil
 }
 
-func (s *GCTrackerService) SetAuthenticated(auth bool) {
-	s.session.Values["authenticated"] = auth
-	// TODO: Save session and test it
+// ResendVerification sends the signed in user a new link confirming the
+// email address
+func (s *GCTrackerService) ResendVerification(r *http.Request) error {
+	ctx := r.Context()
+	user := s.data.NewUser()
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot find user")
+	}
+	if user.IsVerified() {
+		return errors.New("email address is already confirmed")
+	}
+	return user.GenerateVerifyToken(ctx, linkURL(r, "/verify"))
 }
 
-func (s *GCTrackerService) SignUp(formData url.Values) error {
+// ChangeEmail sends a link confirming the new email address of the signed
+// in user to it, the current password is required
+func (s *GCTrackerService) ChangeEmail(r *http.Request) error {
+	ctx := r.Context()
 	user := s.data.NewUser()
-
-	user.Set(formData)
-	if err := user.Validate(true); err != nil {
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
 		log.Println(err.Error())
-		return err
+		return errors.New("cannot find user")
 	}
-	if err := user.HashAndSalt(); err != nil {
+	return user.RequestEmailChange(ctx, r.PostForm.Get("password"), strings.TrimSpace(r.PostForm.Get("email")), linkURL(r, "/verify"))
+}
+
+// RenderAccount renders the email address of the signed in user and the
+// one waiting for confirmation
+func (s *GCTrackerService) RenderAccount(ctx context.Context) (string, error) {
+	user := s.data.NewUser()
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
 		log.Println(err.Error())
-		return err
+		return "", errors.New("cannot find user")
 	}
-	if err := s.data.CreateUser(user); err != nil {
-		log.Println(err.Error())
-		return err
+	str := "<div>Username " + html.EscapeString(user.GetUsername()) + "</div>"
+	str += "<div>Email " + html.EscapeString(user.GetEmail()) + "</div>"
+	if pending := user.GetPendingEmail(); pending != "" {
+		str += "<div>Waiting for confirmation of " + html.EscapeString(pending) + ", check its mailbox for the link</div>"
 	}
-	user.SendNotification("Your account '" + user.GetUsername() + "' has been created.")
-	return nil
+	return str, nil
 }
 
+// RenderVerification asks the signed in user to confirm the email address
+// unless it is confirmed already
+func (s *GCTrackerService) RenderVerification(ctx context.Context) string {
+	user := s.data.NewUser()
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil || user.IsVerified() {
+		return ""
+	}
+	return `<form method=post action="/verify">` + s.csrfInput(ctx) + `<div class=error>Please confirm your email address with the link we have sent you.
+	Until then you get no notifications and cannot add cases or change settings.
+	<input type=submit value="Send the link again"></div></form>`
+}
+
+// ResetPwd sends a password reset link to the user, every request counts
+// toward the limits so that nobody gets flooded with links
 func (s *GCTrackerService) ResetPwd(r *http.Request) error {
+	ctx := r.Context()
 	if username := r.PostForm.Get("username"); username != "" {
-		if s.data.UserAvailable(username) {
+		byUser := s.throttle.user("resetpwd", username)
+		byIP := s.throttle.ip("resetpwd", clientIP(r))
+		if s.throttle.locked(ctx, byUser, byIP) {
+			return ErrTooManyAttempts
+		}
+		s.throttle.hit(ctx, byUser)
+		s.throttle.hit(ctx, byIP)
+		if s.data.UserAvailable(ctx, username) {
 			return errors.New("user not found")
 		}
 		user := s.data.NewUser()
-		user.GetByUsername(username)
-		address := r.URL.Scheme + r.URL.Host + "/changepwd"
-		if err := user.GenerateResetToken(address); err != nil {
+		if err := user.GetByUsername(ctx, username); err != nil {
+			return err
+		}
+		if err := user.GenerateResetToken(ctx, linkURL(r, "/changepwd")); err != nil {
 			return errors.New("cannot generate reset token")
 		}
 	} else {
@@ -155,25 +226,33 @@ func (s *GCTrackerService) ResetPwd(r *http.Request) error {
 	return nil
 }
 
-func (s *GCTrackerService) ChangePwd(r *http.Request) error {
+// ChangePwd sets the password of the signed in user, or of the user the
+// reset link in the session was sent to. A reset link is good for one change
+// only.
+func (s *GCTrackerService) ChangePwd(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	var user data.GCTrackerUser
-	username := fmt.Sprint(s.session.Values["username"])
-	if s.IsAuthenticated() {
+	username := sessionUser(ctx)
+	reset := !s.IsAuthenticated(ctx)
+	if !reset {
 		user = s.data.NewUser()
-		if err := user.GetByUsername(username); err != nil {
+		if err := user.GetByUsername(ctx, username); err != nil {
 			log.Println(err.Error())
 			return errors.New("cannot find user")
 		}
 	} else {
 		var err error
-		token := fmt.Sprint(s.session.Values["resetToken"])
-		user, err = s.data.GetUserByResetToken(token)
+		token := s.GetResetToken(ctx)
+		if token == "" {
+			return data.ErrTokenNotFound
+		}
+		user, err = s.data.GetUserByResetToken(ctx, token)
 		if err != nil {
 			return err
 		}
 	}
 	user.SetPassword2(r.PostForm.Get("password"), r.PostForm.Get("password2"))
-	if err := user.Validate(false); err != nil {
+	if err := user.Validate(ctx, false); err != nil {
 		log.Println(err.Error())
 		return err
 	}
@@ -181,11 +260,20 @@ func (s *GCTrackerService) ChangePwd(r *http.Request) error {
 		log.Println(err.Error())
 		return err
 	}
-	if err := user.Update(); err != nil {
+	if reset {
+		user.ClearResetToken()
+	}
+	if err := user.Update(ctx); err != nil {
 		log.Println(err.Error())
 		return err
 	}
-	user.SendNotification("Your password has been changed.")
+	if reset {
+		delete(getSession(ctx).Values, sessionResetToken)
+		if err := s.SaveSession(w, r); err != nil {
+			log.Println("Cannot clear reset token: " + err.Error())
+		}
+	}
+	user.SendNotification(ctx, data.Notification{Event: data.EventPasswordChanged, Message: "Your password has been changed."})
 	return nil
 }
 
@@ -213,12 +301,17 @@ func (s *GCTrackerService) ShowUsers() string {
 	return s.RenderPage(str, errorMsg)
 }
 
-func (s *GCTrackerService) RenderCases() string {
+func (s *GCTrackerService) RenderCases(ctx context.Context) string {
 	user := s.data.NewUser()
-	username := fmt.Sprint(s.session.Values["username"])
-	user.GetByUsername(username)
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
+		return ""
+	}
 
-	cases := user.GetCases()
+	cases, err := user.GetCases(ctx)
+	if err != nil {
+		log.Println("Cannot get cases: " + err.Error())
+	}
 	if cases == nil {
 		return ""
 	}
@@ -226,44 +319,129 @@ func (s *GCTrackerService) RenderCases() string {
 	for _, c := range cases {
 		str += `<tr><td class=check><input type=checkbox name=cases value=`
 		str += c.GetID()
-		str += `></td><td>`
+		str += `></td><td><a href=/case?id=`
 		str += c.GetID()
-		str += `</td><td>`
+		str += `>`
+		str += c.GetID()
+		str += `</a></td><td>`
 		str += c.GetName()
 		str += `</td><td>`
-		str += c.GetStatus()
+		str += html.EscapeString(c.GetStatus())
+		str += `</td></tr>`
+	}
+	return str
+}
+
+// RenderCase renders the status history of a case of the signed in user,
+// newest entry first
+func (s *GCTrackerService) RenderCase(ctx context.Context, id string) (string, error) {
+	user := s.data.NewUser()
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
+		return "", err
+	}
+	cases, err := user.GetCases(ctx)
+	if err != nil {
+		return "", err
+	}
+	var gcCase data.GCTrackerCase
+	for _, c := range cases {
+		if c.GetID() == id {
+			gcCase = c
+		}
+	}
+	if gcCase == nil {
+		return "", errors.New("case not found")
+	}
+	history, err := s.data.GetCaseHistory(ctx, id)
+	if err != nil {
+		log.Println("Cannot get history of " + id + ": " + err.Error())
+		return "", errors.New("cannot get case history")
+	}
+
+	str := `<h2>` + gcCase.GetID() + ` ` + gcCase.GetName() + `</h2>`
+	str += renderDetails(gcCase.GetDetails())
+	str += `<table>`
+	str += `<tr><th>Status</th><th>Details</th><th>First seen</th><th>Last checked</th></tr>`
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		str += `<tr><td>`
+		str += html.EscapeString(e.Title)
+		str += `</td><td>`
+		str += html.EscapeString(e.Body)
+		str += `</td><td>`
+		str += formatTime(e.FirstSeen)
+		str += `</td><td>`
+		str += formatTime(e.LastChecked)
 		str += `</td></tr>`
 	}
+	str += `</table>`
+	return str, nil
+}
+
+func renderDetails(d status.Status) string {
+	str := ""
+	if d.FormType != "" {
+		str += `<div>Form: ` + html.EscapeString(d.FormType) + `</div>`
+	}
+	if !d.ActionDate.IsZero() {
+		str += `<div>Action date: ` + d.ActionDate.Format("2006-01-02") + `</div>`
+	}
+	if d.Notice != "" {
+		str += `<div>Notice: ` + html.EscapeString(d.Notice) + `</div>`
+	}
+	if d.RFE {
+		str += `<div>Request for evidence was sent</div>`
+	}
+	if d.CardMailed {
+		str += `<div>Card was mailed</div>`
+	}
+	if d.TrackingNumber != "" {
+		str += `<div>USPS tracking number: ` + html.EscapeString(d.TrackingNumber) + `</div>`
+	}
 	return str
 }
 
-func (s *GCTrackerService) AddCase(formData url.Values) {
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04 MST")
+}
+
+func (s *GCTrackerService) AddCase(ctx context.Context, formData url.Values) {
 	user := s.data.NewUser()
-	username := fmt.Sprint(s.session.Values["username"])
-	if err := user.GetByUsername(username); err == nil {
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err == nil {
+		if !user.IsVerified() {
+			log.Println("Cannot add case for " + username + ": " + errNotVerified.Error())
+			return
+		}
 		c := s.data.NewCase()
 		c.Set(formData)
-		c.CheckStatus()
-		if err := user.AddCase(c); err != nil {
+		if err := c.Validate(); err != nil {
 			log.Println(err.Error())
 			return
 		}
-		log.Println("Add case " + c.GetID())
-		if err := user.Update(); err != nil {
+		// Cases are checked before the user subscribes, so adding a case
+		// nobody tracks yet does not notify anyone
+		if _, err := s.data.GetCase(ctx, c.GetID()); errors.Is(err, data.ErrCaseNotFound) {
+			if err := c.CheckStatus(ctx, s.provider); err != nil && !errors.Is(err, data.ErrStatusChanged) {
+				log.Println("Cannot check case " + c.GetID() + ": " + err.Error())
+			}
+		}
+		if err := user.AddCase(ctx, c); err != nil {
 			log.Println(err.Error())
 			return
 		}
+		log.Println("Add case " + c.GetID())
 	}
 }
 
-func (s *GCTrackerService) DelCases(cases []string) {
+func (s *GCTrackerService) DelCases(ctx context.Context, cases []string) {
 	user := s.data.NewUser()
-	username := fmt.Sprint(s.session.Values["username"])
-	if err := user.GetByUsername(username); err == nil {
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err == nil {
 		for _, c := range cases {
 			log.Println("Delete case " + c)
-			user.DelCase(c)
-			if err := user.Update(); err != nil {
+			if err := user.DelCase(ctx, c); err != nil {
 				log.Println(err.Error())
 				return
 			}
@@ -271,12 +449,174 @@ func (s *GCTrackerService) DelCases(cases []string) {
 	}
 }
 
+func (s *GCTrackerService) RenderSettings(ctx context.Context) (string, error) {
+	user := s.data.NewUser()
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
+		log.Println(err.Error())
+		return "", errors.New("cannot find user")
+	}
+	n := user.GetNotificationSettings()
+	str := "<h3>Notifications</h3>"
+	str += "<div>" + renderCheckbox("status", !n.MuteStatus) + " Case status changes</div>"
+	str += "<div>Send status changes " + renderDigest(n) + "</div>"
+	str += "<div>" + renderCheckbox("account", !n.MuteAccount) + " Account events</div>"
+	str += "<h3>Quiet hours</h3>"
+	str += "<div>From " + renderHours("quietFrom", n.QuietFrom) + " till " + renderHours("quietTo", n.QuietTo) + "</div>"
+	str += "<div>Time zone <input type=text name=timeZone value=\"" + html.EscapeString(n.TimeZone) + "\" placeholder=UTC></div>"
+	str += "<h3>Webhook</h3>"
+	str += "<div>URL <input type=text name=webhookUrl value=\"" + html.EscapeString(n.WebhookURL) + "\"></div>"
+	if n.WebhookSecret != "" {
+		str += "<div>Secret <input type=password name=webhookSecret placeholder=unchanged></div>"
+	} else {
+		str += "<div>Secret <input type=password name=webhookSecret></div>"
+	}
+	str += "<h3>Chat</h3>"
+	str += "<div>Service " + renderChatService(n.ChatService) + "</div>"
+	str += "<div>Webhook URL <input type=text name=chatUrl value=\"" + html.EscapeString(n.ChatURL) + "\"></div>"
+	if n.ChatToken != "" {
+		str += "<div>Access token (Matrix) <input type=password name=chatToken placeholder=unchanged></div>"
+	} else {
+		str += "<div>Access token (Matrix) <input type=password name=chatToken></div>"
+	}
+	return str, nil
+}
+
+func renderChatService(selected string) string {
+	str := "<select name=chatService>"
+	for _, o := range []struct{ value, text string }{
+		{notify.ChatSlack, "Slack"},
+		{notify.ChatDiscord, "Discord"},
+		{notify.ChatMatrix, "Matrix"},
+	} {
+		if o.value == selected {
+			str += "<option value=\"" + o.value + "\" selected>" + o.text + "</option>"
+		} else {
+			str += "<option value=\"" + o.value + "\">" + o.text + "</option>"
+		}
+	}
+	return str + "</select>"
+}
+
+func renderCheckbox(name string, checked bool) string {
+	if checked {
+		return "<input type=checkbox name=" + name + " checked>"
+	}
+	return "<input type=checkbox name=" + name + ">"
+}
+
+func renderDigest(n data.NotificationSettings) string {
+	selected := ""
+	if n.DigestOnly {
+		selected = data.DigestDaily
+		if n.DigestPeriod != "" {
+			selected = n.DigestPeriod
+		}
+	}
+	str := "<select name=digest>"
+	for _, o := range []struct{ value, text string }{
+		{"", "right away"},
+		{data.DigestDaily, "in a daily digest"},
+		{data.DigestWeekly, "in a weekly digest"},
+	} {
+		if o.value == selected {
+			str += "<option value=\"" + o.value + "\" selected>" + o.text + "</option>"
+		} else {
+			str += "<option value=\"" + o.value + "\">" + o.text + "</option>"
+		}
+	}
+	return str + "</select>"
+}
+
+func renderHours(name string, selected int) string {
+	str := "<select name=" + name + ">"
+	for h := 0; h < 24; h++ {
+		if h == selected {
+			str += fmt.Sprintf("<option value=%d selected>%02d:00</option>", h, h)
+		} else {
+			str += fmt.Sprintf("<option value=%d>%02d:00</option>", h, h)
+		}
+	}
+	return str + "</select>"
+}
+
+// SaveSettings stores the notification settings of the signed in user.
+// Checkboxes turn events on, digest is empty or the digest period, quiet
+// hours are off when both hours are equal. An empty webhook secret or chat
+// token keeps the current one.
+func (s *GCTrackerService) SaveSettings(ctx context.Context, formData url.Values) error {
+	user := s.data.NewUser()
+	username := sessionUser(ctx)
+	if err := user.GetByUsername(ctx, username); err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot find user")
+	}
+	if !user.IsVerified() {
+		return errNotVerified
+	}
+	from, err := strconv.Atoi(formData.Get("quietFrom"))
+	if err != nil {
+		return errors.New("invalid quiet hours")
+	}
+	to, err := strconv.Atoi(formData.Get("quietTo"))
+	if err != nil {
+		return errors.New("invalid quiet hours")
+	}
+	settings := data.NotificationSettings{
+		MuteStatus:    formData.Get("status") == "",
+		MuteAccount:   formData.Get("account") == "",
+		DigestOnly:    formData.Get("digest") != "",
+		DigestPeriod:  formData.Get("digest"),
+		QuietFrom:     from,
+		QuietTo:       to,
+		TimeZone:      strings.TrimSpace(formData.Get("timeZone")),
+		WebhookURL:    strings.TrimSpace(formData.Get("webhookUrl")),
+		WebhookSecret: formData.Get("webhookSecret"),
+		ChatURL:       strings.TrimSpace(formData.Get("chatUrl")),
+	}
+	if settings.WebhookSecret == "" {
+		settings.WebhookSecret = user.GetNotificationSettings().WebhookSecret
+	}
+	if settings.ChatURL != "" {
+		settings.ChatService = formData.Get("chatService")
+		settings.ChatToken = formData.Get("chatToken")
+		if settings.ChatToken == "" {
+			settings.ChatToken = user.GetNotificationSettings().ChatToken
+		}
+	}
+	if err := user.SetNotificationSettings(settings); err != nil {
+		return err
+	}
+	return user.Update(ctx)
+}
+
+// DeliverNotifications sends queued notifications once quiet hours are over
+// or digests are due
+func (s *GCTrackerService) DeliverNotifications(ctx context.Context) error {
+	usernames, err := s.data.GetQueuedUsernames(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, username := range usernames {
+		user, err := s.data.GetUser(ctx, username)
+		if err != nil {
+			log.Println("Cannot deliver notifications to " + username + ": " + err.Error())
+			continue
+		}
+		if err := user.FlushNotifications(ctx, now); err != nil {
+			log.Println("Cannot deliver notifications to " + username + ": " + err.Error())
+		}
+	}
+	return ctx.Err()
+}
+
 func (s *GCTrackerService) RenderError(errorMsg string) string {
 	if errorMsg != "" {
 		str := "<div class='error'><ul>"
 		for _, s := range strings.Split(errorMsg, "\n") {
 			if s != "" {
-				str += "<li>" + s
+				str += "<li>" + html.EscapeString(s)
 			}
 		}
 		str += "</ul></div>"
@@ -16,16 +16,30 @@ limitations under the License.
 package service
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"html"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/batk0/gc-tracker/config"
 	"github.com/batk0/gc-tracker/data"
+	"github.com/batk0/gc-tracker/notify"
+	"github.com/batk0/gc-tracker/status"
 	"github.com/gorilla/sessions"
 )
 
@@ -37,17 +51,22 @@ type MockGCTrackerData struct {
 }
 
 type MockGCTrackerCase struct {
-	err    error
-	cnt    func()
-	id     string
-	name   string
-	status string
+	err     error
+	cnt     func()
+	id      string
+	name    string
+	status  string
+	details status.Status
 }
 
 type MockGCTrackerUser struct {
 	username     string
 	password     string
 	notification string
+	unverified   bool
+	twoFactor    bool
+	email        string
+	settings     data.NotificationSettings
 	cases        []*MockGCTrackerCase
 	c            data.GCTrackerCase
 	caseAdded    bool
@@ -55,11 +74,28 @@ type MockGCTrackerUser struct {
 	casesDeleted int
 }
 
-func (u *MockGCTrackerUser) GetUsername() string         { return u.username }
-func (u *MockGCTrackerUser) SendNotification(msg string) { u.notification = msg }
-func (u *MockGCTrackerUser) SetPassword2(p1, p2 string)  { u.password = p1 }
+func (u *MockGCTrackerUser) GetUsername() string        { return u.username }
+func (u *MockGCTrackerUser) GetEmail() string           { return u.username + "@example.com" }
+func (u *MockGCTrackerUser) GetPendingEmail() string    { return u.email }
+func (u *MockGCTrackerUser) SetPassword2(p1, p2 string) { u.password = p1 }
 
-func (u *MockGCTrackerUser) Authenticate() error {
+func (u *MockGCTrackerUser) SendNotification(ctx context.Context, n data.Notification) {
+	u.notification = n.Message
+}
+func (u *MockGCTrackerUser) FlushNotifications(context.Context, time.Time) error { return nil }
+func (u *MockGCTrackerUser) Deliver(context.Context, *data.OutboxEntry) error    { return nil }
+func (u *MockGCTrackerUser) GetNotificationSettings() data.NotificationSettings {
+	return u.settings
+}
+func (u *MockGCTrackerUser) SetNotificationSettings(s data.NotificationSettings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	u.settings = s
+	return nil
+}
+
+func (u *MockGCTrackerUser) Authenticate(context.Context) error {
 	if u.username != "existing" {
 		return errors.New("user does not exist")
 	} else if u.password != "testpassword" {
@@ -81,7 +117,7 @@ func (u *MockGCTrackerUser) HashAndSalt() error {
 	return errors.New("cannot hash password")
 }
 
-func (u *MockGCTrackerUser) Validate(online bool) error {
+func (u *MockGCTrackerUser) Validate(ctx context.Context, online bool) error {
 	if online && u.username == "existing" {
 		return errors.New("username already exists")
 	}
@@ -94,74 +130,188 @@ func (u *MockGCTrackerUser) Validate(online bool) error {
 	return nil
 }
 
-func (u *MockGCTrackerUser) GetByUsername(username string) error {
+func (u *MockGCTrackerUser) GetByUsername(ctx context.Context, username string) error {
 	if username != "existing" && username != "gooduser" {
 		return errors.New("user not found")
 	}
 	u.username = username
 	if username == "existing" {
 		u.cases = []*MockGCTrackerCase{
-			{id: "1", name: "case1", status: "status1"},
-			{id: "2", name: "case2", status: "status2"},
+			{id: "1", name: "case1", status: "status1", details: status.Status{
+				FormType:       "I-485",
+				ActionDate:     time.Date(2021, time.July, 1, 0, 0, 0, 0, time.UTC),
+				CardMailed:     true,
+				TrackingNumber: "9205590164917312751089",
+			}},
+			{id: "2", name: "case2", status: "<b>status2</b>"},
 		}
 	}
 	return nil
 }
 
-func (u *MockGCTrackerUser) GenerateResetToken(addr string) error {
+func (u *MockGCTrackerUser) GenerateResetToken(ctx context.Context, addr string) error {
 	u.notification = addr + "?a=r&t=token"
 	return nil
 }
 
-func (u *MockGCTrackerUser) Update() error {
-	if u.c != nil {
-		u.caseAdded = true
+func (u *MockGCTrackerUser) ClearResetToken() {}
+
+func (u *MockGCTrackerUser) GenerateVerifyToken(ctx context.Context, addr string) error {
+	u.notification = addr + "?t=token"
+	return nil
+}
+
+func (u *MockGCTrackerUser) Verify(ctx context.Context, token string) error {
+	if token != "token" {
+		return data.ErrVerifyLink
+	}
+	u.username = "gooduser"
+	return nil
+}
+
+func (u *MockGCTrackerUser) RequestEmailChange(ctx context.Context, password, email, addr string) error {
+	if password != "testpassword" {
+		return errors.New("password does not match")
+	}
+	u.email = email
+	u.notification = addr + "?t=token"
+	return nil
+}
+
+func (u *MockGCTrackerUser) IsVerified() bool          { return !u.unverified }
+func (u *MockGCTrackerUser) SetVerified(verified bool) { u.unverified = !verified }
+func (u *MockGCTrackerUser) TwoFactorEnabled() bool    { return u.twoFactor }
+func (u *MockGCTrackerUser) RecoveryCodesLeft() int {
+	if u.twoFactor {
+		return 10
+	}
+	return 0
+}
+func (u *MockGCTrackerUser) TwoFactorURI() string { return "" }
+func (u *MockGCTrackerUser) StartTwoFactor(context.Context) (string, error) {
+	if u.twoFactor {
+		return "", data.ErrTwoFactorEnabled
+	}
+	return "otpauth://totp/GC-Tracker:" + u.username + "?secret=KEY", nil
+}
+func (u *MockGCTrackerUser) EnableTwoFactor(ctx context.Context, code string) ([]string, error) {
+	if code != "123456" {
+		return nil, data.ErrTwoFactorCode
 	}
+	u.twoFactor = true
+	return []string{"aaaaa-bbbbb", "ccccc-ddddd"}, nil
+}
+func (u *MockGCTrackerUser) CheckTwoFactor(ctx context.Context, code string) error {
+	if !u.twoFactor {
+		return data.ErrTwoFactorDisabled
+	} else if code != "123456" {
+		return data.ErrTwoFactorCode
+	}
+	return nil
+}
+func (u *MockGCTrackerUser) DisableTwoFactor(ctx context.Context, password string) error {
+	if password != "testpassword" {
+		return errors.New("password does not match")
+	}
+	u.twoFactor = false
+	return nil
+}
+
+func (u *MockGCTrackerUser) Update(context.Context) error {
 	u.casesDeleted = u.delCaseCnt
 	return nil
 }
 
-func (u *MockGCTrackerUser) AddCase(c data.GCTrackerCase) error {
+func (u *MockGCTrackerUser) AddCase(ctx context.Context, c data.GCTrackerCase) error {
 	if c.GetID() == "" {
 		return errors.New("wrong case id")
 	}
 	u.c = c
+	u.caseAdded = true
 	return nil
 }
 
-func (u *MockGCTrackerUser) DelCase(c string) {
+func (u *MockGCTrackerUser) DelCase(ctx context.Context, c string) error {
 	if strings.Contains(c, "existingcase") {
 		u.delCaseCnt += 1
 	}
+	u.casesDeleted = u.delCaseCnt
+	return nil
 }
 
-func (u *MockGCTrackerUser) GetCases() []data.GCTrackerCase {
+func (u *MockGCTrackerUser) GetCaseName(id string) string { return id }
+
+func (u *MockGCTrackerUser) GetCases(context.Context) ([]data.GCTrackerCase, error) {
 	cases := []data.GCTrackerCase{}
 	for _, c := range u.cases {
 		cases = append(cases, c)
 	}
-	return cases
+	return cases, nil
 }
 
-func (d *MockGCTrackerData) NewSession() sessions.Store               { return sessions.NewCookieStore() }
-func (d *MockGCTrackerData) CreateUser(user data.GCTrackerUser) error { return nil }
-func (d *MockGCTrackerData) UserAvailable(username string) bool       { return username != "existing" }
+func (d *MockGCTrackerData) NewSession() sessions.Store {
+	return sessions.NewCookieStore([]byte("test-key"))
+}
+func (d *MockGCTrackerData) NewLimiterStore() data.LimiterStore {
+	return data.NewMemoryLimiterStore()
+}
+func (d *MockGCTrackerData) CreateUser(ctx context.Context, user data.GCTrackerUser) error {
+	return nil
+}
+func (d *MockGCTrackerData) UserAvailable(ctx context.Context, username string) bool {
+	return username != "existing"
+}
 
 // Implemented for for compatibility with interface data.GCTrackerData. Not used for tests
-func (*MockGCTrackerData) GetCase(string) (*firestore.DocumentSnapshot, error) { return nil, nil }
-func (*MockGCTrackerData) GetUsersByCase(string) []data.GCTrackerUser          { return nil }
-func (*MockGCTrackerData) CreateCase(data.GCTrackerCase) error                 { return nil }
-func (*MockGCTrackerData) DeleteCase(data.GCTrackerCase) error                 { return nil }
-func (*MockGCTrackerData) GetCases([]string) []data.GCTrackerCase              { return nil }
-func (*MockGCTrackerData) GetUser(string) (*firestore.DocumentSnapshot, error) { return nil, nil }
-func (*MockGCTrackerData) UpdateUser(user data.GCTrackerUser) error            { return nil }
+func (*MockGCTrackerData) GetCase(context.Context, string) (data.GCTrackerCase, error) {
+	return nil, data.ErrCaseNotFound
+}
+func (*MockGCTrackerData) GetUsersByCase(context.Context, string) ([]data.GCTrackerUser, error) {
+	return nil, nil
+}
+func (*MockGCTrackerData) CreateCase(context.Context, data.GCTrackerCase) error  { return nil }
+func (*MockGCTrackerData) UpdateCase(context.Context, data.GCTrackerCase) error  { return nil }
+func (*MockGCTrackerData) AcquireCase(context.Context, data.GCTrackerCase) error { return nil }
+func (*MockGCTrackerData) ReleaseCase(context.Context, string) error             { return nil }
+func (*MockGCTrackerData) RecordStatus(context.Context, string, data.StatusEntry) error {
+	return nil
+}
+func (*MockGCTrackerData) GetCases(context.Context, []string) ([]data.GCTrackerCase, error) {
+	return nil, nil
+}
+func (*MockGCTrackerData) GetUser(context.Context, string) (data.GCTrackerUser, error) {
+	return nil, data.ErrUserNotFound
+}
+func (*MockGCTrackerData) UpdateUser(context.Context, data.GCTrackerUser) error { return nil }
+func (*MockGCTrackerData) QueueNotification(context.Context, string, data.QueuedNotification) error {
+	return nil
+}
+func (*MockGCTrackerData) GetQueuedNotifications(context.Context, string) ([]data.QueuedNotification, error) {
+	return nil, nil
+}
+func (*MockGCTrackerData) DeleteQueuedNotifications(context.Context, string, []string) error {
+	return nil
+}
+func (*MockGCTrackerData) GetQueuedUsernames(context.Context) ([]string, error) { return nil, nil }
+func (*MockGCTrackerData) AddOutbox(context.Context, data.OutboxEntry) (string, error) {
+	return "", nil
+}
+func (*MockGCTrackerData) UpdateOutbox(context.Context, data.OutboxEntry) error { return nil }
+func (*MockGCTrackerData) GetDueOutbox(context.Context, int64) ([]data.OutboxEntry, error) {
+	return nil, nil
+}
+func (*MockGCTrackerData) ClaimOutbox(context.Context, string, int64, int64) error { return nil }
+func (*MockGCTrackerData) GetOutbox(context.Context, string, int) ([]data.OutboxEntry, error) {
+	return nil, nil
+}
+func (*MockGCTrackerData) PruneOutbox(context.Context, int64) error { return nil }
 
 func (d *MockGCTrackerData) NewUser() data.GCTrackerUser {
 	d.user = &MockGCTrackerUser{}
 	return d.user
 }
 
-func (d *MockGCTrackerData) GetUserByResetToken(token string) (data.GCTrackerUser, error) {
+func (d *MockGCTrackerData) GetUserByResetToken(ctx context.Context, token string) (data.GCTrackerUser, error) {
 	if token != "token" {
 		return nil, errors.New("token not found")
 	}
@@ -169,12 +319,22 @@ func (d *MockGCTrackerData) GetUserByResetToken(token string) (data.GCTrackerUse
 	return d.user, nil
 }
 
-func (d *MockGCTrackerData) GetAllCases() []data.GCTrackerCase {
+func (d *MockGCTrackerData) GetAllCases(context.Context) ([]data.GCTrackerCase, error) {
 	cases := []data.GCTrackerCase{}
 	for _, c := range d.cases {
 		cases = append(cases, c)
 	}
-	return cases
+	return cases, nil
+}
+
+func (d *MockGCTrackerData) GetCaseHistory(ctx context.Context, id string) ([]data.StatusEntry, error) {
+	if id != "1" {
+		return nil, nil
+	}
+	return []data.StatusEntry{
+		{Title: "Case Was Received", Body: "We received <Form I-485>", FirstSeen: 0, LastChecked: 3600},
+		{Title: "Case Was Approved", Body: "We approved", FirstSeen: 86400, LastChecked: 90000},
+	}, nil
 }
 
 func (d *MockGCTrackerData) NewCase() data.GCTrackerCase {
@@ -182,12 +342,13 @@ func (d *MockGCTrackerData) NewCase() data.GCTrackerCase {
 	return c
 }
 
-func (c *MockGCTrackerCase) Create()            { c.cnt() }
-func (c *MockGCTrackerCase) CheckStatus() error { return c.err }
-func (c *MockGCTrackerCase) GetID() string      { return c.id }
-func (c *MockGCTrackerCase) GetName() string    { return c.name }
-func (c *MockGCTrackerCase) GetStatus() string  { return c.status }
-func (c *MockGCTrackerCase) Validate() error    { return nil }
+func (c *MockGCTrackerCase) Update(context.Context) error                             { c.cnt(); return nil }
+func (c *MockGCTrackerCase) CheckStatus(context.Context, status.StatusProvider) error { return c.err }
+func (c *MockGCTrackerCase) GetID() string                                            { return c.id }
+func (c *MockGCTrackerCase) GetName() string                                          { return c.name }
+func (c *MockGCTrackerCase) GetStatus() string                                        { return c.status }
+func (c *MockGCTrackerCase) GetDetails() status.Status                                { return c.details }
+func (c *MockGCTrackerCase) Validate() error                                          { return nil }
 
 func (c *MockGCTrackerCase) Set(f url.Values) {
 	c.id = f.Get("case")
@@ -279,9 +440,9 @@ func TestGCTrackerService_GetSession(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			s := NewGCTrackerService(&MockGCTrackerData{})
 			config.Config.Cookie = tt.args.cookie
-			s.GetSession(tt.args.r)
+			r := s.GetSession(httptest.NewRecorder(), tt.args.r)
 
-			assertSession(t, s.session, tt.want)
+			assertSession(t, getSession(r.Context()), tt.want)
 		})
 	}
 }
@@ -323,16 +484,167 @@ func TestGCTrackerService_IsAuthenticated(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &GCTrackerService{
-				session: tt.session,
-			}
-			if got := s.IsAuthenticated(); got != tt.want {
+			s := &GCTrackerService{}
+			if got := s.IsAuthenticated(withSession(context.Background(), tt.session)); got != tt.want {
 				t.Errorf("GCTrackerService.IsAuthenticated() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func TestGCTrackerService_CSRFToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		session *sessions.Session
+		want    string
+	}{
+		{
+			name:    "Empty session",
+			session: nil,
+		},
+		{
+			name:    "Empty session values - new token",
+			session: setSession(nil),
+		},
+		{
+			name:    "Stored token",
+			session: setSession(sessionValues{csrfKey: "token"}),
+			want:    "token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &GCTrackerService{}
+			ctx := withSession(context.Background(), tt.session)
+			got := s.CSRFToken(ctx)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("GCTrackerService.CSRFToken() = %v, want %v", got, tt.want)
+			}
+			if tt.session == nil {
+				if got != "" {
+					t.Errorf("GCTrackerService.CSRFToken() = %v, want empty token without session", got)
+				}
+				return
+			}
+			if len(got) < 32 && tt.want == "" {
+				t.Errorf("GCTrackerService.CSRFToken() = %v, want a random token", got)
+			}
+			if again := s.CSRFToken(ctx); again != got {
+				t.Errorf("GCTrackerService.CSRFToken() = %v, want the same token %v", again, got)
+			}
+			if !s.CheckCSRF(ctx, got) {
+				t.Errorf("GCTrackerService.CheckCSRF(%v) = false, want true", got)
+			}
+		})
+	}
+	s := &GCTrackerService{}
+	a := withSession(context.Background(), setSession(sessionValues{}))
+	b := withSession(context.Background(), setSession(sessionValues{}))
+	if s.CSRFToken(a) == s.CSRFToken(b) {
+		t.Errorf("GCTrackerService.CSRFToken() is the same for two sessions")
+	}
+}
+
+func TestGCTrackerService_CheckCSRF(t *testing.T) {
+	tests := []struct {
+		name    string
+		session *sessions.Session
+		token   string
+		want    bool
+	}{
+		{
+			name:    "Empty session",
+			session: nil,
+			token:   "token",
+			want:    false,
+		},
+		{
+			name:    "Session without token",
+			session: setSession(sessionValues{}),
+			token:   "token",
+			want:    false,
+		},
+		{
+			name:    "Empty token",
+			session: setSession(sessionValues{csrfKey: ""}),
+			token:   "",
+			want:    false,
+		},
+		{
+			name:    "Wrong token",
+			session: setSession(sessionValues{csrfKey: "token"}),
+			token:   "forged",
+			want:    false,
+		},
+		{
+			name:    "Valid token",
+			session: setSession(sessionValues{csrfKey: "token"}),
+			token:   "token",
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &GCTrackerService{}
+			if got := s.CheckCSRF(withSession(context.Background(), tt.session), tt.token); got != tt.want {
+				t.Errorf("GCTrackerService.CheckCSRF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_Forms_CSRF(t *testing.T) {
+	s := NewGCTrackerService(newMemoryData(t))
+	ctx := withSession(context.Background(), setSession(sessionValues{"username": "existing", "authenticated": true, csrfKey: "token"}))
+	input := `<input type=hidden name=csrf value=token>`
+	for name, page := range map[string]string{
+		"ShowSignIn":    s.ShowSignIn(ctx, ""),
+		"ShowSignUp":    s.ShowSignUp(ctx, ""),
+		"ShowChangePwd": s.ShowChangePwd(ctx, ""),
+		"ShowResetPwd":  s.ShowResetPwd(ctx, ""),
+		"ShowCases":     s.ShowCases(ctx),
+		"ShowSettings":  s.ShowSettings(ctx, ""),
+		"ShowAccount":   s.ShowAccount(ctx, ""),
+		"ShowTwoFactor": s.ShowTwoFactor(ctx, ""),
+		// Waits for the second factor of the user
+		"ShowSignInTwoFactor": s.ShowSignInTwoFactor(ctx, ""),
+	} {
+		if forms, inputs := strings.Count(page, "<form"), strings.Count(page, input); forms == 0 || forms != inputs {
+			t.Errorf("GCTrackerService.%s() has %d forms and %d CSRF inputs", name, forms, inputs)
+		}
+	}
+}
+
+func TestGCTrackerService_SaveSession(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("test-key"))
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.Get(request, "TESTSESSION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &GCTrackerService{}
+	request = request.WithContext(withSession(request.Context(), session))
+	token := s.CSRFToken(request.Context())
+	response := httptest.NewRecorder()
+	if err := s.SaveSession(response, request); err != nil {
+		t.Fatalf("GCTrackerService.SaveSession() error = %v, wantErr %v", err, false)
+	}
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range response.Result().Cookies() {
+		request.AddCookie(c)
+	}
+	session, err = store.Get(request, "TESTSESSION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.CheckCSRF(withSession(context.Background(), session), token); !got {
+		t.Errorf("GCTrackerService.CheckCSRF() = %v after SaveSession(), want %v", got, true)
+	}
+	if err := (&GCTrackerService{}).SaveSession(httptest.NewRecorder(), request); err != nil {
+		t.Errorf("GCTrackerService.SaveSession() error = %v without session, wantErr %v", err, false)
+	}
+}
+
 func TestGCTrackerService_UpdateCases(t *testing.T) {
 	createCnt := 0
 	cntFunc := func() {
@@ -341,30 +653,35 @@ func TestGCTrackerService_UpdateCases(t *testing.T) {
 	tests := []struct {
 		name      string
 		cases     []*MockGCTrackerCase
+		want      UpdateResult
 		wantErr   bool
 		createCnt int
 	}{
 		{
 			name:      "No cases",
+			want:      UpdateResult{FailedIDs: []string{}},
 			wantErr:   false,
 			createCnt: 0,
 		},
 		{
 			name:      "Update successfull",
-			cases:     []*MockGCTrackerCase{{cnt: cntFunc}, {cnt: cntFunc}},
+			cases:     []*MockGCTrackerCase{{id: "1", cnt: cntFunc}, {id: "2", cnt: cntFunc}},
+			want:      UpdateResult{Checked: 2, FailedIDs: []string{}},
 			wantErr:   false,
 			createCnt: 0,
 		},
 		{
 			name:      "Status Check = status changed",
-			cases:     []*MockGCTrackerCase{{err: errors.New("status changed"), cnt: cntFunc}, {cnt: cntFunc}},
+			cases:     []*MockGCTrackerCase{{id: "1", err: data.ErrStatusChanged, cnt: cntFunc}, {id: "2", cnt: cntFunc}},
+			want:      UpdateResult{Checked: 2, Changed: 1, FailedIDs: []string{}},
 			wantErr:   false,
 			createCnt: 1,
 		},
 		{
 			name:      "Status Check failed",
-			cases:     []*MockGCTrackerCase{{err: errors.New("fail"), cnt: cntFunc}, {cnt: cntFunc}},
-			wantErr:   true,
+			cases:     []*MockGCTrackerCase{{id: "1", err: errors.New("fail"), cnt: cntFunc}, {id: "2", cnt: cntFunc}},
+			want:      UpdateResult{Checked: 2, Failed: 1, FailedIDs: []string{"1"}},
+			wantErr:   false,
 			createCnt: 0,
 		},
 	}
@@ -376,9 +693,13 @@ func TestGCTrackerService_UpdateCases(t *testing.T) {
 					cases: tt.cases,
 				},
 			}
-			if err := s.UpdateCases(); (err != nil) != tt.wantErr {
+			got, err := s.UpdateCases(context.Background())
+			if (err != nil) != tt.wantErr {
 				t.Errorf("GCTrackerService.UpdateCases() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GCTrackerService.UpdateCases() = %+v, want %+v", got, tt.want)
+			}
 			if tt.createCnt != createCnt {
 				t.Errorf("GCTrackerService.UpdateCases() creted = %d, want %d", createCnt, tt.createCnt)
 			}
@@ -427,9 +748,13 @@ func TestGCTrackerService_SignIn(t *testing.T) {
 			s := &GCTrackerService{
 				data: &MockGCTrackerData{},
 			}
-			if err := s.SignIn(tt.args); (err != nil) != tt.wantErr {
+			r := s.GetSession(httptest.NewRecorder(), postForm("/signin", tt.args))
+			if err := s.SignIn(httptest.NewRecorder(), r); (err != nil) != tt.wantErr {
 				t.Errorf("GCTrackerService.SignIn() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if got := s.IsAuthenticated(r.Context()); got != !tt.wantErr {
+				t.Errorf("GCTrackerService.IsAuthenticated() = %v after SignIn(), want %v", got, !tt.wantErr)
+			}
 		})
 	}
 }
@@ -477,19 +802,69 @@ func TestGCTrackerService_SignUp(t *testing.T) {
 				"password": []string{"goodpassword"},
 			},
 			wantErr:          false,
-			wantNotification: "Your account 'gooduser' has been created.",
+			wantNotification: "http://example.com/verify?t=token",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			d := &MockGCTrackerData{}
 			s := &GCTrackerService{data: d}
-			if err := s.SignUp(tt.args); (err != nil) != tt.wantErr {
+			if err := s.SignUp(postForm("/signup", tt.args)); (err != nil) != tt.wantErr {
 				t.Errorf("GCTrackerService.SignUp() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			if d.user.notification != tt.wantNotification {
 				t.Errorf("GCTrackerService.SignUp() notification = %v, want %v", d.user.notification, tt.wantNotification)
 			}
+			if !tt.wantErr && d.user.IsVerified() {
+				t.Errorf("GCTrackerService.SignUp() created a verified user")
+			}
+		})
+	}
+}
+
+func Test_linkURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		header  http.Header
+		tls     bool
+		want    string
+	}{
+		{
+			name: "Plain request",
+			want: "http://example.com/verify",
+		},
+		{
+			name: "TLS request",
+			tls:  true,
+			want: "https://example.com/verify",
+		},
+		{
+			name:   "Behind HTTPS proxy",
+			header: http.Header{"X-Forwarded-Proto": []string{"https"}},
+			want:   "https://example.com/verify",
+		},
+		{
+			name:    "BASE_URL",
+			baseURL: "https://tracker.example.org/",
+			want:    "https://tracker.example.org/verify",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(base string) { config.Config.BaseURL = base }(config.Config.BaseURL)
+			config.Config.BaseURL = tt.baseURL
+			target := "http://example.com/signup"
+			if tt.tls {
+				target = "https://example.com/signup"
+			}
+			r := httptest.NewRequest(http.MethodPost, target, nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			if got := linkURL(r, "/verify"); got != tt.want {
+				t.Errorf("linkURL() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
@@ -498,6 +873,7 @@ func TestGCTrackerService_ResetPwd(t *testing.T) {
 	tests := []struct {
 		name             string
 		args             *http.Request
+		baseURL          string
 		wantErr          bool
 		wantNotification string
 	}{
@@ -519,11 +895,22 @@ func TestGCTrackerService_ResetPwd(t *testing.T) {
 				"username": []string{"existing"},
 			}),
 			wantErr:          false,
-			wantNotification: "/changepwd?a=r&t=token",
+			wantNotification: "http://example.com/changepwd?a=r&t=token",
+		},
+		{
+			name: "Existing user behind base URL",
+			args: postForm("/resetpwd", url.Values{
+				"username": []string{"existing"},
+			}),
+			baseURL:          "https://tracker.example.org/",
+			wantErr:          false,
+			wantNotification: "https://tracker.example.org/changepwd?a=r&t=token",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			defer func(base string) { config.Config.BaseURL = base }(config.Config.BaseURL)
+			config.Config.BaseURL = tt.baseURL
 			d := &MockGCTrackerData{}
 			s := &GCTrackerService{data: d}
 			if err := s.ResetPwd(tt.args); (err != nil) != tt.wantErr {
@@ -553,7 +940,7 @@ func TestGCTrackerService_ChangePwd(t *testing.T) {
 	}{
 		{
 			name: "Empty session and form",
-			args: args{s: setSession(nil)},
+			args: args{r: postForm("/changepwd", nil), s: setSession(nil)},
 			want: want{err: true},
 		},
 		{
@@ -640,8 +1027,8 @@ func TestGCTrackerService_ChangePwd(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			d := &MockGCTrackerData{}
-			s := &GCTrackerService{session: tt.args.s, data: d}
-			if err := s.ChangePwd(tt.args.r); (err != nil) != tt.want.err {
+			s := &GCTrackerService{data: d}
+			if err := s.ChangePwd(httptest.NewRecorder(), tt.args.r.WithContext(withSession(context.Background(), tt.args.s))); (err != nil) != tt.want.err {
 				t.Errorf("GCTrackerService.ChangePwd() error = %v, wantErr %v", err, tt.want.err)
 			}
 			if d.user != nil && d.user.notification != tt.want.notification {
@@ -654,6 +1041,31 @@ func TestGCTrackerService_ChangePwd(t *testing.T) {
 	}
 }
 
+func TestGCTrackerService_ChangePwd_ResetOnce_MemoryData(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d}
+	if err := s.ResetPwd(postForm("/resetpwd", url.Values{"username": []string{"existing"}})); err != nil {
+		t.Fatalf("GCTrackerService.ResetPwd() error = %v", err)
+	}
+	user, _ := d.GetUser(ctx, "existing")
+	token := user.(*data.GCTrackerUserImpl).Reset.Token
+	form := url.Values{"password": []string{"newpassword1"}, "password2": []string{"newpassword1"}}
+
+	session := setSession(sessionValues{"resetToken": token})
+	if err := s.ChangePwd(httptest.NewRecorder(), postForm("/changepwd", form).WithContext(withSession(ctx, session))); err != nil {
+		t.Fatalf("GCTrackerService.ChangePwd() error = %v", err)
+	}
+	if _, ok := session.Values["resetToken"]; ok {
+		t.Errorf("GCTrackerService.ChangePwd() kept the reset token in the session")
+	}
+	// The link cannot be used again, even from another session
+	session = setSession(sessionValues{"resetToken": token})
+	if err := s.ChangePwd(httptest.NewRecorder(), postForm("/changepwd", form).WithContext(withSession(ctx, session))); !errors.Is(err, data.ErrTokenNotFound) {
+		t.Errorf("GCTrackerService.ChangePwd() with used token error = %v, want %v", err, data.ErrTokenNotFound)
+	}
+}
+
 func TestGCTrackerService_AddCase(t *testing.T) {
 	type args struct {
 		formData url.Values
@@ -700,8 +1112,8 @@ func TestGCTrackerService_AddCase(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			d := &MockGCTrackerData{}
-			s := &GCTrackerService{session: tt.args.s, data: d}
-			s.AddCase(tt.args.formData)
+			s := &GCTrackerService{data: d}
+			s.AddCase(withSession(context.Background(), tt.args.s), tt.args.formData)
 			if d.user.caseAdded != tt.want {
 				t.Errorf("GCTrackerService.AddCase() caseAdded = %v, want %v", d.user.caseAdded, tt.want)
 			}
@@ -763,8 +1175,8 @@ func TestGCTrackerService_DelCases(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			d := &MockGCTrackerData{}
-			s := &GCTrackerService{session: tt.args.s, data: d}
-			s.DelCases(tt.args.cases)
+			s := &GCTrackerService{data: d}
+			s.DelCases(withSession(context.Background(), tt.args.s), tt.args.cases)
 			if d.user.casesDeleted != tt.want {
 				t.Errorf("GCTrackerService.DelCases() caseAdded = %v, want %v", d.user.casesDeleted, tt.want)
 			}
@@ -795,7 +1207,7 @@ func TestGCTrackerService_RenderCases(t *testing.T) {
 		{
 			name: "Existing user with cases",
 			args: args{s: setSession(sessionValues{"username": "existing"})},
-			want: "<tr><td class=check><input type=checkbox name=cases value=1></td><td>1</td><td>case1</td><td>status1</td></tr><tr><td class=check><input type=checkbox name=cases value=2></td><td>2</td><td>case2</td><td>status2</td></tr>",
+			want: "<tr><td class=check><input type=checkbox name=cases value=1></td><td><a href=/case?id=1>1</a></td><td>case1</td><td>status1</td></tr><tr><td class=check><input type=checkbox name=cases value=2></td><td><a href=/case?id=2>2</a></td><td>case2</td><td>&lt;b&gt;status2&lt;/b&gt;</td></tr>",
 		},
 		{
 			name: "Existing user without cases",
@@ -806,14 +1218,65 @@ func TestGCTrackerService_RenderCases(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			d := &MockGCTrackerData{}
-			s := &GCTrackerService{session: tt.args.s, data: d}
-			if got := s.RenderCases(); got != tt.want {
+			s := &GCTrackerService{data: d}
+			if got := s.RenderCases(withSession(context.Background(), tt.args.s)); got != tt.want {
 				t.Errorf("GCTrackerService.RenderCases() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func TestGCTrackerService_RenderCase(t *testing.T) {
+	type args struct {
+		s  *sessions.Session
+		id string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Non-existing user",
+			args:    args{s: setSession(sessionValues{"username": "nonexisting"}), id: "1"},
+			wantErr: true,
+		},
+		{
+			name:    "Case of other user",
+			args:    args{s: setSession(sessionValues{"username": "existing"}), id: "3"},
+			wantErr: true,
+		},
+		{
+			name: "Case without history",
+			args: args{s: setSession(sessionValues{"username": "existing"}), id: "2"},
+			want: "<h2>2 case2</h2><table><tr><th>Status</th><th>Details</th><th>First seen</th><th>Last checked</th></tr></table>",
+		},
+		{
+			name: "Case with history",
+			args: args{s: setSession(sessionValues{"username": "existing"}), id: "1"},
+			want: "<h2>1 case1</h2><div>Form: I-485</div><div>Action date: 2021-07-01</div><div>Card was mailed</div>" +
+				"<div>USPS tracking number: 9205590164917312751089</div><table><tr><th>Status</th><th>Details</th><th>First seen</th><th>Last checked</th></tr>" +
+				"<tr><td>Case Was Approved</td><td>We approved</td><td>1970-01-02 00:00 UTC</td><td>1970-01-02 01:00 UTC</td></tr>" +
+				"<tr><td>Case Was Received</td><td>We received &lt;Form I-485&gt;</td><td>1970-01-01 00:00 UTC</td><td>1970-01-01 01:00 UTC</td></tr>" +
+				"</table>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &MockGCTrackerData{}
+			s := &GCTrackerService{data: d}
+			got, err := s.RenderCase(withSession(context.Background(), tt.args.s), tt.args.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GCTrackerService.RenderCase() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GCTrackerService.RenderCase() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGCTrackerService_RenderError(t *testing.T) {
 	type args struct {
 		errorMsg string
@@ -838,6 +1301,11 @@ func TestGCTrackerService_RenderError(t *testing.T) {
 			args: args{"error1\nerror2"},
 			want: "<div class='error'><ul><li>error1<li>error2</ul></div>",
 		},
+		{
+			name: "Markup in error",
+			args: args{"unknown time zone <script>alert(1)</script>"},
+			want: "<div class='error'><ul><li>unknown time zone &lt;script&gt;alert(1)&lt;/script&gt;</ul></div>",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -849,3 +1317,1309 @@ func TestGCTrackerService_RenderError(t *testing.T) {
 		})
 	}
 }
+
+func newMemoryData(t *testing.T) *data.MemoryGCTrackerData {
+	t.Helper()
+	d := data.NewMemoryGCTrackerData()
+	user := d.NewUser()
+	user.Set(url.Values{
+		"username": []string{"existing"},
+		"email":    []string{"existing@example.com"},
+		"password": []string{"testpassword"},
+	})
+	if err := user.HashAndSalt(); err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+	if err := d.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("cannot create user: %v", err)
+	}
+	for _, c := range []url.Values{
+		{"case": []string{"ABC0000000001"}, "name": []string{"case1"}},
+		{"case": []string{"ABC0000000002"}, "name": []string{"case2"}},
+	} {
+		gcCase := d.NewCase()
+		gcCase.Set(c)
+		if err := user.AddCase(context.Background(), gcCase); err != nil {
+			t.Fatalf("cannot add case: %v", err)
+		}
+	}
+	return d
+}
+
+func TestGCTrackerService_SignIn_MemoryData(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    url.Values
+		wantErr bool
+	}{
+		{
+			name: "Wrong user",
+			args: url.Values{
+				"username": []string{"nonexisting"},
+				"password": []string{"testpassword"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Wrong password",
+			args: url.Values{
+				"username": []string{"existing"},
+				"password": []string{"wrongpassword"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Successful sign in",
+			args: url.Values{
+				"username": []string{"existing"},
+				"password": []string{"testpassword"},
+			},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewGCTrackerService(newMemoryData(t))
+			r := s.GetSession(httptest.NewRecorder(), postForm("/signin", tt.args))
+			if err := s.SignIn(httptest.NewRecorder(), r); (err != nil) != tt.wantErr {
+				t.Errorf("GCTrackerService.SignIn() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// sessionRequest carries the session cookies set by response. Requests are
+// not reused, the sessions registry caches sessions per request.
+func sessionRequest(response *httptest.ResponseRecorder) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	cookies := map[string]*http.Cookie{}
+	// The latest cookie of a name wins, as in browsers
+	for _, c := range response.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	for _, c := range cookies {
+		if c.MaxAge >= 0 {
+			request.AddCookie(c)
+		}
+	}
+	return request
+}
+
+func TestGCTrackerService_Session_MemoryData(t *testing.T) {
+	config.Config.Cookie = "TESTSESSION"
+	defer func(maxAge time.Duration) { config.Config.SessionMaxAge = maxAge }(config.Config.SessionMaxAge)
+	config.Config.SessionMaxAge = 12 * time.Hour
+	s := NewGCTrackerService(newMemoryData(t))
+
+	// An anonymous session, e.g. with an ID planted by someone else
+	anonymous := httptest.NewRecorder()
+	r := s.GetSession(anonymous, httptest.NewRequest(http.MethodGet, "/", nil))
+	s.CSRFToken(r.Context())
+	s.SaveSession(anonymous, r)
+	anonymousID := getSession(r.Context()).ID
+
+	signedIn := httptest.NewRecorder()
+	r = postForm("/signin", url.Values{"username": []string{"existing"}, "password": []string{"testpassword"}})
+	for _, c := range sessionRequest(anonymous).Cookies() {
+		r.AddCookie(c)
+	}
+	r = s.GetSession(httptest.NewRecorder(), r)
+	if err := s.SignIn(signedIn, r); err != nil {
+		t.Fatalf("GCTrackerService.SignIn() error = %v, wantErr %v", err, false)
+	}
+	if session := getSession(r.Context()); session.ID == "" || session.ID == anonymousID {
+		t.Errorf("GCTrackerService.SignIn() kept session ID %q", anonymousID)
+	}
+	if got, want := getSession(r.Context()).Options.MaxAge, int((12 * time.Hour).Seconds()); got != want {
+		t.Errorf("GCTrackerService.SignIn() MaxAge = %v, want %v", got, want)
+	}
+
+	r = s.GetSession(httptest.NewRecorder(), sessionRequest(anonymous))
+	if s.IsAuthenticated(r.Context()) || getSession(r.Context()).ID == anonymousID {
+		t.Errorf("Session ID %q known before sign in still works", anonymousID)
+	}
+	r = s.GetSession(httptest.NewRecorder(), sessionRequest(signedIn))
+	if !s.IsAuthenticated(r.Context()) || sessionUser(r.Context()) != "existing" {
+		t.Errorf("GCTrackerService.GetSession() = %v, want the session of %v", getSession(r.Context()).Values, "existing")
+	}
+
+	if err := s.SignOut(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("GCTrackerService.SignOut() error = %v, wantErr %v", err, false)
+	}
+	if s.IsAuthenticated(r.Context()) {
+		t.Errorf("GCTrackerService.IsAuthenticated() = %v after SignOut(), want %v", true, false)
+	}
+	r = s.GetSession(httptest.NewRecorder(), sessionRequest(signedIn))
+	if s.IsAuthenticated(r.Context()) {
+		t.Errorf("Session is still authenticated after SignOut()")
+	}
+}
+
+func TestGCTrackerService_Session_Expiry(t *testing.T) {
+	config.Config.Cookie = "TESTSESSION"
+	defer func(maxAge, idle time.Duration) {
+		config.Config.SessionMaxAge, config.Config.SessionIdle = maxAge, idle
+	}(config.Config.SessionMaxAge, config.Config.SessionIdle)
+	config.Config.SessionMaxAge = 24 * time.Hour
+	config.Config.SessionIdle = time.Hour
+	now := time.Now()
+	tests := []struct {
+		name     string
+		created  time.Time
+		seen     time.Time
+		wantAuth bool
+		wantSeen bool
+	}{
+		{
+			name:     "Active session",
+			created:  now.Add(-time.Hour),
+			seen:     now.Add(-10 * time.Second),
+			wantAuth: true,
+		},
+		{
+			name:     "Active session - latest request saved",
+			created:  now.Add(-time.Hour),
+			seen:     now.Add(-10 * time.Minute),
+			wantAuth: true,
+			wantSeen: true,
+		},
+		{
+			name:     "Idle session",
+			created:  now.Add(-2 * time.Hour),
+			seen:     now.Add(-90 * time.Minute),
+			wantAuth: false,
+		},
+		{
+			name:     "Old session",
+			created:  now.Add(-25 * time.Hour),
+			seen:     now.Add(-time.Minute),
+			wantAuth: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewGCTrackerService(newMemoryData(t))
+			response := httptest.NewRecorder()
+			r := s.GetSession(response, httptest.NewRequest(http.MethodGet, "/", nil))
+			session := getSession(r.Context())
+			session.Values[sessionAuthenticated] = true
+			session.Values[sessionUsername] = "existing"
+			session.Values[sessionCreated] = tt.created.Unix()
+			session.Values[sessionSeen] = tt.seen.Unix()
+			s.SaveSession(response, r)
+
+			r = s.GetSession(httptest.NewRecorder(), sessionRequest(response))
+			if got := s.IsAuthenticated(r.Context()); got != tt.wantAuth {
+				t.Errorf("GCTrackerService.IsAuthenticated() = %v, want %v", got, tt.wantAuth)
+			}
+			r = s.GetSession(httptest.NewRecorder(), sessionRequest(response))
+			if got := s.IsAuthenticated(r.Context()); got != tt.wantAuth {
+				t.Errorf("GCTrackerService.IsAuthenticated() = %v on the next request, want %v", got, tt.wantAuth)
+			}
+			if got := sessionTime(getSession(r.Context()).Values[sessionSeen]) > tt.seen.Unix(); tt.wantAuth && got != tt.wantSeen {
+				t.Errorf("Latest request saved = %v, want %v", got, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_SetResetToken_MemoryData(t *testing.T) {
+	config.Config.Cookie = "TESTSESSION"
+	s := NewGCTrackerService(newMemoryData(t))
+	response := httptest.NewRecorder()
+	r := s.GetSession(response, httptest.NewRequest(http.MethodGet, "/changepwd?a=r&t=token", nil))
+	if err := s.SetResetToken(response, r, "token"); err != nil {
+		t.Fatalf("GCTrackerService.SetResetToken() error = %v, wantErr %v", err, false)
+	}
+	r = s.GetSession(httptest.NewRecorder(), sessionRequest(response))
+	if got := s.GetResetToken(r.Context()); got != "token" {
+		t.Errorf("GCTrackerService.GetResetToken() = %v, want %v", got, "token")
+	}
+}
+
+func TestGCTrackerService_DelCases_MemoryData(t *testing.T) {
+	tests := []struct {
+		name  string
+		cases []string
+		want  string
+	}{
+		{
+			name:  "Delete nothing",
+			cases: []string{},
+			want:  "<tr><td class=check><input type=checkbox name=cases value=ABC0000000001></td><td><a href=/case?id=ABC0000000001>ABC0000000001</a></td><td>case1</td><td></td></tr><tr><td class=check><input type=checkbox name=cases value=ABC0000000002></td><td><a href=/case?id=ABC0000000002>ABC0000000002</a></td><td>case2</td><td></td></tr>",
+		},
+		{
+			name:  "Delete 1 case",
+			cases: []string{"ABC0000000001"},
+			want:  "<tr><td class=check><input type=checkbox name=cases value=ABC0000000002></td><td><a href=/case?id=ABC0000000002>ABC0000000002</a></td><td>case2</td><td></td></tr>",
+		},
+		{
+			name:  "Delete all cases",
+			cases: []string{"ABC0000000001", "ABC0000000002"},
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newMemoryData(t)
+			s := &GCTrackerService{data: d}
+			ctx := withSession(context.Background(), setSession(sessionValues{"username": "existing"}))
+			s.DelCases(ctx, tt.cases)
+			if got := s.RenderCases(ctx); got != tt.want {
+				t.Errorf("GCTrackerService.RenderCases() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newStatusProvider checks cases against a local stand-in for USCIS which
+// reports the titles by receipt number
+func newStatusProvider(t *testing.T, titles map[string]string) status.StatusProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		title, ok := titles[r.PostFormValue("appReceiptNum")]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `<div class="rows text-center"><h1>%s</h1><p>On May 5, 2021, we did it.</p></div>`, title)
+	}))
+	t.Cleanup(server.Close)
+	return status.NewUSCISProvider(server.URL, server.Client())
+}
+
+func TestGCTrackerService_AddCase_MemoryData(t *testing.T) {
+	tests := []struct {
+		name        string
+		formData    url.Values
+		wantStatus  string
+		wantHistory int
+	}{
+		{
+			name:        "New case is checked",
+			formData:    url.Values{"case": []string{"ABC0000000003"}, "name": []string{"case3"}},
+			wantStatus:  "Case Was Received",
+			wantHistory: 1,
+		},
+		{
+			name:        "Tracked case is not checked again",
+			formData:    url.Values{"case": []string{"ABC0000000001"}, "name": []string{"mine"}},
+			wantStatus:  "",
+			wantHistory: 0,
+		},
+		{
+			name:        "Provider failure",
+			formData:    url.Values{"case": []string{"ABC0000000004"}, "name": []string{"case4"}},
+			wantStatus:  "",
+			wantHistory: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withSession(context.Background(), setSession(sessionValues{"username": "existing"}))
+			d := newMemoryData(t)
+			s := &GCTrackerService{
+				data: d,
+				provider: newStatusProvider(t, map[string]string{
+					"ABC0000000001": "Case Was Approved",
+					"ABC0000000003": "Case Was Received",
+				}),
+			}
+			s.AddCase(ctx, tt.formData)
+			id := tt.formData.Get("case")
+			c, err := d.GetCase(ctx, id)
+			if err != nil {
+				t.Fatalf("GCTrackerData.GetCase() error = %v", err)
+			}
+			if c.GetStatus() != tt.wantStatus {
+				t.Errorf("GCTrackerService.AddCase() status = %q, want %q", c.GetStatus(), tt.wantStatus)
+			}
+			if history, _ := d.GetCaseHistory(ctx, id); len(history) != tt.wantHistory {
+				t.Errorf("GCTrackerService.AddCase() history = %v, want %d entries", history, tt.wantHistory)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_UpdateCases_MemoryData(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryData(t)
+	s := &GCTrackerService{
+		data: d,
+		provider: newStatusProvider(t, map[string]string{
+			"ABC0000000001": "Case Was Approved",
+			"ABC0000000002": "Case Was Received",
+		}),
+		update: UpdateOptions{Workers: 4},
+	}
+	result, err := s.UpdateCases(ctx)
+	if err != nil {
+		t.Fatalf("GCTrackerService.UpdateCases() error = %v", err)
+	}
+	if want := (UpdateResult{Checked: 2, Changed: 2, FailedIDs: []string{}}); !reflect.DeepEqual(result, want) {
+		t.Errorf("GCTrackerService.UpdateCases() = %+v, want %+v", result, want)
+	}
+	c, _ := d.GetCase(ctx, "ABC0000000001")
+	if got, want := c.GetStatus(), "Case Was Approved"; got != want {
+		t.Errorf("GCTrackerService.UpdateCases() status = %q, want %q", got, want)
+	}
+	if got, want := c.GetDetails().ActionDate, time.Date(2021, time.May, 5, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("GCTrackerService.UpdateCases() action date = %v, want %v", got, want)
+	}
+	if history, _ := d.GetCaseHistory(ctx, "ABC0000000001"); len(history) != 1 {
+		t.Errorf("GCTrackerService.UpdateCases() history = %v, want 1 entry", history)
+	}
+}
+
+// flakyProvider fails the first fails[id] checks of a case
+type flakyProvider struct {
+	mu    sync.Mutex
+	fails map[string]int
+	calls map[string]int
+}
+
+func (p *flakyProvider) CheckStatus(ctx context.Context, id string) (status.Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls[id]++
+	if p.calls[id] <= p.fails[id] {
+		return status.Status{}, errors.New("non-ok response received")
+	}
+	return status.Status{Title: "Case Was Received"}, nil
+}
+
+func TestGCTrackerService_UpdateCases_Retry(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		fails     map[string]int
+		want      UpdateResult
+		wantCalls map[string]int
+	}{
+		{
+			name:      "No retries",
+			fails:     map[string]int{"ABC0000000001": 1},
+			want:      UpdateResult{Checked: 2, Changed: 1, Failed: 1, FailedIDs: []string{"ABC0000000001"}},
+			wantCalls: map[string]int{"ABC0000000001": 1, "ABC0000000002": 1},
+		},
+		{
+			name:      "Recovered after retries",
+			retries:   2,
+			fails:     map[string]int{"ABC0000000001": 2, "ABC0000000002": 1},
+			want:      UpdateResult{Checked: 2, Changed: 2, FailedIDs: []string{}},
+			wantCalls: map[string]int{"ABC0000000001": 3, "ABC0000000002": 2},
+		},
+		{
+			name:      "Retries exhausted",
+			retries:   1,
+			fails:     map[string]int{"ABC0000000001": 5, "ABC0000000002": 5},
+			want:      UpdateResult{Checked: 2, Failed: 2, FailedIDs: []string{"ABC0000000001", "ABC0000000002"}},
+			wantCalls: map[string]int{"ABC0000000001": 2, "ABC0000000002": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &flakyProvider{fails: tt.fails, calls: map[string]int{}}
+			s := &GCTrackerService{
+				data:     newMemoryData(t),
+				provider: p,
+				update:   UpdateOptions{Workers: 2, Retries: tt.retries, Backoff: time.Millisecond},
+			}
+			got, err := s.UpdateCases(context.Background())
+			if err != nil {
+				t.Fatalf("GCTrackerService.UpdateCases() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GCTrackerService.UpdateCases() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(p.calls, tt.wantCalls) {
+				t.Errorf("GCTrackerService.UpdateCases() calls = %v, want %v", p.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_UpdateCases_Rate(t *testing.T) {
+	s := &GCTrackerService{
+		data:     newMemoryData(t),
+		provider: &flakyProvider{calls: map[string]int{}},
+		update:   UpdateOptions{Workers: 4, Rate: 20},
+	}
+	start := time.Now()
+	if _, err := s.UpdateCases(context.Background()); err != nil {
+		t.Fatalf("GCTrackerService.UpdateCases() error = %v", err)
+	}
+	// 2 requests at 20 per second cannot be done in less than 100ms
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("GCTrackerService.UpdateCases() took %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestGCTrackerService_UpdateCases_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := &GCTrackerService{
+		data:     newMemoryData(t),
+		provider: &flakyProvider{calls: map[string]int{}},
+		update:   UpdateOptions{Rate: 1},
+	}
+	if _, err := s.UpdateCases(ctx); err != context.Canceled {
+		t.Errorf("GCTrackerService.UpdateCases() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// releasingProvider lets the user drop a case while its status is checked
+type releasingProvider struct {
+	data *data.MemoryGCTrackerData
+	id   string
+}
+
+func (p *releasingProvider) CheckStatus(ctx context.Context, id string) (status.Status, error) {
+	if id == p.id {
+		user := p.data.NewUser()
+		if err := user.GetByUsername(ctx, "existing"); err != nil {
+			return status.Status{}, err
+		}
+		if err := user.DelCase(ctx, id); err != nil {
+			return status.Status{}, err
+		}
+	}
+	return status.Status{Title: "Case Was Approved"}, nil
+}
+
+func TestGCTrackerService_UpdateCases_Released(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d, provider: &releasingProvider{data: d, id: "ABC0000000001"}}
+	result, err := s.UpdateCases(ctx)
+	if err != nil {
+		t.Fatalf("GCTrackerService.UpdateCases() error = %v", err)
+	}
+	if want := (UpdateResult{Checked: 2, Changed: 1, FailedIDs: []string{}}); !reflect.DeepEqual(result, want) {
+		t.Errorf("GCTrackerService.UpdateCases() = %+v, want %+v", result, want)
+	}
+	if _, err := d.GetCase(ctx, "ABC0000000001"); !errors.Is(err, data.ErrCaseNotFound) {
+		t.Errorf("GCTrackerData.GetCase() of released case error = %v, wantErr %v", err, data.ErrCaseNotFound)
+	}
+	if c, err := d.GetCase(ctx, "ABC0000000002"); err != nil || c.GetStatus() != "Case Was Approved" {
+		t.Errorf("GCTrackerData.GetCase() = %v, %v, want status %q", c, err, "Case Was Approved")
+	}
+}
+
+// blockingProvider waits for release before answering
+type blockingProvider struct {
+	called  chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (p *blockingProvider) CheckStatus(ctx context.Context, id string) (status.Status, error) {
+	p.once.Do(func() { close(p.called) })
+	<-p.release
+	return status.Status{Title: "Case Was Received"}, nil
+}
+
+func TestGCTrackerService_UpdateCases_Overlap(t *testing.T) {
+	p := &blockingProvider{called: make(chan struct{}), release: make(chan struct{})}
+	s := &GCTrackerService{data: newMemoryData(t), provider: p, updates: &updateState{}}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.UpdateCases(context.Background())
+		done <- err
+	}()
+	<-p.called
+	if !s.UpdateStatus().Running {
+		t.Errorf("GCTrackerService.UpdateStatus() running = false, want true")
+	}
+	if _, err := s.UpdateCases(context.Background()); err != ErrUpdateRunning {
+		t.Errorf("GCTrackerService.UpdateCases() error = %v, want %v", err, ErrUpdateRunning)
+	}
+	close(p.release)
+	if err := <-done; err != nil {
+		t.Fatalf("GCTrackerService.UpdateCases() error = %v", err)
+	}
+
+	got := s.UpdateStatus()
+	if got.Running || got.LastStarted == 0 || got.LastFinished == 0 || got.LastError != "" {
+		t.Errorf("GCTrackerService.UpdateStatus() = %+v", got)
+	}
+	if want := (&UpdateResult{Checked: 2, Changed: 2, FailedIDs: []string{}}); !reflect.DeepEqual(got.LastResult, want) {
+		t.Errorf("GCTrackerService.UpdateStatus() result = %+v, want %+v", got.LastResult, want)
+	}
+}
+
+func TestGCTrackerService_StartScheduler(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		wantRun  bool
+	}{
+		{
+			name:     "Disabled",
+			interval: 0,
+			wantRun:  false,
+		},
+		{
+			name:     "Enabled",
+			interval: 10 * time.Millisecond,
+			wantRun:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := &GCTrackerService{
+				data:     newMemoryData(t),
+				provider: &flakyProvider{calls: map[string]int{}},
+				updates:  &updateState{},
+			}
+			s.StartScheduler(ctx, tt.interval, 5*time.Millisecond)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for s.UpdateStatus().LastResult == nil && tt.wantRun && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if !tt.wantRun {
+				time.Sleep(50 * time.Millisecond)
+			}
+			got := s.UpdateStatus()
+			if (got.LastResult != nil) != tt.wantRun {
+				t.Errorf("GCTrackerService.StartScheduler() ran = %v, want %v", got.LastResult != nil, tt.wantRun)
+			}
+			if (got.NextRun != 0) != tt.wantRun {
+				t.Errorf("GCTrackerService.StartScheduler() next run = %d", got.NextRun)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_SaveSettings_MemoryData(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		before   data.NotificationSettings
+		form     url.Values
+		want     data.NotificationSettings
+		wantErr  bool
+	}{
+		{
+			name:     "Non-existing user",
+			username: "nonexisting",
+			form:     url.Values{"quietFrom": []string{"0"}, "quietTo": []string{"0"}},
+			wantErr:  true,
+		},
+		{
+			name:     "Everything on",
+			username: "existing",
+			form: url.Values{
+				"status":    []string{"on"},
+				"account":   []string{"on"},
+				"quietFrom": []string{"0"},
+				"quietTo":   []string{"0"},
+			},
+			want: data.NotificationSettings{},
+		},
+		{
+			name:     "Digest and quiet hours",
+			username: "existing",
+			form: url.Values{
+				"status":    []string{"on"},
+				"digest":    []string{"weekly"},
+				"quietFrom": []string{"22"},
+				"quietTo":   []string{"7"},
+				"timeZone":  []string{" Europe/Berlin "},
+			},
+			want: data.NotificationSettings{
+				MuteAccount:  true,
+				DigestOnly:   true,
+				DigestPeriod: data.DigestWeekly,
+				QuietFrom:    22,
+				QuietTo:      7,
+				TimeZone:     "Europe/Berlin",
+			},
+		},
+		{
+			name:     "Unknown digest period",
+			username: "existing",
+			form:     url.Values{"digest": []string{"hourly"}, "quietFrom": []string{"0"}, "quietTo": []string{"0"}},
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid hours",
+			username: "existing",
+			form:     url.Values{"quietFrom": []string{"noon"}, "quietTo": []string{"7"}},
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown time zone",
+			username: "existing",
+			form:     url.Values{"quietFrom": []string{"0"}, "quietTo": []string{"0"}, "timeZone": []string{"Mars/Olympus"}},
+			wantErr:  true,
+		},
+		{
+			name:     "Webhook",
+			username: "existing",
+			form: url.Values{
+				"status":        []string{"on"},
+				"account":       []string{"on"},
+				"quietFrom":     []string{"0"},
+				"quietTo":       []string{"0"},
+				"webhookUrl":    []string{" https://example.com/hook "},
+				"webhookSecret": []string{"secret"},
+			},
+			want: data.NotificationSettings{WebhookURL: "https://example.com/hook", WebhookSecret: "secret"},
+		},
+		{
+			name:     "Webhook keeps secret",
+			username: "existing",
+			before:   data.NotificationSettings{WebhookURL: "https://example.com/hook", WebhookSecret: "secret"},
+			form: url.Values{
+				"status":     []string{"on"},
+				"account":    []string{"on"},
+				"quietFrom":  []string{"0"},
+				"quietTo":    []string{"0"},
+				"webhookUrl": []string{"https://example.com/other"},
+			},
+			want: data.NotificationSettings{WebhookURL: "https://example.com/other", WebhookSecret: "secret"},
+		},
+		{
+			name:     "Matrix keeps token",
+			username: "existing",
+			before:   data.NotificationSettings{ChatService: "matrix", ChatURL: "https://matrix.example.org/send", ChatToken: "token"},
+			form: url.Values{
+				"status":      []string{"on"},
+				"account":     []string{"on"},
+				"quietFrom":   []string{"0"},
+				"quietTo":     []string{"0"},
+				"chatService": []string{"matrix"},
+				"chatUrl":     []string{"https://matrix.example.org/other"},
+			},
+			want: data.NotificationSettings{ChatService: "matrix", ChatURL: "https://matrix.example.org/other", ChatToken: "token"},
+		},
+		{
+			name:     "Chat off",
+			username: "existing",
+			before:   data.NotificationSettings{ChatService: "slack", ChatURL: "https://hooks.slack.com/services/T/B/X"},
+			form: url.Values{
+				"status":      []string{"on"},
+				"account":     []string{"on"},
+				"quietFrom":   []string{"0"},
+				"quietTo":     []string{"0"},
+				"chatService": []string{"slack"},
+			},
+			want: data.NotificationSettings{},
+		},
+		{
+			name:     "Unknown chat service",
+			username: "existing",
+			form:     url.Values{"quietFrom": []string{"0"}, "quietTo": []string{"0"}, "chatService": []string{"irc"}, "chatUrl": []string{"https://example.com/chat"}},
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid webhook URL",
+			username: "existing",
+			form:     url.Values{"quietFrom": []string{"0"}, "quietTo": []string{"0"}, "webhookUrl": []string{"example.com/hook"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := newMemoryData(t)
+			if user, err := d.GetUser(ctx, tt.username); err == nil {
+				user.SetNotificationSettings(tt.before)
+				user.Update(ctx)
+			}
+			s := &GCTrackerService{data: d}
+			ctx = withSession(ctx, setSession(sessionValues{"username": tt.username}))
+			if err := s.SaveSettings(ctx, tt.form); (err != nil) != tt.wantErr {
+				t.Fatalf("GCTrackerService.SaveSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			user, _ := d.GetUser(ctx, tt.username)
+			if got := user.GetNotificationSettings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GCTrackerService.SaveSettings() = %+v, want %+v", got, tt.want)
+			}
+			page, err := s.RenderSettings(ctx)
+			if err != nil {
+				t.Fatalf("GCTrackerService.RenderSettings() error = %v", err)
+			}
+			if strings.Contains(page, `<option value="weekly" selected>`) != (tt.want.DigestPeriod == data.DigestWeekly) {
+				t.Errorf("GCTrackerService.RenderSettings() = %s", page)
+			}
+			if strings.Contains(page, `<option value="matrix" selected>`) != (tt.want.ChatService == "matrix") {
+				t.Errorf("GCTrackerService.RenderSettings() = %s", page)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_UpdateCases_Digest(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryData(t)
+	user, _ := d.GetUser(ctx, "existing")
+	if err := user.SetNotificationSettings(data.NotificationSettings{DigestOnly: true, DigestPeriod: data.DigestWeekly}); err != nil {
+		t.Fatalf("GCTrackerUser.SetNotificationSettings() error = %v", err)
+	}
+	if err := user.Update(ctx); err != nil {
+		t.Fatalf("GCTrackerUser.Update() error = %v", err)
+	}
+	s := &GCTrackerService{data: d, provider: &flakyProvider{calls: map[string]int{}}}
+	if _, err := s.UpdateCases(ctx); err != nil {
+		t.Fatalf("GCTrackerService.UpdateCases() error = %v", err)
+	}
+
+	queue, err := d.GetQueuedNotifications(ctx, "existing")
+	if err != nil {
+		t.Fatalf("GCTrackerData.GetQueuedNotifications() error = %v", err)
+	}
+	var got []data.Notification
+	for _, n := range queue {
+		if !n.Digest {
+			t.Errorf("GCTrackerService.UpdateCases() queued %+v out of digest", n)
+		}
+		n.Message = ""
+		got = append(got, n.Notification)
+	}
+	want := []data.Notification{
+		{Event: data.EventStatusChange, CaseID: "ABC0000000001", CaseName: "case1", NewStatus: "Case Was Received"},
+		{Event: data.EventStatusChange, CaseID: "ABC0000000002", CaseName: "case2", NewStatus: "Case Was Received"},
+	}
+	// Workers finish in any order
+	sort.Slice(got, func(i, j int) bool { return got[i].CaseID < got[j].CaseID })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GCTrackerService.UpdateCases() queued %+v, want %+v", got, want)
+	}
+}
+
+func TestGCTrackerService_DeliverOutbox_MemoryData(t *testing.T) {
+	ctx := context.Background()
+	defer func(retries int, backoff time.Duration) {
+		config.Config.OutboxRetries, config.Config.OutboxBackoff = retries, backoff
+	}(config.Config.OutboxRetries, config.Config.OutboxBackoff)
+	config.Config.OutboxRetries, config.Config.OutboxBackoff = 2, 0
+	defer func(allow bool) { config.Config.NotifyPrivateHosts = allow }(config.Config.NotifyPrivateHosts)
+	config.Config.NotifyPrivateHosts = true
+
+	var posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The chat is down for the first attempt only
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	d := newMemoryData(t)
+	user, _ := d.GetUser(ctx, "existing")
+	if err := user.SetNotificationSettings(data.NotificationSettings{ChatService: "slack", ChatURL: ts.URL}); err != nil {
+		t.Fatalf("GCTrackerUser.SetNotificationSettings() error = %v", err)
+	}
+	if err := user.Update(ctx); err != nil {
+		t.Fatalf("GCTrackerUser.Update() error = %v", err)
+	}
+	// There is no SMTP server, every email fails
+	user.SendNotification(ctx, data.Notification{Event: data.EventAccount, Message: "Hello"})
+
+	s := &GCTrackerService{data: d}
+	for _, want := range []int{1, 0, 0} {
+		delivered, err := s.DeliverOutbox(ctx)
+		if err != nil {
+			t.Fatalf("GCTrackerService.DeliverOutbox() error = %v", err)
+		}
+		if delivered != want {
+			t.Errorf("GCTrackerService.DeliverOutbox() = %v, want %v", delivered, want)
+		}
+	}
+
+	entries, _ := d.GetOutbox(ctx, "existing", 10)
+	got := map[string]string{}
+	for _, e := range entries {
+		got[e.Channel] = fmt.Sprintf("%s %d", e.Status, e.Attempts)
+	}
+	want := map[string]string{data.ChannelChat: "delivered 2", data.ChannelEmail: "failed 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GCTrackerService.DeliverOutbox() outbox = %v, want %v", got, want)
+	}
+
+	page, err := s.RenderOutbox(withSession(ctx, setSession(sessionValues{"username": "existing"})))
+	if err != nil {
+		t.Fatalf("GCTrackerService.RenderOutbox() error = %v", err)
+	}
+	for _, s := range []string{"<td>Hello</td>", "<td>delivered</td>", "<td>failed after 3 attempts: "} {
+		if !strings.Contains(page, s) {
+			t.Errorf("GCTrackerService.RenderOutbox() = %s, want %s in it", page, s)
+		}
+	}
+}
+
+func TestGCTrackerService_DeliverOutbox_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	defer func(allow bool) { config.Config.NotifyPrivateHosts = allow }(config.Config.NotifyPrivateHosts)
+	config.Config.NotifyPrivateHosts = true
+
+	var posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	d := newMemoryData(t)
+	now := time.Now().Unix()
+	if _, err := d.AddOutbox(ctx, data.OutboxEntry{Username: "existing", Channel: data.ChannelChat, Status: data.OutboxPending,
+		Notification: notify.Notification{Event: data.EventAccount, Username: "existing", Message: "Hello"}, Created: now, Updated: now, NextAttempt: now}); err != nil {
+		t.Fatalf("GCTrackerData.AddOutbox() error = %v", err)
+	}
+	user, _ := d.GetUser(ctx, "existing")
+	user.SetNotificationSettings(data.NotificationSettings{ChatService: "slack", ChatURL: ts.URL})
+	user.Update(ctx)
+
+	// Instances of the service do not share a lock
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &GCTrackerService{data: d}
+			if _, err := s.DeliverOutbox(ctx); err != nil {
+				t.Errorf("GCTrackerService.DeliverOutbox() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&posts); n != 1 {
+		t.Errorf("GCTrackerService.DeliverOutbox() posted %d times, want 1", n)
+	}
+}
+
+func TestGCTrackerService_SignUp_Verification_MemoryData(t *testing.T) {
+	ctx := withSession(context.Background(), setSession(sessionValues{"username": "newuser"}))
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d}
+	err := s.SignUp(postForm("/signup", url.Values{
+		"username":  []string{"newuser"},
+		"email":     []string{"newuser@example.com"},
+		"password":  []string{"newpassword"},
+		"password2": []string{"newpassword"},
+	}))
+	if err != nil {
+		t.Fatalf("GCTrackerService.SignUp() error = %v", err)
+	}
+	outbox, _ := d.GetOutbox(ctx, "newuser", 10)
+	if len(outbox) != 1 || outbox[0].Notification.Event != data.EventVerifyEmail {
+		t.Fatalf("GCTrackerService.SignUp() outbox = %+v, want the verification link", outbox)
+	}
+	link := outbox[0].Notification.Link
+
+	// Features are limited until the email address is confirmed
+	if got := s.RenderVerification(ctx); !strings.Contains(got, `action="/verify"`) {
+		t.Errorf("GCTrackerService.RenderVerification() = %q, want the resend form", got)
+	}
+	s.AddCase(ctx, url.Values{"case": []string{"ABC0000000001"}, "name": []string{"mine"}})
+	if user, _ := d.GetUser(ctx, "newuser"); user.GetCaseName("ABC0000000001") == "mine" {
+		t.Error("GCTrackerService.AddCase() added a case of an unverified user")
+	}
+	if err := s.SaveSettings(ctx, url.Values{"quietFrom": []string{"0"}, "quietTo": []string{"0"}}); err != errNotVerified {
+		t.Errorf("GCTrackerService.SaveSettings() error = %v, want %v", err, errNotVerified)
+	}
+	if err := s.ResendVerification(postForm("/verify", nil).WithContext(ctx)); !errors.Is(err, data.ErrVerifyTooSoon) {
+		t.Errorf("GCTrackerService.ResendVerification() error = %v, want %v", err, data.ErrVerifyTooSoon)
+	}
+
+	if err := s.VerifyEmail(ctx, "forged"); err == nil {
+		t.Error("GCTrackerService.VerifyEmail() accepted a forged link")
+	}
+	if err := s.VerifyEmail(ctx, strings.TrimPrefix(link, "http://example.com/verify?t=")); err != nil {
+		t.Fatalf("GCTrackerService.VerifyEmail() error = %v", err)
+	}
+	if got := s.RenderVerification(ctx); got != "" {
+		t.Errorf("GCTrackerService.RenderVerification() = %q, want empty", got)
+	}
+	if err := s.ResendVerification(postForm("/verify", nil)); err == nil {
+		t.Error("GCTrackerService.ResendVerification() sent a link to a verified user")
+	}
+	if err := s.SaveSettings(ctx, url.Values{"quietFrom": []string{"0"}, "quietTo": []string{"0"}}); err != nil {
+		t.Errorf("GCTrackerService.SaveSettings() error = %v", err)
+	}
+}
+
+func TestGCTrackerService_ChangeEmail(t *testing.T) {
+	tests := []struct {
+		name             string
+		session          *sessions.Session
+		form             url.Values
+		wantErr          bool
+		wantEmail        string
+		wantNotification string
+	}{
+		{
+			name:    "Unknown user",
+			session: setSession(sessionValues{"username": "nonexisting"}),
+			form:    url.Values{"email": []string{"new@example.com"}, "password": []string{"testpassword"}},
+			wantErr: true,
+		},
+		{
+			name:    "Wrong password",
+			session: setSession(sessionValues{"username": "existing"}),
+			form:    url.Values{"email": []string{"new@example.com"}, "password": []string{"wrongpassword"}},
+			wantErr: true,
+		},
+		{
+			name:             "Link sent",
+			session:          setSession(sessionValues{"username": "existing"}),
+			form:             url.Values{"email": []string{" new@example.com "}, "password": []string{"testpassword"}},
+			wantErr:          false,
+			wantEmail:        "new@example.com",
+			wantNotification: "http://example.com/verify?t=token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &MockGCTrackerData{}
+			s := &GCTrackerService{data: d}
+			if err := s.ChangeEmail(postForm("/account", tt.form).WithContext(withSession(context.Background(), tt.session))); (err != nil) != tt.wantErr {
+				t.Errorf("GCTrackerService.ChangeEmail() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if d.user.email != tt.wantEmail || d.user.notification != tt.wantNotification {
+				t.Errorf("GCTrackerService.ChangeEmail() email = %q, notification = %q, want %q, %q",
+					d.user.email, d.user.notification, tt.wantEmail, tt.wantNotification)
+			}
+		})
+	}
+}
+
+func TestGCTrackerService_RenderAccount_MemoryData(t *testing.T) {
+	ctx := withSession(context.Background(), setSession(sessionValues{"username": "existing"}))
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d}
+	got, err := s.RenderAccount(ctx)
+	if err != nil || !strings.Contains(got, "existing@example.com") || strings.Contains(got, "Waiting") {
+		t.Errorf("GCTrackerService.RenderAccount() = %q, %v", got, err)
+	}
+	if err := s.ChangeEmail(postForm("/account", url.Values{
+		"email":    []string{"existing@example.org"},
+		"password": []string{"testpassword"},
+	}).WithContext(ctx)); err != nil {
+		t.Fatalf("GCTrackerService.ChangeEmail() error = %v", err)
+	}
+	got, err = s.RenderAccount(ctx)
+	if err != nil || !strings.Contains(got, "Waiting for confirmation of existing@example.org") {
+		t.Errorf("GCTrackerService.RenderAccount() = %q, %v", got, err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	l := &throttle{store: data.NewMemoryLimiterStore(), opts: LimitOptions{Window: time.Hour, User: 3, IP: 0}}
+	byUser := l.user("signin", "alice")
+	for i, want := range []bool{false, false, true} {
+		if l.locked(ctx, byUser) {
+			t.Fatalf("throttle.locked() = true before attempt %d", i+1)
+		}
+		if got := l.hit(ctx, byUser); got != want {
+			t.Errorf("throttle.hit() of attempt %d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.locked(ctx, byUser) {
+		t.Error("throttle.locked() = false after 3 attempts")
+	}
+	if l.locked(ctx, l.user("signin", "bob"), l.user("resetpwd", "alice")) {
+		t.Error("throttle.locked() = true for other keys")
+	}
+	// A zero limit never locks
+	byIP := l.ip("signin", "192.0.2.1")
+	for i := 0; i < 5; i++ {
+		if l.hit(ctx, byIP) {
+			t.Fatal("throttle.hit() locked a disabled limit")
+		}
+	}
+	l.reset(ctx, byUser)
+	if l.locked(ctx, byUser) {
+		t.Error("throttle.locked() = true after reset")
+	}
+
+	var disabled *throttle
+	if disabled.hit(ctx, disabled.user("signin", "alice")) || disabled.locked(ctx, disabled.user("signin", "alice")) {
+		t.Error("nil throttle locked")
+	}
+}
+
+func TestThrottle_Window(t *testing.T) {
+	ctx := context.Background()
+	store := data.NewMemoryLimiterStore()
+	l := &throttle{store: store, opts: LimitOptions{Window: time.Minute, User: 2, Lockout: time.Hour}}
+	byUser := l.user("signin", "alice")
+
+	// An attempt from a window which is over does not count
+	now := time.Now().Unix()
+	store.UpdateAttempts(ctx, byUser.key, func(a *data.Attempts) {
+		a.Count = 1
+		a.Start = now - 120
+		a.Expires = now + 60
+	})
+	if l.hit(ctx, byUser) {
+		t.Error("throttle.hit() counted an attempt of the previous window")
+	}
+	if !l.hit(ctx, byUser) {
+		t.Error("throttle.hit() did not lock after 2 attempts in the window")
+	}
+	a, _ := store.GetAttempts(ctx, byUser.key)
+	if a.LockedUntil < now+3600 || a.Expires < a.LockedUntil {
+		t.Errorf("throttle.hit() = %+v, want locked for the lockout duration", a)
+	}
+}
+
+func TestGCTrackerService_SignIn_Throttle_MemoryData(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d, throttle: &throttle{store: d.NewLimiterStore(), opts: LimitOptions{Window: time.Hour, User: 3, IP: 5, Lockout: 15 * time.Minute}}}
+	signIn := func(username, password, ip string) error {
+		r := postForm("/signin", url.Values{"username": []string{username}, "password": []string{password}})
+		r.RemoteAddr = ip + ":1234"
+		return s.SignIn(httptest.NewRecorder(), s.GetSession(httptest.NewRecorder(), r))
+	}
+
+	// A successful sign in forgets earlier failures
+	for i := 0; i < 2; i++ {
+		signIn("existing", "wrongpassword", "192.0.2.1")
+	}
+	if err := signIn("existing", "testpassword", "192.0.2.1"); err != nil {
+		t.Fatalf("GCTrackerService.SignIn() error = %v, wantErr %v", err, false)
+	}
+	for i := 0; i < 3; i++ {
+		if err := signIn("existing", "wrongpassword", "192.0.2.1"); err == nil || err == ErrTooManyAttempts {
+			t.Fatalf("GCTrackerService.SignIn() error = %v, want a wrong password", err)
+		}
+	}
+	// Even the right password is refused during the lockout
+	if err := signIn("existing", "testpassword", "192.0.2.2"); err != ErrTooManyAttempts {
+		t.Errorf("GCTrackerService.SignIn() error = %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	outbox, _ := d.GetOutbox(ctx, "existing", 10)
+	if len(outbox) != 1 || outbox[0].Notification.Event != data.EventLockout || outbox[0].Channel != data.ChannelEmail {
+		t.Fatalf("GCTrackerService.SignIn() outbox = %+v, want the lockout email", outbox)
+	}
+	if msg := outbox[0].Notification.Message; !strings.Contains(msg, "blocked for 15 minutes") {
+		t.Errorf("GCTrackerService.SignIn() lockout message = %q", msg)
+	}
+
+	// Failures of many usernames lock the address, other addresses still
+	// sign in
+	for _, username := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		signIn(username, "wrongpassword", "198.51.100.1")
+	}
+	if err := signIn("other", "wrongpassword", "198.51.100.1"); err != ErrTooManyAttempts {
+		t.Errorf("GCTrackerService.SignIn() error = %v, want %v", err, ErrTooManyAttempts)
+	}
+	if err := signIn("other", "wrongpassword", "198.51.100.2"); err == ErrTooManyAttempts {
+		t.Errorf("GCTrackerService.SignIn() locked another address")
+	}
+}
+
+func TestGCTrackerService_ResetPwd_Throttle_MemoryData(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d, throttle: &throttle{store: d.NewLimiterStore(), opts: LimitOptions{Window: time.Hour, User: 2, IP: 10}}}
+	for i, want := range []error{nil, nil, ErrTooManyAttempts, ErrTooManyAttempts} {
+		if err := s.ResetPwd(postForm("/resetpwd", url.Values{"username": []string{"existing"}})); err != want {
+			t.Errorf("GCTrackerService.ResetPwd() of request %d error = %v, want %v", i+1, err, want)
+		}
+	}
+	outbox, _ := d.GetOutbox(ctx, "existing", 10)
+	if len(outbox) != 2 {
+		t.Errorf("GCTrackerService.ResetPwd() sent %d links, want %d", len(outbox), 2)
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	defer func(gae config.IsGAE, trust bool) {
+		config.Config.IsAppEngine, config.Config.TrustProxy = gae, trust
+	}(config.Config.IsAppEngine, config.Config.TrustProxy)
+
+	tests := []struct {
+		name    string
+		gae     bool
+		trust   bool
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "Peer address",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.1", "X-Appengine-User-IP": "203.0.113.2"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "Trusted proxy",
+			trust:   true,
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9, 203.0.113.1"},
+			want:    "203.0.113.1",
+		},
+		{
+			name:  "Trusted proxy without header",
+			trust: true,
+			want:  "192.0.2.1",
+		},
+		{
+			name:    "App Engine",
+			gae:     true,
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.1", "X-Appengine-User-IP": "203.0.113.2"},
+			want:    "203.0.113.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.IsAppEngine, config.Config.TrustProxy = config.IsGAE(tt.gae), tt.trust
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// authenticatorCode is what an authenticator app shows now for the key of
+// the provisioning URI
+func authenticatorCode(t *testing.T, uri string) string {
+	t.Helper()
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("invalid provisioning URI %q: %v", uri, err)
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatalf("invalid key in %q: %v", uri, err)
+	}
+	var step [8]byte
+	binary.BigEndian.PutUint64(step[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(step[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func TestGCTrackerService_TwoFactor_MemoryData(t *testing.T) {
+	config.Config.Cookie = "TESTSESSION"
+	d := newMemoryData(t)
+	s := &GCTrackerService{data: d, throttle: &throttle{store: d.NewLimiterStore(), opts: LimitOptions{Window: time.Hour, User: 3}}}
+	ctx := withSession(context.Background(), setSession(sessionValues{"username": "existing", "authenticated": true}))
+
+	user := d.NewUser()
+	if page := s.ShowTwoFactor(ctx, ""); !strings.Contains(page, `name=start`) {
+		t.Errorf("GCTrackerService.ShowTwoFactor() = %s, want the form creating the key", page)
+	}
+	if user.GetByUsername(ctx, "existing"); user.TwoFactorURI() != "" {
+		t.Errorf("GCTrackerService.ShowTwoFactor() saved key %q, want none", user.TwoFactorURI())
+	}
+	if err := s.StartTwoFactor(postForm("/twofactor", url.Values{"start": []string{"Set up"}}).WithContext(ctx)); err != nil {
+		t.Fatalf("GCTrackerService.StartTwoFactor() error = %v", err)
+	}
+	page := s.ShowTwoFactor(ctx, "")
+	uri := regexp.MustCompile(`<code>(otpauth://[^<]+)</code>`).FindStringSubmatch(page)
+	if uri == nil {
+		t.Fatalf("GCTrackerService.ShowTwoFactor() = %s, want the provisioning URI", page)
+	}
+	provisioning := html.UnescapeString(uri[1])
+	if _, err := s.EnableTwoFactor(postForm("/twofactor", url.Values{"code": []string{"abcdef"}}).WithContext(ctx)); err != data.ErrTwoFactorCode {
+		t.Errorf("GCTrackerService.EnableTwoFactor() error = %v, want %v", err, data.ErrTwoFactorCode)
+	}
+	codes, err := s.EnableTwoFactor(postForm("/twofactor", url.Values{"code": []string{authenticatorCode(t, provisioning)}}).WithContext(ctx))
+	if err != nil || len(codes) == 0 {
+		t.Fatalf("GCTrackerService.EnableTwoFactor() = %v, %v, want recovery codes", codes, err)
+	}
+	if page := s.ShowTwoFactor(ctx, ""); !strings.Contains(page, fmt.Sprintf("%d recovery codes left", len(codes))) {
+		t.Errorf("GCTrackerService.ShowTwoFactor() = %s, want two-factor authentication on", page)
+	}
+
+	// The password alone does not sign in
+	signIn := func() *httptest.ResponseRecorder {
+		t.Helper()
+		response := httptest.NewRecorder()
+		r := s.GetSession(httptest.NewRecorder(), postForm("/signin", url.Values{"username": []string{"existing"}, "password": []string{"testpassword"}}))
+		if err := s.SignIn(response, r); err != ErrTwoFactorRequired {
+			t.Fatalf("GCTrackerService.SignIn() error = %v, want %v", err, ErrTwoFactorRequired)
+		}
+		if s.IsAuthenticated(r.Context()) {
+			t.Fatal("GCTrackerService.SignIn() signed in without the second factor")
+		}
+		return response
+	}
+	verify := func(pending *httptest.ResponseRecorder, code string) (*httptest.ResponseRecorder, *http.Request, error) {
+		response := httptest.NewRecorder()
+		r := sessionRequest(pending)
+		r.Method = http.MethodPost
+		r.PostForm = url.Values{"code": []string{code}}
+		r = s.GetSession(httptest.NewRecorder(), r)
+		return response, r, s.VerifyTwoFactor(response, r)
+	}
+
+	pending := signIn()
+	if _, r, err := verify(pending, "abcdef"); err != data.ErrTwoFactorCode || s.IsAuthenticated(r.Context()) {
+		t.Errorf("GCTrackerService.VerifyTwoFactor() error = %v, want %v", err, data.ErrTwoFactorCode)
+	}
+	signedIn, r, err := verify(pending, codes[0])
+	if err != nil || !s.IsAuthenticated(r.Context()) || sessionUser(r.Context()) != "existing" {
+		t.Fatalf("GCTrackerService.VerifyTwoFactor() error = %v, want the session of %v", err, "existing")
+	}
+	if r := s.GetSession(httptest.NewRecorder(), sessionRequest(signedIn)); !s.IsAuthenticated(r.Context()) {
+		t.Error("GCTrackerService.VerifyTwoFactor() did not save the session")
+	}
+	// The session waiting for the code is void once signed in
+	if _, _, err := verify(pending, codes[1]); err != ErrTwoFactorExpired {
+		t.Errorf("GCTrackerService.VerifyTwoFactor() of a used session error = %v, want %v", err, ErrTwoFactorExpired)
+	}
+	if _, _, err := verify(signIn(), codes[0]); err != data.ErrTwoFactorCode {
+		t.Errorf("GCTrackerService.VerifyTwoFactor() with a used recovery code error = %v, want %v", err, data.ErrTwoFactorCode)
+	}
+
+	// Guessing codes locks the user out, even with a right code
+	pending = signIn()
+	verify(pending, "abcdef")
+	verify(pending, "abcdef")
+	if _, _, err := verify(pending, codes[1]); err != ErrTooManyAttempts {
+		t.Errorf("GCTrackerService.VerifyTwoFactor() error = %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	if err := s.DisableTwoFactor(postForm("/twofactor", url.Values{"password": []string{"wrongpassword"}}).WithContext(ctx)); err == nil {
+		t.Error("GCTrackerService.DisableTwoFactor() with a wrong password succeeded")
+	}
+	if err := s.DisableTwoFactor(postForm("/twofactor", url.Values{"password": []string{"testpassword"}}).WithContext(ctx)); err != nil {
+		t.Fatalf("GCTrackerService.DisableTwoFactor() error = %v", err)
+	}
+	r = s.GetSession(httptest.NewRecorder(), postForm("/signin", url.Values{"username": []string{"existing"}, "password": []string{"testpassword"}}))
+	if err := s.SignIn(httptest.NewRecorder(), r); err != nil || !s.IsAuthenticated(r.Context()) {
+		t.Errorf("GCTrackerService.SignIn() error = %v, want signed in without the second factor", err)
+	}
+}
+
+func TestGCTrackerService_VerifyTwoFactor_Expired(t *testing.T) {
+	s := &GCTrackerService{data: newMemoryData(t)}
+	tests := []struct {
+		name    string
+		session sessionValues
+	}{
+		{name: "No password given", session: sessionValues{}},
+		{name: "Password given too long ago", session: sessionValues{
+			sessionTwoFactorUser:    "existing",
+			sessionTwoFactorStarted: time.Now().Add(-twoFactorTimeout - time.Minute).Unix(),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := postForm("/signin/2fa", url.Values{"code": []string{"123456"}})
+			r = r.WithContext(withSession(r.Context(), setSession(tt.session)))
+			if err := s.VerifyTwoFactor(httptest.NewRecorder(), r); err != ErrTwoFactorExpired {
+				t.Errorf("GCTrackerService.VerifyTwoFactor() error = %v, want %v", err, ErrTwoFactorExpired)
+			}
+		})
+	}
+}
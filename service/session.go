@@ -0,0 +1,277 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/data"
+	"github.com/gorilla/sessions"
+)
+
+// Session values
+const (
+	sessionAuthenticated = "authenticated"
+	sessionUsername      = "username"
+	sessionResetToken    = "resetToken"
+	// Unix times of the sign in and of the latest request, see expired
+	sessionCreated = "created"
+	sessionSeen    = "seen"
+	// User who has given the password and still has to give the second
+	// factor, and since when, see VerifyTwoFactor
+	sessionTwoFactorUser    = "twoFactorUser"
+	sessionTwoFactorStarted = "twoFactorStarted"
+)
+
+// sessionKey is the context key of the requestSession
+type sessionKey struct{}
+
+// requestSession is the session of a request. Renewing the session replaces
+// it for the rest of the request.
+type requestSession struct{ session *sessions.Session }
+
+func withSession(ctx context.Context, session *sessions.Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &requestSession{session: session})
+}
+
+// getSession is the session loaded by GetSession, nil without one
+func getSession(ctx context.Context) *sessions.Session {
+	if rs, ok := ctx.Value(sessionKey{}).(*requestSession); ok {
+		return rs.session
+	}
+	return nil
+}
+
+// sessionUser is the username of the session, empty without one
+func sessionUser(ctx context.Context) string {
+	session := getSession(ctx)
+	if session == nil {
+		return ""
+	}
+	username, _ := session.Values[sessionUsername].(string)
+	return username
+}
+
+// sessionTouchInterval is how often the time of the latest request is
+// saved, so that not every request writes the session
+const sessionTouchInterval = time.Minute
+
+// GetSession loads the session of the request and returns the request
+// carrying it in its context, which the other methods take the session
+// from. A signed in session past its absolute or idle expiry is destroyed.
+func (s *GCTrackerService) GetSession(w http.ResponseWriter, r *http.Request) *http.Request {
+	store := s.data.NewSession()
+	if store == nil {
+		log.Println("Session store does not exist")
+		return r.WithContext(withSession(r.Context(), nil))
+	}
+
+	session, err := store.Get(r, config.Config.Cookie)
+	if err != nil {
+		log.Println("Cannot get session " + err.Error())
+		return r.WithContext(withSession(r.Context(), nil))
+	}
+	r = r.WithContext(withSession(r.Context(), session))
+
+	now := time.Now()
+	if expired(session, now) {
+		log.Println("Session of " + sessionUser(r.Context()) + " has expired")
+		s.renewSession(w, r)
+		return r
+	}
+	if s.IsAuthenticated(r.Context()) && now.Sub(time.Unix(sessionTime(session.Values[sessionSeen]), 0)) >= sessionTouchInterval {
+		session.Values[sessionSeen] = now.Unix()
+		s.SaveSession(w, r)
+	}
+	return r
+}
+
+// expired tells whether the signed in session is older than SessionMaxAge
+// or has had no requests for SessionIdle
+func expired(session *sessions.Session, now time.Time) bool {
+	if session.Values[sessionCreated] == nil {
+		return false
+	}
+	created := time.Unix(sessionTime(session.Values[sessionCreated]), 0)
+	seen := time.Unix(sessionTime(session.Values[sessionSeen]), 0)
+	if max := config.Config.SessionMaxAge; max > 0 && now.Sub(created) > max {
+		return true
+	}
+	if idle := config.Config.SessionIdle; idle > 0 && now.Sub(seen) > idle {
+		return true
+	}
+	return false
+}
+
+func sessionTime(v interface{}) int64 {
+	t, _ := v.(int64)
+	return t
+}
+
+// SaveSession stores the session. It has to be called before anything is
+// written to w.
+func (s *GCTrackerService) SaveSession(w http.ResponseWriter, r *http.Request) error {
+	session := getSession(r.Context())
+	if session == nil {
+		return nil
+	}
+	if err := session.Save(r, w); err != nil {
+		log.Println("Cannot save session: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// renewSession destroys the session and starts an empty one, which gets a
+// new ID once saved. An ID known to someone else before sign in is thus of
+// no use after it.
+func (s *GCTrackerService) renewSession(w http.ResponseWriter, r *http.Request) error {
+	rs, ok := r.Context().Value(sessionKey{}).(*requestSession)
+	if !ok {
+		return errors.New("no session")
+	}
+	var err error
+	options := data.SessionOptions()
+	if old := rs.session; old != nil {
+		if old.Options != nil {
+			options = *old.Options
+		}
+		expired := options
+		expired.MaxAge = -1
+		old.Options = &expired
+		if err = old.Save(r, w); err != nil {
+			log.Println("Cannot destroy session: " + err.Error())
+		}
+	}
+	session := sessions.NewSession(s.data.NewSession(), config.Config.Cookie)
+	session.Options = &options
+	session.IsNew = true
+	rs.session = session
+	return err
+}
+
+// SignIn checks the username and password posted with r and starts a new
+// session of the user. Users with two-factor authentication get
+// ErrTwoFactorRequired and a session waiting for the code instead.
+func (s *GCTrackerService) SignIn(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	byUser := s.throttle.user("signin", r.PostForm.Get("username"))
+	byIP := s.throttle.ip("signin", clientIP(r))
+	if s.throttle.locked(ctx, byUser, byIP) {
+		return ErrTooManyAttempts
+	}
+
+	user := s.data.NewUser()
+	user.Set(r.PostForm)
+	if err := user.Authenticate(ctx); err != nil {
+		log.Println(err.Error())
+		if s.throttle.hit(ctx, byUser) {
+			s.notifyLockout(ctx, user.GetUsername())
+		}
+		s.throttle.hit(ctx, byIP)
+		return err
+	}
+	s.throttle.reset(ctx, byUser)
+	if err := user.GetByUsername(ctx, user.GetUsername()); err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot find user")
+	}
+	if user.TwoFactorEnabled() {
+		return s.startTwoFactor(w, r, user.GetUsername())
+	}
+	return s.startSession(w, r, user.GetUsername())
+}
+
+// startSession renews the session and signs the user in
+func (s *GCTrackerService) startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	if err := s.renewSession(w, r); err != nil && getSession(r.Context()) == nil {
+		return errors.New("cannot start session")
+	}
+	session := getSession(r.Context())
+	now := time.Now().Unix()
+	session.Values[sessionAuthenticated] = true
+	session.Values[sessionUsername] = username
+	session.Values[sessionCreated] = now
+	session.Values[sessionSeen] = now
+	if max := config.Config.SessionMaxAge; max > 0 {
+		session.Options.MaxAge = int(max.Seconds())
+	}
+	if err := s.SaveSession(w, r); err != nil {
+		return errors.New("cannot save session")
+	}
+	return nil
+}
+
+// notifyLockout tells the owner of the account that sign in has been
+// locked, unless the account does not exist
+func (s *GCTrackerService) notifyLockout(ctx context.Context, username string) {
+	user := s.data.NewUser()
+	if err := user.GetByUsername(ctx, username); err != nil {
+		return
+	}
+	lockout := s.throttle.lockout()
+	user.SendNotification(ctx, data.Notification{
+		Event: data.EventLockout,
+		Message: fmt.Sprintf("Sign in to your account '%s' has been blocked for %d minutes after too many failed attempts. "+
+			"If it was not you, someone may be guessing your password, consider changing it once you can sign in again.",
+			username, int(math.Ceil(lockout.Minutes()))),
+	})
+}
+
+// SignOut destroys the session
+func (s *GCTrackerService) SignOut(w http.ResponseWriter, r *http.Request) error {
+	if getSession(r.Context()) == nil {
+		return nil
+	}
+	return s.renewSession(w, r)
+}
+
+func (s *GCTrackerService) IsAuthenticated(ctx context.Context) bool {
+	session := getSession(ctx)
+	if session == nil {
+		log.Println("IsAuthenticated(): session is nil")
+		return false
+	}
+	auth, _ := session.Values[sessionAuthenticated].(bool)
+	return auth && session.Values[sessionUsername] != nil
+}
+
+func (s *GCTrackerService) GetResetToken(ctx context.Context) string {
+	session := getSession(ctx)
+	if session == nil {
+		return ""
+	}
+	token, _ := session.Values[sessionResetToken].(string)
+	return token
+}
+
+// SetResetToken keeps the token of the reset link for the form posting the
+// new password
+func (s *GCTrackerService) SetResetToken(w http.ResponseWriter, r *http.Request, token string) error {
+	session := getSession(r.Context())
+	if session == nil {
+		return errors.New("no session")
+	}
+	session.Values[sessionResetToken] = token
+	return s.SaveSession(w, r)
+}
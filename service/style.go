@@ -35,6 +35,10 @@ func showStyle() string {
 	h1 {
 		text-align: center;
 	}
+	th {
+		text-align: left;
+		padding: 0px 5px;
+	}
 	td {
 		background-color: lightgray;
 		border-width: 0px 3px;
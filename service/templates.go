@@ -15,6 +15,8 @@ limitations under the License.
 */
 package service
 
+import "context"
+
 var header string = `<!DOCTYPE HTML>
 	<html>
 	<head>
@@ -34,12 +36,15 @@ var footer string = `
 	</html>
 	`
 
-var signout string = `<div><span><a href="/signout">Sign out</a></span><span width=100%>&nbsp;</span><span><a href="/changepwd">Change password</a></span></div>`
+func (s *GCTrackerService) signout(ctx context.Context) string {
+	return `<div><span><form method=post action="/signout">` + s.csrfInput(ctx) + `<input type=submit value="Sign out"></form></span><span width=100%>&nbsp;</span><span><a href="/notifications">Notifications</a></span><span><a href="/settings">Settings</a></span><span><a href="/account">Account</a></span><span><a href="/changepwd">Change password</a></span></div>`
+}
 
-func (s *GCTrackerService) ShowSignIn(errorMsg string) string {
+func (s *GCTrackerService) ShowSignIn(ctx context.Context, errorMsg string) string {
 	return s.RenderPage(`
 	<h2>Sign In</h2>
 	<form method=post>
+	`+s.csrfInput(ctx)+`
 	<div>Username <input type=text name=username></div>
 	<div>Password <input type=password name=password></div>
 	<div>
@@ -51,10 +56,26 @@ func (s *GCTrackerService) ShowSignIn(errorMsg string) string {
 	`, errorMsg)
 }
 
-func (s *GCTrackerService) ShowSignUp(errorMsg string) string {
+// ShowSignInTwoFactor asks for the second factor after the password
+func (s *GCTrackerService) ShowSignInTwoFactor(ctx context.Context, errorMsg string) string {
+	return s.RenderPage(`
+	<h2>Sign In</h2>
+	<form method=post>
+	`+s.csrfInput(ctx)+`
+	<div>Code from your authenticator app or a recovery code <input type=text name=code autocomplete=one-time-code></div>
+	<div>
+	<span><input type=submit value="Sign in"></span>
+	<span><a href="/signin">Back</a></span>
+	</div>
+	</form>
+	`, errorMsg)
+}
+
+func (s *GCTrackerService) ShowSignUp(ctx context.Context, errorMsg string) string {
 	return s.RenderPage(`
 <h2>Sign Up</h2>
 <form method=post>
+`+s.csrfInput(ctx)+`
 <div>Username <input type=text name=username></div>
 <div>E-Mail <input type=text name=email></div>	
 <div>Password <input type=password name=password></div>
@@ -68,9 +89,10 @@ func (s *GCTrackerService) ShowSignUp(errorMsg string) string {
 `, errorMsg)
 }
 
-func (s *GCTrackerService) ShowChangePwd(errorMsg string) string {
+func (s *GCTrackerService) ShowChangePwd(ctx context.Context, errorMsg string) string {
 	return s.RenderPage(`<h2>Change password</h2>
 	<form method=post>
+	`+s.csrfInput(ctx)+`
 	<div>Password <input type=password name=password></div>
 	<div>Confirm password <input type=password name=password2></div>
 	<div>
@@ -80,9 +102,10 @@ func (s *GCTrackerService) ShowChangePwd(errorMsg string) string {
 	`, errorMsg)
 }
 
-func (s *GCTrackerService) ShowResetPwd(errorMsg string) string {
+func (s *GCTrackerService) ShowResetPwd(ctx context.Context, errorMsg string) string {
 	return s.RenderPage(`<h2>Reset password</h2>
 	<form method=post>
+	`+s.csrfInput(ctx)+`
 	<div>Username <input type=text name=username></div>
 	<div>
 	<span><input type=submit value="Reset password"></span>
@@ -93,11 +116,12 @@ func (s *GCTrackerService) ShowResetPwd(errorMsg string) string {
 	`, errorMsg)
 }
 
-func (s *GCTrackerService) ShowCases() string {
-	return s.RenderPage(`<h2>Cases</h2>
+func (s *GCTrackerService) ShowCases(ctx context.Context) string {
+	return s.RenderPage(s.RenderVerification(ctx)+`<h2>Cases</h2>
 	<form method=post action="/case">
+	`+s.csrfInput(ctx)+`
 	<table>
-	`+s.RenderCases()+`
+	`+s.RenderCases(ctx)+`
 	</table>
 	<div>
 	<span>ID <input type=text name=case></span>
@@ -108,5 +132,84 @@ func (s *GCTrackerService) ShowCases() string {
 	<span><input type=submit name=delete value="Delete"></span>
 	</div>
 	</form>
-	`+signout, "")
+	`+s.signout(ctx), "")
+}
+
+func (s *GCTrackerService) ShowCase(ctx context.Context, id string) string {
+	content, err := s.RenderCase(ctx, id)
+	errorMsg := ""
+	if err != nil {
+		errorMsg = err.Error()
+	}
+	return s.RenderPage(content+`
+	<div><a href="/">Back to cases</a></div>
+	`+s.signout(ctx), errorMsg)
+}
+
+func (s *GCTrackerService) ShowOutbox(ctx context.Context) string {
+	content, err := s.RenderOutbox(ctx)
+	errorMsg := ""
+	if err != nil {
+		errorMsg = err.Error()
+	}
+	return s.RenderPage(`<h2>Notifications</h2>
+	`+content+`
+	<div><a href="/">Back to cases</a></div>
+	`+s.signout(ctx), errorMsg)
+}
+
+func (s *GCTrackerService) ShowAccount(ctx context.Context, errorMsg string) string {
+	content, err := s.RenderAccount(ctx)
+	if err != nil {
+		errorMsg = err.Error()
+	}
+	return s.RenderPage(`<h2>Account</h2>
+	`+content+`
+	<h3>Change email</h3>
+	<form method=post>
+	`+s.csrfInput(ctx)+`
+	<div>New email <input type=text name=email></div>
+	<div>Current password <input type=password name=password></div>
+	<div>
+	<span><input type=submit value="Change email"></span>
+	</div>
+	</form>
+	<div><a href="/twofactor">Two-factor authentication</a></div>
+	<div><a href="/">Back to cases</a></div>
+	`+s.signout(ctx), errorMsg)
+}
+
+func (s *GCTrackerService) ShowTwoFactor(ctx context.Context, errorMsg string) string {
+	content, err := s.RenderTwoFactor(ctx)
+	if err != nil {
+		errorMsg = err.Error()
+	}
+	return s.RenderPage(`<h2>Two-factor authentication</h2>
+	`+content+`
+	<div><a href="/account">Back to account</a></div>
+	`+s.signout(ctx), errorMsg)
+}
+
+func (s *GCTrackerService) ShowRecoveryCodes(ctx context.Context, codes []string) string {
+	return s.RenderPage(`<h2>Two-factor authentication</h2>
+	`+s.RenderRecoveryCodes(codes)+`
+	<div><a href="/account">Back to account</a></div>
+	`+s.signout(ctx), "")
+}
+
+func (s *GCTrackerService) ShowSettings(ctx context.Context, errorMsg string) string {
+	content, err := s.RenderSettings(ctx)
+	if err != nil {
+		errorMsg = err.Error()
+	}
+	return s.RenderPage(s.RenderVerification(ctx)+`<h2>Settings</h2>
+	<form method=post>
+	`+s.csrfInput(ctx)+`
+	`+content+`
+	<div>
+	<span><input type=submit value="Save"></span>
+	</div>
+	</form>
+	<div><a href="/">Back to cases</a></div>
+	`+s.signout(ctx), errorMsg)
 }
@@ -0,0 +1,187 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/data"
+)
+
+// ErrTooManyAttempts is returned while sign in, password reset or sign up
+// are locked for the username or the client address
+var ErrTooManyAttempts = errors.New("too many attempts, please try again later")
+
+// LimitOptions throttle sign in, password reset and sign up. Zero limits
+// disable throttling, a zero lockout locks for the window.
+type LimitOptions struct {
+	Window  time.Duration
+	User    int
+	IP      int
+	Lockout time.Duration
+}
+
+func limitOptionsFromConfig() LimitOptions {
+	return LimitOptions{
+		Window:  config.Config.RateLimitWindow,
+		User:    config.Config.RateLimitUser,
+		IP:      config.Config.RateLimitIP,
+		Lockout: config.Config.LockoutDuration,
+	}
+}
+
+// throttle locks a key once it has been hit max times within the window. A
+// nil throttle never locks.
+type throttle struct {
+	store data.LimiterStore
+	opts  LimitOptions
+}
+
+func newThrottle(d data.GCTrackerData, opts LimitOptions) *throttle {
+	if config.Config.LimiterStore == config.LimiterMemory {
+		return &throttle{store: data.NewMemoryLimiterStore(), opts: opts}
+	}
+	return &throttle{store: d.NewLimiterStore(), opts: opts}
+}
+
+// limit is a key counted for an action, e.g. sign in failures of a user
+type limit struct {
+	key string
+	max int
+}
+
+func (l *throttle) user(action, username string) limit {
+	if l == nil || username == "" {
+		return limit{}
+	}
+	return limit{key: action + ":user:" + username, max: l.opts.User}
+}
+
+func (l *throttle) ip(action, ip string) limit {
+	if l == nil || ip == "" {
+		return limit{}
+	}
+	return limit{key: action + ":ip:" + ip, max: l.opts.IP}
+}
+
+// locked tells whether any of the limits is locked. Errors of the store are
+// logged and let the attempt through.
+func (l *throttle) locked(ctx context.Context, limits ...limit) bool {
+	if l == nil {
+		return false
+	}
+	now := time.Now().Unix()
+	for _, lim := range limits {
+		if lim.max <= 0 {
+			continue
+		}
+		a, err := l.store.GetAttempts(ctx, lim.key)
+		if err != nil {
+			log.Println("Cannot get attempts of " + lim.key + ": " + err.Error())
+			continue
+		}
+		if a.LockedUntil > now {
+			log.Println("Attempt of " + lim.key + " is locked")
+			return true
+		}
+	}
+	return false
+}
+
+// hit counts an attempt and tells whether it has locked the limit
+func (l *throttle) hit(ctx context.Context, lim limit) bool {
+	if l == nil || lim.max <= 0 {
+		return false
+	}
+	window := int64(l.opts.Window.Seconds())
+	lockout := int64(l.lockout().Seconds())
+	locked := false
+	_, err := l.store.UpdateAttempts(ctx, lim.key, func(a *data.Attempts) {
+		now := time.Now().Unix()
+		locked = false
+		if a.Start+window <= now {
+			a.Count = 0
+			a.Start = now
+		}
+		a.Count++
+		if a.Count >= lim.max {
+			locked = true
+			a.Count = 0
+			a.Start = now
+			a.LockedUntil = now + lockout
+		}
+		a.Expires = a.Start + window
+		if a.LockedUntil > a.Expires {
+			a.Expires = a.LockedUntil
+		}
+	})
+	if err != nil {
+		log.Println("Cannot count attempt of " + lim.key + ": " + err.Error())
+		return false
+	}
+	if locked {
+		log.Println("Locked " + lim.key)
+	}
+	return locked
+}
+
+func (l *throttle) lockout() time.Duration {
+	if l.opts.Lockout <= 0 {
+		return l.opts.Window
+	}
+	return l.opts.Lockout
+}
+
+// reset forgets the attempts of the limit, e.g. after a successful sign in
+func (l *throttle) reset(ctx context.Context, lim limit) {
+	if l == nil || lim.max <= 0 {
+		return
+	}
+	if err := l.store.DeleteAttempts(ctx, lim.key); err != nil {
+		log.Println("Cannot reset attempts of " + lim.key + ": " + err.Error())
+	}
+}
+
+// clientIP is the address of the client: the App Engine header on App
+// Engine, the last X-Forwarded-For entry behind a trusted proxy, the peer
+// address otherwise
+func clientIP(r *http.Request) string {
+	if config.Config.IsAppEngine {
+		if ip := r.Header.Get("X-Appengine-User-IP"); ip != "" {
+			return ip
+		}
+	}
+	if config.Config.TrustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrTwoFactorRequired is returned by SignIn when the password is right
+	// and the code of the authenticator app is still needed
+	ErrTwoFactorRequired = errors.New("please enter the code of your authenticator app")
+	// ErrTwoFactorExpired is returned when the password was given too long
+	// ago, or not at all
+	ErrTwoFactorExpired = errors.New("sign in has expired, please sign in again")
+)
+
+// twoFactorTimeout is how long the code may be entered after the password
+const twoFactorTimeout = 5 * time.Minute
+
+// startTwoFactor renews the session, which then waits for the second factor
+// of the user
+func (s *GCTrackerService) startTwoFactor(w http.ResponseWriter, r *http.Request, username string) error {
+	if err := s.renewSession(w, r); err != nil && getSession(r.Context()) == nil {
+		return errors.New("cannot start session")
+	}
+	session := getSession(r.Context())
+	session.Values[sessionTwoFactorUser] = username
+	session.Values[sessionTwoFactorStarted] = time.Now().Unix()
+	if err := s.SaveSession(w, r); err != nil {
+		return errors.New("cannot save session")
+	}
+	return ErrTwoFactorRequired
+}
+
+// VerifyTwoFactor checks the code posted with r, of the authenticator app
+// or a recovery code, and signs in the user who has given the password.
+// Wrong codes count toward the limits as wrong passwords do.
+func (s *GCTrackerService) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	session := getSession(ctx)
+	if session == nil {
+		return ErrTwoFactorExpired
+	}
+	username, _ := session.Values[sessionTwoFactorUser].(string)
+	started := time.Unix(sessionTime(session.Values[sessionTwoFactorStarted]), 0)
+	if username == "" || time.Since(started) > twoFactorTimeout {
+		return ErrTwoFactorExpired
+	}
+	byUser := s.throttle.user("twofactor", username)
+	byIP := s.throttle.ip("twofactor", clientIP(r))
+	if s.throttle.locked(ctx, byUser, byIP) {
+		return ErrTooManyAttempts
+	}
+
+	user := s.data.NewUser()
+	if err := user.GetByUsername(ctx, username); err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot find user")
+	}
+	if err := user.CheckTwoFactor(ctx, r.PostForm.Get("code")); err != nil {
+		log.Println("Second factor of " + username + ": " + err.Error())
+		if s.throttle.hit(ctx, byUser) {
+			s.notifyLockout(ctx, username)
+		}
+		s.throttle.hit(ctx, byIP)
+		return err
+	}
+	s.throttle.reset(ctx, byUser)
+	return s.startSession(w, r, username)
+}
+
+// StartTwoFactor creates the key which the signed in user adds to the
+// authenticator app before turning two-factor authentication on
+func (s *GCTrackerService) StartTwoFactor(r *http.Request) error {
+	ctx := r.Context()
+	user := s.data.NewUser()
+	if err := user.GetByUsername(ctx, sessionUser(ctx)); err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot find user")
+	}
+	_, err := user.StartTwoFactor(ctx)
+	return err
+}
+
+// EnableTwoFactor turns two-factor authentication on for the signed in
+// user with the code posted with r, and returns the recovery codes
+func (s *GCTrackerService) EnableTwoFactor(r *http.Request) ([]string, error) {
+	ctx := r.Context()
+	user := s.data.NewUser()
+	if err := user.GetByUsername(ctx, sessionUser(ctx)); err != nil {
+		log.Println(err.Error())
+		return nil, errors.New("cannot find user")
+	}
+	return user.EnableTwoFactor(ctx, r.PostForm.Get("code"))
+}
+
+// DisableTwoFactor turns two-factor authentication off for the signed in
+// user, the current password is required
+func (s *GCTrackerService) DisableTwoFactor(r *http.Request) error {
+	ctx := r.Context()
+	user := s.data.NewUser()
+	if err := user.GetByUsername(ctx, sessionUser(ctx)); err != nil {
+		log.Println(err.Error())
+		return errors.New("cannot find user")
+	}
+	return user.DisableTwoFactor(ctx, r.PostForm.Get("password"))
+}
+
+// RenderTwoFactor renders the state of two-factor authentication of the
+// signed in user with the form to disable it, the key to enroll with, or
+// the form creating the key. Rendering does not change the user.
+func (s *GCTrackerService) RenderTwoFactor(ctx context.Context) (string, error) {
+	user := s.data.NewUser()
+	if err := user.GetByUsername(ctx, sessionUser(ctx)); err != nil {
+		log.Println(err.Error())
+		return "", errors.New("cannot find user")
+	}
+	if user.TwoFactorEnabled() {
+		return fmt.Sprintf(`<div>Two-factor authentication is on, %d recovery codes left.</div>
+	<h3>Turn off</h3>
+	<form method=post>
+	`+s.csrfInput(ctx)+`
+	<div>Current password <input type=password name=password></div>
+	<div>
+	<span><input type=submit name=disable value="Turn off"></span>
+	</div>
+	</form>`, user.RecoveryCodesLeft()), nil
+	}
+	uri := user.TwoFactorURI()
+	if uri == "" {
+		return `<div>Two-factor authentication is off. Once on, signing in also asks for a code
+	of an authenticator app on your phone.</div>
+	<form method=post>
+	` + s.csrfInput(ctx) + `
+	<div>
+	<span><input type=submit name=start value="Set up"></span>
+	</div>
+	</form>`, nil
+	}
+	return `<div>Add the key to your authenticator app with <a href="` + html.EscapeString(uri) + `">this link</a>
+	on your phone, or copy the key URI into it:</div>
+	<div><code>` + html.EscapeString(uri) + `</code></div>
+	<form method=post>
+	` + s.csrfInput(ctx) + `
+	<div>Code from the app <input type=text name=code autocomplete=one-time-code></div>
+	<div>
+	<span><input type=submit name=enable value="Turn on"></span>
+	</div>
+	</form>`, nil
+}
+
+// RenderRecoveryCodes lists the recovery codes, which are shown only once
+func (s *GCTrackerService) RenderRecoveryCodes(codes []string) string {
+	str := `<div>Two-factor authentication is on. Keep these recovery codes in a safe place,
+	each of them signs you in once without the app. They are not shown again.</div>
+	<ul>`
+	for _, code := range codes {
+		str += "<li><code>" + html.EscapeString(code) + "</code></li>"
+	}
+	return str + "</ul>"
+}
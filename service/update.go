@@ -0,0 +1,208 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/batk0/gc-tracker/config"
+	"github.com/batk0/gc-tracker/data"
+)
+
+// UpdateOptions tune the refresh of all cases. Zero values check cases one
+// by one, as fast as USCIS answers, without retries.
+type UpdateOptions struct {
+	Workers int
+	Rate    float64 // requests per second shared by all workers
+	Retries int
+	Backoff time.Duration // delay before the first retry, doubled every time
+}
+
+func updateOptionsFromConfig() UpdateOptions {
+	return UpdateOptions{
+		Workers: config.Config.UpdateWorkers,
+		Rate:    config.Config.UpdateRate,
+		Retries: config.Config.UpdateRetries,
+		Backoff: config.Config.UpdateBackoff,
+	}
+}
+
+// UpdateResult summarizes a refresh of all cases
+type UpdateResult struct {
+	Checked   int      `json:"checked"`
+	Changed   int      `json:"changed"`
+	Failed    int      `json:"failed"`
+	FailedIDs []string `json:"failedIds"`
+}
+
+type caseResult struct {
+	id      string
+	changed bool
+	err     error
+}
+
+// UpdateCases checks every stored case. A failure of a single case does not
+// stop the others and is only reported in the result. Only one refresh runs
+// at a time, others get ErrUpdateRunning.
+func (s *GCTrackerService) UpdateCases(ctx context.Context) (UpdateResult, error) {
+	var result UpdateResult
+	var err error
+	if s.updates == nil {
+		result, err = s.updateCases(ctx)
+	} else if !s.updates.begin() {
+		return UpdateResult{FailedIDs: []string{}}, ErrUpdateRunning
+	} else {
+		result, err = s.updateCases(ctx)
+		s.updates.finish(result, err)
+	}
+	// Every refresh is also a chance to deliver what quiet hours held back
+	if err := s.DeliverNotifications(ctx); err != nil {
+		log.Println("Cannot deliver notifications: " + err.Error())
+	}
+	if _, err := s.DeliverOutbox(ctx); err != nil {
+		log.Println("Cannot deliver outbox: " + err.Error())
+	}
+	return result, err
+}
+
+func (s *GCTrackerService) updateCases(ctx context.Context) (UpdateResult, error) {
+	result := UpdateResult{FailedIDs: []string{}}
+	cases, err := s.data.GetAllCases(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	workers := s.update.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	limit := newLimiter(s.update.Rate)
+	defer limit.stop()
+
+	jobs := make(chan data.GCTrackerCase)
+	results := make(chan caseResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				results <- s.updateCase(ctx, c, limit)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, c := range cases {
+			select {
+			case jobs <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		result.Checked++
+		if r.err != nil {
+			log.Println("Cannot update case " + r.id + ": " + r.err.Error())
+			result.Failed++
+			result.FailedIDs = append(result.FailedIDs, r.id)
+		} else if r.changed {
+			result.Changed++
+		}
+	}
+	sort.Strings(result.FailedIDs)
+	return result, ctx.Err()
+}
+
+// updateCase checks a single case, retrying failed checks with exponential
+// backoff, and saves it when the status has changed
+func (s *GCTrackerService) updateCase(ctx context.Context, c data.GCTrackerCase, limit *limiter) caseResult {
+	r := caseResult{id: c.GetID()}
+	backoff := s.update.Backoff
+	for attempt := 0; ; attempt++ {
+		if r.err = limit.wait(ctx); r.err != nil {
+			return r
+		}
+		r.err = c.CheckStatus(ctx, s.provider)
+		if r.err == nil {
+			return r
+		}
+		if errors.Is(r.err, data.ErrStatusChanged) {
+			r.err = c.Update(ctx)
+			if errors.Is(r.err, data.ErrCaseNotFound) {
+				// Released by its last subscriber during the check
+				log.Println("Case " + r.id + " is no longer tracked")
+				r.err = nil
+				return r
+			}
+			r.changed = true
+			return r
+		}
+		if attempt >= s.update.Retries {
+			return r
+		}
+		log.Println("Retrying case " + r.id + ": " + r.err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			r.err = ctx.Err()
+			return r
+		}
+		backoff *= 2
+	}
+}
+
+// limiter lets through at most rate requests per second. A zero rate
+// disables it.
+type limiter struct {
+	ticker *time.Ticker
+}
+
+func newLimiter(rate float64) *limiter {
+	if rate <= 0 {
+		return &limiter{}
+	}
+	return &limiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / rate))}
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l.ticker == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
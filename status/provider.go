@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package status
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultUSCISURL is where USCISProvider checks cases unless configured
+const DefaultUSCISURL = "https://egov.uscis.gov"
+
+// StatusProvider looks up the current status of a case by receipt number
+type StatusProvider interface {
+	CheckStatus(ctx context.Context, id string) (Status, error)
+}
+
+// USCISProvider scrapes the USCIS Case Status Online page
+type USCISProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewUSCISProvider returns a provider for the site at baseURL. Requests are
+// sent with client, or http.DefaultClient if it is nil.
+func NewUSCISProvider(baseURL string, client *http.Client) *USCISProvider {
+	if baseURL == "" {
+		baseURL = DefaultUSCISURL
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &USCISProvider{BaseURL: strings.TrimSuffix(baseURL, "/"), Client: client}
+}
+
+func (p *USCISProvider) CheckStatus(ctx context.Context, id string) (Status, error) {
+	form := url.Values{
+		"completedActionsCurrentPage": []string{"0"},
+		"upcomingActionsCurrentPage":  []string{"0"},
+		"appReceiptNum":               []string{id},
+		"caseStatusSearchBtn":         []string{"CHECK+STATUS"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		p.BaseURL+"/casestatus/mycasestatus.do", strings.NewReader(form.Encode()))
+	if err != nil {
+		return Status{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return Status{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Status{}, errors.New("non-ok response received")
+	}
+	return Parse(resp.Body)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package status
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newTestServer stands in for egov.uscis.gov, serving fixtures by receipt number
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	fixtures := map[string]string{
+		"MSC2190000001": "received.html",
+		"IOE0900000005": "rfe.html",
+		"INVALID":       "invalid_receipt.html",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/casestatus/mycasestatus.do", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := r.PostForm.Get("appReceiptNum")
+		if id == "DOWN" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fixture, ok := fixtures[id]
+		if !ok || r.PostForm.Get("caseStatusSearchBtn") != "CHECK+STATUS" {
+			fixture = "maintenance.html"
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", fixture))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestUSCISProvider_CheckStatus(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name      string
+		id        string
+		wantTitle string
+		wantErr   bool
+	}{
+		{
+			name:      "Received",
+			id:        "MSC2190000001",
+			wantTitle: "Case Was Received",
+		},
+		{
+			name:      "Request for evidence",
+			id:        "IOE0900000005",
+			wantTitle: "Request for Additional Evidence Was Sent",
+		},
+		{
+			name:    "Invalid receipt number",
+			id:      "INVALID",
+			wantErr: true,
+		},
+		{
+			name:    "Service unavailable",
+			id:      "DOWN",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewUSCISProvider(server.URL+"/", server.Client())
+			got, err := p.CheckStatus(context.Background(), tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("USCISProvider.CheckStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Title != tt.wantTitle {
+				t.Errorf("USCISProvider.CheckStatus() title = %q, want %q", got.Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestUSCISProvider_CheckStatus_Canceled(t *testing.T) {
+	server := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewUSCISProvider(server.URL, nil).CheckStatus(ctx, "MSC2190000001"); err == nil {
+		t.Errorf("USCISProvider.CheckStatus() error = nil for canceled context")
+	}
+}
+
+func TestNewUSCISProvider(t *testing.T) {
+	p := NewUSCISProvider("", nil)
+	if p.BaseURL != DefaultUSCISURL || p.Client != http.DefaultClient {
+		t.Errorf("NewUSCISProvider() = %+v, want defaults", p)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package status
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Status is a case status parsed from the USCIS case status page
+type Status struct {
+	Title       string `firestore:"title" json:"title"`
+	Description string `firestore:"description" json:"description"`
+	// FormType is the form the case was filed with, e.g. I-485
+	FormType string `firestore:"formType" json:"formType"`
+	// ActionDate is the date of the latest action, zero if not mentioned
+	ActionDate time.Time `firestore:"actionDate" json:"actionDate"`
+	// Notice is the kind of notice USCIS sent, e.g. "receipt notice"
+	Notice         string `firestore:"notice" json:"notice"`
+	CardMailed     bool   `firestore:"cardMailed" json:"cardMailed"`
+	RFE            bool   `firestore:"rfe" json:"rfe"`
+	TrackingNumber string `firestore:"trackingNumber" json:"trackingNumber"`
+}
+
+var ErrNoStatus = errors.New("no case status in response")
+
+var (
+	formTypeRe   = regexp.MustCompile(`\bForm ([A-Z]-\d+[A-Z]?)\b`)
+	actionDateRe = regexp.MustCompile(`\b(?:On|As of) ([A-Z][a-z]+ \d{1,2}, \d{4})`)
+	noticeRe     = regexp.MustCompile(`(?i)\b([a-z]+) notice\b`)
+	cardMailedRe = regexp.MustCompile(`(?i)\bcard was (?:mailed|picked up|delivered)|\bmailed your (?:new )?card\b`)
+	rfeRe        = regexp.MustCompile(`(?i)\brequest for (?:additional |initial )?evidence\b|\bRFE\b`)
+	trackingRe   = regexp.MustCompile(`(?i)\btracking number\D{0,40}?(\d{10,34})`)
+)
+
+// Words which come before "notice" but do not tell its kind
+var noticeArticles = map[string]bool{"a": true, "the": true, "your": true, "this": true, "that": true, "our": true}
+
+// Parse reads the USCIS case status page. It returns ErrNoStatus, or the
+// validation message of the page, if the page has no status.
+func Parse(r io.Reader) (Status, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return Status{}, err
+	}
+
+	var s Status
+	s.Title = normalize(doc.Find(".rows.text-center h1").First().Text())
+	if s.Title == "" {
+		// Older pages only have the headline in the status bar
+		bar := doc.Find(".current-status-sec").First().Clone()
+		bar.Find("strong, span").Remove()
+		s.Title = normalize(bar.Text())
+	}
+	if s.Title == "" {
+		if msg := normalize(doc.Find("#formErrorMessages li").First().Text()); msg != "" {
+			return Status{}, errors.New(msg)
+		}
+		return Status{}, ErrNoStatus
+	}
+	s.Description = normalize(doc.Find(".rows.text-center p").First().Text())
+
+	text := s.Title + "\n" + s.Description
+	if m := formTypeRe.FindStringSubmatch(s.Description); m != nil {
+		s.FormType = m[1]
+	}
+	if m := actionDateRe.FindStringSubmatch(s.Description); m != nil {
+		if date, err := time.Parse("January 2, 2006", m[1]); err == nil {
+			s.ActionDate = date
+		}
+	}
+	for _, m := range noticeRe.FindAllStringSubmatch(s.Description, -1) {
+		if kind := strings.ToLower(m[1]); !noticeArticles[kind] {
+			s.Notice = kind + " notice"
+			break
+		}
+	}
+	s.CardMailed = cardMailedRe.MatchString(text)
+	s.RFE = rfeRe.MatchString(text)
+	if m := trackingRe.FindStringSubmatch(s.Description); m != nil {
+		s.TrackingNumber = m[1]
+	}
+	return s, nil
+}
+
+// normalize collapses whitespace the page is indented with
+func normalize(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
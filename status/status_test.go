@@ -0,0 +1,142 @@
+/*
+Copyright © 2021 Anton Kaiukov <batko@batko.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package status
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		want    Status
+		wantErr string
+	}{
+		{
+			name:    "Case received",
+			fixture: "received.html",
+			want: Status{
+				Title: "Case Was Received",
+				Description: "On January 4, 2021, we received your Form I-485, Application to Register Permanent Residence or Adjust Status, " +
+					"Receipt Number MSC2190000001, and sent you the receipt notice that describes how we will process your case. " +
+					"Please follow the instructions in the notice. If you have any questions, contact the USCIS Contact Center at " +
+					"www.uscis.gov/contactcenter. If you move, go to www.uscis.gov/addresschange to give us your new mailing address.",
+				FormType:   "I-485",
+				ActionDate: date(2021, time.January, 4),
+				Notice:     "receipt notice",
+			},
+		},
+		{
+			name:    "Case approved",
+			fixture: "approved.html",
+			want: Status{
+				Title: "Case Was Approved",
+				Description: "On June 15, 2021, we approved your Form I-765, Application for Employment Authorization, " +
+					"Receipt Number MSC2190000002. We will mail your new card to the address we have on file. " +
+					"We mailed you an approval notice. Please follow the instructions in the notice.",
+				FormType:   "I-765",
+				ActionDate: date(2021, time.June, 15),
+				Notice:     "approval notice",
+			},
+		},
+		{
+			name:    "Card mailed",
+			fixture: "card_mailed.html",
+			want: Status{
+				Title: "Card Was Mailed To Me",
+				Description: "On July 2, 2021, we mailed your new card for your Form I-485, Application to Register Permanent Residence " +
+					"or Adjust Status, Receipt Number MSC2190000004, to the address you gave us. " +
+					"If you do not receive your card within 30 days, contact us.",
+				FormType:   "I-485",
+				ActionDate: date(2021, time.July, 2),
+				CardMailed: true,
+			},
+		},
+		{
+			name:    "Card picked up with tracking number",
+			fixture: "card_picked_up.html",
+			want: Status{
+				Title: "Card Was Picked Up By The United States Postal Service",
+				Description: "On July 1, 2021, the Post Office picked up your new card for Receipt Number MSC2190000003, " +
+					"and is delivering it to the address you gave us. The Post Office tracking number for your case is " +
+					"9205590164917312751089. You can use your tracking number at www.USPS.com in the Quick Tools Tracking section.",
+				ActionDate:     date(2021, time.July, 1),
+				CardMailed:     true,
+				TrackingNumber: "9205590164917312751089",
+			},
+		},
+		{
+			name:    "Request for evidence",
+			fixture: "rfe.html",
+			want: Status{
+				Title: "Request for Additional Evidence Was Sent",
+				Description: "On February 10, 2021, we sent a request for additional evidence for your Form I-130, " +
+					"Petition for Alien Relative, Receipt Number IOE0900000005. The request for evidence explains what we need from you. " +
+					"We will not take action on your case until we receive the evidence or the deadline to submit it expires.",
+				FormType:   "I-130",
+				ActionDate: date(2021, time.February, 10),
+				RFE:        true,
+			},
+		},
+		{
+			name:    "Status bar only",
+			fixture: "status_bar_only.html",
+			want:    Status{Title: "Case Is Being Actively Reviewed By USCIS"},
+		},
+		{
+			name:    "Invalid receipt number",
+			fixture: "invalid_receipt.html",
+			wantErr: "The application receipt number entered is invalid. Please check your receipt number and try again.",
+		},
+		{
+			name:    "No status",
+			fixture: "maintenance.html",
+			wantErr: ErrNoStatus.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatalf("cannot open fixture: %v", err)
+			}
+			defer f.Close()
+
+			got, err := Parse(f)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}